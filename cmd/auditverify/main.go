@@ -0,0 +1,35 @@
+// Command auditverify checks that the audit log has not been tampered with, by
+// recomputing the hash chain of the audit events in the database configured for
+// the app env; it exits with status 1 if the chain is broken:
+//
+//	PUREST_ENV=development go run ./cmd/auditverify
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/padurean/purest/internal/database"
+)
+
+func main() {
+	ctx := context.Background()
+	db := database.MustConnect(ctx, database.ConfigFromEnv())
+	defer db.Close()
+
+	verified, err := database.VerifyAuditChain(ctx, db)
+	if err != nil {
+		var errBroken *database.ErrAuditChainBroken
+		if errors.As(err, &errBroken) {
+			fmt.Printf("%d audit events verified before the chain broke\n", verified)
+			fmt.Println(errBroken)
+			db.Close()
+			os.Exit(1)
+		}
+		log.Fatalf("error verifying the audit chain: %v", err)
+	}
+	fmt.Printf("%d audit events verified, the chain is intact\n", verified)
+}
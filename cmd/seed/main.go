@@ -0,0 +1,204 @@
+// Command seed fills the database configured for the app env with the
+// organizations and users from the given YAML or JSON fixture files:
+//
+//	PUREST_ENV=development go run ./cmd/seed fixtures/dev.yaml
+//
+// Seeding is idempotent: the organizations are matched by slug and the users by
+// organization and username, so the ones which already exist are updated instead
+// of being created again. It refuses to seed the production database unless
+// -force is given.
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/env"
+	"github.com/padurean/purest/internal/validator"
+	"gopkg.in/yaml.v2"
+)
+
+// fixtures are the contents of a fixture file; unknown fields are rejected,
+// so that typos do not silently leave values out
+type fixtures struct {
+	Organizations []organizationFixture `json:"organizations" yaml:"organizations"`
+	Users         []userFixture         `json:"users" yaml:"users"`
+}
+
+type organizationFixture struct {
+	Name string `json:"name" yaml:"name"`
+	Slug string `json:"slug" yaml:"slug"`
+}
+
+type userFixture struct {
+	// Organization is the slug of the organization of the user,
+	// the default organization if not given
+	Organization string `json:"organization" yaml:"organization"`
+	Username     string `json:"username" yaml:"username"`
+	// Password is in plain text, and is hashed before being stored
+	Password  string `json:"password" yaml:"password"`
+	Email     string `json:"email" yaml:"email"`
+	FirstName string `json:"first_name" yaml:"first_name"`
+	LastName  string `json:"last_name" yaml:"last_name"`
+	// Role is either the name or the number of the role, e.g. Admin or 1
+	Role string `json:"role" yaml:"role"`
+}
+
+func main() {
+	force := flag.Bool("force", false, "seed even if the app env is production")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-force] fixtures.yaml|fixtures.json ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if appEnv := env.GetAppEnv(); appEnv == env.Production && !*force {
+		log.Fatalf("refusing to seed the %s database, run with -force to seed it anyway", appEnv)
+	}
+
+	var all []*fixtures
+	for _, fileName := range flag.Args() {
+		f, err := loadFixtures(fileName)
+		if err != nil {
+			log.Fatalf("error loading fixtures: %v", err)
+		}
+		all = append(all, f)
+	}
+
+	ctx := database.WithAllTenants(context.Background())
+	db := database.MustConnect(ctx, database.ConfigFromEnv())
+	defer db.Close()
+	database.Migrate(ctx, db)
+	database.CreateDefaultUser(ctx, db)
+
+	// all or nothing, so that fixing a fixture and seeding again is enough
+	err := db.InTx(ctx, func(ctx context.Context) error {
+		for i, f := range all {
+			if err := f.seed(ctx, db); err != nil {
+				return fmt.Errorf("error seeding fixtures from %s: %w", flag.Arg(i), err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		log.Fatal(err)
+	}
+}
+
+// loadFixtures reads the fixtures from the given file, as JSON if it has
+// the .json extension, or as YAML otherwise
+func loadFixtures(fileName string) (*fixtures, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading fixtures file %s: %v", fileName, err)
+	}
+	f := &fixtures{}
+	if strings.EqualFold(filepath.Ext(fileName), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(f)
+	} else {
+		err = yaml.UnmarshalStrict(data, f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing fixtures file %s: %v", fileName, err)
+	}
+	return f, nil
+}
+
+func (f *fixtures) seed(ctx context.Context, db *database.DB) error {
+	for _, of := range f.Organizations {
+		if err := of.seed(ctx, db); err != nil {
+			return fmt.Errorf("error seeding organization %s: %w", of.Slug, err)
+		}
+	}
+	for _, uf := range f.Users {
+		if err := uf.seed(ctx, db); err != nil {
+			return fmt.Errorf("error seeding user %s: %w", uf.Username, err)
+		}
+	}
+	return nil
+}
+
+func (of organizationFixture) seed(ctx context.Context, db *database.DB) error {
+	o := &database.Organization{Name: of.Name, Slug: of.Slug}
+	if err := validator.Validate(ctx, o); err != nil {
+		return err
+	}
+	existing, err := o.GetBySlug(ctx, db)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		o, err = o.Create(ctx, db)
+		if err == nil {
+			fmt.Printf("created organization %s (%d)\n", o.Slug, o.ID)
+		}
+	case err == nil:
+		o.ID, o.Version = existing.ID, existing.Version
+		o, err = o.Update(ctx, db)
+		if err == nil {
+			fmt.Printf("updated organization %s (%d)\n", o.Slug, o.ID)
+		}
+	}
+	return err
+}
+
+func (uf userFixture) seed(ctx context.Context, db *database.DB) error {
+	if uf.Organization == "" {
+		uf.Organization = database.DefaultOrganizationSlug
+	}
+	o, err := (&database.Organization{Slug: uf.Organization}).GetBySlug(ctx, db)
+	if err != nil {
+		return fmt.Errorf("error getting organization %s: %w", uf.Organization, err)
+	}
+	role, err := auth.ParseRole(uf.Role)
+	if err != nil {
+		return err
+	}
+	u := &database.User{
+		OrganizationID: o.ID,
+		Username:       uf.Username,
+		Password:       uf.Password,
+		Email:          uf.Email,
+		FirstName:      sql.NullString{String: uf.FirstName, Valid: uf.FirstName != ""},
+		LastName:       sql.NullString{String: uf.LastName, Valid: uf.LastName != ""},
+		Role:           role,
+	}
+	if err := validator.Validate(ctx, u); err != nil {
+		return err
+	}
+	if u.Password, err = auth.HashAndSaltPassword(u.Password); err != nil {
+		return err
+	}
+
+	ctx = database.WithTenant(ctx, o.ID)
+	existing, err := u.GetByUsername(ctx, db)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		u, err = u.Create(ctx, db)
+		if err == nil {
+			fmt.Printf("created user %s (%d) in organization %s\n", u.Username, u.ID, o.Slug)
+		}
+	case err == nil:
+		u.ID, u.Version = existing.ID, existing.Version
+		u, err = u.Update(ctx, db)
+		if err == nil {
+			fmt.Printf("updated user %s (%d) in organization %s\n", u.Username, u.ID, o.Slug)
+		}
+	}
+	return err
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http"
 
 	"github.com/padurean/purest/internal/auth"
 	"github.com/padurean/purest/internal/database"
 	"github.com/padurean/purest/internal/env"
 	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/outbox"
+	"github.com/padurean/purest/internal/rpc"
 	"github.com/padurean/purest/internal/server"
+	"github.com/padurean/purest/internal/webhook"
 )
 
 // @title puREST API
@@ -27,12 +32,45 @@ func main() {
 		logger.Fatal().Err(err).Msgf("error generating or loading access keys")
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	logger.Info().Msg("connecting to database ...")
-	db := database.MustConnect(env.GetDbDriver(), env.GetDbURL())
+	db := database.MustConnect(ctx, database.ConfigFromEnv())
 	logger.Info().Msg("migrating database ...")
-	database.Migrate(db)
+	database.Migrate(ctx, db)
 	logger.Info().Msg("creating default admin user (if there is no user) ...")
-	database.CreateDefaultUser(db)
+	database.CreateDefaultUser(ctx, db)
+	go db.MonitorHealth(ctx, env.GetDbHealthCheckInterval())
+	if retention := env.GetUserPurgeRetention(); retention > 0 {
+		mode, err := database.ParseUserPurgeMode(env.GetUserPurgeMode())
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid user purge mode")
+		}
+		go database.SchedulePurgeOfDeletedUsers(database.WithAllTenants(ctx), db, retention, mode, env.GetUserPurgeInterval())
+	}
+
+	sinks := []outbox.Sink{outbox.LogSink{}}
+	if interval := env.GetWebhookDispatchInterval(); interval > 0 {
+		sinks = append(sinks, webhook.NewSink(db))
+		client := &http.Client{Timeout: env.GetWebhookTimeout()}
+		go webhook.NewDispatcher(db, client, env.GetWebhookMaxAttempts()).Run(ctx, interval)
+	}
+	if interval := env.GetOutboxDispatchInterval(); interval > 0 {
+		dispatcher := outbox.NewDispatcher(db, env.GetOutboxBatchSize(), sinks...)
+		go dispatcher.Run(ctx, interval)
+	}
 
+	grpcServer := rpc.Start(env.GetGRPCPort(), logger, db, rpc.Options{
+		RequireVersion: env.GetHTTPRequireIfMatch(),
+		LogRequests:    env.GetLogRequests(),
+	})
 	server.Start(env.GetHTTPPort(), logger, db)
+	logger.Info().Msg("gRPC server is shutting down ...")
+	grpcServer.GracefulStop()
+
+	cancel()
+	logger.Info().Msg("closing database ...")
+	if err := db.Close(); err != nil {
+		logger.Err(err).Msg("error closing database")
+	}
 }
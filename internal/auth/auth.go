@@ -54,6 +54,18 @@ func GenerateOrLoadKeys() error {
 	return nil
 }
 
+// GenerateKeys generates a new pair of access keys, which are only kept
+// in memory, so the tokens signed with them are valid until the process ends,
+// e.g. for tests
+func GenerateKeys() error {
+	var err error
+	publicKey, privateKey, err = ed25519.GenerateKey(nil)
+	if err != nil {
+		return fmt.Errorf("error generating public and private keys: %v", err)
+	}
+	return nil
+}
+
 func writeKeyToFile(key []byte, fileName string) error {
 	keyHex := make([]byte, hex.EncodedLen(len(key)))
 	hex.Encode(keyHex, key)
@@ -74,50 +86,79 @@ func readKeyFromFile(fileName string) ([]byte, error) {
 }
 
 // GenerateToken ...
-func GenerateToken(userID int64, role Role) (string, time.Time, error) {
+func GenerateToken(userID int64, organizationID int64, role Role) (string, time.Time, error) {
 	expiration := time.Now().Add(24 * time.Hour)
+	token, err := GenerateTokenExpiring(userID, organizationID, role, expiration)
+	return token, expiration, err
+}
+
+// GenerateTokenExpiring is like GenerateToken, but the token expires at the given
+// time, e.g. for tests to get expired tokens
+func GenerateTokenExpiring(userID int64, organizationID int64, role Role, expiration time.Time) (string, error) {
 	jsonToken := paseto.JSONToken{
 		Expiration: expiration,
 		Subject:    strconv.FormatInt(userID, 10),
 	}
 	jsonToken.Set("role", fmt.Sprintf("%d", role))
+	jsonToken.Set("org", strconv.FormatInt(organizationID, 10))
 	footer := "puREST"
-	token, err := pasetoV2.Sign(privateKey, jsonToken, footer)
-	return token, expiration, err
+	return pasetoV2.Sign(privateKey, jsonToken, footer)
 }
 
 // JSONToken ...
 type JSONToken struct {
-	UserID     int64
-	Role       Role
-	Expiration time.Time
+	UserID         int64
+	OrganizationID int64
+	Role           Role
+	Expiration     time.Time
 }
 
+// Errors of the tokens
+var (
+	// ErrTokenMissing is for the requests which carry no token
+	ErrTokenMissing = errors.New("missing Authorization header")
+	// ErrTokenInvalid is wrapped by the errors of VerifyToken, but for the expired tokens
+	ErrTokenInvalid = errors.New("invalid token")
+	// ErrTokenExpired ...
+	ErrTokenExpired = errors.New("token has expired")
+)
+
 // VerifyToken ...
 func VerifyToken(token string) (*JSONToken, error) {
 	var jsonToken paseto.JSONToken
 	var footer string
 	if err := pasetoV2.Verify(token, publicKey, &jsonToken, &footer); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+	}
+	// checked apart from the other claims, so that the clients can tell when to sign in again
+	if !jsonToken.Expiration.IsZero() && time.Now().After(jsonToken.Expiration) {
+		return nil, ErrTokenExpired
 	}
 	if err := jsonToken.Validate(); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
 	}
 	userID, err := strconv.ParseInt(jsonToken.Subject, 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing token subject as user ID (i.e. int64): %v", err)
+		return nil, fmt.Errorf("%w: error parsing token subject as user ID (i.e. int64): %v", ErrTokenInvalid, err)
 	}
 	roleStr := jsonToken.Get("role")
 	if roleStr == "" {
-		return nil, errors.New("user role is missing from token")
+		return nil, fmt.Errorf("%w: user role is missing from token", ErrTokenInvalid)
 	}
 	role, err := ParseRole(roleStr)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing user role from token: %v", err)
+		return nil, fmt.Errorf("%w: error parsing user role from token: %v", ErrTokenInvalid, err)
+	}
+	// tokens issued before organizations were introduced are not valid anymore
+	organizationID, err := strconv.ParseInt(jsonToken.Get("org"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"%w: error parsing user organization ID (i.e. int64) from token: %v", ErrTokenInvalid, err)
 	}
 	return &JSONToken{
-		UserID:     userID,
-		Role:       role,
-		Expiration: jsonToken.Expiration,
+		UserID:         userID,
+		OrganizationID: organizationID,
+		Role:           role,
+		Expiration:     jsonToken.Expiration,
 	}, nil
 }
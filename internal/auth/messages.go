@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"github.com/padurean/purest/internal/i18n"
+)
+
+// IDs of the messages of the auth package
+const (
+	msgPasswordRequirements = "password_requirements"
+	msgValidRoles           = "valid_roles"
+)
+
+// messages are the translations of the messages of the auth package
+var messages = i18n.Catalogue{
+	"en": {
+		msgPasswordRequirements: "password must have between %d and %d characters of which at least " +
+			"1 uppercase letter, 1 digit and 1 special character",
+		msgValidRoles: "valid roles: %s",
+	},
+	"de": {
+		msgPasswordRequirements: "das Passwort muss zwischen %d und %d Zeichen lang sein, davon mindestens " +
+			"1 Großbuchstabe, 1 Ziffer und 1 Sonderzeichen",
+		msgValidRoles: "gültige Rollen: %s",
+	},
+	"fr": {
+		msgPasswordRequirements: "le mot de passe doit contenir entre %d et %d caractères dont au moins " +
+			"1 lettre majuscule, 1 chiffre et 1 caractère spécial",
+		msgValidRoles: "rôles valides : %s",
+	},
+	"ro": {
+		msgPasswordRequirements: "parola trebuie să aibă între %d și %d caractere, dintre care cel puțin " +
+			"1 literă mare, 1 cifră și 1 caracter special",
+		msgValidRoles: "roluri valide: %s",
+	},
+}
+
+// PasswordRequirementsMsgIn returns PasswordRequirementsMsg translated to the given locale
+func PasswordRequirementsMsgIn(locale string) string {
+	return messages.T(locale, msgPasswordRequirements, minPasswordLen, maxPasswordLen)
+}
+
+// ValidRolesMsgIn returns ValidRolesMsg translated to the given locale; the names of
+// the roles are not translated, as they are the ones the API accepts
+func ValidRolesMsgIn(locale string) string {
+	return messages.T(locale, msgValidRoles, validRoles)
+}
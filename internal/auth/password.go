@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"unicode"
 
+	"github.com/padurean/purest/internal/i18n"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -28,6 +29,9 @@ func HashAndSaltPassword(password string) (string, error) {
 	return hashedPassword, nil
 }
 
+// ErrWrongPassword is wrapped by the errors of the checks of passwords
+var ErrWrongPassword = errors.New("wrong password")
+
 // ComparePasswords ...
 func ComparePasswords(plainPassword string, hashedPassword string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(plainPassword))
@@ -42,12 +46,7 @@ const minPasswordLen = 8
 const maxPasswordLen = 32
 
 // PasswordRequirementsMsg message used to inform the user about password strength requirements
-var PasswordRequirementsMsg = fmt.Sprintf(
-	"password must have between %d and %d characters of which at least "+
-		"1 uppercase letter, 1 digit and 1 special character",
-	minPasswordLen,
-	maxPasswordLen,
-)
+var PasswordRequirementsMsg = PasswordRequirementsMsgIn(i18n.Default)
 
 // IsStrongPassword checks if the provided password meets the strength requirements
 func IsStrongPassword(password string) error {
@@ -1,8 +1,12 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+
+	"github.com/padurean/purest/internal/i18n"
 )
 
 // Role ...
@@ -12,6 +16,8 @@ type Role uint8
 const (
 	RoleAdmin Role = iota + 1
 	RoleAuditor
+	// RoleSuperAdmin administers all the organizations
+	RoleSuperAdmin
 )
 
 func (r Role) String() string {
@@ -20,6 +26,8 @@ func (r Role) String() string {
 		return "Admin"
 	case RoleAuditor:
 		return "Auditor"
+	case RoleSuperAdmin:
+		return "SuperAdmin"
 	default:
 		return "Unknown"
 	}
@@ -32,6 +40,9 @@ var roles = map[string]Role{
 	// RoleAuditor
 	strconv.Itoa(int(RoleAuditor)): RoleAuditor,
 	fmt.Sprintf("%s", RoleAuditor): RoleAuditor,
+	// RoleSuperAdmin
+	strconv.Itoa(int(RoleSuperAdmin)): RoleSuperAdmin,
+	fmt.Sprintf("%s", RoleSuperAdmin): RoleSuperAdmin,
 }
 
 // ParseRole ...
@@ -43,15 +54,39 @@ func ParseRole(roleStr string) (Role, error) {
 	return 0, fmt.Errorf("unknown role %s", roleStr)
 }
 
-// ValidRolesMsg ...
-var ValidRolesMsg = fmt.Sprintf(
-	"valid roles: %d = %s, %d = %s",
+// validRoles lists the roles by their values and names
+var validRoles = fmt.Sprintf(
+	"%d = %s, %d = %s, %d = %s",
 	RoleAdmin, RoleAdmin,
 	RoleAuditor, RoleAuditor,
+	RoleSuperAdmin, RoleSuperAdmin,
 )
 
+// ValidRolesMsg ...
+var ValidRolesMsg = ValidRolesMsgIn(i18n.Default)
+
 // IsValidRole ...
 func IsValidRole(role int) bool {
 	_, ok := roles[strconv.Itoa(role)]
 	return ok
 }
+
+// ErrInsufficientRole is wrapped by the errors of CheckRole
+var ErrInsufficientRole = errors.New("insufficient permissions")
+
+// CheckRole checks that the given role is one of the allowed ones, if any are given
+func CheckRole(role Role, allowed ...Role) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	names := make([]string, len(allowed))
+	for i, a := range allowed {
+		if a == role {
+			return nil
+		}
+		names[i] = a.String()
+	}
+	return fmt.Errorf(
+		"%s role has %w: this operation requires the %s role",
+		role, ErrInsufficientRole, strings.Join(names, " or "))
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/padurean/purest/internal/auth"
 	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/query"
+	"github.com/padurean/purest/internal/stream"
 )
 
 // Key ...
@@ -13,12 +15,18 @@ type Key string
 
 // ContextKey ...
 const (
-	KeyDB           Key = "db"
+	KeyStore        Key = "store"
 	KeyUser         Key = "user"
 	KeySignedInUser Key = "signedInUser"
 	KeyJSONToken    Key = "jsonToken"
 	KeyPage         Key = "page"
 	KeyPageSize     Key = "pageSize"
+	KeyCursor       Key = "cursor"
+	KeyQuery        Key = "query"
+	KeyOrganization Key = "organization"
+	KeyWebhook      Key = "webhook"
+	KeyBroker       Key = "broker"
+	KeyAuditOrigin  Key = "auditOrigin"
 )
 
 // Str ...
@@ -26,13 +34,22 @@ func (k Key) Str() string {
 	return string(k)
 }
 
-// DB retrieves the DB handle from the given context
-func DB(ctx context.Context) (*database.DB, error) {
-	db, ok := ctx.Value(KeyDB).(*database.DB)
+// Store retrieves the Store from the given context
+func Store(ctx context.Context) (database.Store, error) {
+	store, ok := ctx.Value(KeyStore).(database.Store)
 	if !ok {
-		return nil, fmt.Errorf("no DB handle found in given context for key %v", KeyDB)
+		return nil, fmt.Errorf("no Store found in given context for key %v", KeyStore)
 	}
-	return db, nil
+	return store, nil
+}
+
+// Broker retrieves the events Broker from the given context
+func Broker(ctx context.Context) (*stream.Broker, error) {
+	broker, ok := ctx.Value(KeyBroker).(*stream.Broker)
+	if !ok {
+		return nil, fmt.Errorf("no Broker found in given context for key %v", KeyBroker)
+	}
+	return broker, nil
 }
 
 // User retrieves the User from the given context
@@ -44,6 +61,24 @@ func User(ctx context.Context) (*database.User, error) {
 	return u, nil
 }
 
+// Organization retrieves the Organization from the given context
+func Organization(ctx context.Context) (*database.Organization, error) {
+	o, ok := ctx.Value(KeyOrganization).(*database.Organization)
+	if !ok {
+		return nil, fmt.Errorf("no Organization found in given context for key %v", KeyOrganization)
+	}
+	return o, nil
+}
+
+// Webhook retrieves the Webhook from the given context
+func Webhook(ctx context.Context) (*database.Webhook, error) {
+	w, ok := ctx.Value(KeyWebhook).(*database.Webhook)
+	if !ok {
+		return nil, fmt.Errorf("no Webhook found in given context for key %v", KeyWebhook)
+	}
+	return w, nil
+}
+
 // SignedInUser retrieves the signed-in User from the given context
 func SignedInUser(ctx context.Context) (*database.User, error) {
 	u, ok := ctx.Value(KeySignedInUser).(*database.User)
@@ -62,20 +97,29 @@ func JSONToken(ctx context.Context) (*auth.JSONToken, error) {
 	return jt, nil
 }
 
-// Page retrieves the page number from the given context
-func Page(ctx context.Context) (int, error) {
-	page, ok := ctx.Value(KeyPage).(int)
+// AuditOrigin retrieves from the given context where the request came from
+func AuditOrigin(ctx context.Context) (*database.AuditOrigin, error) {
+	o, ok := ctx.Value(KeyAuditOrigin).(*database.AuditOrigin)
+	if !ok {
+		return nil, fmt.Errorf("no AuditOrigin found in given context for key %v", KeyAuditOrigin)
+	}
+	return o, nil
+}
+
+// Page retrieves the requested page of a list from the given context
+func Page(ctx context.Context) (*database.Page, error) {
+	page, ok := ctx.Value(KeyPage).(*database.Page)
 	if !ok {
-		return 0, fmt.Errorf("no page number found in given context for key %v", KeyPage)
+		return nil, fmt.Errorf("no page found in given context for key %v", KeyPage)
 	}
 	return page, nil
 }
 
-// PageSize retrieves the page size from the given context
-func PageSize(ctx context.Context) (int, error) {
-	pageSize, ok := ctx.Value(KeyPageSize).(int)
+// Query retrieves the filtering and sorting of a list from the given context
+func Query(ctx context.Context) (*query.Query, error) {
+	q, ok := ctx.Value(KeyQuery).(*query.Query)
 	if !ok {
-		return 0, fmt.Errorf("no page size found in given context for key %v", KeyPageSize)
+		return nil, fmt.Errorf("no query found in given context for key %v", KeyQuery)
 	}
-	return pageSize, nil
+	return q, nil
 }
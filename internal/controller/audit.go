@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/logging"
+)
+
+// AuditEventResponse ...
+type AuditEventResponse struct {
+	*database.AuditEvent
+	ActorID   NullInt64  `json:"actor_id" swaggertype:"integer"`
+	ActorRole NullString `json:"actor_role" swaggertype:"string"`
+}
+
+// Render ...
+func (ae *AuditEventResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	ae.ActorID = NullInt64(ae.AuditEvent.ActorID)
+	ae.ActorRole = NullString(ae.AuditEvent.ActorRole)
+	return nil
+}
+
+// AuditEventList ...
+// @id AuditEventList
+// @tags audit
+// @summary Lists the audit events, the latest first
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param page query int false "Page number, for paginating by page number instead of by cursor"
+// @param pageSize query int false "Page size (default 20, at most 100)"
+// @param cursor query string false "Opaque cursor of the page, as found in the Link header (none for the first page)"
+// @param actorId query int false "Id of the user who did the audited action"
+// @param action query string false "Audited action, e.g. user.update"
+// @param target query string false "Target of the audited action, e.g. user:1"
+// @param outcome query string false "Outcome of the audited action: success or failure"
+// @param from query string false "Earliest time (inclusive) of the audited action, in RFC 3339 format"
+// @param to query string false "Latest time (exclusive) of the audited action, in RFC 3339 format"
+// @success 200 {array} controller.AuditEventResponse
+// @header 200 {integer} X-Total-Count "Total number of audit events"
+// @header 200 {string} Link "Links to the next and previous pages"
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @router /audit-events [get]
+func AuditEventList(w http.ResponseWriter, r *http.Request) {
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	page, err := icontext.Page(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+
+	query := r.URL.Query()
+	filter := database.AuditEventFilter{
+		Action:  query.Get("action"),
+		Target:  query.Get("target"),
+		Outcome: query.Get("outcome"),
+	}
+	if actorIDParam := query.Get("actorId"); actorIDParam != "" {
+		actorID, err := strconv.ParseInt(actorIDParam, 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(
+				fmt.Errorf("'actorId' url param '%s' is not an integer number", actorIDParam)))
+			return
+		}
+		filter.ActorID = sql.NullInt64{Int64: actorID, Valid: true}
+	}
+	for _, param := range []struct {
+		name string
+		dest *sql.NullTime
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if value := query.Get(param.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				render.Render(w, r, ErrBadRequest(
+					fmt.Errorf("'%s' url param '%s' is not a RFC 3339 time", param.name, value)))
+				return
+			}
+			*param.dest = sql.NullTime{Time: t, Valid: true}
+		}
+	}
+
+	reqLogger := logging.Simple(r)
+	events, err := store.ListAuditEvents(r.Context(), filter, page.ListOptions())
+	if err != nil {
+		reqLogger.Err(err).Msgf("error listing audit events page")
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	total, err := store.CountAuditEvents(r.Context(), filter)
+	if err != nil {
+		reqLogger.Err(err).Msgf("error counting audit events")
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+
+	eventsResponseList := []render.Renderer{}
+	keys := []int64{}
+	for _, e := range events {
+		eventsResponseList = append(eventsResponseList, &AuditEventResponse{AuditEvent: e})
+		keys = append(keys, e.ID)
+	}
+	page.Listed(total, keys)
+	if err := render.RenderList(w, r, eventsResponseList); err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	render.Status(r, http.StatusOK)
+}
@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/render"
+)
+
+// ETag returns the (strong) entity tag of the given version of a resource
+func ETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", ETag(version))
+}
+
+// checkIfMatch checks the If-Match request header, if any, against the given
+// current version of the resource; if the check fails it renders the
+// 412 Precondition Failed response and returns false
+func checkIfMatch(w http.ResponseWriter, r *http.Request, version int64) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	etag := ETag(version)
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		// If-Match uses the strong comparison, so weak tags never match
+		if candidate = strings.TrimSpace(candidate); candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	render.Render(w, r, ErrPreconditionFailed(fmt.Errorf(
+		"If-Match %s does not match the current ETag %s: the resource has been changed in the meantime",
+		ifMatch, etag)))
+	return false
+}
@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/gorilla/websocket"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/stream"
+)
+
+// EventResponse is an event of the stream
+type EventResponse struct {
+	ID             int64                 `json:"id"`
+	OrganizationID int64                 `json:"organization_id"`
+	Type           string                `json:"type"`
+	Target         string                `json:"target"`
+	Created        time.Time             `json:"created"`
+	Data           database.EventPayload `json:"data" swaggertype:"object"`
+}
+
+func newEventResponse(e *database.OutboxEvent) *EventResponse {
+	return &EventResponse{
+		ID:             e.ID,
+		OrganizationID: e.OrganizationID,
+		Type:           e.Type,
+		Target:         e.Target,
+		Created:        e.Created,
+		Data:           e.Payload,
+	}
+}
+
+const (
+	// eventWriteTimeout is how long a WebSocket client has to take an event or a ping,
+	// after which it is considered gone; it can then resume after the last event it got
+	eventWriteTimeout = 10 * time.Second
+	// sseRetry is how long, in milliseconds, the SSE clients wait before reconnecting
+	sseRetry = 3000
+)
+
+// eventUpgrader upgrades the requests to WebSocket whatever their origin, like the other
+// requests are served to any origin, as the clients are authenticated with tokens, which
+// (unlike cookies) the browsers do not send on their own
+var eventUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// lastEventID returns the id of the last event the client got, if it resumes the stream
+func lastEventID(r *http.Request) (id int64, resumed bool, err error) {
+	param := r.Header.Get("Last-Event-ID")
+	if param == "" {
+		param = r.URL.Query().Get("lastEventId")
+	}
+	if param == "" {
+		return 0, false, nil
+	}
+	id, err = strconv.ParseInt(param, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, fmt.Errorf("last event id '%s' is not a positive integer number", param)
+	}
+	return id, true, nil
+}
+
+// errClientGone is returned when the client does not take what is sent to it
+var errClientGone = errors.New("event stream client is gone")
+
+// EventStream ...
+// @id EventStream
+// @tags events
+// @summary Streams the user lifecycle events as they happen, over Server-Sent Events or, if the request asks to be upgraded, WebSocket
+// @description Each event is sent as an SSE event with the id, the type (e.g. user.created) and the event as JSON data,
+// @description or as a WebSocket text message with the event as JSON. A heartbeat (an SSE comment, or a WebSocket ping)
+// @description is sent every PUREST_EVENTS_HEARTBEAT_INTERVAL. The stream resumes after the event with the id given
+// @description by the Last-Event-ID header (as sent by the browsers when reconnecting) or the lastEventId query param,
+// @description or starts with the next event if there is none. Since the browsers can not set headers on EventSource
+// @description and WebSocket, the token can also be given as the access_token query param.
+// @description WebSocket clients which do not keep up are disconnected, and can then resume after the last event they got.
+// @produce text/event-stream
+// @param Authorization header string false "Bearer <token>"
+// @param access_token query string false "Token, instead of the Authorization header"
+// @param Last-Event-ID header int false "Id of the last event received, to resume after"
+// @param lastEventId query int false "Id of the last event received, to resume after"
+// @success 200 {object} controller.EventResponse
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @router /events/stream [get]
+func EventStream(w http.ResponseWriter, r *http.Request) {
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	broker, err := icontext.Broker(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	after, resumed, err := lastEventID(r)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+	if !resumed {
+		// the stream starts with the next event
+		if after, err = store.LatestOutboxEventID(r.Context()); err != nil {
+			logging.Simple(r).Err(err).Msg("error starting event stream")
+			render.Render(w, r, ErrInternalServer(err))
+			return
+		}
+	}
+
+	sub := broker.Subscribe(r.Context(), after)
+	defer sub.Close()
+	if websocket.IsWebSocketUpgrade(r) {
+		streamWebSocket(w, r, sub)
+		return
+	}
+	streamSSE(w, r, sub)
+}
+
+// follow sends the events of the subscription, and the heartbeats, until the
+// request is done or sending fails, when it returns errClientGone
+func follow(ctx context.Context, sub *stream.Subscription, send func(e *EventResponse) error, heartbeat func() error) error {
+	for {
+		events, err := sub.Next(ctx)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err := send(newEventResponse(e)); err != nil {
+				return fmt.Errorf("%w: %v", errClientGone, err)
+			}
+		}
+		var heartbeatDue bool
+		if len(events) == stream.BatchSize {
+			// a full batch means there may be more to send right away
+			heartbeatDue = sub.HeartbeatDue()
+		} else if heartbeatDue, err = sub.Wait(ctx); err != nil {
+			return err
+		}
+		if heartbeatDue {
+			if err := heartbeat(); err != nil {
+				return fmt.Errorf("%w: %v", errClientGone, err)
+			}
+		}
+	}
+}
+
+func streamSSE(w http.ResponseWriter, r *http.Request, sub *stream.Subscription) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		render.Render(w, r, ErrInternalServer(errors.New("streaming is not supported")))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// so that proxies, e.g. nginx, do not buffer the events
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+	flusher.Flush()
+
+	send := func(e *EventResponse) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("error marshaling event %d: %w", e.ID, err)
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	heartbeat := func() error {
+		if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	err := follow(r.Context(), sub, send, heartbeat)
+	if r.Context().Err() == nil && !errors.Is(err, errClientGone) {
+		logging.Simple(r).Err(err).Msg("error streaming events")
+	}
+}
+
+func streamWebSocket(w http.ResponseWriter, r *http.Request, sub *stream.Subscription) {
+	// the upgrader responds with the error itself
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// the messages of the client are only read for the pongs and the close,
+	// and the client is gone if it does not answer the pings in time
+	go func() {
+		defer cancel()
+		conn.SetReadLimit(512)
+		pongTimeout := 2*sub.HeartbeatInterval() + eventWriteTimeout
+		_ = conn.SetReadDeadline(time.Now().Add(pongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(e *EventResponse) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		return conn.WriteJSON(e)
+	}
+	heartbeat := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteTimeout))
+	}
+	err = follow(ctx, sub, send, heartbeat)
+	if ctx.Err() != nil || errors.Is(err, errClientGone) {
+		return
+	}
+	logging.Simple(r).Err(err).Msg("error streaming events")
+	_ = conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "error streaming events"),
+		time.Now().Add(eventWriteTimeout))
+}
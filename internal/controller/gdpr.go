@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/render"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/service"
+)
+
+// UserExportResponse ...
+type UserExportResponse struct {
+	*database.UserExport
+}
+
+// Render ...
+func (ue *UserExportResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf(`attachment; filename="user-%d-personal-data.json"`, ue.User.ID))
+	return nil
+}
+
+// UserExportMe ...
+// @id UserExportMe
+// @tags users
+// @summary Exports all the personal data of the currently signed-in user as a downloadable JSON archive
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @success 200 {object} controller.UserExportResponse
+// @failure 401 {object} controller.ErrResponse
+// @router /users/me/export [get]
+func UserExportMe(w http.ResponseWriter, r *http.Request) {
+	u, err := icontext.SignedInUser(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	exportUser(w, r, u)
+}
+
+// UserExport ...
+// @id UserExport
+// @tags users
+// @summary Exports all the personal data of an user (deleted or not) as a downloadable JSON archive
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param id path int true "User id"
+// @success 200 {object} controller.UserExportResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @router /users/{id}/export [get]
+func UserExport(w http.ResponseWriter, r *http.Request) {
+	u, err := icontext.User(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	exportUser(w, r, u)
+}
+
+func exportUser(w http.ResponseWriter, r *http.Request, u *database.User) {
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	export, err := store.ExportUser(r.Context(), u)
+	if err != nil {
+		logging.Simple(r).Err(err).Msgf("error exporting the personal data of user %d", u.ID)
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	// no export is handed out without being recorded
+	if err := service.Audit(r.Context(), service.UserAuditEvent("user.export", u), nil, nil); err != nil {
+		render.Render(w, r, ErrService(err))
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.Render(w, r, &UserExportResponse{UserExport: export})
+}
+
+// UserErase ...
+// @id UserErase
+// @tags users
+// @summary Irreversibly anonymizes the personal data of an user, who is also marked as deleted
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param id path int true "User id"
+// @success 200 {object} controller.UserResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @failure 422 {object} controller.ErrResponse
+// @router /users/{id}/erase [post]
+func UserErase(w http.ResponseWriter, r *http.Request) {
+	u, err := icontext.User(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	erased, err := service.EraseUser(r.Context(), u)
+	if err != nil {
+		render.Render(w, r, ErrService(err))
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Render(w, r, &UserResponse{User: erased})
+}
@@ -0,0 +1,262 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/location"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/i18n"
+	"github.com/padurean/purest/internal/validator"
+)
+
+// GraphQLRequest ...
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Bind ...
+func (gr *GraphQLRequest) Bind(r *http.Request) error {
+	if strings.TrimSpace(gr.Query) == "" {
+		return validator.NewError(validator.FieldError{
+			Field:   "query",
+			Rule:    "required",
+			Message: messages.T(i18n.Locale(r.Context()), msgQueryRequired),
+		})
+	}
+	return nil
+}
+
+// GraphQLResponse ...
+type GraphQLResponse struct {
+	Data   interface{}                `json:"data,omitempty" swaggertype:"object"`
+	Errors []gqlerrors.FormattedError `json:"errors,omitempty" swaggerignore:"true"`
+}
+
+// graphQLRootOptions is the key of the options of the endpoint in the root value of the queries
+const graphQLRootOptions = "options"
+
+// GraphQLOptions ...
+type GraphQLOptions struct {
+	// MaxDepth is the max nesting of the fields of a query
+	MaxDepth int
+	// MaxComplexity is the max cost of a query, where each field costs 1, plus
+	// the cost of its fields, times the page size for the lists
+	MaxComplexity int
+	// RequireVersion makes the changes require the version of the user they
+	// change, like PUREST_HTTP_REQUIRE_IF_MATCH does for the If-Match header
+	RequireVersion bool
+	// Introspection allows the queries of the schema, i.e. of __schema and __type,
+	// e.g. by the playground
+	Introspection bool
+}
+
+// GraphQL returns the handler of the GraphQL endpoint, which serves the queries
+// and mutations of the users; see the schema in graphql_schema.go
+// @id GraphQL
+// @tags graphql
+// @summary Runs a GraphQL query or mutation of the users
+// @description Each field requires the same role as the REST operation it mirrors. The queries deeper, or
+// @description more complex, than allowed are rejected, the introspection fields included. In Development
+// @description only, the schema can be introspected, e.g. explored with the playground at /graphql/playground.
+// @accept application/json
+// @produce application/json
+// @param Authorization header string false "Bearer <token>, needed by all but the signIn mutation"
+// @param payload body controller.GraphQLRequest true "GraphQL query, operation name and variables"
+// @success 200 {object} controller.GraphQLResponse
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @router /graphql [post]
+func GraphQL(opts GraphQLOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gReq := &GraphQLRequest{}
+		if err := render.Bind(r, gReq); err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, executeGraphQL(r, gReq, opts))
+	}
+}
+
+// executeGraphQL parses and validates the query, and runs it
+// unless it is deeper, or more complex, than allowed
+func executeGraphQL(r *http.Request, gReq *GraphQLRequest, opts GraphQLOptions) *graphql.Result {
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(gReq.Query), Name: "GraphQL request"}),
+	})
+	if err != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+	}
+	if validation := graphql.ValidateDocument(&graphQLSchema, doc, nil); !validation.IsValid {
+		return &graphql.Result{Errors: validation.Errors}
+	}
+	limits := &graphQLLimits{
+		maxDepth:      opts.MaxDepth,
+		maxComplexity: opts.MaxComplexity,
+		introspection: opts.Introspection,
+		fragments:     map[string]*ast.FragmentDefinition{},
+		variables:     gReq.Variables,
+	}
+	if err := limits.check(doc, gReq.OperationName); err != nil {
+		// wrapped, so that it keeps the extensions of graphQLError
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(&gqlerrors.Error{
+			Message:       err.Error(),
+			Locations:     []location.SourceLocation{},
+			OriginalError: errGraphQL(http.StatusBadRequest, err),
+		})}
+	}
+	return graphql.Execute(graphql.ExecuteParams{
+		Schema:        graphQLSchema,
+		Root:          map[string]interface{}{graphQLRootOptions: opts},
+		AST:           doc,
+		OperationName: gReq.OperationName,
+		Args:          gReq.Variables,
+		Context:       r.Context(),
+	})
+}
+
+// graphQLListFields are the fields listing a page, the fields of which
+// are multiplied by the page size when computing the complexity
+var graphQLListFields = map[string]bool{"users": true}
+
+// graphQLIntrospectionFields are the fields querying the schema, unlike __typename,
+// which only names the type of the object it is selected on
+var graphQLIntrospectionFields = map[string]bool{"__schema": true, "__type": true}
+
+// graphQLLimits computes the depth and the complexity of a query, and fails
+// as soon as any of them is greater than allowed, or if the query introspects
+// the schema while the introspection is not allowed
+type graphQLLimits struct {
+	maxDepth      int
+	maxComplexity int
+	introspection bool
+	fragments     map[string]*ast.FragmentDefinition
+	variables     map[string]interface{}
+}
+
+func (l *graphQLLimits) check(doc *ast.Document, operationName string) error {
+	var operation *ast.OperationDefinition
+	for _, definition := range doc.Definitions {
+		switch d := definition.(type) {
+		case *ast.FragmentDefinition:
+			l.fragments[d.Name.Value] = d
+		case *ast.OperationDefinition:
+			// the validation made sure there is only one if it is not named
+			if operationName == "" || (d.Name != nil && d.Name.Value == operationName) {
+				operation = d
+			}
+		}
+	}
+	if operation == nil {
+		return fmt.Errorf("unknown operation %s", operationName)
+	}
+	_, err := l.cost(operation.SelectionSet, 0)
+	return err
+}
+
+// cost returns the complexity of the given selections, found at the given depth
+func (l *graphQLLimits) cost(set *ast.SelectionSet, depth int) (int, error) {
+	if set == nil {
+		return 0, nil
+	}
+	total := 0
+	for _, selection := range set.Selections {
+		var cost int
+		var err error
+		switch s := selection.(type) {
+		case *ast.Field:
+			if graphQLIntrospectionFields[s.Name.Value] && !l.introspection {
+				return 0, fmt.Errorf("the introspection of the schema is disabled")
+			}
+			if depth+1 > l.maxDepth {
+				return 0, fmt.Errorf("the query is deeper than the max depth of %d", l.maxDepth)
+			}
+			if cost, err = l.cost(s.SelectionSet, depth+1); err == nil {
+				cost = 1 + cost*l.pageSize(s)
+			}
+		case *ast.InlineFragment:
+			cost, err = l.cost(s.SelectionSet, depth)
+		case *ast.FragmentSpread:
+			if fragment, ok := l.fragments[s.Name.Value]; ok {
+				cost, err = l.cost(fragment.SelectionSet, depth)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		if total += cost; total > l.maxComplexity {
+			return 0, fmt.Errorf("the query is more complex than the max complexity of %d", l.maxComplexity)
+		}
+	}
+	return total, nil
+}
+
+// pageSize returns the size of the page listed by the field, or 1 if it is not a list
+func (l *graphQLLimits) pageSize(field *ast.Field) int {
+	if !graphQLListFields[field.Name.Value] {
+		return 1
+	}
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "pageSize" {
+			continue
+		}
+		size := 0
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			size, _ = strconv.Atoi(v.Value)
+		case *ast.Variable:
+			// JSON numbers are decoded as float64
+			if f, ok := l.variables[v.Name.Value].(float64); ok {
+				size = int(f)
+			}
+		}
+		if size < 1 || size > database.PageSizeMax {
+			// the invalid page sizes are rejected by the resolver anyway
+			return database.PageSizeMax
+		}
+		return size
+	}
+	return database.PageSizeDefault
+}
+
+// graphQLPlaygroundPage is GraphiQL, loaded from a CDN
+const graphQLPlaygroundPage = `<!DOCTYPE html>
+<html>
+<head>
+	<title>puREST GraphQL playground</title>
+	<link rel="stylesheet" href="https://unpkg.com/graphiql@3/graphiql.min.css" />
+</head>
+<body style="margin: 0;">
+	<div id="graphiql" style="height: 100vh;"></div>
+	<script crossorigin src="https://unpkg.com/react@18/umd/react.production.min.js"></script>
+	<script crossorigin src="https://unpkg.com/react-dom@18/umd/react-dom.production.min.js"></script>
+	<script crossorigin src="https://unpkg.com/graphiql@3/graphiql.min.js"></script>
+	<script>
+		const fetcher = GraphiQL.createFetcher({ url: window.location.pathname.replace(/\/playground$/, '') });
+		ReactDOM.createRoot(document.getElementById('graphiql')).render(React.createElement(GraphiQL, {
+			fetcher: fetcher,
+			defaultHeaders: JSON.stringify({ Authorization: 'Bearer <token>' }, null, 2),
+		}));
+	</script>
+</body>
+</html>
+`
+
+// GraphQLPlayground serves an in-browser IDE for exploring the schema and
+// running queries, which is only routed in Development
+func GraphQLPlayground(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(graphQLPlaygroundPage))
+}
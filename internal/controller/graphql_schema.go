@@ -0,0 +1,622 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+	"github.com/padurean/purest/internal/auth"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/env"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/query"
+	"github.com/padurean/purest/internal/service"
+	"github.com/padurean/purest/internal/validator"
+)
+
+// graphQLError is an error of a field, which tells the clients, in its extensions,
+// the problem code and the HTTP status the same error has in the REST API
+type graphQLError struct {
+	status int
+	err    error
+}
+
+func (e *graphQLError) Error() string {
+	if e.status >= http.StatusInternalServerError && env.GetAppEnv() == env.Production {
+		// the details of the internal errors (e.g. of SQL) are only for the logs
+		return http.StatusText(e.status)
+	}
+	return e.err.Error()
+}
+
+// Extensions ...
+func (e *graphQLError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{
+		// e.g. USER_DUPLICATE_EMAIL or NOT_FOUND
+		"code":   problemCodeOf(e.err, e.status),
+		"status": e.status,
+	}
+	var errInvalid *validator.Error
+	if errors.As(e.err, &errInvalid) {
+		extensions["errors"] = errInvalid.Fields
+	}
+	return extensions
+}
+
+func errGraphQL(status int, err error) error {
+	return &graphQLError{status: status, err: err}
+}
+
+// errGraphQLService returns the error of a service with the status it has in the REST API
+func errGraphQLService(err error) error {
+	status := http.StatusInternalServerError
+	if e, ok := ErrService(err).(*ErrResponse); ok {
+		status = e.HTTPStatusCode
+	}
+	return errGraphQL(status, err)
+}
+
+// graphQLOptions returns the options of the endpoint
+func graphQLOptions(p graphql.ResolveParams) GraphQLOptions {
+	root, _ := p.Info.RootValue.(map[string]interface{})
+	opts, _ := root[graphQLRootOptions].(GraphQLOptions)
+	return opts
+}
+
+// authorize does the checks of authenticate with the given roles,
+// for the fields which require a signed-in user
+func authorize(p graphql.ResolveParams, roles ...auth.Role) error {
+	jsonToken, err := icontext.JSONToken(p.Context)
+	if err != nil {
+		return errGraphQL(http.StatusUnauthorized, auth.ErrTokenMissing)
+	}
+	if err := auth.CheckRole(jsonToken.Role, roles...); err != nil {
+		return errGraphQL(http.StatusUnauthorized, err)
+	}
+	return nil
+}
+
+// graphQLVersion returns the version argument, if any
+func graphQLVersion(p graphql.ResolveParams) *int64 {
+	version, ok := p.Args["version"].(int)
+	if !ok {
+		return nil
+	}
+	v := int64(version)
+	return &v
+}
+
+// graphQLUserByID gets the user with the id argument
+func graphQLUserByID(p graphql.ResolveParams, withDeleted bool) (*database.User, error) {
+	idArg, _ := p.Args["id"].(string)
+	id, err := strconv.ParseInt(idArg, 10, 64)
+	if err != nil {
+		return nil, errGraphQL(http.StatusBadRequest, fmt.Errorf("user id '%s' is not an integer number", idArg))
+	}
+	u, err := service.GetUser(p.Context, id, withDeleted)
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	return u, nil
+}
+
+var graphQLRole = graphql.NewEnum(graphql.EnumConfig{
+	Name: "Role",
+	Values: graphql.EnumValueConfigMap{
+		"ADMIN":       &graphql.EnumValueConfig{Value: auth.RoleAdmin},
+		"AUDITOR":     &graphql.EnumValueConfig{Value: auth.RoleAuditor},
+		"SUPER_ADMIN": &graphql.EnumValueConfig{Value: auth.RoleSuperAdmin, Description: "Administers all the organizations"},
+	},
+})
+
+var graphQLOrganization = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Organization",
+	Fields: graphql.Fields{
+		"id":      &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		"name":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"slug":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"created": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		"updated": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+	},
+})
+
+// userField resolves a nullable field of the user
+func userField(field func(u *database.User) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		u, ok := p.Source.(*database.User)
+		if !ok {
+			return nil, nil
+		}
+		return field(u), nil
+	}
+}
+
+func nullString(s sql.NullString) interface{} {
+	if !s.Valid {
+		return nil
+	}
+	return s.String
+}
+
+func nullTime(t sql.NullTime) interface{} {
+	if !t.Valid {
+		return nil
+	}
+	return t.Time
+}
+
+var graphQLUser = graphql.NewObject(graphql.ObjectConfig{
+	Name: "User",
+	Fields: graphql.Fields{
+		"id":       &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		"username": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"email":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"firstName": &graphql.Field{
+			Type:    graphql.String,
+			Resolve: userField(func(u *database.User) interface{} { return nullString(u.FirstName) }),
+		},
+		"lastName": &graphql.Field{
+			Type:    graphql.String,
+			Resolve: userField(func(u *database.User) interface{} { return nullString(u.LastName) }),
+		},
+		"role":    &graphql.Field{Type: graphql.NewNonNull(graphQLRole)},
+		"created": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		"updated": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		"deleted": &graphql.Field{
+			Type:    graphql.DateTime,
+			Resolve: userField(func(u *database.User) interface{} { return nullTime(u.Deleted) }),
+		},
+		"anonymized": &graphql.Field{
+			Type:    graphql.DateTime,
+			Resolve: userField(func(u *database.User) interface{} { return nullTime(u.Anonymized) }),
+		},
+		"version": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.Int),
+			Description: "Version of the user, to be given when changing it",
+		},
+		"organization": &graphql.Field{
+			Type:    graphql.NewNonNull(graphQLOrganization),
+			Resolve: resolveUserOrganization,
+		},
+	},
+})
+
+func resolveUserOrganization(p graphql.ResolveParams) (interface{}, error) {
+	u, ok := p.Source.(*database.User)
+	if !ok {
+		return nil, nil
+	}
+	store, err := icontext.Store(p.Context)
+	if err != nil {
+		return nil, errGraphQL(http.StatusInternalServerError, err)
+	}
+	o, err := store.GetOrganizationByID(p.Context, u.OrganizationID)
+	if err != nil {
+		logging.SimpleFromCtx(p.Context).Err(err).Msgf(
+			"error getting organization %d of user %d", u.OrganizationID, u.ID)
+		return nil, errGraphQL(http.StatusInternalServerError, err)
+	}
+	return o, nil
+}
+
+// graphQLPageInfo tells how to get the pages around a page of a list,
+// by cursor or by number, like the Link header does in the REST API
+type graphQLPageInfo struct {
+	NextCursor *string `json:"nextCursor"`
+	PrevCursor *string `json:"prevCursor"`
+	NextPage   *int    `json:"nextPage"`
+	PrevPage   *int    `json:"prevPage"`
+}
+
+func newGraphQLPageInfo(page *database.Page) *graphQLPageInfo {
+	info := &graphQLPageInfo{}
+	set := func(p *database.Page, cursor **string, number **int) {
+		if p.Number > 0 {
+			*number = &p.Number
+			return
+		}
+		encoded := p.Cursor.Encode()
+		*cursor = &encoded
+	}
+	if next, ok := page.Next(); ok {
+		set(next, &info.NextCursor, &info.NextPage)
+	}
+	if prev, ok := page.Prev(); ok {
+		set(prev, &info.PrevCursor, &info.PrevPage)
+	}
+	return info
+}
+
+// graphQLUserConnection is a page of the list of users
+type graphQLUserConnection struct {
+	Nodes      []*database.User `json:"nodes"`
+	TotalCount int64            `json:"totalCount"`
+	PageInfo   *graphQLPageInfo `json:"pageInfo"`
+}
+
+var graphQLUserConnectionType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "UserConnection",
+	Fields: graphql.Fields{
+		"nodes":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphQLUser)))},
+		"totalCount": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"pageInfo": &graphql.Field{Type: graphql.NewNonNull(graphql.NewObject(graphql.ObjectConfig{
+			Name: "PageInfo",
+			Fields: graphql.Fields{
+				"nextCursor": &graphql.Field{Type: graphql.String},
+				"prevCursor": &graphql.Field{Type: graphql.String},
+				"nextPage":   &graphql.Field{Type: graphql.Int},
+				"prevPage":   &graphql.Field{Type: graphql.Int},
+			},
+		}))},
+	},
+})
+
+var graphQLUserFilter = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "UserFilter",
+	Description: "Filters users like the filter[field][op]=value params of GET /users, " +
+		"e.g. {field: \"username\", op: \"prefix\", value: \"jo\"}",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"field": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"op":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"value": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+var graphQLUserInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "UserInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"username":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"password":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"email":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"firstName": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"lastName":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		"role":      &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphQLRole)},
+	},
+})
+
+// userFromGraphQLInput returns the user given by the input argument
+func userFromGraphQLInput(p graphql.ResolveParams) *database.User {
+	input, _ := p.Args["input"].(map[string]interface{})
+	u := &database.User{}
+	u.Username, _ = input["username"].(string)
+	u.Password, _ = input["password"].(string)
+	u.Email, _ = input["email"].(string)
+	if firstName, ok := input["firstName"].(string); ok {
+		u.FirstName = sql.NullString{String: firstName, Valid: true}
+	}
+	if lastName, ok := input["lastName"].(string); ok {
+		u.LastName = sql.NullString{String: lastName, Valid: true}
+	}
+	u.Role, _ = input["role"].(auth.Role)
+	return u
+}
+
+var graphQLSignInPayload = graphql.NewObject(graphql.ObjectConfig{
+	Name: "SignInPayload",
+	Fields: graphql.Fields{
+		"token":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"expiration": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		"warning":    &graphql.Field{Type: graphql.String},
+	},
+})
+
+var graphQLVersionArg = &graphql.ArgumentConfig{
+	Type:        graphql.Int,
+	Description: "Version of the user, as returned when it was read, to make sure it has not been changed since",
+}
+
+var graphQLQuery = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Query",
+	Fields: graphql.Fields{
+		"me": &graphql.Field{
+			Type:        graphql.NewNonNull(graphQLUser),
+			Description: "The signed-in user",
+			Resolve:     resolveMe,
+		},
+		"user": &graphql.Field{
+			Type:        graphql.NewNonNull(graphQLUser),
+			Description: "Requires the Admin or SuperAdmin role",
+			Args: graphql.FieldConfigArgument{
+				"id":             &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"includeDeleted": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+			},
+			Resolve: resolveUser,
+		},
+		"users": &graphql.Field{
+			Type: graphql.NewNonNull(graphQLUserConnectionType),
+			Description: "Lists users, by cursor or, if page is given, by page number, " +
+				"like GET /users does; requires the Admin or SuperAdmin role",
+			Args: graphql.FieldConfigArgument{
+				"filter": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphQLUserFilter))},
+				"sort": &graphql.ArgumentConfig{
+					Type:        graphql.String,
+					Description: "Comma separated fields to sort by, descending if prefixed with -, e.g. -created,username",
+				},
+				"page":     &graphql.ArgumentConfig{Type: graphql.Int},
+				"pageSize": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: database.PageSizeDefault},
+				"cursor":   &graphql.ArgumentConfig{Type: graphql.String},
+				"includeDeleted": &graphql.ArgumentConfig{
+					Type:        graphql.Boolean,
+					Description: "Whether to also list the deleted users, which is implied when filtering by deleted",
+				},
+			},
+			Resolve: resolveUsers,
+		},
+	},
+})
+
+var graphQLMutation = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Mutation",
+	Fields: graphql.Fields{
+		"signIn": &graphql.Field{
+			Type: graphql.NewNonNull(graphQLSignInPayload),
+			Args: graphql.FieldConfigArgument{
+				"usernameOrEmail": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"password":        &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"organization": &graphql.ArgumentConfig{
+					Type:        graphql.String,
+					Description: "Slug of the organization of the user, the default organization if not given",
+				},
+			},
+			Resolve: resolveSignIn,
+		},
+		"createUser": &graphql.Field{
+			Type:        graphql.NewNonNull(graphQLUser),
+			Description: "Requires the Admin or SuperAdmin role",
+			Args: graphql.FieldConfigArgument{
+				"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphQLUserInput)},
+			},
+			Resolve: resolveCreateUser,
+		},
+		"updateUser": &graphql.Field{
+			Type:        graphql.NewNonNull(graphQLUser),
+			Description: "Requires the Admin or SuperAdmin role",
+			Args: graphql.FieldConfigArgument{
+				"id":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"version": graphQLVersionArg,
+				"input":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphQLUserInput)},
+			},
+			Resolve: resolveUpdateUser,
+		},
+		"deleteUser": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.Boolean),
+			Description: "Requires the Admin or SuperAdmin role",
+			Args: graphql.FieldConfigArgument{
+				"id":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"version": graphQLVersionArg,
+			},
+			Resolve: resolveDeleteUser,
+		},
+		"restoreUser": &graphql.Field{
+			Type:        graphql.NewNonNull(graphQLUser),
+			Description: "Requires the Admin or SuperAdmin role",
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: resolveRestoreUser,
+		},
+		"updatePassword": &graphql.Field{
+			Type:        graphql.NewNonNull(graphQLUser),
+			Description: "Updates the password of the signed-in user",
+			Args: graphql.FieldConfigArgument{
+				"oldPassword": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"newPassword": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: resolveUpdatePassword,
+		},
+		"updateEmail": &graphql.Field{
+			Type:        graphql.NewNonNull(graphQLUser),
+			Description: "Updates the email of the signed-in user",
+			Args: graphql.FieldConfigArgument{
+				"email":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"version": graphQLVersionArg,
+			},
+			Resolve: resolveUpdateEmail,
+		},
+	},
+})
+
+var graphQLSchema graphql.Schema
+
+func init() {
+	var err error
+	graphQLSchema, err = graphql.NewSchema(graphql.SchemaConfig{
+		Query:    graphQLQuery,
+		Mutation: graphQLMutation,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("error building GraphQL schema: %v", err))
+	}
+}
+
+func resolveMe(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p); err != nil {
+		return nil, err
+	}
+	u, err := service.GetSignedInUser(p.Context)
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	return u, nil
+}
+
+func resolveUser(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p, auth.RoleAdmin, auth.RoleSuperAdmin); err != nil {
+		return nil, err
+	}
+	includeDeleted, _ := p.Args["includeDeleted"].(bool)
+	return graphQLUserByID(p, includeDeleted)
+}
+
+func resolveUsers(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p, auth.RoleAdmin, auth.RoleSuperAdmin); err != nil {
+		return nil, err
+	}
+
+	// the arguments are checked like the URL query params of GET /users
+	page := &database.Page{Size: database.PageSizeDefault}
+	if number, ok := p.Args["page"].(int); ok {
+		if number < 1 {
+			return nil, errGraphQL(http.StatusBadRequest, fmt.Errorf("page %d is not a positive integer number", number))
+		}
+		page.Number = number
+	}
+	if size, ok := p.Args["pageSize"].(int); ok {
+		if size < 1 || size > database.PageSizeMax {
+			return nil, errGraphQL(http.StatusBadRequest, fmt.Errorf(
+				"pageSize %d is not an integer number between 1 and %d", size, database.PageSizeMax))
+		}
+		page.Size = size
+	}
+	if cursor, ok := p.Args["cursor"].(string); ok {
+		if page.Number > 0 {
+			return nil, errGraphQL(http.StatusBadRequest, errors.New("page and cursor can not be used together"))
+		}
+		var err error
+		if page.Cursor, err = database.DecodeCursor(cursor); err != nil {
+			return nil, errGraphQL(http.StatusBadRequest, err)
+		}
+	}
+	values := url.Values{}
+	filters, _ := p.Args["filter"].([]interface{})
+	for _, f := range filters {
+		filter, _ := f.(map[string]interface{})
+		values.Add(fmt.Sprintf("filter[%v][%v]", filter["field"], filter["op"]), fmt.Sprint(filter["value"]))
+	}
+	if sort, ok := p.Args["sort"].(string); ok {
+		values.Set(query.SortParam, sort)
+	}
+	q, err := database.UserQuerySpec.Parse(values)
+	if err != nil {
+		return nil, errGraphQL(http.StatusBadRequest, err)
+	}
+	// filtering by the deletion time implies including the deleted users
+	includeDeleted := q.FiltersBy("deleted")
+	if includeDeletedArg, ok := p.Args["includeDeleted"].(bool); ok {
+		includeDeleted = includeDeletedArg
+	}
+
+	users, err := service.ListUsers(p.Context, page, q, includeDeleted)
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	total, _ := page.Total()
+	return &graphQLUserConnection{
+		Nodes:      users,
+		TotalCount: total,
+		PageInfo:   newGraphQLPageInfo(page),
+	}, nil
+}
+
+func resolveSignIn(p graphql.ResolveParams) (interface{}, error) {
+	usernameOrEmail, _ := p.Args["usernameOrEmail"].(string)
+	password, _ := p.Args["password"].(string)
+	organization, _ := p.Args["organization"].(string)
+	signIn, err := service.SignInUser(p.Context, usernameOrEmail, password, organization)
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	return &SignInResponse{Token: signIn.Token, Expiration: signIn.Expiration, Warning: signIn.Warning}, nil
+}
+
+func resolveCreateUser(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p, auth.RoleAdmin, auth.RoleSuperAdmin); err != nil {
+		return nil, err
+	}
+	u, err := service.CreateUser(p.Context, userFromGraphQLInput(p))
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	return u, nil
+}
+
+func resolveUpdateUser(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p, auth.RoleAdmin, auth.RoleSuperAdmin); err != nil {
+		return nil, err
+	}
+	u, err := graphQLUserByID(p, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.CheckVersion(graphQLVersion(p), u.Version, graphQLOptions(p).RequireVersion); err != nil {
+		return nil, errGraphQLService(err)
+	}
+	updated, err := service.UpdateUser(p.Context, u, userFromGraphQLInput(p))
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	return updated, nil
+}
+
+func resolveDeleteUser(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p, auth.RoleAdmin, auth.RoleSuperAdmin); err != nil {
+		return nil, err
+	}
+	u, err := graphQLUserByID(p, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.CheckVersion(graphQLVersion(p), u.Version, graphQLOptions(p).RequireVersion); err != nil {
+		return nil, errGraphQLService(err)
+	}
+	if err := service.DeleteUser(p.Context, u); err != nil {
+		return nil, errGraphQLService(err)
+	}
+	return true, nil
+}
+
+func resolveRestoreUser(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p, auth.RoleAdmin, auth.RoleSuperAdmin); err != nil {
+		return nil, err
+	}
+	u, err := graphQLUserByID(p, true)
+	if err != nil {
+		return nil, err
+	}
+	restored, err := service.RestoreUser(p.Context, u)
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	return restored, nil
+}
+
+func resolveUpdatePassword(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p); err != nil {
+		return nil, err
+	}
+	u, err := service.GetSignedInUser(p.Context)
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	oldPassword, _ := p.Args["oldPassword"].(string)
+	newPassword, _ := p.Args["newPassword"].(string)
+	updated, err := service.UpdatePassword(p.Context, u, oldPassword, newPassword)
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	return updated, nil
+}
+
+func resolveUpdateEmail(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p); err != nil {
+		return nil, err
+	}
+	u, err := service.GetSignedInUser(p.Context)
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	if err := service.CheckVersion(graphQLVersion(p), u.Version, graphQLOptions(p).RequireVersion); err != nil {
+		return nil, errGraphQLService(err)
+	}
+	email, _ := p.Args["email"].(string)
+	updated, err := service.UpdateEmail(p.Context, u, email)
+	if err != nil {
+		return nil, errGraphQLService(err)
+	}
+	return updated, nil
+}
@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGraphQLIntrospectionLimits(t *testing.T) {
+	deep := "{ __schema { types { fields { type { fields { type { fields { type { fields { name } } } } } } } } } }"
+	tests := []struct {
+		name          string
+		query         string
+		maxComplexity int
+		introspection bool
+		// wantErr is a part of the message of the expected error, if any
+		wantErr string
+	}{
+		{"schema", "{ __schema { queryType { name } } }", 2000, true, ""},
+		{"deeper than allowed", deep, 2000, true, "deeper than the max depth of 8"},
+		{"more complex than allowed", "{ __schema { types { name kind } } }", 3, true, "more complex than the max complexity of 3"},
+		{"schema when disabled", "{ __schema { queryType { name } } }", 2000, false, "introspection of the schema is disabled"},
+		{"type when disabled", `{ __type(name: "User") { name } }`, 2000, false, "introspection of the schema is disabled"},
+		{"deep when disabled", deep, 2000, false, "introspection of the schema is disabled"},
+		{"typename when disabled", "{ __typename }", 2000, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/graphql", nil)
+			result := executeGraphQL(r, &GraphQLRequest{Query: tt.query}, GraphQLOptions{
+				MaxDepth:      8,
+				MaxComplexity: tt.maxComplexity,
+				Introspection: tt.introspection,
+			})
+			if tt.wantErr == "" {
+				if result.HasErrors() || result.Data == nil {
+					t.Fatalf("expected data, got errors %v", result.Errors)
+				}
+				return
+			}
+			if result.Data != nil {
+				t.Fatalf("expected no data, got %v", result.Data)
+			}
+			if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Message, tt.wantErr) {
+				t.Fatalf("expected the error %q, got %v", tt.wantErr, result.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+)
+
+// HealthStatusResponse is whether the database is up, without the details of the
+// health report, which are only for the admins
+type HealthStatusResponse struct {
+	Up      bool      `json:"up"`
+	Checked time.Time `json:"checked"`
+}
+
+// Render ...
+func (hr *HealthStatusResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// HealthResponse ...
+type HealthResponse struct {
+	Database database.Health `json:"database"`
+}
+
+// Render ...
+func (hr *HealthResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Health ...
+// @id Health
+// @tags health
+// @summary Gets whether the database is up
+// @produce application/json
+// @success 200 {object} controller.HealthStatusResponse
+// @failure 503 {object} controller.HealthStatusResponse
+// @router /health [get]
+func Health(w http.ResponseWriter, r *http.Request) {
+	renderHealth(w, r, func(health database.Health) render.Renderer {
+		return &HealthStatusResponse{Up: health.Up, Checked: health.Checked}
+	})
+}
+
+// HealthDetails ...
+// @id HealthDetails
+// @tags health
+// @summary Gets the health of the database along with its errors and connection pool stats
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @success 200 {object} controller.HealthResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 503 {object} controller.HealthResponse
+// @router /health/details [get]
+func HealthDetails(w http.ResponseWriter, r *http.Request) {
+	renderHealth(w, r, func(health database.Health) render.Renderer {
+		return &HealthResponse{Database: health}
+	})
+}
+
+// renderHealth renders the health of the database as returned by response,
+// with the 503 status if the database is down
+func renderHealth(w http.ResponseWriter, r *http.Request, response func(health database.Health) render.Renderer) {
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	health := store.Health(r.Context())
+	if health.Up {
+		render.Status(r, http.StatusOK)
+	} else {
+		render.Status(r, http.StatusServiceUnavailable)
+	}
+	render.Render(w, r, response(health))
+}
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+)
+
+// downStore is a Store whose database is down
+type downStore struct {
+	*database.MemoryStore
+}
+
+func (s *downStore) Health(ctx context.Context) database.Health {
+	return database.Health{
+		Checked: time.Now().UTC(),
+		Error:   "dial tcp 10.0.0.5:5432: connect: connection refused",
+		Pool:    database.PoolStats{MaxOpenConnections: 20},
+	}
+}
+
+func TestHealthDown(t *testing.T) {
+	store := database.Store(&downStore{MemoryStore: database.NewMemoryStore()})
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		// wantDetails is whether the error and the pool stats are expected
+		wantDetails bool
+	}{
+		{"public", Health, false},
+		{"details", HealthDetails, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/health", nil)
+			r = r.WithContext(context.WithValue(r.Context(), icontext.KeyStore, store))
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+			}
+			body, _ := io.ReadAll(w.Body)
+			for _, detail := range []string{"connection refused", "max_open_connections"} {
+				if got := strings.Contains(string(body), detail); got != tt.wantDetails {
+					t.Errorf("expected %q in the body to be %v, got %s", detail, tt.wantDetails, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/padurean/purest/internal/i18n"
+)
+
+// IDs of the messages of the controllers, besides the titles of the problems,
+// whose IDs are the texts of their HTTP statuses
+const (
+	msgQueryRequired    = "query_required"
+	msgUnknownEventType = "unknown_event_type"
+)
+
+// messages are the translations of the messages of the controllers
+var messages = i18n.Catalogue{
+	"en": {
+		msgQueryRequired:    "query is a required field",
+		msgUnknownEventType: "unknown event type %s, valid types: %s",
+	},
+	"de": {
+		http.StatusText(http.StatusBadRequest):           "Ungültige Anfrage",
+		http.StatusText(http.StatusUnauthorized):         "Nicht autorisiert",
+		http.StatusText(http.StatusNotFound):             "Nicht gefunden",
+		http.StatusText(http.StatusMethodNotAllowed):     "Methode nicht erlaubt",
+		http.StatusText(http.StatusUnsupportedMediaType): "Nicht unterstützter Medientyp",
+		http.StatusText(http.StatusPreconditionFailed):   "Vorbedingung fehlgeschlagen",
+		http.StatusText(http.StatusUnprocessableEntity):  "Nicht verarbeitbare Entität",
+		http.StatusText(http.StatusPreconditionRequired): "Vorbedingung erforderlich",
+		http.StatusText(http.StatusInternalServerError):  "Interner Serverfehler",
+		msgQueryRequired:    "query ist ein Pflichtfeld",
+		msgUnknownEventType: "unbekannter Ereignistyp %s, gültige Typen: %s",
+	},
+	"fr": {
+		http.StatusText(http.StatusBadRequest):           "Requête invalide",
+		http.StatusText(http.StatusUnauthorized):         "Non autorisé",
+		http.StatusText(http.StatusNotFound):             "Introuvable",
+		http.StatusText(http.StatusMethodNotAllowed):     "Méthode non autorisée",
+		http.StatusText(http.StatusUnsupportedMediaType): "Type de média non supporté",
+		http.StatusText(http.StatusPreconditionFailed):   "Échec de la précondition",
+		http.StatusText(http.StatusUnprocessableEntity):  "Entité non traitable",
+		http.StatusText(http.StatusPreconditionRequired): "Précondition requise",
+		http.StatusText(http.StatusInternalServerError):  "Erreur interne du serveur",
+		msgQueryRequired:    "query est un champ obligatoire",
+		msgUnknownEventType: "type d'événement inconnu %s, types valides : %s",
+	},
+	"ro": {
+		http.StatusText(http.StatusBadRequest):           "Cerere invalidă",
+		http.StatusText(http.StatusUnauthorized):         "Neautorizat",
+		http.StatusText(http.StatusNotFound):             "Negăsit",
+		http.StatusText(http.StatusMethodNotAllowed):     "Metodă nepermisă",
+		http.StatusText(http.StatusUnsupportedMediaType): "Tip media nesuportat",
+		http.StatusText(http.StatusPreconditionFailed):   "Precondiție eșuată",
+		http.StatusText(http.StatusUnprocessableEntity):  "Entitate neprocesabilă",
+		http.StatusText(http.StatusPreconditionRequired): "Precondiție necesară",
+		http.StatusText(http.StatusInternalServerError):  "Eroare internă a serverului",
+		msgQueryRequired:    "query este un câmp obligatoriu",
+		msgUnknownEventType: "tip de eveniment necunoscut %s, tipuri valide: %s",
+	},
+}
+
+// statusTitle returns the text of the given HTTP status translated to the given
+// locale, or in English if there is no such translation
+func statusTitle(locale string, status int) string {
+	text := http.StatusText(status)
+	if messages.Has(locale, text) {
+		return messages.T(locale, text)
+	}
+	return text
+}
@@ -71,3 +71,36 @@ func (nt *NullTime) UnmarshalJSON(data []byte) error {
 }
 
 //<===
+
+//===> NullInt64
+
+// NullInt64 is a wrapper around sql.NullInt64
+type NullInt64 sql.NullInt64
+
+// MarshalJSON method is called by json.Marshal,
+// whenever it is of type NullInt64
+func (ni *NullInt64) MarshalJSON() ([]byte, error) {
+	if !ni.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(ni.Int64)
+}
+
+// UnmarshalJSON method is called by json.Unmarshal,
+// whenever it is of type NullInt64
+func (ni *NullInt64) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		ni.Valid = false
+		ni.Int64 = 0
+		return nil
+	}
+	var v int64
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	ni.Valid = true
+	ni.Int64 = v
+	return nil
+}
+
+//<===
@@ -0,0 +1,354 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/service"
+	"github.com/padurean/purest/internal/validator"
+)
+
+// OrganizationRequest ...
+type OrganizationRequest struct {
+	*database.Organization
+	Deleted NullTime `json:"deleted,omitempty" swaggertype:"string"`
+}
+
+// Bind ...
+func (o *OrganizationRequest) Bind(r *http.Request) error {
+	if o.Organization == nil {
+		// an empty organization, so that its required fields are told apart
+		o.Organization = &database.Organization{}
+	}
+	if err := validator.Validate(r.Context(), o); err != nil {
+		return err
+	}
+	o.Organization.Deleted = sql.NullTime(o.Deleted)
+	return nil
+}
+
+// OrganizationResponse ...
+type OrganizationResponse struct {
+	*database.Organization
+	Deleted NullTime `json:"deleted,omitempty" swaggertype:"string"`
+}
+
+// Render ...
+func (o *OrganizationResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	o.Deleted = NullTime(o.Organization.Deleted)
+	return nil
+}
+
+func organizationAuditEvent(action string, o *database.Organization) *database.AuditEvent {
+	return &database.AuditEvent{
+		Action:         action,
+		Target:         fmt.Sprintf("organization:%d", o.ID),
+		OrganizationID: sql.NullInt64{Int64: o.ID, Valid: true},
+	}
+}
+
+// OrganizationCtx ...
+func OrganizationCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store, err := icontext.Store(r.Context())
+		if err != nil {
+			render.Render(w, r, ErrInternalServer(err))
+			return
+		}
+		idParam := chi.URLParam(r, "id")
+		id, err := strconv.ParseInt(idParam, 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(
+				fmt.Errorf("organization 'id' url param '%s' is not an integer number", idParam)))
+			return
+		}
+		o, err := store.GetOrganizationByID(r.Context(), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				render.Render(w, r, ErrNotFound(fmt.Errorf("organization %d not found", id)))
+				return
+			default:
+				logging.Simple(r).Err(err).Msgf("error getting organization by id %d", id)
+				render.Render(w, r, ErrInternalServer(err))
+				return
+			}
+		}
+		ctx := context.WithValue(r.Context(), icontext.KeyOrganization, o)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// OrganizationCreate ...
+// @id OrganizationCreate
+// @tags organizations
+// @summary Creates a new organization
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param payload body controller.OrganizationRequest true "Request body payload"
+// @success 201 {object} controller.OrganizationResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 422 {object} controller.ErrResponse
+// @router /organizations [post]
+func OrganizationCreate(w http.ResponseWriter, r *http.Request) {
+	oReq := &OrganizationRequest{}
+	reqLogger := logging.Simple(r)
+	if err := render.Bind(r, oReq); err != nil {
+		reqLogger.Err(err).Msgf("error unmarshaling organization from JSON")
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	var o *database.Organization
+	err = service.InTx(r.Context(), func(ctx context.Context) error {
+		var err error
+		if o, err = store.CreateOrganization(ctx, oReq.Organization); err != nil {
+			return err
+		}
+		return service.Audit(ctx, organizationAuditEvent("organization.create", o),
+			nil, &OrganizationResponse{Organization: o})
+	})
+	if err != nil {
+		var errDuplicate *database.ErrDuplicateRow
+		switch {
+		case errors.As(err, &errDuplicate):
+			render.Render(w, r, ErrUnprocessableEntity(err))
+			return
+		default:
+			reqLogger.Err(err).Msgf("error creating organization %+v", oReq.Organization)
+			render.Render(w, r, ErrInternalServer(err))
+			return
+		}
+	}
+	setETag(w, o.Version)
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &OrganizationResponse{Organization: o})
+}
+
+// OrganizationList ...
+// @id OrganizationList
+// @tags organizations
+// @summary Lists organizations
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param page query int false "Page number, for paginating by page number instead of by cursor"
+// @param pageSize query int false "Page size (default 20, at most 100)"
+// @param cursor query string false "Opaque cursor of the page, as found in the Link header (none for the first page)"
+// @success 200 {array} controller.OrganizationResponse
+// @header 200 {integer} X-Total-Count "Total number of organizations"
+// @header 200 {string} Link "Links to the next and previous pages"
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @router /organizations [get]
+func OrganizationList(w http.ResponseWriter, r *http.Request) {
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	page, err := icontext.Page(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+
+	reqLogger := logging.Simple(r)
+	opts := page.ListOptions()
+	organizations, err := store.ListOrganizations(r.Context(), opts)
+	if err != nil {
+		reqLogger.Err(err).Msgf("error listing organizations page")
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	total, err := store.CountOrganizations(r.Context(), opts)
+	if err != nil {
+		reqLogger.Err(err).Msgf("error counting organizations")
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+
+	organizationsResponseList := []render.Renderer{}
+	keys := []int64{}
+	for _, o := range organizations {
+		organizationsResponseList = append(organizationsResponseList, &OrganizationResponse{Organization: o})
+		keys = append(keys, o.ID)
+	}
+	page.Listed(total, keys)
+	if err := render.RenderList(w, r, organizationsResponseList); err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	render.Status(r, http.StatusOK)
+}
+
+// OrganizationGet ...
+// @id OrganizationGet
+// @tags organizations
+// @summary Gets an existing organization
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param id path int true "Organization id"
+// @success 200 {object} controller.OrganizationResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @router /organizations/{id} [get]
+func OrganizationGet(w http.ResponseWriter, r *http.Request) {
+	o, err := icontext.Organization(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	setETag(w, o.Version)
+	render.Status(r, http.StatusOK)
+	render.Render(w, r, &OrganizationResponse{Organization: o})
+}
+
+// OrganizationUpdate ...
+// @id OrganizationUpdate
+// @tags organizations
+// @summary Updates an existing organization
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param If-Match header string false "ETag of the organization, as returned when it was read"
+// @param id path int true "Organization id"
+// @param payload body controller.OrganizationRequest true "Request body payload"
+// @success 200 {object} controller.OrganizationResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @failure 412 {object} controller.ErrResponse
+// @failure 422 {object} controller.ErrResponse
+// @failure 428 {object} controller.ErrResponse
+// @router /organizations/{id} [put]
+func OrganizationUpdate(w http.ResponseWriter, r *http.Request) {
+	oReq := &OrganizationRequest{}
+	reqLogger := logging.Simple(r)
+	if err := render.Bind(r, oReq); err != nil {
+		reqLogger.Err(err).Msgf("error unmarshaling organization from JSON")
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+	o, err := icontext.Organization(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	if !checkIfMatch(w, r, o.Version) {
+		return
+	}
+	oReq.ID = o.ID
+	oReq.Version = o.Version
+
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	var updated *database.Organization
+	err = service.InTx(r.Context(), func(ctx context.Context) error {
+		var err error
+		if updated, err = store.UpdateOrganization(ctx, oReq.Organization); err != nil {
+			return err
+		}
+		return service.Audit(ctx, organizationAuditEvent("organization.update", o),
+			&OrganizationResponse{Organization: o}, &OrganizationResponse{Organization: updated})
+	})
+	if err != nil {
+		var errDuplicate *database.ErrDuplicateRow
+		var errStale *database.ErrStaleRow
+		switch {
+		case errors.As(err, &errDuplicate):
+			render.Render(w, r, ErrUnprocessableEntity(err))
+			return
+		case errors.As(err, &errStale):
+			render.Render(w, r, ErrPreconditionFailed(err))
+			return
+		case errors.Is(err, sql.ErrNoRows):
+			render.Render(w, r, ErrNotFound(fmt.Errorf("organization %d not found", o.ID)))
+			return
+		default:
+			reqLogger.Err(err).Msgf("error updating organization %+v", oReq.Organization)
+			render.Render(w, r, ErrInternalServer(err))
+			return
+		}
+	}
+	setETag(w, updated.Version)
+	render.Status(r, http.StatusOK)
+	render.Render(w, r, &OrganizationResponse{Organization: updated})
+}
+
+// OrganizationDelete ...
+// @id OrganizationDelete
+// @tags organizations
+// @summary Deletes an existing organization, whose users can not sign in anymore
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param If-Match header string false "ETag of the organization, as returned when it was read"
+// @param id path int true "Organization id"
+// @success 204
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @failure 412 {object} controller.ErrResponse
+// @failure 422 {object} controller.ErrResponse
+// @failure 428 {object} controller.ErrResponse
+// @router /organizations/{id} [delete]
+func OrganizationDelete(w http.ResponseWriter, r *http.Request) {
+	o, err := icontext.Organization(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	if !checkIfMatch(w, r, o.Version) {
+		return
+	}
+	// the default organization is where the super-admins sign in
+	if o.Slug == database.DefaultOrganizationSlug {
+		render.Render(w, r, ErrUnprocessableEntity(
+			fmt.Errorf("the %s organization can not be deleted", database.DefaultOrganizationSlug)))
+		return
+	}
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	err = service.InTx(r.Context(), func(ctx context.Context) error {
+		if err := store.DeleteOrganization(ctx, o); err != nil {
+			return err
+		}
+		return service.Audit(ctx, organizationAuditEvent("organization.delete", o), nil, nil)
+	})
+	if err != nil {
+		var errStale *database.ErrStaleRow
+		switch {
+		case errors.As(err, &errStale):
+			render.Render(w, r, ErrPreconditionFailed(err))
+			return
+		case errors.Is(err, sql.ErrNoRows):
+			render.Render(w, r, ErrNotFound(fmt.Errorf("organization %d not found", o.ID)))
+			return
+		default:
+			logging.Simple(r).Err(err).Msgf("error deleting organization %d", o.ID)
+			render.Render(w, r, ErrInternalServer(err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/go-chi/render"
+)
+
+// Content types of the PATCH requests
+const (
+	// ContentTypeMergePatch is the content type of the merge patches, as of RFC 7396
+	ContentTypeMergePatch = "application/merge-patch+json"
+	// ContentTypeJSONPatch is the content type of the JSON Patches, as of RFC 6902
+	ContentTypeJSONPatch = "application/json-patch+json"
+)
+
+// applyPatch applies the patch in the body of the request, a merge patch or a JSON Patch
+// by its content type, to the JSON of the given document and decodes the result into
+// patched, which is to be empty, so that the fields the patch removes are left empty;
+// if the patch can not be applied it renders the error response and returns false
+func applyPatch(w http.ResponseWriter, r *http.Request, doc interface{}, patched interface{}) bool {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != ContentTypeMergePatch && contentType != ContentTypeJSONPatch {
+		render.Render(w, r, ErrUnsupportedMediaType(fmt.Errorf(
+			"unsupported content type %q: use %s or %s", contentType, ContentTypeMergePatch, ContentTypeJSONPatch)))
+		return false
+	}
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(fmt.Errorf("error reading the patch: %w", err)))
+		return false
+	}
+	original, err := json.Marshal(doc)
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return false
+	}
+	var result []byte
+	if contentType == ContentTypeMergePatch {
+		if !json.Valid(patch) {
+			render.Render(w, r, ErrBadRequest(fmt.Errorf("the merge patch is not valid JSON")))
+			return false
+		}
+		result, err = jsonpatch.MergePatch(original, patch)
+	} else {
+		var operations jsonpatch.Patch
+		if operations, err = jsonpatch.DecodePatch(patch); err != nil {
+			render.Render(w, r, ErrBadRequest(fmt.Errorf("error decoding the JSON Patch: %w", err)))
+			return false
+		}
+		result, err = operations.Apply(original)
+	}
+	if err != nil {
+		// e.g. a path which is missing or a test operation which fails
+		render.Render(w, r, ErrUnprocessableEntity(fmt.Errorf("error applying the patch: %w", err)))
+		return false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(result))
+	// only the fields of the document can be patched
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(patched); err != nil {
+		render.Render(w, r, ErrBadRequest(fmt.Errorf("error decoding the patched document: %w", err)))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/service"
+	"github.com/padurean/purest/internal/validator"
+)
+
+// ProblemCode is the code of a type of problem which, unlike the detail of the problem,
+// does not change, so that the clients can tell the problems apart by it
+type ProblemCode string
+
+// problemTypePrefix makes the URI of the type of a problem out of its code,
+// e.g. urn:purest:problem:USER_DUPLICATE_EMAIL
+const problemTypePrefix = "urn:purest:problem:"
+
+// Codes of the problems which have a code of their own; the other ones have the code
+// of their HTTP status, e.g. BAD_REQUEST, NOT_FOUND or INTERNAL_SERVER_ERROR
+const (
+	ProblemValidationFailed          ProblemCode = "VALIDATION_FAILED"
+	ProblemAuthTokenMissing          ProblemCode = "AUTH_TOKEN_MISSING"
+	ProblemAuthTokenInvalid          ProblemCode = "AUTH_TOKEN_INVALID"
+	ProblemAuthTokenExpired          ProblemCode = "AUTH_TOKEN_EXPIRED"
+	ProblemAuthWrongPassword         ProblemCode = "AUTH_WRONG_PASSWORD"
+	ProblemAuthInsufficientRole      ProblemCode = "AUTH_INSUFFICIENT_ROLE"
+	ProblemAuthRoleNotAssignable     ProblemCode = "AUTH_ROLE_NOT_ASSIGNABLE"
+	ProblemUserDuplicateUsername     ProblemCode = "USER_DUPLICATE_USERNAME"
+	ProblemUserDuplicateEmail        ProblemCode = "USER_DUPLICATE_EMAIL"
+	ProblemOrganizationDuplicateSlug ProblemCode = "ORGANIZATION_DUPLICATE_SLUG"
+	ProblemOrganizationRequired      ProblemCode = "ORGANIZATION_REQUIRED"
+	ProblemDuplicate                 ProblemCode = "DUPLICATE"
+	ProblemStale                     ProblemCode = "STALE"
+	ProblemStaleCursor               ProblemCode = "STALE_CURSOR"
+)
+
+// duplicateProblemCodes are the codes of the duplicates, by table and column
+var duplicateProblemCodes = map[string]ProblemCode{
+	"user.username":     ProblemUserDuplicateUsername,
+	"user.email":        ProblemUserDuplicateEmail,
+	"organization.slug": ProblemOrganizationDuplicateSlug,
+}
+
+// problemCodeOf returns the code of the problem of the given error, which is
+// rendered with the given HTTP status
+func problemCodeOf(err error, status int) ProblemCode {
+	var errInvalid *validator.Error
+	var errDuplicate *database.ErrDuplicateRow
+	var errStale *database.ErrStaleRow
+	switch {
+	case err == nil:
+	case errors.As(err, &errInvalid):
+		return ProblemValidationFailed
+	case errors.Is(err, auth.ErrTokenMissing):
+		return ProblemAuthTokenMissing
+	case errors.Is(err, auth.ErrTokenInvalid):
+		return ProblemAuthTokenInvalid
+	case errors.Is(err, auth.ErrTokenExpired):
+		return ProblemAuthTokenExpired
+	case errors.Is(err, auth.ErrWrongPassword):
+		return ProblemAuthWrongPassword
+	case errors.Is(err, auth.ErrInsufficientRole):
+		return ProblemAuthInsufficientRole
+	case errors.Is(err, service.ErrRoleNotAssignable):
+		return ProblemAuthRoleNotAssignable
+	case errors.As(err, &errDuplicate):
+		if code, ok := duplicateProblemCodes[errDuplicate.Table+"."+errDuplicate.ColName]; ok {
+			return code
+		}
+		return ProblemDuplicate
+	case errors.As(err, &errStale):
+		return ProblemStale
+	case errors.Is(err, database.ErrOrganizationRequired):
+		return ProblemOrganizationRequired
+	case errors.Is(err, database.ErrStaleCursor):
+		return ProblemStaleCursor
+	}
+	return ProblemCode(strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_")))
+}
@@ -1,69 +1,158 @@
 package controller
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/go-chi/render"
+	"github.com/padurean/purest/internal/env"
+	"github.com/padurean/purest/internal/i18n"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/service"
+	"github.com/padurean/purest/internal/validator"
+	"github.com/rs/zerolog/hlog"
 )
 
-// ErrResponse ...
+// ContentTypeProblem is the content type of the error responses, as of RFC 7807
+const ContentTypeProblem = "application/problem+json"
+
+func init() {
+	// the problems are sent as such, while everything else is sent as before
+	render.Respond = func(w http.ResponseWriter, r *http.Request, v interface{}) {
+		if e, ok := v.(*ErrResponse); ok {
+			respondProblem(w, e)
+			return
+		}
+		render.DefaultResponder(w, r, v)
+	}
+}
+
+// ErrResponse is a problem, as of RFC 7807
 type ErrResponse struct {
-	Err            error `json:"-"` // low-level runtime error
-	HTTPStatusCode int   `json:"-"` // http response status code
+	Err            error `json:"-"`      // low-level runtime error
+	HTTPStatusCode int   `json:"status"` // http response status code
+
+	Type      string      `json:"type"`                 // URI of the type of the problem, made of its code
+	Title     string      `json:"title"`                // user-level status message, in the locale of the request
+	AppCode   ProblemCode `json:"code"`                 // application-specific error code, see problems.go
+	Detail    string      `json:"detail,omitempty"`     // application-level error message, for debugging
+	Instance  string      `json:"instance,omitempty"`   // path of the request
+	RequestID string      `json:"request_id,omitempty"` // ID of the request, as in the X-Request-Id header and in the logs
 
-	StatusText string `json:"status"`          // user-level status message
-	AppCode    int64  `json:"code,omitempty"`  // application-specific error code
-	ErrorText  string `json:"error,omitempty"` // application-level error message, for debugging
+	Errors []validator.FieldError `json:"errors,omitempty"` // what is invalid in the request, field by field
+}
+
+// newErrResponse returns the problem of the given error, rendered with the given HTTP status
+func newErrResponse(status int, err error) *ErrResponse {
+	code := problemCodeOf(err, status)
+	e := &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: status,
+		Type:           problemTypePrefix + string(code),
+		Title:          http.StatusText(status),
+		AppCode:        code,
+	}
+	if err != nil {
+		e.Detail = err.Error()
+	}
+	var errInvalid *validator.Error
+	if errors.As(err, &errInvalid) {
+		e.Errors = errInvalid.Fields
+	}
+	return e
 }
 
 // Render ...
 func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	e.Title = statusTitle(i18n.Locale(r.Context()), e.HTTPStatusCode)
+	e.Instance = r.URL.Path
+	if id, ok := hlog.IDFromRequest(r); ok {
+		e.RequestID = id.String()
+	}
+	if e.HTTPStatusCode >= http.StatusInternalServerError && env.GetAppEnv() == env.Production {
+		// the details of the internal errors (e.g. of SQL) are only for the logs
+		logging.Detailed(r).Err(e.Err).Msgf("%s %s failed with status %d", r.Method, e.Instance, e.HTTPStatusCode)
+		e.Detail = ""
+	}
 	render.Status(r, e.HTTPStatusCode)
 	return nil
 }
 
+// respondProblem writes the problem, as application/problem+json
+func respondProblem(w http.ResponseWriter, e *ErrResponse) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeProblem)
+	w.WriteHeader(e.HTTPStatusCode)
+	_, _ = w.Write(body)
+}
+
 // ErrBadRequest ...
 func ErrBadRequest(err error) render.Renderer {
-	return &ErrResponse{
-		Err:            err,
-		HTTPStatusCode: http.StatusBadRequest,
-		StatusText:     http.StatusText(http.StatusBadRequest),
-		ErrorText:      err.Error(),
-	}
+	return newErrResponse(http.StatusBadRequest, err)
 }
 
 // ErrUnprocessableEntity ...
 func ErrUnprocessableEntity(err error) render.Renderer {
-	return &ErrResponse{
-		Err:            err,
-		HTTPStatusCode: http.StatusUnprocessableEntity,
-		StatusText:     http.StatusText(http.StatusUnprocessableEntity),
-		ErrorText:      err.Error(),
-	}
+	return newErrResponse(http.StatusUnprocessableEntity, err)
 }
 
 // ErrNotFound ...
-var ErrNotFound = &ErrResponse{
-	HTTPStatusCode: http.StatusNotFound,
-	StatusText:     http.StatusText(http.StatusNotFound),
+func ErrNotFound(err error) render.Renderer {
+	return newErrResponse(http.StatusNotFound, err)
+}
+
+// ErrMethodNotAllowed ...
+func ErrMethodNotAllowed(err error) render.Renderer {
+	return newErrResponse(http.StatusMethodNotAllowed, err)
+}
+
+// ErrUnsupportedMediaType ...
+func ErrUnsupportedMediaType(err error) render.Renderer {
+	return newErrResponse(http.StatusUnsupportedMediaType, err)
 }
 
 // ErrUnauthorized ...
 func ErrUnauthorized(err error) render.Renderer {
-	return &ErrResponse{
-		Err:            err,
-		HTTPStatusCode: http.StatusUnauthorized,
-		StatusText:     http.StatusText(http.StatusUnauthorized),
-		ErrorText:      err.Error(),
-	}
+	return newErrResponse(http.StatusUnauthorized, err)
 }
 
 // ErrInternalServer ...
 func ErrInternalServer(err error) render.Renderer {
-	return &ErrResponse{
-		Err:            err,
-		HTTPStatusCode: http.StatusInternalServerError,
-		StatusText:     http.StatusText(http.StatusInternalServerError),
-		ErrorText:      err.Error(),
+	return newErrResponse(http.StatusInternalServerError, err)
+}
+
+// ErrPreconditionFailed ...
+func ErrPreconditionFailed(err error) render.Renderer {
+	return newErrResponse(http.StatusPreconditionFailed, err)
+}
+
+// ErrPreconditionRequired ...
+func ErrPreconditionRequired(err error) render.Renderer {
+	return newErrResponse(http.StatusPreconditionRequired, err)
+}
+
+// ErrService renders the error of a service by its kind
+func ErrService(err error) render.Renderer {
+	switch service.KindOf(err) {
+	case service.KindInvalid:
+		return ErrBadRequest(err)
+	case service.KindUnauthorized, service.KindForbidden:
+		// the API has always answered 401 to the roles which do not allow the request
+		return ErrUnauthorized(err)
+	case service.KindNotFound:
+		return ErrNotFound(err)
+	case service.KindConflict, service.KindUnprocessable:
+		return ErrUnprocessableEntity(err)
+	case service.KindStale:
+		return ErrPreconditionFailed(err)
+	case service.KindPreconditionRequired:
+		return ErrPreconditionRequired(err)
+	default:
+		return ErrInternalServer(err)
 	}
 }
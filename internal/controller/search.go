@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/service"
+)
+
+// UserSearchResultResponse ...
+type UserSearchResultResponse struct {
+	*UserResponse
+	Rank float64 `json:"rank"`
+	// Highlights has, for each field containing the searched text, the HTML escaped
+	// value of the field, with the occurrences of the text enclosed in <em> tags
+	Highlights map[string]string `json:"highlights"`
+}
+
+// Render ...
+func (ur *UserSearchResultResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return ur.UserResponse.Render(w, r)
+}
+
+// UserSearch ...
+// @id UserSearch
+// @tags users
+// @summary Searches users by a fragment of their username, email, first or last name
+// @description The users containing the text, or a word similar to it, are ranked by similarity.
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param q query string true "Text to search for (at least 3 characters)"
+// @param page query int false "Page number"
+// @param pageSize query int false "Page size (default 20, at most 100)"
+// @success 200 {array} controller.UserSearchResultResponse
+// @header 200 {integer} X-Total-Count "Total number of users found"
+// @header 200 {string} Link "Links to the next and previous pages"
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @router /users/search [get]
+func UserSearch(w http.ResponseWriter, r *http.Request) {
+	page, err := icontext.Page(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	text := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	results, err := service.SearchUsers(r.Context(), page, text)
+	if err != nil {
+		render.Render(w, r, ErrService(err))
+		return
+	}
+	resultsResponseList := []render.Renderer{}
+	for _, result := range results {
+		u := result.User
+		resultsResponseList = append(resultsResponseList, &UserSearchResultResponse{
+			UserResponse: &UserResponse{User: &u},
+			Rank:         result.Rank,
+			Highlights:   highlights(&u, text),
+		})
+	}
+	if err := render.RenderList(w, r, resultsResponseList); err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	render.Status(r, http.StatusOK)
+}
+
+// highlights returns the highlighted values of the searched fields of the user
+// which contain the given text
+func highlights(u *database.User, text string) map[string]string {
+	values := map[string]string{
+		"username":   u.Username,
+		"email":      u.Email,
+		"first_name": u.FirstName.String,
+		"last_name":  u.LastName.String,
+	}
+	highlighted := map[string]string{}
+	for _, field := range database.UserSearchFields {
+		if h, ok := highlight(values[field], text); ok {
+			highlighted[field] = h
+		}
+	}
+	return highlighted
+}
+
+// highlight encloses in <em> tags the case-insensitive occurrences of text in value
+func highlight(value string, text string) (string, bool) {
+	// lowercasing can change the byte length of some characters,
+	// in which case the occurrences can not be mapped back to value
+	lowerValue, lowerText := strings.ToLower(value), strings.ToLower(text)
+	if len(lowerValue) != len(value) || lowerText == "" {
+		return "", false
+	}
+	var b strings.Builder
+	found := false
+	for {
+		i := strings.Index(lowerValue, lowerText)
+		if i < 0 {
+			break
+		}
+		found = true
+		b.WriteString(html.EscapeString(value[:i]))
+		b.WriteString("<em>" + html.EscapeString(value[i:i+len(lowerText)]) + "</em>")
+		value, lowerValue = value[i+len(lowerText):], lowerValue[i+len(lowerText):]
+	}
+	b.WriteString(html.EscapeString(value))
+	return b.String(), found
+}
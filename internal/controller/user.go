@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -15,17 +14,21 @@ import (
 	icontext "github.com/padurean/purest/internal/context"
 	"github.com/padurean/purest/internal/database"
 	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/service"
 	"github.com/padurean/purest/internal/validator"
 )
 
 // SignInRequest ...
 type SignInRequest struct {
 	Password string `json:"password" validate:"required"`
+	// Organization is the slug of the organization of the user,
+	// the default organization if not given
+	Organization string `json:"organization,omitempty"`
 }
 
 // Bind ...
 func (sr *SignInRequest) Bind(r *http.Request) error {
-	if err := validator.Validate(sr); err != nil {
+	if err := validator.Validate(r.Context(), sr); err != nil {
 		return err
 	}
 	return nil
@@ -53,7 +56,11 @@ type UserRequest struct {
 
 // Bind ...
 func (u *UserRequest) Bind(r *http.Request) error {
-	if err := validator.Validate(u); err != nil {
+	if u.User == nil {
+		// an empty user, so that its required fields are told apart
+		u.User = &database.User{}
+	}
+	if err := validator.Validate(r.Context(), u); err != nil {
 		return err
 	}
 	u.User.FirstName = sql.NullString(u.FirstName)
@@ -65,9 +72,10 @@ func (u *UserRequest) Bind(r *http.Request) error {
 // UserResponse ...
 type UserResponse struct {
 	*database.User
-	FirstName NullString `json:"first_name" swaggertype:"string"`
-	LastName  NullString `json:"last_name" swaggertype:"string"`
-	Deleted   NullTime   `json:"deleted,omitempty" swaggertype:"string"`
+	FirstName  NullString `json:"first_name" swaggertype:"string"`
+	LastName   NullString `json:"last_name" swaggertype:"string"`
+	Deleted    NullTime   `json:"deleted,omitempty" swaggertype:"string"`
+	Anonymized NullTime   `json:"anonymized,omitempty" swaggertype:"string"`
 }
 
 // Render ...
@@ -75,6 +83,7 @@ func (u *UserResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	u.FirstName = NullString(u.User.FirstName)
 	u.LastName = NullString(u.User.LastName)
 	u.Deleted = NullTime(u.User.Deleted)
+	u.Anonymized = NullTime(u.User.Anonymized)
 	return nil
 }
 
@@ -86,7 +95,7 @@ type UserUpdatePasswordRequest struct {
 
 // Bind ...
 func (u *UserUpdatePasswordRequest) Bind(r *http.Request) error {
-	if err := validator.Validate(u); err != nil {
+	if err := validator.Validate(r.Context(), u); err != nil {
 		return err
 	}
 	return nil
@@ -99,53 +108,24 @@ type UserUpdateEmailRequest struct {
 
 // Bind ...
 func (u *UserUpdateEmailRequest) Bind(r *http.Request) error {
-	if err := validator.Validate(u); err != nil {
+	if err := validator.Validate(r.Context(), u); err != nil {
 		return err
 	}
 	return nil
 }
 
-// SignedInUserCtx ...
-func SignedInUserCtx(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		db, err := icontext.DB(r.Context())
-		if err != nil {
-			render.Render(w, r, ErrInternalServer(err))
-			return
-		}
-		reqLogger := logging.Simple(r)
-		var u *database.User
-		jsonToken, err := icontext.JSONToken(r.Context())
-		if err != nil {
-			render.Render(w, r, ErrUnauthorized(err))
-			return
-		}
-		u, err = (&database.User{ID: jsonToken.UserID}).GetByID(db)
-		if err != nil {
-			switch err {
-			case sql.ErrNoRows:
-				render.Render(w, r, ErrNotFound)
-				return
-			default:
-				reqLogger.Err(err).Msgf("error getting signed-in user with id %d", jsonToken.UserID)
-				render.Render(w, r, ErrInternalServer(err))
-				return
-			}
-		}
-		ctx := context.WithValue(r.Context(), icontext.KeySignedInUser, u)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
-
 // UserCtx ...
 func UserCtx(next http.Handler) http.Handler {
+	return userCtx(next, false)
+}
+
+// UserCtxWithDeleted is like UserCtx, but it also finds deleted users by id
+func UserCtxWithDeleted(next http.Handler) http.Handler {
+	return userCtx(next, true)
+}
+
+func userCtx(next http.Handler, withDeleted bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		db, err := icontext.DB(r.Context())
-		if err != nil {
-			render.Render(w, r, ErrInternalServer(err))
-			return
-		}
-		reqLogger := logging.Simple(r)
 		var u *database.User
 		idParam := chi.URLParam(r, "id")
 		usernameOrEmail := chi.URLParam(r, "usernameOrEmail")
@@ -154,54 +134,21 @@ func UserCtx(next http.Handler) http.Handler {
 				fmt.Errorf("neither user id, nor username or email path params are specified")))
 			return
 		}
+		var err error
 		if idParam != "" {
-			id, err := strconv.ParseInt(idParam, 10, 64)
-			if err != nil {
+			id, parseErr := strconv.ParseInt(idParam, 10, 64)
+			if parseErr != nil {
 				render.Render(w, r, ErrBadRequest(
 					fmt.Errorf("user 'id' url param '%s' is not an integer number", idParam)))
 				return
 			}
-			u, err = (&database.User{ID: id}).GetByID(db)
-			if err != nil {
-				switch err {
-				case sql.ErrNoRows:
-					render.Render(w, r, ErrNotFound)
-					return
-				default:
-					reqLogger.Err(err).Msgf("error getting user with id %d", id)
-					render.Render(w, r, ErrInternalServer(err))
-					return
-				}
-			}
-		} else if usernameOrEmail != "" {
-			var err error
-			if strings.Contains(usernameOrEmail, "@") {
-				u, err = (&database.User{Email: usernameOrEmail}).GetByEmail(db)
-				if err != nil {
-					switch err {
-					case sql.ErrNoRows:
-						// do nothing
-					default:
-						reqLogger.Err(err).Msgf("error getting user %s by email ", usernameOrEmail)
-						render.Render(w, r, ErrInternalServer(err))
-						return
-					}
-				}
-			}
-			if u == nil {
-				u, err = (&database.User{Username: usernameOrEmail}).GetByUsername(db)
-				if err != nil {
-					switch err {
-					case sql.ErrNoRows:
-						render.Render(w, r, ErrNotFound)
-						return
-					default:
-						reqLogger.Err(err).Msgf("error getting user %s by username", usernameOrEmail)
-						render.Render(w, r, ErrInternalServer(err))
-						return
-					}
-				}
-			}
+			u, err = service.GetUser(r.Context(), id, withDeleted)
+		} else {
+			u, err = service.GetUserByUsernameOrEmail(r.Context(), usernameOrEmail)
+		}
+		if err != nil {
+			render.Render(w, r, ErrService(err))
+			return
 		}
 		ctx := context.WithValue(r.Context(), icontext.KeyUser, u)
 		next.ServeHTTP(w, r.WithContext(ctx))
@@ -221,39 +168,17 @@ func UserCtx(next http.Handler) http.Handler {
 // @router /users [post]
 func UserCreate(w http.ResponseWriter, r *http.Request) {
 	uReq := &UserRequest{}
-	reqLogger := logging.Simple(r)
 	if err := render.Bind(r, uReq); err != nil {
-		reqLogger.Err(err).Msgf("error unmarshaling user from JSON")
+		logging.Simple(r).Err(err).Msgf("error unmarshaling user from JSON")
 		render.Render(w, r, ErrBadRequest(err))
 		return
 	}
-
-	hashedPassword, err := auth.HashAndSaltPassword(uReq.Password)
+	u, err := service.CreateUser(r.Context(), uReq.User)
 	if err != nil {
-		reqLogger.Err(err).Msgf("error hashing and setting password")
-		render.Render(w, r, ErrUnprocessableEntity(err))
+		render.Render(w, r, ErrService(err))
 		return
 	}
-	uReq.Password = hashedPassword
-
-	db, err := icontext.DB(r.Context())
-	if err != nil {
-		render.Render(w, r, ErrInternalServer(err))
-		return
-	}
-	u, err := uReq.Create(db)
-	if err != nil {
-		switch err.(type) {
-		case *database.ErrDuplicateRow:
-			render.Render(w, r, ErrUnprocessableEntity(err))
-			return
-		default:
-			reqLogger.Err(err).Msgf("error creating user %+v", uReq.User)
-			render.Render(w, r, ErrInternalServer(err))
-			return
-		}
-	}
-
+	setETag(w, u.Version)
 	render.Status(r, http.StatusCreated)
 	render.Render(w, r, &UserResponse{User: u})
 }
@@ -271,38 +196,23 @@ func UserCreate(w http.ResponseWriter, r *http.Request) {
 // @failure 404 {object} controller.ErrResponse
 // @router /users/sign-in/{usernameOrEmail} [post]
 func UserSignIn(w http.ResponseWriter, r *http.Request) {
-	reqLogger := logging.Simple(r)
 	sReq := &SignInRequest{}
 	if err := render.Bind(r, sReq); err != nil {
-		reqLogger.Err(err).Msgf("error unmarshaling sign in payload from JSON")
+		logging.Simple(r).Err(err).Msgf("error unmarshaling sign in payload from JSON")
 		render.Render(w, r, ErrBadRequest(err))
 		return
 	}
-	u, err := icontext.User(r.Context())
+	signIn, err := service.SignInUser(r.Context(), chi.URLParam(r, "usernameOrEmail"), sReq.Password, sReq.Organization)
+	sReq.Password = ""
 	if err != nil {
-		render.Render(w, r, ErrInternalServer(err))
-		return
-	}
-	if !auth.ComparePasswords(sReq.Password, u.Password) {
-		err := fmt.Errorf("wrong password supplied for user %d", u.ID)
-		reqLogger.Err(err).Msg("")
-		render.Render(w, r, ErrUnauthorized(err))
+		render.Render(w, r, ErrService(err))
 		return
 	}
-	token, expiration, err := auth.GenerateToken(u.ID, u.Role)
-	reqLogger.Debug().Msgf("generated token: %s, Error: %v", token, err)
-	warning := ""
-	if u.Username == auth.DefaultAdminUser && sReq.Password == auth.DefaultAdminPassword {
-		warning = fmt.Sprintf(
-			"%s user is using the default password, to improve security please change it ASAP",
-			u.Username)
-	}
-	sReq.Password = ""
 	render.Status(r, http.StatusOK)
 	render.Render(w, r, &SignInResponse{
-		Token:      token,
-		Expiration: expiration,
-		Warning:    warning})
+		Token:      signIn.Token,
+		Expiration: signIn.Expiration,
+		Warning:    signIn.Warning})
 }
 
 // UserList ...
@@ -312,37 +222,45 @@ func UserSignIn(w http.ResponseWriter, r *http.Request) {
 // @accept application/json
 // @produce application/json
 // @param Authorization header string true "Bearer <token>"
-// @param page query int false "Page number"
-// @param pageSize query int false "Page size (default 20)"
+// @param page query int false "Page number, for paginating by page number instead of by cursor"
+// @param pageSize query int false "Page size (default 20, at most 100)"
+// @param cursor query string false "Opaque cursor of the page, as found in the Link header (none for the first page)"
+// @param includeDeleted query bool false "Whether to also list the deleted users (default false)"
+// @param filter[field][op] query string false "Filters users, e.g. filter[username][prefix]=jo, filter[role][in]=1,2, filter[created][gte]=2020-01-01T00:00:00Z or filter[deleted][null]=false; the fields are id, username, email, first_name, last_name, role, created, updated and deleted, and the operators are eq, ne, lt, lte, gt, gte, in, prefix and null"
+// @param sort query string false "Comma separated fields to sort by, descending if prefixed with -, e.g. -created,username; the fields are id, username, email, role, created and updated"
 // @success 200 {array} controller.UserResponse
+// @header 200 {integer} X-Total-Count "Total number of users"
+// @header 200 {string} Link "Links to the next and previous pages"
+// @failure 400 {object} controller.ErrResponse
 // @failure 401 {object} controller.ErrResponse
 // @router /users [get]
 func UserList(w http.ResponseWriter, r *http.Request) {
-	db, err := icontext.DB(r.Context())
-	if err != nil {
-		render.Render(w, r, ErrInternalServer(err))
-		return
-	}
 	page, err := icontext.Page(r.Context())
 	if err != nil {
 		render.Render(w, r, ErrInternalServer(err))
 		return
 	}
-	pageSize, err := icontext.PageSize(r.Context())
+	q, err := icontext.Query(r.Context())
 	if err != nil {
 		render.Render(w, r, ErrInternalServer(err))
 		return
 	}
+	// filtering by the deletion time implies including the deleted users
+	includeDeleted := q.FiltersBy("deleted")
+	if includeDeletedParam := r.URL.Query().Get("includeDeleted"); includeDeletedParam != "" {
+		includeDeleted, err = strconv.ParseBool(includeDeletedParam)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(
+				fmt.Errorf("'includeDeleted' url param '%s' is not a boolean (true or false)", includeDeletedParam)))
+			return
+		}
+	}
 
-	u := &database.User{}
-	reqLogger := logging.Simple(r)
-	users, err := u.List(db, pageSize, (page-1)*pageSize)
+	users, err := service.ListUsers(r.Context(), page, q, includeDeleted)
 	if err != nil {
-		reqLogger.Err(err).Msgf("error listing users page")
-		render.Render(w, r, ErrInternalServer(err))
+		render.Render(w, r, ErrService(err))
 		return
 	}
-
 	usersResponseList := []render.Renderer{}
 	for _, u := range users {
 		usersResponseList = append(usersResponseList, &UserResponse{User: u})
@@ -361,17 +279,19 @@ func UserList(w http.ResponseWriter, r *http.Request) {
 // @accept application/json
 // @produce application/json
 // @param Authorization header string true "Bearer <token>"
+// @param If-Match header string false "ETag of the user, as returned when it was read"
 // @param id path int true "User id"
 // @param payload body controller.UserRequest true "Request body payload"
 // @success 200 {object} controller.UserResponse
 // @failure 401 {object} controller.ErrResponse
 // @failure 404 {object} controller.ErrResponse
+// @failure 412 {object} controller.ErrResponse
+// @failure 428 {object} controller.ErrResponse
 // @router /users/{id} [put]
 func UserUpdate(w http.ResponseWriter, r *http.Request) {
 	uReq := &UserRequest{}
-	reqLogger := logging.Simple(r)
 	if err := render.Bind(r, uReq); err != nil {
-		reqLogger.Err(err).Msgf("error unmarshaling user from JSON")
+		logging.Simple(r).Err(err).Msgf("error unmarshaling user from JSON")
 		render.Render(w, r, ErrBadRequest(err))
 		return
 	}
@@ -380,35 +300,110 @@ func UserUpdate(w http.ResponseWriter, r *http.Request) {
 		render.Render(w, r, ErrInternalServer(err))
 		return
 	}
-	uReq.ID = u.ID
-	hashedPassword, err := auth.HashAndSaltPassword(uReq.Password)
+	if !checkIfMatch(w, r, u.Version) {
+		return
+	}
+	updated, err := service.UpdateUser(r.Context(), u, uReq.User)
 	if err != nil {
-		reqLogger.Err(err).Msgf("error hashing and setting password")
-		render.Render(w, r, ErrUnprocessableEntity(err))
+		render.Render(w, r, ErrService(err))
 		return
 	}
-	uReq.Password = hashedPassword
+	setETag(w, updated.Version)
+	render.Status(r, http.StatusOK)
+	render.Render(w, r, &UserResponse{User: updated})
+}
 
-	db, err := icontext.DB(r.Context())
+// UserPatchDocument is the user as PATCH /users/{id} changes it; its password is empty,
+// as it is only there to be set
+type UserPatchDocument struct {
+	Username  string     `json:"username"`
+	Password  string     `json:"password"`
+	Email     string     `json:"email"`
+	FirstName NullString `json:"first_name" swaggertype:"string"`
+	LastName  NullString `json:"last_name" swaggertype:"string"`
+	Role      auth.Role  `json:"role"`
+}
+
+// changes returns the user with the fields of the patched document and the names of
+// the fields which the patch changed
+func (d *UserPatchDocument) changes(u *database.User, patched *UserPatchDocument) (*database.User, []string) {
+	var fields []string
+	changed := func(field string, isChanged bool) {
+		if isChanged {
+			fields = append(fields, field)
+		}
+	}
+	changed("username", patched.Username != d.Username)
+	// the password is only changed if the patch sets it
+	changed("password", patched.Password != "")
+	changed("email", patched.Email != d.Email)
+	changed("first_name", patched.FirstName != d.FirstName)
+	changed("last_name", patched.LastName != d.LastName)
+	changed("role", patched.Role != d.Role)
+
+	pu := *u
+	pu.Username = patched.Username
+	pu.Password = patched.Password
+	pu.Email = patched.Email
+	pu.FirstName = sql.NullString(patched.FirstName)
+	pu.LastName = sql.NullString(patched.LastName)
+	pu.Role = patched.Role
+	return &pu, fields
+}
+
+// UserPatch ...
+// @id UserPatch
+// @tags users
+// @summary Updates some of the fields of an existing user
+// @description The body is either a merge patch (RFC 7396) of the user, with the application/merge-patch+json
+// @description content type, or a JSON Patch (RFC 6902) of it, i.e. a list of operations such as
+// @description {"op": "replace", "path": "/role", "value": 2}, with the application/json-patch+json one.
+// @description Only the fields which change are validated, and the password is only changed if the patch sets it.
+// @accept application/merge-patch+json
+// @accept application/json-patch+json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param If-Match header string false "ETag of the user, as returned when it was read"
+// @param id path int true "User id"
+// @param payload body controller.UserPatchDocument true "Merge patch of the user, or JSON Patch of it"
+// @success 200 {object} controller.UserResponse
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @failure 412 {object} controller.ErrResponse
+// @failure 415 {object} controller.ErrResponse
+// @failure 422 {object} controller.ErrResponse
+// @failure 428 {object} controller.ErrResponse
+// @router /users/{id} [patch]
+func UserPatch(w http.ResponseWriter, r *http.Request) {
+	u, err := icontext.User(r.Context())
 	if err != nil {
 		render.Render(w, r, ErrInternalServer(err))
 		return
 	}
-	u, err = uReq.Update(db)
+	if !checkIfMatch(w, r, u.Version) {
+		return
+	}
+	doc := &UserPatchDocument{
+		Username:  u.Username,
+		Email:     u.Email,
+		FirstName: NullString(u.FirstName),
+		LastName:  NullString(u.LastName),
+		Role:      u.Role,
+	}
+	patched := &UserPatchDocument{}
+	if !applyPatch(w, r, doc, patched) {
+		return
+	}
+	pu, fields := doc.changes(u, patched)
+	updated, err := service.PatchUser(r.Context(), u, pu, fields)
 	if err != nil {
-		switch err.(type) {
-		case *database.ErrDuplicateRow:
-			render.Render(w, r, ErrUnprocessableEntity(err))
-			return
-		default:
-			reqLogger.Err(err).Msgf("error updating user %+v", uReq.User)
-			render.Render(w, r, ErrInternalServer(err))
-			return
-		}
+		render.Render(w, r, ErrService(err))
+		return
 	}
-
+	setETag(w, updated.Version)
 	render.Status(r, http.StatusOK)
-	render.Render(w, r, &UserResponse{User: u})
+	render.Render(w, r, &UserResponse{User: updated})
 }
 
 // UserUpdatePassword ...
@@ -425,9 +420,8 @@ func UserUpdate(w http.ResponseWriter, r *http.Request) {
 // @router /users/password [put]
 func UserUpdatePassword(w http.ResponseWriter, r *http.Request) {
 	uReq := &UserUpdatePasswordRequest{}
-	reqLogger := logging.Simple(r)
 	if err := render.Bind(r, uReq); err != nil {
-		reqLogger.Err(err).Msgf("error unmarshaling password update from JSON")
+		logging.Simple(r).Err(err).Msgf("error unmarshaling password update from JSON")
 		render.Render(w, r, ErrBadRequest(err))
 		return
 	}
@@ -436,34 +430,16 @@ func UserUpdatePassword(w http.ResponseWriter, r *http.Request) {
 		render.Render(w, r, ErrInternalServer(err))
 		return
 	}
-	if !auth.ComparePasswords(uReq.OldPassword, u.Password) {
-		render.Render(w, r, ErrUnauthorized(fmt.Errorf("old password is incorrect")))
-		return
-	}
-	hashedPassword, err := auth.HashAndSaltPassword(uReq.NewPassword)
-	if err != nil {
-		reqLogger.Err(err).Msgf("error hashing and setting password")
-		render.Render(w, r, ErrUnprocessableEntity(err))
-		return
-	}
+	updated, err := service.UpdatePassword(r.Context(), u, uReq.OldPassword, uReq.NewPassword)
 	uReq.OldPassword = ""
 	uReq.NewPassword = ""
-	u.Password = hashedPassword
-
-	db, err := icontext.DB(r.Context())
 	if err != nil {
-		render.Render(w, r, ErrInternalServer(err))
+		render.Render(w, r, ErrService(err))
 		return
 	}
-	u, err = u.Update(db)
-	if err != nil {
-		reqLogger.Err(err).Msgf("error updating password for user %d", u.ID)
-		render.Render(w, r, ErrInternalServer(err))
-		return
-	}
-
+	setETag(w, updated.Version)
 	render.Status(r, http.StatusOK)
-	render.Render(w, r, &UserResponse{User: u})
+	render.Render(w, r, &UserResponse{User: updated})
 }
 
 // UserUpdateEmail ...
@@ -473,16 +449,18 @@ func UserUpdatePassword(w http.ResponseWriter, r *http.Request) {
 // @accept application/json
 // @produce application/json
 // @param Authorization header string true "Bearer <token>"
+// @param If-Match header string false "ETag of the user, as returned when it was read"
 // @param payload body controller.UserUpdateEmailRequest true "Request body payload"
 // @success 200 {object} controller.UserResponse
 // @failure 401 {object} controller.ErrResponse
 // @failure 404 {object} controller.ErrResponse
+// @failure 412 {object} controller.ErrResponse
+// @failure 428 {object} controller.ErrResponse
 // @router /users/email [put]
 func UserUpdateEmail(w http.ResponseWriter, r *http.Request) {
 	uReq := &UserUpdateEmailRequest{}
-	reqLogger := logging.Simple(r)
 	if err := render.Bind(r, uReq); err != nil {
-		reqLogger.Err(err).Msgf("error unmarshaling email update from JSON")
+		logging.Simple(r).Err(err).Msgf("error unmarshaling email update from JSON")
 		render.Render(w, r, ErrBadRequest(err))
 		return
 	}
@@ -491,28 +469,17 @@ func UserUpdateEmail(w http.ResponseWriter, r *http.Request) {
 		render.Render(w, r, ErrInternalServer(err))
 		return
 	}
-	u.Email = uReq.Email
-
-	db, err := icontext.DB(r.Context())
-	if err != nil {
-		render.Render(w, r, ErrInternalServer(err))
+	if !checkIfMatch(w, r, u.Version) {
 		return
 	}
-	u, err = u.Update(db)
+	updated, err := service.UpdateEmail(r.Context(), u, uReq.Email)
 	if err != nil {
-		switch err.(type) {
-		case *database.ErrDuplicateRow:
-			render.Render(w, r, ErrUnprocessableEntity(err))
-			return
-		default:
-			reqLogger.Err(err).Msgf("error updating email for user %d", u.ID)
-			render.Render(w, r, ErrInternalServer(err))
-			return
-		}
+		render.Render(w, r, ErrService(err))
+		return
 	}
-
+	setETag(w, updated.Version)
 	render.Status(r, http.StatusOK)
-	render.Render(w, r, &UserResponse{User: u})
+	render.Render(w, r, &UserResponse{User: updated})
 }
 
 // UserGet ...
@@ -533,6 +500,7 @@ func UserGet(w http.ResponseWriter, r *http.Request) {
 		render.Render(w, r, ErrInternalServer(err))
 		return
 	}
+	setETag(w, u.Version)
 	render.Status(r, http.StatusOK)
 	render.Render(w, r, &UserResponse{User: u})
 }
@@ -554,6 +522,7 @@ func UserGetMe(w http.ResponseWriter, r *http.Request) {
 		render.Render(w, r, ErrInternalServer(err))
 		return
 	}
+	setETag(w, u.Version)
 	render.Status(r, http.StatusOK)
 	render.Render(w, r, &UserResponse{User: u})
 }
@@ -565,10 +534,13 @@ func UserGetMe(w http.ResponseWriter, r *http.Request) {
 // @accept application/json
 // @produce application/json
 // @param Authorization header string true "Bearer <token>"
+// @param If-Match header string false "ETag of the user, as returned when it was read"
 // @param id path int true "User id"
 // @success 204
 // @failure 401 {object} controller.ErrResponse
 // @failure 404 {object} controller.ErrResponse
+// @failure 412 {object} controller.ErrResponse
+// @failure 428 {object} controller.ErrResponse
 // @router /users/{id} [delete]
 func UserDelete(w http.ResponseWriter, r *http.Request) {
 	u, err := icontext.User(r.Context())
@@ -576,17 +548,41 @@ func UserDelete(w http.ResponseWriter, r *http.Request) {
 		render.Render(w, r, ErrInternalServer(err))
 		return
 	}
-	db, err := icontext.DB(r.Context())
+	if !checkIfMatch(w, r, u.Version) {
+		return
+	}
+	if err := service.DeleteUser(r.Context(), u); err != nil {
+		render.Render(w, r, ErrService(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UserRestore ...
+// @id UserRestore
+// @tags users
+// @summary Restores a deleted user
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param id path int true "User id"
+// @success 200 {object} controller.UserResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @failure 422 {object} controller.ErrResponse
+// @router /users/{id}/restore [post]
+func UserRestore(w http.ResponseWriter, r *http.Request) {
+	u, err := icontext.User(r.Context())
 	if err != nil {
 		render.Render(w, r, ErrInternalServer(err))
 		return
 	}
-	reqLogger := logging.Simple(r)
-
-	if err := u.Delete(db); err != nil {
-		reqLogger.Err(err).Msgf("error deleting user %d", u.ID)
-		render.Render(w, r, ErrUnprocessableEntity(err))
+	restored, err := service.RestoreUser(r.Context(), u)
+	if err != nil {
+		render.Render(w, r, ErrService(err))
 		return
 	}
-	render.Status(r, http.StatusNoContent)
+	setETag(w, restored.Version)
+	render.Status(r, http.StatusOK)
+	render.Render(w, r, &UserResponse{User: restored})
 }
@@ -0,0 +1,505 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/i18n"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/service"
+	"github.com/padurean/purest/internal/validator"
+)
+
+// WebhookRequest ...
+type WebhookRequest struct {
+	*database.Webhook
+}
+
+// Bind ...
+func (wh *WebhookRequest) Bind(r *http.Request) error {
+	if wh.Webhook == nil {
+		// an empty webhook, so that its required fields are told apart
+		wh.Webhook = &database.Webhook{}
+	}
+	if err := validator.Validate(r.Context(), wh); err != nil {
+		return err
+	}
+	var errs []validator.FieldError
+	for i, e := range wh.Events {
+		if !database.IsValidEventType(e) {
+			errs = append(errs, validator.FieldError{
+				Field:   fmt.Sprintf("events[%d]", i),
+				Rule:    "event",
+				Message: messages.T(i18n.Locale(r.Context()), msgUnknownEventType, e, database.ValidEventTypes()),
+			})
+		}
+	}
+	if len(errs) > 0 {
+		return validator.NewError(errs...)
+	}
+	return nil
+}
+
+// WebhookResponse ...
+type WebhookResponse struct {
+	*database.Webhook
+	// Secret is never sent back
+	Secret  string   `json:"secret,omitempty" swaggerignore:"true"`
+	Deleted NullTime `json:"deleted,omitempty" swaggertype:"string"`
+}
+
+// Render ...
+func (wh *WebhookResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	wh.Deleted = NullTime(wh.Webhook.Deleted)
+	return nil
+}
+
+// WebhookDeliveryResponse ...
+type WebhookDeliveryResponse struct {
+	*database.WebhookDelivery
+	LastError      NullString `json:"last_error,omitempty" swaggertype:"string"`
+	ResponseStatus NullInt64  `json:"response_status,omitempty" swaggertype:"integer"`
+	Delivered      NullTime   `json:"delivered,omitempty" swaggertype:"string"`
+}
+
+// Render ...
+func (d *WebhookDeliveryResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	d.LastError = NullString(d.WebhookDelivery.LastError)
+	d.ResponseStatus = NullInt64(d.WebhookDelivery.ResponseStatus)
+	d.Delivered = NullTime(d.WebhookDelivery.Delivered)
+	return nil
+}
+
+// webhookAudited is the webhook as audited, with its secret,
+// which the audit log redacts, so that changing it shows in the diff
+func webhookAudited(wh *database.Webhook) *WebhookResponse {
+	return &WebhookResponse{Webhook: wh, Secret: wh.Secret, Deleted: NullTime(wh.Deleted)}
+}
+
+func webhookAuditEvent(action string, wh *database.Webhook) *database.AuditEvent {
+	return &database.AuditEvent{
+		Action:         action,
+		Target:         fmt.Sprintf("webhook:%d", wh.ID),
+		OrganizationID: sql.NullInt64{Int64: wh.OrganizationID, Valid: true},
+	}
+}
+
+// WebhookCtx ...
+func WebhookCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store, err := icontext.Store(r.Context())
+		if err != nil {
+			render.Render(w, r, ErrInternalServer(err))
+			return
+		}
+		idParam := chi.URLParam(r, "id")
+		id, err := strconv.ParseInt(idParam, 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(
+				fmt.Errorf("webhook 'id' url param '%s' is not an integer number", idParam)))
+			return
+		}
+		wh, err := store.GetWebhookByID(r.Context(), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				render.Render(w, r, ErrNotFound(fmt.Errorf("webhook %d not found", id)))
+				return
+			default:
+				logging.Simple(r).Err(err).Msgf("error getting webhook by id %d", id)
+				render.Render(w, r, ErrInternalServer(err))
+				return
+			}
+		}
+		ctx := context.WithValue(r.Context(), icontext.KeyWebhook, wh)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// WebhookCreate ...
+// @id WebhookCreate
+// @tags webhooks
+// @summary Subscribes an URL to events, e.g. user.created, user.* or *
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param payload body controller.WebhookRequest true "Request body payload"
+// @success 201 {object} controller.WebhookResponse
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 422 {object} controller.ErrResponse
+// @router /webhooks [post]
+func WebhookCreate(w http.ResponseWriter, r *http.Request) {
+	whReq := &WebhookRequest{}
+	reqLogger := logging.Simple(r)
+	if err := render.Bind(r, whReq); err != nil {
+		reqLogger.Err(err).Msgf("error unmarshaling webhook from JSON")
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	var wh *database.Webhook
+	err = service.InTx(r.Context(), func(ctx context.Context) error {
+		var err error
+		if wh, err = store.CreateWebhook(ctx, whReq.Webhook); err != nil {
+			return err
+		}
+		return service.Audit(ctx, webhookAuditEvent("webhook.create", wh), nil, webhookAudited(wh))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrOrganizationRequired):
+			render.Render(w, r, ErrUnprocessableEntity(err))
+			return
+		default:
+			reqLogger.Err(err).Msgf("error creating webhook for %s", whReq.URL)
+			render.Render(w, r, ErrInternalServer(err))
+			return
+		}
+	}
+	setETag(w, wh.Version)
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &WebhookResponse{Webhook: wh})
+}
+
+// WebhookList ...
+// @id WebhookList
+// @tags webhooks
+// @summary Lists webhooks
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param page query int false "Page number, for paginating by page number instead of by cursor"
+// @param pageSize query int false "Page size (default 20, at most 100)"
+// @param cursor query string false "Opaque cursor of the page, as found in the Link header (none for the first page)"
+// @success 200 {array} controller.WebhookResponse
+// @header 200 {integer} X-Total-Count "Total number of webhooks"
+// @header 200 {string} Link "Links to the next and previous pages"
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @router /webhooks [get]
+func WebhookList(w http.ResponseWriter, r *http.Request) {
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	page, err := icontext.Page(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+
+	reqLogger := logging.Simple(r)
+	opts := page.ListOptions()
+	webhooks, err := store.ListWebhooks(r.Context(), opts)
+	if err != nil {
+		reqLogger.Err(err).Msgf("error listing webhooks page")
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	total, err := store.CountWebhooks(r.Context(), opts)
+	if err != nil {
+		reqLogger.Err(err).Msgf("error counting webhooks")
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+
+	webhooksResponseList := []render.Renderer{}
+	keys := []int64{}
+	for _, wh := range webhooks {
+		webhooksResponseList = append(webhooksResponseList, &WebhookResponse{Webhook: wh})
+		keys = append(keys, wh.ID)
+	}
+	page.Listed(total, keys)
+	if err := render.RenderList(w, r, webhooksResponseList); err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	render.Status(r, http.StatusOK)
+}
+
+// WebhookGet ...
+// @id WebhookGet
+// @tags webhooks
+// @summary Gets an existing webhook
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param id path int true "Webhook id"
+// @success 200 {object} controller.WebhookResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @router /webhooks/{id} [get]
+func WebhookGet(w http.ResponseWriter, r *http.Request) {
+	wh, err := icontext.Webhook(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	setETag(w, wh.Version)
+	render.Status(r, http.StatusOK)
+	render.Render(w, r, &WebhookResponse{Webhook: wh})
+}
+
+// WebhookUpdate ...
+// @id WebhookUpdate
+// @tags webhooks
+// @summary Updates an existing webhook
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param If-Match header string false "ETag of the webhook, as returned when it was read"
+// @param id path int true "Webhook id"
+// @param payload body controller.WebhookRequest true "Request body payload"
+// @success 200 {object} controller.WebhookResponse
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @failure 412 {object} controller.ErrResponse
+// @failure 428 {object} controller.ErrResponse
+// @router /webhooks/{id} [put]
+func WebhookUpdate(w http.ResponseWriter, r *http.Request) {
+	whReq := &WebhookRequest{}
+	reqLogger := logging.Simple(r)
+	if err := render.Bind(r, whReq); err != nil {
+		reqLogger.Err(err).Msgf("error unmarshaling webhook from JSON")
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+	wh, err := icontext.Webhook(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	if !checkIfMatch(w, r, wh.Version) {
+		return
+	}
+	whReq.ID = wh.ID
+	whReq.OrganizationID = wh.OrganizationID
+	whReq.Version = wh.Version
+
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	var updated *database.Webhook
+	err = service.InTx(r.Context(), func(ctx context.Context) error {
+		var err error
+		if updated, err = store.UpdateWebhook(ctx, whReq.Webhook); err != nil {
+			return err
+		}
+		return service.Audit(ctx, webhookAuditEvent("webhook.update", wh),
+			webhookAudited(wh), webhookAudited(updated))
+	})
+	if err != nil {
+		var errStale *database.ErrStaleRow
+		switch {
+		case errors.As(err, &errStale):
+			render.Render(w, r, ErrPreconditionFailed(err))
+			return
+		case errors.Is(err, sql.ErrNoRows):
+			render.Render(w, r, ErrNotFound(fmt.Errorf("webhook %d not found", wh.ID)))
+			return
+		default:
+			reqLogger.Err(err).Msgf("error updating webhook %d", wh.ID)
+			render.Render(w, r, ErrInternalServer(err))
+			return
+		}
+	}
+	setETag(w, updated.Version)
+	render.Status(r, http.StatusOK)
+	render.Render(w, r, &WebhookResponse{Webhook: updated})
+}
+
+// WebhookDelete ...
+// @id WebhookDelete
+// @tags webhooks
+// @summary Deletes an existing webhook, whose pending deliveries are not attempted anymore
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param If-Match header string false "ETag of the webhook, as returned when it was read"
+// @param id path int true "Webhook id"
+// @success 204
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @failure 412 {object} controller.ErrResponse
+// @failure 428 {object} controller.ErrResponse
+// @router /webhooks/{id} [delete]
+func WebhookDelete(w http.ResponseWriter, r *http.Request) {
+	wh, err := icontext.Webhook(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	if !checkIfMatch(w, r, wh.Version) {
+		return
+	}
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	err = service.InTx(r.Context(), func(ctx context.Context) error {
+		if err := store.DeleteWebhook(ctx, wh); err != nil {
+			return err
+		}
+		return service.Audit(ctx, webhookAuditEvent("webhook.delete", wh), nil, nil)
+	})
+	if err != nil {
+		var errStale *database.ErrStaleRow
+		switch {
+		case errors.As(err, &errStale):
+			render.Render(w, r, ErrPreconditionFailed(err))
+			return
+		case errors.Is(err, sql.ErrNoRows):
+			render.Render(w, r, ErrNotFound(fmt.Errorf("webhook %d not found", wh.ID)))
+			return
+		default:
+			logging.Simple(r).Err(err).Msgf("error deleting webhook %d", wh.ID)
+			render.Render(w, r, ErrInternalServer(err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WebhookDeliveryList ...
+// @id WebhookDeliveryList
+// @tags webhooks
+// @summary Lists the deliveries of events to a webhook, the latest first
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param id path int true "Webhook id"
+// @param page query int false "Page number, for paginating by page number instead of by cursor"
+// @param pageSize query int false "Page size (default 20, at most 100)"
+// @param cursor query string false "Opaque cursor of the page, as found in the Link header (none for the first page)"
+// @success 200 {array} controller.WebhookDeliveryResponse
+// @header 200 {integer} X-Total-Count "Total number of deliveries to the webhook"
+// @header 200 {string} Link "Links to the next and previous pages"
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @router /webhooks/{id}/deliveries [get]
+func WebhookDeliveryList(w http.ResponseWriter, r *http.Request) {
+	wh, err := icontext.Webhook(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	page, err := icontext.Page(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+
+	reqLogger := logging.Simple(r)
+	deliveries, err := store.ListWebhookDeliveries(r.Context(), wh, page.ListOptions())
+	if err != nil {
+		reqLogger.Err(err).Msgf("error listing deliveries page of webhook %d", wh.ID)
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	total, err := store.CountWebhookDeliveries(r.Context(), wh)
+	if err != nil {
+		reqLogger.Err(err).Msgf("error counting deliveries of webhook %d", wh.ID)
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+
+	deliveriesResponseList := []render.Renderer{}
+	keys := []int64{}
+	for _, d := range deliveries {
+		deliveriesResponseList = append(deliveriesResponseList, &WebhookDeliveryResponse{WebhookDelivery: d})
+		keys = append(keys, d.ID)
+	}
+	page.Listed(total, keys)
+	if err := render.RenderList(w, r, deliveriesResponseList); err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	render.Status(r, http.StatusOK)
+}
+
+// WebhookRedeliver ...
+// @id WebhookRedeliver
+// @tags webhooks
+// @summary Delivers again an event to a webhook, whatever the status of its delivery, e.g. dead
+// @accept application/json
+// @produce application/json
+// @param Authorization header string true "Bearer <token>"
+// @param id path int true "Webhook id"
+// @param deliveryID path int true "Delivery id"
+// @success 202 {object} controller.WebhookDeliveryResponse
+// @failure 400 {object} controller.ErrResponse
+// @failure 401 {object} controller.ErrResponse
+// @failure 404 {object} controller.ErrResponse
+// @router /webhooks/{id}/deliveries/{deliveryID}/redeliver [post]
+func WebhookRedeliver(w http.ResponseWriter, r *http.Request) {
+	wh, err := icontext.Webhook(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	store, err := icontext.Store(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrInternalServer(err))
+		return
+	}
+	idParam := chi.URLParam(r, "deliveryID")
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(
+			fmt.Errorf("delivery 'deliveryID' url param '%s' is not an integer number", idParam)))
+		return
+	}
+	reqLogger := logging.Simple(r)
+	d, err := store.GetWebhookDeliveryByID(r.Context(), id)
+	if err == nil && d.WebhookID != wh.ID {
+		err = sql.ErrNoRows
+	}
+	if err == nil {
+		err = service.InTx(r.Context(), func(ctx context.Context) error {
+			var err error
+			if d, err = store.RedeliverWebhookDelivery(ctx, d); err != nil {
+				return err
+			}
+			e := webhookAuditEvent("webhook.redeliver", wh)
+			e.Target = fmt.Sprintf("webhook_delivery:%d", d.ID)
+			return service.Audit(ctx, e, nil, nil)
+		})
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			render.Render(w, r, ErrNotFound(fmt.Errorf("delivery %d of webhook %d not found", id, wh.ID)))
+			return
+		default:
+			reqLogger.Err(err).Msgf("error redelivering delivery %d of webhook %d", id, wh.ID)
+			render.Render(w, r, ErrInternalServer(err))
+			return
+		}
+	}
+	render.Status(r, http.StatusAccepted)
+	render.Render(w, r, &WebhookDeliveryResponse{WebhookDelivery: d})
+}
@@ -0,0 +1,452 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Audit event outcomes
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// AuditEvent records who did what to which target, from where and when.
+// Every event is chained to the previous one through its hash, so that
+// changing or removing past events can be detected (see VerifyAuditChain).
+type AuditEvent struct {
+	ID        int64          `json:"id" repo:"pk"`
+	ActorID   sql.NullInt64  `json:"actor_id" db:"actor_id"`
+	ActorRole sql.NullString `json:"actor_role" db:"actor_role"`
+	Action    string         `json:"action"`
+	Target    string         `json:"target"`
+	Outcome   string         `json:"outcome"`
+	Diff      AuditDiff      `json:"diff"`
+	// DiffHash is the digest of the diff, which the hash covers instead of the diff
+	// itself, so that the diff can be erased without breaking the chain; it is empty
+	// for the events recorded before, whose hash covers their diff
+	DiffHash  string    `json:"diff_hash" db:"diff_hash"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent" db:"user_agent"`
+	RequestID string    `json:"request_id" db:"request_id"`
+	Created   time.Time `json:"created"`
+	PrevHash  string    `json:"prev_hash" db:"prev_hash"`
+	Hash      string    `json:"hash"`
+	// OrganizationID is the organization the event happened in, if any
+	OrganizationID sql.NullInt64 `json:"organization_id" db:"organization_id"`
+}
+
+// AuditOrigin is where the request which did an audited action came from
+type AuditOrigin struct {
+	IP        string
+	UserAgent string
+	RequestID string
+}
+
+// AuditChange holds the before and after values of a changed field
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditDiff maps the JSON names of the changed fields to their changes
+type AuditDiff map[string]AuditChange
+
+// Value ...
+func (d AuditDiff) Value() (driver.Value, error) {
+	if len(d) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan ...
+func (d *AuditDiff) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*d = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("can not scan %T into an audit diff", src)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(d)
+}
+
+// auditRedacted are the fields whose values are never written to the audit log
+var auditRedacted = map[string]bool{"password": true, "secret": true}
+
+const auditRedactedValue = "[redacted]"
+
+// auditErasedValue replaces the values of the diffs of the users whose personal data is erased
+const auditErasedValue = "[erased]"
+
+// AuditDiffOf compares the JSON representations of before and after (any of
+// which can be nil) and returns the fields which differ
+func AuditDiffOf(before interface{}, after interface{}) (AuditDiff, error) {
+	beforeFields, err := auditFieldsOf(before)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the fields of the audited value before the change: %w", err)
+	}
+	afterFields, err := auditFieldsOf(after)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the fields of the audited value after the change: %w", err)
+	}
+	names := map[string]bool{}
+	for name := range beforeFields {
+		names[name] = true
+	}
+	for name := range afterFields {
+		names[name] = true
+	}
+	diff := AuditDiff{}
+	for name := range names {
+		b, a := beforeFields[name], afterFields[name]
+		if bytes.Equal(b, a) {
+			continue
+		}
+		var change AuditChange
+		if auditRedacted[name] {
+			change = AuditChange{Before: auditRedactedValue, After: auditRedactedValue}
+		} else if change.Before, err = auditValueOf(b); err != nil {
+			return nil, err
+		} else if change.After, err = auditValueOf(a); err != nil {
+			return nil, err
+		}
+		diff[name] = change
+	}
+	return diff, nil
+}
+
+func auditFieldsOf(v interface{}) (map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if v == nil {
+		return fields, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func auditValueOf(raw json.RawMessage) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return nil, fmt.Errorf("error decoding audited value %s: %w", raw, err)
+	}
+	return v, nil
+}
+
+// digest returns the hash of the diff, or nothing if it is empty
+func (d AuditDiff) digest() (string, error) {
+	if len(d) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling audit diff: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// erased returns the diff with the same fields, but with their values erased
+func (d AuditDiff) erased() AuditDiff {
+	erased := AuditDiff{}
+	for name := range d {
+		erased[name] = AuditChange{Before: auditErasedValue, After: auditErasedValue}
+	}
+	return erased
+}
+
+// isErased reports whether the values of the diff have been erased
+func (d AuditDiff) isErased() bool {
+	for _, change := range d {
+		if change.Before != auditErasedValue || change.After != auditErasedValue {
+			return false
+		}
+	}
+	return len(d) > 0
+}
+
+// computeHash hashes the previous hash together with all the recorded fields
+func (e *AuditEvent) computeHash() (string, error) {
+	diff := []byte("null")
+	switch {
+	case e.DiffHash != "":
+		diff = []byte(e.DiffHash)
+	case len(e.Diff) > 0:
+		var err error
+		if diff, err = json.Marshal(e.Diff); err != nil {
+			return "", fmt.Errorf("error marshaling audit diff: %w", err)
+		}
+	}
+	actorID := ""
+	if e.ActorID.Valid {
+		actorID = strconv.FormatInt(e.ActorID.Int64, 10)
+	}
+	hashed := []string{
+		e.PrevHash,
+		actorID,
+		e.ActorRole.String,
+		e.Action,
+		e.Target,
+		e.Outcome,
+		string(diff),
+		e.IP,
+		e.UserAgent,
+		e.RequestID,
+		// the database keeps microseconds, in whatever time zone
+		strconv.FormatInt(e.Created.UnixMicro(), 10),
+	}
+	// only hashed when set, so that the events recorded before
+	// organizations were introduced keep their hashes
+	if e.OrganizationID.Valid {
+		hashed = append(hashed, strconv.FormatInt(e.OrganizationID.Int64, 10))
+	}
+	fields, err := json.Marshal(hashed)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling audit event fields: %w", err)
+	}
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// chainTo chains the event, recorded now, to the one with the given hash
+func (e *AuditEvent) chainTo(prevHash string) error {
+	e.PrevHash = prevHash
+	e.Created = time.Now().UTC().Truncate(time.Microsecond)
+	digest, err := e.Diff.digest()
+	if err != nil {
+		return err
+	}
+	e.DiffHash = digest
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	return nil
+}
+
+// verify returns an *ErrAuditChainBroken if the event does not follow the one
+// with the given hash, or has been changed, except for the erasure of its diff
+func (e *AuditEvent) verify(prevHash string) error {
+	if e.PrevHash != prevHash {
+		return &ErrAuditChainBroken{ID: e.ID, Reason: fmt.Sprintf(
+			"previous hash %s does not match the hash of the previous event %s", e.PrevHash, prevHash)}
+	}
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	if hash != e.Hash {
+		return &ErrAuditChainBroken{ID: e.ID, Reason: fmt.Sprintf(
+			"hash %s does not match the recomputed hash %s", e.Hash, hash)}
+	}
+	if e.DiffHash == "" || e.Diff.isErased() {
+		return nil
+	}
+	digest, err := e.Diff.digest()
+	if err != nil {
+		return err
+	}
+	if digest != e.DiffHash {
+		return &ErrAuditChainBroken{ID: e.ID, Reason: fmt.Sprintf(
+			"diff hash %s does not match the recomputed diff hash %s", e.DiffHash, digest)}
+	}
+	return nil
+}
+
+var auditEventRepo *Repository[AuditEvent]
+var auditSQLLockChain string
+var auditSQLSelectLastHash string
+var auditSQLSelectChainPage string
+
+// auditChainLockKey identifies the advisory lock serializing the appends to the chain
+const auditChainLockKey = 7236014
+
+func init() {
+	auditEventRepo = NewRepository[AuditEvent](dbSchema + ".audit_event")
+	auditSQLLockChain = `SELECT pg_advisory_xact_lock($1)`
+	auditSQLSelectLastHash = `SELECT hash FROM ` + dbSchema + `.audit_event ORDER BY id DESC LIMIT $1`
+	auditSQLSelectChainPage = `SELECT * FROM ` + dbSchema + `.audit_event
+		WHERE id > :after ORDER BY id LIMIT :limit`
+}
+
+// RecordAuditEvent appends the given event to the audit log, chaining it to the last one;
+// the event happens in the organization ctx is scoped to, unless it says otherwise
+func RecordAuditEvent(ctx context.Context, db *DB, e *AuditEvent) (*AuditEvent, error) {
+	if organizationID, ok := Tenant(ctx); ok && !e.OrganizationID.Valid {
+		e.OrganizationID = sql.NullInt64{Int64: organizationID, Valid: true}
+	}
+	var recorded *AuditEvent
+	err := db.InTx(ctx, func(ctx context.Context) error {
+		if _, err := Exec(ctx, db, auditSQLLockChain, auditChainLockKey); err != nil {
+			return fmt.Errorf("error locking the audit chain: %w", err)
+		}
+		var prevHash string
+		if err := SelectOne(ctx, db, auditSQLSelectLastHash, &prevHash, 1); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("error getting the hash of the last audit event: %w", err)
+		}
+		if err := e.chainTo(prevHash); err != nil {
+			return err
+		}
+		var err error
+		recorded, err = auditEventRepo.Create(ctx, db, e)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error recording audit event %s on %s: %w", e.Action, e.Target, err)
+	}
+	return recorded, nil
+}
+
+// AuditEventFilter ...
+type AuditEventFilter struct {
+	ActorID sql.NullInt64
+	Action  string
+	Target  string
+	Outcome string
+	From    sql.NullTime
+	To      sql.NullTime
+}
+
+// ListAuditEvents lists the audit events matching the given filter, the latest first
+func ListAuditEvents(ctx context.Context, db *DB, filter AuditEventFilter, opts ListOptions) ([]*AuditEvent, error) {
+	arg := map[string]interface{}{}
+	scope, err := scopeConditions(ctx, nil, "organization_id", arg)
+	if err != nil {
+		return nil, fmt.Errorf("error listing audit events: %w", err)
+	}
+	sqlList, reversed := listSQL(auditEventRepo.table, scope, filter.conditions(arg), auditEventRepo.pk, true, opts, arg)
+	events, err := auditEventRepo.list(ctx, db, sqlList, arg)
+	if err != nil {
+		return nil, err
+	}
+	if reversed {
+		reverse(events)
+	}
+	return events, nil
+}
+
+// CountAuditEvents counts the audit events matching the given filter
+func CountAuditEvents(ctx context.Context, db *DB, filter AuditEventFilter) (int64, error) {
+	arg := map[string]interface{}{}
+	conditions, err := scopeConditions(ctx, filter.conditions(arg), "organization_id", arg)
+	if err != nil {
+		return 0, fmt.Errorf("error counting audit events: %w", err)
+	}
+	count, err := Count(ctx, db, countSQL(auditEventRepo.table, conditions), arg)
+	if err != nil {
+		return 0, fmt.Errorf("error counting audit events: %w", err)
+	}
+	return count, nil
+}
+
+func (filter AuditEventFilter) conditions(arg map[string]interface{}) []string {
+	var conditions []string
+	if filter.ActorID.Valid {
+		conditions = append(conditions, "actor_id=:actor_id")
+		arg["actor_id"] = filter.ActorID.Int64
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action=:action")
+		arg["action"] = filter.Action
+	}
+	if filter.Target != "" {
+		conditions = append(conditions, "target=:target")
+		arg["target"] = filter.Target
+	}
+	if filter.Outcome != "" {
+		conditions = append(conditions, "outcome=:outcome")
+		arg["outcome"] = filter.Outcome
+	}
+	if filter.From.Valid {
+		conditions = append(conditions, "created>=:from")
+		arg["from"] = filter.From.Time
+	}
+	if filter.To.Valid {
+		conditions = append(conditions, "created<:to")
+		arg["to"] = filter.To.Time
+	}
+	return conditions
+}
+
+// ErrAuditChainBroken ...
+type ErrAuditChainBroken struct {
+	ID     int64
+	Reason string
+}
+
+func (err *ErrAuditChainBroken) Error() string {
+	return fmt.Sprintf("audit chain broken at event %d: %s", err.ID, err.Reason)
+}
+
+const auditVerifyBatchSize = 1000
+
+// VerifyAuditChain recomputes the hashes of all the audit events, in order, and
+// returns the number of verified events, or an *ErrAuditChainBroken at the first
+// event which has been changed (other than by erasing its diff), or which follows
+// removed events
+func VerifyAuditChain(ctx context.Context, db *DB) (int, error) {
+	verified := 0
+	prevHash := ""
+	var after int64
+	for {
+		var batch []*AuditEvent
+		arg := map[string]interface{}{"after": after, "limit": auditVerifyBatchSize}
+		err := SelectMany(ctx, db, auditSQLSelectChainPage, arg, func(rows *sqlx.Rows) error {
+			var e AuditEvent
+			if err := rows.StructScan(&e); err != nil {
+				return fmt.Errorf("error scanning audit event row to struct: %w", err)
+			}
+			batch = append(batch, &e)
+			return nil
+		})
+		if err != nil {
+			return verified, fmt.Errorf("error listing audit events after %d: %w", after, err)
+		}
+		for _, e := range batch {
+			if err := e.verify(prevHash); err != nil {
+				return verified, err
+			}
+			prevHash = e.Hash
+			after = e.ID
+			verified++
+		}
+		if len(batch) < auditVerifyBatchSize {
+			return verified, nil
+		}
+	}
+}
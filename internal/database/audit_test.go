@@ -0,0 +1,76 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestAuditEventVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		// change changes the event after it was chained, if not nil
+		change     func(e *AuditEvent)
+		wantBroken bool
+	}{
+		{"intact", nil, false},
+		{"erased diff", func(e *AuditEvent) { e.Diff = e.Diff.erased() }, false},
+		{"changed diff", func(e *AuditEvent) { e.Diff = AuditDiff{"email": {Before: "a@example.com", After: "c@example.com"}} }, true},
+		{"partly erased diff", func(e *AuditEvent) {
+			e.Diff = AuditDiff{
+				"email": {Before: auditErasedValue, After: auditErasedValue},
+				"role":  {Before: "auditor", After: "admin"},
+			}
+		}, true},
+		{"changed actor", func(e *AuditEvent) { e.ActorID.Int64++ }, true},
+		{"changed diff hash", func(e *AuditEvent) { e.DiffHash = "" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &AuditEvent{
+				ActorID: sql.NullInt64{Int64: 1, Valid: true},
+				Action:  "user.update",
+				Target:  "user:2",
+				Outcome: AuditOutcomeSuccess,
+				Diff: AuditDiff{
+					"email": {Before: "a@example.com", After: "b@example.com"},
+					"role":  {Before: "auditor", After: "auditor"},
+				},
+			}
+			if err := e.chainTo("previous"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				tt.change(e)
+			}
+			err := e.verify("previous")
+			var errBroken *ErrAuditChainBroken
+			if got := errors.As(err, &errBroken); got != tt.wantBroken {
+				t.Fatalf("broken chain = %v, want %v (err: %v)", got, tt.wantBroken, err)
+			}
+		})
+	}
+}
+
+func TestAuditEventVerifyWithoutDiffHash(t *testing.T) {
+	// as recorded before the diffs were hashed on their own
+	e := &AuditEvent{
+		Action:  "user.update",
+		Target:  "user:2",
+		Outcome: AuditOutcomeSuccess,
+		Diff:    AuditDiff{"email": {Before: "a@example.com", After: "b@example.com"}},
+	}
+	hash, err := e.computeHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Hash = hash
+	if err := e.verify(""); err != nil {
+		t.Fatalf("expected the event to be intact, got %v", err)
+	}
+	e.Diff = e.Diff.erased()
+	var errBroken *ErrAuditChainBroken
+	if err := e.verify(""); !errors.As(err, &errBroken) {
+		t.Fatalf("expected the erasure of a diff covered by the hash to break the chain, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// benchDB connects to the database at PUREST_BENCH_DB_URL, which is to be migrated
+// and to have at least one user, e.g. the one of the development env once the server
+// has run; the benchmarks only read from it and are skipped if it is not set
+func benchDB(b *testing.B) (context.Context, *DB, *User) {
+	url := os.Getenv("PUREST_BENCH_DB_URL")
+	if url == "" {
+		b.Skip("PUREST_BENCH_DB_URL is not set")
+	}
+	config := ConfigFromEnv()
+	config.URL = url
+	config.ReplicaURLs = nil
+	config.ConnectRetries = 0
+
+	ctx := WithAllTenants(context.Background())
+	db, err := Connect(ctx, config)
+	if err != nil {
+		b.Skipf("error connecting to the bench db: %v", err)
+	}
+	b.Cleanup(func() { db.Close() })
+	users, err := (&User{}).List(ctx, db, ListOptions{Limit: 1})
+	if err != nil {
+		b.Fatalf("error listing users: %v", err)
+	}
+	if len(users) == 0 {
+		b.Skip("there is no user in the bench db")
+	}
+	return ctx, db, users[0]
+}
+
+// benchHandles returns the db with and without the prepared statements cache
+func benchHandles(db *DB) []struct {
+	name string
+	db   *DB
+} {
+	return []struct {
+		name string
+		db   *DB
+	}{
+		{"uncached", db.WithoutStmtCache()},
+		{"cached", db},
+	}
+}
+
+func BenchmarkGetByID(b *testing.B) {
+	ctx, db, u := benchDB(b)
+	for _, h := range benchHandles(db) {
+		b.Run(h.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := (&User{ID: u.ID}).GetByID(ctx, h.db); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkList(b *testing.B) {
+	ctx, db, _ := benchDB(b)
+	for _, h := range benchHandles(db) {
+		b.Run(h.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := (&User{}).List(ctx, h.db, ListOptions{Limit: 20}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,69 +1,373 @@
 package database
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	// initialize database (PosgreSQL) driver
 	_ "github.com/jackc/pgx/stdlib"
 	"github.com/jmoiron/sqlx"
+	"github.com/padurean/purest/internal/env"
+	"github.com/rs/zerolog/log"
 )
 
+var queryTimeout time.Duration
+
+func init() {
+	queryTimeout = env.GetDbQueryTimeout()
+}
+
 // DB ...
 type DB struct {
 	*sqlx.DB
+	stmts       *stmtCache[*sqlx.Stmt]
+	namedStmts  *stmtCache[*sqlx.NamedStmt]
+	health      *healthState
+	replicas    []*DB
+	nextReplica *uint32
+	// url is the one of the primary, for the connections made outside of the
+	// pool, e.g. to listen to notifications
+	url string
 }
 
-// LimitAndOffset ...
-type LimitAndOffset struct {
-	Limit  int `db:"limit"`
-	Offset int `db:"offset"`
+// Config ...
+type Config struct {
+	Driver string
+	URL    string
+	// ReplicaURLs are the URLs of the read replicas, if any
+	ReplicaURLs []string
+
+	// MaxOpenConns is the max number of open connections (0 means unlimited)
+	MaxOpenConns int
+	// MaxIdleConns is the max number of idle connections (0 means none)
+	MaxIdleConns int
+	// ConnMaxLifetime is the max time a connection may be reused (0 means forever)
+	ConnMaxLifetime time.Duration
+	// ConnMaxIdleTime is the max time a connection may stay idle (0 means forever)
+	ConnMaxIdleTime time.Duration
+
+	// ConnectTimeout bounds each connection attempt
+	ConnectTimeout time.Duration
+	// ConnectRetries is the number of retries, with exponential backoff,
+	// after a failed connection attempt
+	ConnectRetries int
+}
+
+// ConfigFromEnv ...
+func ConfigFromEnv() Config {
+	return Config{
+		Driver:          env.GetDbDriver(),
+		URL:             env.GetDbURL(),
+		ReplicaURLs:     env.GetDbReplicaURLs(),
+		MaxOpenConns:    env.GetDbMaxOpenConns(),
+		MaxIdleConns:    env.GetDbMaxIdleConns(),
+		ConnMaxLifetime: env.GetDbConnMaxLifetime(),
+		ConnMaxIdleTime: env.GetDbConnMaxIdleTime(),
+		ConnectTimeout:  env.GetDbConnectTimeout(),
+		ConnectRetries:  env.GetDbConnectRetries(),
+	}
+}
+
+const (
+	connectBackoffMin = 1 * time.Second
+	connectBackoffMax = 30 * time.Second
+)
+
+// Connect connects to the database, retrying with exponential backoff
+// if the database is not reachable, and configures the connection pool
+func Connect(ctx context.Context, config Config) (*DB, error) {
+	db, err := connectWithRetry(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := connectReplicas(ctx, config)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening db replica: %w", err)
+	}
+	return &DB{
+		DB:          db,
+		stmts:       newStmtCache[*sqlx.Stmt](),
+		namedStmts:  newStmtCache[*sqlx.NamedStmt](),
+		health:      &healthState{},
+		replicas:    replicas,
+		nextReplica: new(uint32),
+		url:         config.URL,
+	}, nil
 }
 
 // MustConnect ...
-func MustConnect(driver string, url string) *DB {
-	return &DB{DB: sqlx.MustConnect(driver, url)}
+func MustConnect(ctx context.Context, config Config) *DB {
+	db, err := Connect(ctx, config)
+	if err != nil {
+		panic(err)
+	}
+	return db
 }
 
-// Upsert ...
-func Upsert(db *DB, sqlUpsert string, sqlSelectByID string, argUpsert interface{}, dest interface{}) error {
-	stmtUpsert, err := db.PrepareNamed(sqlUpsert)
+func connectWithRetry(ctx context.Context, config Config) (*sqlx.DB, error) {
+	backoff := connectBackoffMin
+	for attempt := 0; ; attempt++ {
+		db, err := connect(ctx, config)
+		if err == nil {
+			return db, nil
+		}
+		if attempt >= config.ConnectRetries {
+			return nil, fmt.Errorf("error connecting to db after %d attempts: %w", attempt+1, err)
+		}
+		log.Warn().Err(err).Msgf(
+			"error connecting to db (attempt %d of %d), retrying in %s ...",
+			attempt+1, config.ConnectRetries+1, backoff)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error connecting to db: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > connectBackoffMax {
+			backoff = connectBackoffMax
+		}
+	}
+}
+
+func connect(ctx context.Context, config Config) (*sqlx.DB, error) {
+	if config.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.ConnectTimeout)
+		defer cancel()
+	}
+	db, err := sqlx.ConnectContext(ctx, config.Driver, config.URL)
 	if err != nil {
-		return fmt.Errorf("error preparing named db upsert: %v", err)
+		return nil, err
 	}
-	var id int64
-	if err := stmtUpsert.Get(&id, argUpsert); err != nil {
-		return fmt.Errorf("error executing db upsert: %v", err)
+	configurePool(db, config)
+	return db, nil
+}
+
+func configurePool(db *sqlx.DB, config Config) {
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+}
+
+// WithoutStmtCache returns a handle sharing the same connection pool, but which
+// prepares and closes the statements for each query instead of caching them
+func (db *DB) WithoutStmtCache() *DB {
+	replicas := make([]*DB, len(db.replicas))
+	for i, replica := range db.replicas {
+		replicas[i] = replica.WithoutStmtCache()
+	}
+	return &DB{DB: db.DB, health: db.health, replicas: replicas, nextReplica: db.nextReplica, url: db.url}
+}
+
+// Close closes the cached prepared statements and then the connection pool,
+// for the primary as well as for the replicas
+func (db *DB) Close() error {
+	for _, replica := range db.replicas {
+		if err := replica.Close(); err != nil {
+			log.Error().Err(err).Msg("error closing db replica")
+		}
+	}
+	var errStmts error
+	if db.stmts != nil {
+		errStmts = db.stmts.close()
+	}
+	if db.namedStmts != nil {
+		if err := db.namedStmts.close(); err != nil && errStmts == nil {
+			errStmts = err
+		}
 	}
-	stmtSelectByID, err := db.Preparex(sqlSelectByID)
+	if err := db.DB.Close(); err != nil {
+		return fmt.Errorf("error closing db: %w", err)
+	}
+	return errStmts
+}
+
+// withQueryTimeout bounds a single query by the configured query timeout
+func withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, queryTimeout)
+}
+
+type txKey struct{}
+
+// txFrom returns the transaction carried by the given context, if any
+func txFrom(ctx context.Context) (*sqlx.Tx, bool) {
+	tx, ok := ctx.Value(txKey{}).(*sqlx.Tx)
+	return tx, ok
+}
+
+// InTx runs fn in a transaction which is carried by the context passed to fn;
+// the transaction is committed if fn returns nil and rolled back otherwise.
+// If ctx already carries a transaction, fn joins it instead of starting a new one.
+func (db *DB) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := txFrom(ctx); ok {
+		return fn(ctx)
+	}
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error preparing db select by ID: %v", err)
+		return fmt.Errorf("error beginning db transaction: %w", err)
 	}
-	if err := stmtSelectByID.Get(dest, id); err != nil {
-		return fmt.Errorf("error executing db select by ID: %v", err)
+	markWrite(ctx)
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(context.WithValue(ctx, txKey{}, tx)); err != nil {
+		if errRollback := tx.Rollback(); errRollback != nil {
+			return fmt.Errorf("%w (error rolling back db transaction: %v)", err, errRollback)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing db transaction: %w", err)
 	}
 	return nil
 }
 
+// Upsert ...
+func Upsert(ctx context.Context, db *DB, sqlUpsert string, sqlSelectByID string, argUpsert interface{}, dest interface{}) error {
+	return db.InTx(ctx, func(ctx context.Context) error {
+		id, err := upsertReturningID(ctx, db, sqlUpsert, argUpsert)
+		if err != nil {
+			return err
+		}
+		if err := SelectOne(ctx, db, sqlSelectByID, dest, id); err != nil {
+			return fmt.Errorf("error executing db select by ID: %w", err)
+		}
+		return nil
+	})
+}
+
+func upsertReturningID(ctx context.Context, db *DB, sqlUpsert string, argUpsert interface{}) (int64, error) {
+	markWrite(ctx)
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	stmtUpsert, release, err := db.prepareNamed(ctx, sqlUpsert)
+	if err != nil {
+		return 0, fmt.Errorf("error preparing named db upsert: %w", err)
+	}
+	defer release()
+	var id int64
+	if err := stmtUpsert.GetContext(ctx, &id, argUpsert); err != nil {
+		if errDuplicate := duplicateRowFrom(err); errDuplicate != nil {
+			return 0, errDuplicate
+		}
+		return 0, fmt.Errorf("error executing db upsert: %w", err)
+	}
+	return id, nil
+}
+
 // SelectOne ...
-func SelectOne(db *DB, sqlSelect string, argSelect interface{}, dest interface{}) error {
-	stmtSelect, err := db.Preparex(sqlSelect)
+func SelectOne(ctx context.Context, db *DB, sqlSelect string, dest interface{}, argsSelect ...interface{}) error {
+	return db.readWithFallback(ctx, func(r *DB) error {
+		ctx, cancel := withQueryTimeout(ctx)
+		defer cancel()
+		stmtSelect, release, err := r.preparex(ctx, sqlSelect)
+		if err != nil {
+			return fmt.Errorf("error preparing db select one: %w", err)
+		}
+		defer release()
+		return stmtSelect.GetContext(ctx, dest, argsSelect...)
+	})
+}
+
+// SelectMany ...
+func SelectMany(ctx context.Context, db *DB, sqlSelect string, argSelect interface{}, scan func(rows *sqlx.Rows) error) error {
+	return db.readWithFallback(ctx, func(r *DB) error {
+		ctx, cancel := withQueryTimeout(ctx)
+		defer cancel()
+		stmtSelect, release, err := r.prepareNamed(ctx, sqlSelect)
+		if err != nil {
+			return fmt.Errorf("error preparing named db select: %w", err)
+		}
+		defer release()
+		rows, err := stmtSelect.QueryxContext(ctx, argSelect)
+		if err != nil {
+			return fmt.Errorf("error executing named db select: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			// not wrapped, as rows might have been scanned already,
+			// so the select must not be retried on another handle
+			return fmt.Errorf("error iterating rows: %v", err)
+		}
+		if err := rows.Close(); err != nil {
+			return fmt.Errorf("error closing rows: %w", err)
+		}
+		return nil
+	})
+}
+
+// Count executes the given named count query
+func Count(ctx context.Context, db *DB, sqlCount string, argCount interface{}) (int64, error) {
+	var count int64
+	err := db.readWithFallback(ctx, func(r *DB) error {
+		ctx, cancel := withQueryTimeout(ctx)
+		defer cancel()
+		stmtCount, release, err := r.prepareNamed(ctx, sqlCount)
+		if err != nil {
+			return fmt.Errorf("error preparing named db count: %w", err)
+		}
+		defer release()
+		return stmtCount.GetContext(ctx, &count, argCount)
+	})
+	return count, err
+}
+
+// Exec executes the given statement and returns the number of affected rows
+func Exec(ctx context.Context, db *DB, sqlExec string, args ...interface{}) (int64, error) {
+	markWrite(ctx)
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	stmtExec, release, err := db.preparex(ctx, sqlExec)
+	if err != nil {
+		return 0, fmt.Errorf("error preparing db exec: %w", err)
+	}
+	defer release()
+	result, err := stmtExec.ExecContext(ctx, args...)
 	if err != nil {
-		return fmt.Errorf("error preparing db select one: %v", err)
+		if errDuplicate := duplicateRowFrom(err); errDuplicate != nil {
+			return 0, errDuplicate
+		}
+		return 0, fmt.Errorf("error executing db exec: %w", err)
 	}
-	return stmtSelect.Get(dest, argSelect)
+	nbAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error getting number of rows affected by db exec: %w", err)
+	}
+	return nbAffected, nil
 }
 
-// MarkAsDeleted ...
-func MarkAsDeleted(db *DB, sqlMarkAsDeleted string, id int64) error {
-	stmtMarkAsDeleted, err := db.Preparex(sqlMarkAsDeleted)
+// MarkAsDeleted marks as deleted the row with the given ID, which is the first param
+// of the statement, followed by the given args, if any
+func MarkAsDeleted(ctx context.Context, db *DB, sqlMarkAsDeleted string, id int64, args ...interface{}) error {
+	markWrite(ctx)
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	stmtMarkAsDeleted, release, err := db.preparex(ctx, sqlMarkAsDeleted)
 	if err != nil {
-		return fmt.Errorf("error preparing db mark as deleted ID %d: %v", id, err)
+		return fmt.Errorf("error preparing db mark as deleted ID %d: %w", id, err)
 	}
-	result, err := stmtMarkAsDeleted.Exec(id)
+	defer release()
+	result, err := stmtMarkAsDeleted.ExecContext(ctx, append([]interface{}{id}, args...)...)
 	if err != nil {
-		return fmt.Errorf("error executing db mark as deleted ID %d: %v", id, err)
+		return fmt.Errorf("error executing db mark as deleted ID %d: %w", id, err)
 	}
 	nbMarkedAsDeleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting number of rows marked as deleted for ID %d: %w", id, err)
+	}
 	if nbMarkedAsDeleted == 0 {
 		return fmt.Errorf("error marking as deleted ID %d: nothing was marked as deleted", id)
 	} else if nbMarkedAsDeleted > 1 {
@@ -1,9 +1,17 @@
 package database
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx"
+)
 
 // ErrDuplicateRow ...
 type ErrDuplicateRow struct {
+	Table    string
 	ColName  string
 	ColValue string
 }
@@ -11,3 +19,44 @@ type ErrDuplicateRow struct {
 func (err *ErrDuplicateRow) Error() string {
 	return fmt.Sprintf("%s '%s' already exists", err.ColName, err.ColValue)
 }
+
+// ErrStaleRow ...
+type ErrStaleRow struct {
+	Table string
+	ID    int64
+}
+
+func (err *ErrStaleRow) Error() string {
+	return fmt.Sprintf("%s %d has been changed or deleted in the meantime", err.Table, err.ID)
+}
+
+// PostgreSQL error code for unique constraint violations
+const pgCodeUniqueViolation = "23505"
+
+// matches the detail of PostgreSQL unique violation errors,
+// e.g. Key (email)=(john@doe.com) already exists.
+var uniqueViolationDetailRegexp = regexp.MustCompile(`^Key \((.+)\)=\((.*)\) already exists`)
+
+// duplicateRowFrom returns an *ErrDuplicateRow if err is a PostgreSQL
+// unique constraint violation or nil otherwise
+func duplicateRowFrom(err error) *ErrDuplicateRow {
+	var pgErr pgx.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != pgCodeUniqueViolation {
+		return nil
+	}
+	matches := uniqueViolationDetailRegexp.FindStringSubmatch(pgErr.Detail)
+	if matches == nil {
+		return &ErrDuplicateRow{Table: pgErr.TableName, ColName: pgErr.ConstraintName}
+	}
+	// for composite keys, e.g. Key (organization_id, email)=(1, john@doe.com),
+	// the last column is the one which is duplicated within the others
+	colNames, colValues := strings.Split(matches[1], ", "), strings.Split(matches[2], ", ")
+	if len(colNames) > 1 && len(colNames) == len(colValues) {
+		return &ErrDuplicateRow{
+			Table:    pgErr.TableName,
+			ColName:  colNames[len(colNames)-1],
+			ColValue: colValues[len(colValues)-1],
+		}
+	}
+	return &ErrDuplicateRow{Table: pgErr.TableName, ColName: matches[1], ColValue: matches[2]}
+}
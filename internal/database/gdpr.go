@@ -0,0 +1,218 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// UserErasure records the erasure of the personal data of an user
+type UserErasure struct {
+	ID             int64     `json:"id" repo:"pk"`
+	OrganizationID int64     `json:"organization_id" db:"organization_id" repo:"tenant"`
+	UserID         int64     `json:"user_id" db:"user_id"`
+	RequestedBy    int64     `json:"requested_by" db:"requested_by"`
+	Created        time.Time `json:"created" repo:"readonly"`
+}
+
+var userErasureRepo *Repository[UserErasure]
+var auditSQLEraseDiffs string
+var outboxSQLErasePayloads string
+var webhookDeliverySQLErasePayloads string
+var auditSQLSelectOfUser string
+
+func init() {
+	userErasureRepo = NewRepository[UserErasure](dbSchema + ".user_erasure")
+	// the diffs keep their fields, but not their values; they are not scoped to the
+	// organization of the user, whose target is unique anyway, so that the events
+	// recorded before organizations were introduced are erased too
+	auditSQLEraseDiffs = `UPDATE ` + dbSchema + `.audit_event SET diff=(
+		SELECT jsonb_object_agg(field, '{"before": "` + auditErasedValue + `", "after": "` + auditErasedValue + `"}'::jsonb)
+		FROM jsonb_object_keys(diff) AS field) WHERE target=$1 AND diff IS NOT NULL AND diff <> '{}'::jsonb`
+	// the payloads get the anonymized personal data of the user
+	sqlErasedPayload := `(payload - 'previous_email') || jsonb_build_object(
+		'username', $2::text, 'email', $3::text, 'first_name', NULL, 'last_name', NULL)`
+	outboxSQLErasePayloads = `UPDATE ` + dbSchema + `.outbox_event SET payload=` + sqlErasedPayload + `
+		WHERE target=$1`
+	webhookDeliverySQLErasePayloads = `UPDATE ` + dbSchema + `.webhook_delivery SET payload=` + sqlErasedPayload + `
+		WHERE event_id IN (SELECT id FROM ` + dbSchema + `.outbox_event WHERE target=$1)`
+	auditSQLSelectOfUser = `SELECT * FROM ` + dbSchema + `.audit_event`
+}
+
+// ErrAlreadyErased ...
+type ErrAlreadyErased struct {
+	UserID int64
+}
+
+func (err *ErrAlreadyErased) Error() string {
+	return fmt.Sprintf("the personal data of user %d has already been erased", err.UserID)
+}
+
+// Erase irreversibly anonymizes the username, email, first and last name of the user,
+// which is also marked as deleted, erases them from its audit events, events and
+// webhook deliveries, records who requested the erasure and when, and writes a
+// user.erased event to the outbox
+func (u *User) Erase(ctx context.Context, db *DB, requestedBy int64) (*User, error) {
+	ctx, err := tenantOf(ctx, u.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	sqlAnonymize, args, err := scopeSQL(ctx, userSQLAnonymize, "organization_id", []interface{}{u.ID})
+	if err != nil {
+		return nil, err
+	}
+	var erased *User
+	err = db.InTx(ctx, func(ctx context.Context) error {
+		nbAnonymized, err := Exec(ctx, db, sqlAnonymize, args...)
+		if err != nil {
+			return fmt.Errorf("error anonymizing user %d: %w", u.ID, err)
+		}
+		if nbAnonymized == 0 {
+			return &ErrAlreadyErased{UserID: u.ID}
+		}
+		if _, err := userErasureRepo.Create(ctx, db, &UserErasure{UserID: u.ID, RequestedBy: requestedBy}); err != nil {
+			return fmt.Errorf("error recording the erasure of user %d: %w", u.ID, err)
+		}
+		if erased, err = u.GetByIDWithDeleted(ctx, db); err != nil {
+			return err
+		}
+		if err := eraseTraces(ctx, db, erased); err != nil {
+			return err
+		}
+		events, err := userEvents(EventUserErased, nil, erased)
+		if err != nil {
+			return err
+		}
+		return enqueueEvents(ctx, db, events)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return erased, nil
+}
+
+// eraseTraces erases the personal data of the given erased user from the diffs of
+// its audit events, and from the payloads of its events and of their webhook
+// deliveries, which get its anonymized data instead
+func eraseTraces(ctx context.Context, db *DB, erased *User) error {
+	target := userAuditTarget(erased.ID)
+	if _, err := Exec(ctx, db, auditSQLEraseDiffs, target); err != nil {
+		return fmt.Errorf("error erasing the audit diffs of user %d: %w", erased.ID, err)
+	}
+	// the deliveries first, as they find the events by their target
+	if _, err := Exec(ctx, db, webhookDeliverySQLErasePayloads, target, erased.Username, erased.Email); err != nil {
+		return fmt.Errorf("error erasing the webhook delivery payloads of user %d: %w", erased.ID, err)
+	}
+	if _, err := Exec(ctx, db, outboxSQLErasePayloads, target, erased.Username, erased.Email); err != nil {
+		return fmt.Errorf("error erasing the event payloads of user %d: %w", erased.ID, err)
+	}
+	return nil
+}
+
+// erasedPayload returns the given payload of an event of the given erased user,
+// with its anonymized data instead, as eraseTraces does in SQL
+func erasedPayload(payload EventPayload, erased *User) (EventPayload, error) {
+	var data UserEventData
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, fmt.Errorf("error unmarshaling the payload of an event of user %d: %w", erased.ID, err)
+	}
+	data.Username, data.Email, data.FirstName, data.LastName = erased.Username, erased.Email, nil, nil
+	data.PreviousEmail = ""
+	erasedData, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling the payload of an event of user %d: %w", erased.ID, err)
+	}
+	return erasedData, nil
+}
+
+// UserPersonalData holds all the personal data kept about an user
+type UserPersonalData struct {
+	ID             int64      `json:"id"`
+	OrganizationID int64      `json:"organization_id"`
+	Username       string     `json:"username"`
+	Email          string     `json:"email"`
+	FirstName      *string    `json:"first_name"`
+	LastName       *string    `json:"last_name"`
+	Role           string     `json:"role"`
+	Created        time.Time  `json:"created"`
+	Updated        time.Time  `json:"updated"`
+	Deleted        *time.Time `json:"deleted"`
+	Anonymized     *time.Time `json:"anonymized"`
+}
+
+// UserExport ...
+type UserExport struct {
+	Exported time.Time        `json:"exported"`
+	User     UserPersonalData `json:"user"`
+	Erasures []*UserErasure   `json:"erasures"`
+	// AuditEvents are the audit events with the user as actor or target, which
+	// hold where its requests came from
+	AuditEvents []*AuditEvent `json:"audit_events"`
+}
+
+// Export gathers all the personal data kept about the user
+func (u *User) Export(ctx context.Context, db *DB) (*UserExport, error) {
+	erasures, err := userErasureRepo.ListBy(ctx, db, "user_id", u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the erasures of user %d: %w", u.ID, err)
+	}
+	arg := map[string]interface{}{"actor_id": u.ID, "target": userAuditTarget(u.ID)}
+	conditions, err := scopeConditions(ctx, []string{"(actor_id=:actor_id OR target=:target)"}, "organization_id", arg)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the audit events of user %d: %w", u.ID, err)
+	}
+	events, err := auditEventRepo.list(ctx, db, auditSQLSelectOfUser+where(conditions)+` ORDER BY id`, arg)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the audit events of user %d: %w", u.ID, err)
+	}
+	return newUserExport(u, erasures, events), nil
+}
+
+// userAuditTarget is the target of the audit events of the user with the given id
+func userAuditTarget(id int64) string {
+	return fmt.Sprintf("user:%d", id)
+}
+
+func newUserExport(u *User, erasures []*UserErasure, events []*AuditEvent) *UserExport {
+	target := userAuditTarget(u.ID)
+	for _, e := range events {
+		// the diffs of the changes done by the user to others hold their data, not its own
+		if e.Target != target {
+			e.Diff = nil
+		}
+	}
+	return &UserExport{
+		Exported: time.Now().UTC(),
+		User: UserPersonalData{
+			ID:             u.ID,
+			OrganizationID: u.OrganizationID,
+			Username:       u.Username,
+			Email:          u.Email,
+			FirstName:      nullStringPtr(u.FirstName),
+			LastName:       nullStringPtr(u.LastName),
+			Role:           u.Role.String(),
+			Created:        u.Created,
+			Updated:        u.Updated,
+			Deleted:        nullTimePtr(u.Deleted),
+			Anonymized:     nullTimePtr(u.Anonymized),
+		},
+		Erasures:    erasures,
+		AuditEvents: events,
+	}
+}
+
+func nullStringPtr(ns sql.NullString) *string {
+	if !ns.Valid {
+		return nil
+	}
+	return &ns.String
+}
+
+func nullTimePtr(nt sql.NullTime) *time.Time {
+	if !nt.Valid {
+		return nil
+	}
+	return &nt.Time
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStoreEraseUser(t *testing.T) {
+	ctx := WithAllTenants(context.Background())
+	m := NewMemoryStore()
+	o, err := m.GetOrganizationBySlug(ctx, DefaultOrganizationSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateWebhook(ctx, &Webhook{
+		OrganizationID: o.ID,
+		URL:            "https://example.com/hook",
+		Events:         WebhookEvents{"user.*"},
+		Secret:         "0123456789abcdef",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	u, err := m.CreateUser(ctx, &User{
+		OrganizationID: o.ID,
+		Username:       "jdoe",
+		Email:          "jdoe@example.com",
+		FirstName:      sql.NullString{String: "Jonathan", Valid: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := *u
+	changed.Email = "jdoe@example.org"
+	if _, err := m.UpdateUser(ctx, &changed); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := AuditDiffOf(map[string]string{"email": u.Email}, map[string]string{"email": changed.Email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "user:1"
+	for _, e := range []*AuditEvent{
+		{Action: "user.create", Target: target, Diff: AuditDiff{"username": {After: u.Username}}},
+		{Action: "user.update", Target: target, Diff: diff},
+		{Action: "user.export", Target: target},
+		{Action: "user.update", Target: "user:2", Diff: AuditDiff{"role": {Before: "admin", After: "auditor"}}},
+	} {
+		if _, err := m.RecordAuditEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := m.ListOutboxEvents(ctx, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range events {
+		if _, err := m.EnqueueWebhookDeliveries(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := m.EraseUser(ctx, u, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	personal := []string{"jdoe", "Jonathan"}
+	containsPersonal := func(s string) bool {
+		for _, p := range personal {
+			if strings.Contains(s, p) {
+				return true
+			}
+		}
+		return false
+	}
+	prevHash := ""
+	for _, id := range m.auditEvents.ids() {
+		e := m.auditEvents.rows[id]
+		if err := e.verify(prevHash); err != nil {
+			t.Fatalf("expected the audit chain to be intact after the erasure, got %v", err)
+		}
+		prevHash = e.Hash
+		data, err := e.Diff.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, _ := data.(string); containsPersonal(s) {
+			t.Errorf("expected the diff of audit event %d to be erased, got %s", e.ID, s)
+		}
+		if e.Target != target && !strings.Contains(data.(string), "auditor") {
+			t.Errorf("expected the diff of audit event %d of another user to be kept, got %v", e.ID, data)
+		}
+	}
+	for _, e := range m.outbox.rows {
+		if containsPersonal(string(e.Payload)) {
+			t.Errorf("expected the payload of event %d to be erased, got %s", e.ID, e.Payload)
+		}
+	}
+	if len(m.deliveries.rows) == 0 {
+		t.Fatal("expected webhook deliveries")
+	}
+	for _, d := range m.deliveries.rows {
+		if containsPersonal(string(d.Payload)) {
+			t.Errorf("expected the payload of webhook delivery %d to be erased, got %s", d.ID, d.Payload)
+		}
+	}
+}
+
+func TestMemoryStoreExportUser(t *testing.T) {
+	ctx := WithAllTenants(context.Background())
+	m := NewMemoryStore()
+	o, err := m.GetOrganizationBySlug(ctx, DefaultOrganizationSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := m.CreateOrganization(ctx, &Organization{Name: "Other", Slug: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := m.CreateUser(ctx, &User{OrganizationID: o.ID, Username: "jdoe", Email: "jdoe@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inOrganization := func(id int64) sql.NullInt64 { return sql.NullInt64{Int64: id, Valid: true} }
+	for _, e := range []*AuditEvent{
+		{ActorID: sql.NullInt64{Int64: u.ID, Valid: true}, Action: "user.sign_in", Target: "user:1",
+			IP: "192.0.2.1", UserAgent: "curl", OrganizationID: inOrganization(o.ID)},
+		{Action: "user.update", Target: "user:1", IP: "192.0.2.2", OrganizationID: inOrganization(o.ID)},
+		{ActorID: sql.NullInt64{Int64: u.ID, Valid: true}, Action: "user.update", Target: "user:3",
+			Diff: AuditDiff{"email": {Before: "a@example.com", After: "b@example.com"}},
+			IP:   "192.0.2.3", OrganizationID: inOrganization(o.ID)},
+		{Action: "user.update", Target: "user:2", IP: "192.0.2.4", OrganizationID: inOrganization(o.ID)},
+		{Action: "user.update", Target: "user:1", IP: "192.0.2.5", OrganizationID: inOrganization(other.ID)},
+	} {
+		if _, err := m.RecordAuditEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	export, err := m.ExportUser(WithTenant(ctx, o.ID), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	for _, e := range export.AuditEvents {
+		ips = append(ips, e.IP)
+		if e.Target != "user:1" && len(e.Diff) > 0 {
+			t.Errorf("expected the diff of the change of %s to be left out, got %v", e.Target, e.Diff)
+		}
+	}
+	if got, want := strings.Join(ips, ","), "192.0.2.1,192.0.2.2,192.0.2.3"; got != want {
+		t.Errorf("expected the audit events from %s, got the ones from %s", want, got)
+	}
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// PoolStats ...
+type PoolStats struct {
+	MaxOpenConnections int    `json:"max_open_connections"`
+	OpenConnections    int    `json:"open_connections"`
+	InUse              int    `json:"in_use"`
+	Idle               int    `json:"idle"`
+	WaitCount          int64  `json:"wait_count"`
+	WaitDuration       string `json:"wait_duration"`
+	MaxIdleClosed      int64  `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64  `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64  `json:"max_lifetime_closed"`
+}
+
+// Health ...
+type Health struct {
+	Up       bool      `json:"up"`
+	Checked  time.Time `json:"checked"`
+	Error    string    `json:"error,omitempty"`
+	Pool     PoolStats `json:"pool"`
+	Replicas []Health  `json:"replicas,omitempty"`
+}
+
+type healthState struct {
+	mu      sync.RWMutex
+	checked time.Time
+	err     error
+}
+
+// PoolStats ...
+func (db *DB) PoolStats() PoolStats {
+	stats := db.Stats()
+	return PoolStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDuration:       stats.WaitDuration.String(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
+
+// Health returns the result of the latest health check along with the current
+// pool stats, for the primary and for the replicas; a database which was never
+// checked before is checked right away
+func (db *DB) Health(ctx context.Context) Health {
+	db.health.mu.RLock()
+	checked, err := db.health.checked, db.health.err
+	db.health.mu.RUnlock()
+	if checked.IsZero() {
+		checked, err = db.checkHealth(ctx)
+	}
+	h := Health{Up: err == nil, Checked: checked, Pool: db.PoolStats()}
+	if err != nil {
+		h.Error = err.Error()
+	}
+	for _, replica := range db.replicas {
+		h.Replicas = append(h.Replicas, replica.Health(ctx))
+	}
+	return h
+}
+
+func (db *DB) healthy() bool {
+	db.health.mu.RLock()
+	defer db.health.mu.RUnlock()
+	return db.health.err == nil
+}
+
+func (db *DB) setHealth(err error) (checked time.Time, wasUp bool) {
+	db.health.mu.Lock()
+	defer db.health.mu.Unlock()
+	wasUp = db.health.checked.IsZero() || db.health.err == nil
+	checked = time.Now()
+	db.health.checked, db.health.err = checked, err
+	return checked, wasUp
+}
+
+func (db *DB) checkHealth(ctx context.Context) (time.Time, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+	err := db.PingContext(ctx)
+	checked, wasUp := db.setHealth(err)
+
+	switch {
+	case err != nil:
+		log.Error().Err(err).Msg("db health check failed")
+	case !wasUp:
+		log.Info().Msg("db is healthy again")
+	}
+	return checked, err
+}
+
+// MonitorHealth checks the health of the primary and of the replicas,
+// and logs their pool stats, every interval until ctx is done
+func (db *DB) MonitorHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			db.checkAndLogHealth(ctx, log.Info().Str("db", "primary"))
+			for i, replica := range db.replicas {
+				replica.checkAndLogHealth(ctx, log.Info().Str("db", "replica").Int("replica", i))
+			}
+		}
+	}
+}
+
+func (db *DB) checkAndLogHealth(ctx context.Context, event *zerolog.Event) {
+	_, err := db.checkHealth(ctx)
+	stats := db.PoolStats()
+	event.
+		Bool("up", err == nil).
+		Int("max_open", stats.MaxOpenConnections).
+		Int("open", stats.OpenConnections).
+		Int("in_use", stats.InUse).
+		Int("idle", stats.Idle).
+		Int64("wait_count", stats.WaitCount).
+		Str("wait_duration", stats.WaitDuration).
+		Int64("max_idle_closed", stats.MaxIdleClosed).
+		Int64("max_idle_time_closed", stats.MaxIdleTimeClosed).
+		Int64("max_lifetime_closed", stats.MaxLifetimeClosed).
+		Msg("db pool stats")
+}
@@ -0,0 +1,1145 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/padurean/purest/internal/query"
+)
+
+// MemoryStore is a Store keeping everything in memory, with the same semantics
+// as the PostgreSQL one (tenants, soft deletes, versions, unique usernames and
+// emails, filters, sorts and pagination), except for searches, which only find
+// the users containing the searched text, all ranked the same.
+// It starts with the default organization, as a freshly migrated database does.
+type MemoryStore struct {
+	mu sync.Mutex
+	// txMu serializes the transactions (see InTx)
+	txMu          sync.Mutex
+	users         *memoryTable[User]
+	erasures      *memoryTable[UserErasure]
+	organizations *memoryTable[Organization]
+	auditEvents   *memoryTable[AuditEvent]
+	outbox        *memoryTable[OutboxEvent]
+	webhooks      *memoryTable[Webhook]
+	deliveries    *memoryTable[WebhookDelivery]
+	// watchers are notified of the events written to the outbox
+	watchers    map[int]func(organizationID int64)
+	lastWatcher int
+	// advanced is how far the clock of the dispatches has been moved forward
+	advanced time.Duration
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore ...
+func NewMemoryStore() *MemoryStore {
+	m := &MemoryStore{
+		users: newMemoryTable[User]("user",
+			[]string{"organization_id", "username"}, []string{"organization_id", "email"}),
+		erasures:      newMemoryTable[UserErasure]("user_erasure"),
+		organizations: newMemoryTable[Organization]("organization", []string{"slug"}),
+		auditEvents:   newMemoryTable[AuditEvent]("audit_event"),
+		outbox:        newMemoryTable[OutboxEvent]("outbox_event"),
+		webhooks:      newMemoryTable[Webhook]("webhook"),
+		deliveries:    newMemoryTable[WebhookDelivery]("webhook_delivery", []string{"webhook_id", "event_id"}),
+		watchers:      map[int]func(organizationID int64){},
+	}
+	_, err := m.organizations.create(context.Background(), &Organization{Name: "Default", Slug: DefaultOrganizationSlug})
+	if err != nil {
+		panic(err.Error())
+	}
+	return m
+}
+
+// Advance moves forward the clock by which the events and the webhook deliveries are
+// dispatched, e.g. for tests to let the delays before their next attempts elapse
+func (m *MemoryStore) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advanced += d
+}
+
+// memoryTxKey is the key of the context of the transactions of a MemoryStore
+type memoryTxKey struct{}
+
+// InTx runs fn and, if it fails, undoes the changes made since it started, like
+// the transactions of *DB are rolled back, except that the ids taken are not given
+// back, as the sequences of PostgreSQL do not either. The transactions are run one
+// at a time, while the changes made meanwhile outside of them are undone as well.
+func (m *MemoryStore) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx.Value(memoryTxKey{}) != nil {
+		return fn(ctx)
+	}
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+	m.mu.Lock()
+	rollback := m.snapshot()
+	m.mu.Unlock()
+	if err := fn(context.WithValue(ctx, memoryTxKey{}, true)); err != nil {
+		m.mu.Lock()
+		rollback()
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// snapshot returns a function which brings the rows of all the tables back to
+// how they are now; its callers have to hold mu, as the ones of the function do
+func (m *MemoryStore) snapshot() (restore func()) {
+	restores := []func(){
+		m.users.snapshot(),
+		m.erasures.snapshot(),
+		m.organizations.snapshot(),
+		m.auditEvents.snapshot(),
+		m.outbox.snapshot(),
+		m.webhooks.snapshot(),
+		m.deliveries.snapshot(),
+	}
+	return func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+}
+
+// now is the time of the dispatches; its callers have to hold mu
+func (m *MemoryStore) now() time.Time {
+	return time.Now().UTC().Add(m.advanced)
+}
+
+// CreateUser ...
+func (m *MemoryStore) CreateUser(ctx context.Context, u *User) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, err := tenantOf(ctx, u.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	created, err := m.users.create(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.enqueueUserEvents(ctx, EventUserCreated, nil, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// UpdateUser ...
+func (m *MemoryStore) UpdateUser(ctx context.Context, u *User) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, err := tenantOf(ctx, u.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	before, _ := m.users.getBy(ctx, "id", u.ID, false)
+	updated, err := m.users.update(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.enqueueUserEvents(ctx, EventUserUpdated, before, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// RestoreUser ...
+func (m *MemoryStore) RestoreUser(ctx context.Context, u *User) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, err := tenantOf(ctx, u.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	restored, err := m.users.restore(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.enqueueUserEvents(ctx, EventUserRestored, nil, restored); err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+// GetUserByID ...
+func (m *MemoryStore) GetUserByID(ctx context.Context, id int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.users.getBy(ctx, "id", id, false)
+}
+
+// GetUserByIDWithDeleted ...
+func (m *MemoryStore) GetUserByIDWithDeleted(ctx context.Context, id int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.users.getBy(ctx, "id", id, true)
+}
+
+// GetUserByUsername ...
+func (m *MemoryStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.users.getBy(ctx, "username", username, false)
+}
+
+// GetUserByEmail ...
+func (m *MemoryStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.users.getBy(ctx, "email", email, false)
+}
+
+// ListUsers ...
+func (m *MemoryStore) ListUsers(ctx context.Context, opts ListOptions) ([]*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users, _, err := m.users.list(ctx, opts, false, nil)
+	return users, err
+}
+
+// CountUsers ...
+func (m *MemoryStore) CountUsers(ctx context.Context, opts ListOptions) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, count, err := m.users.list(ctx, opts, false, nil)
+	return count, err
+}
+
+// DeleteUser ...
+func (m *MemoryStore) DeleteUser(ctx context.Context, u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.users.delete(ctx, u.ID, u.Version); err != nil {
+		return err
+	}
+	deleted, err := m.users.getBy(ctx, "id", u.ID, true)
+	if err != nil {
+		return fmt.Errorf("error getting user %d after deleting it: %w", u.ID, err)
+	}
+	return m.enqueueUserEvents(ctx, EventUserDeleted, nil, deleted)
+}
+
+// EraseUser ...
+func (m *MemoryStore) EraseUser(ctx context.Context, u *User, requestedBy int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, err := tenantOf(ctx, u.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := m.users.stored(ctx, u.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Anonymized.Valid {
+		return nil, &ErrAlreadyErased{UserID: u.ID}
+	}
+	now := time.Now().UTC()
+	stored.Username = fmt.Sprintf("anonymized%d", stored.ID)
+	stored.Email = fmt.Sprintf("anonymized%d@anonymized.invalid", stored.ID)
+	stored.Password = ""
+	stored.FirstName = sql.NullString{}
+	stored.LastName = sql.NullString{}
+	if !stored.Deleted.Valid {
+		stored.Deleted = sql.NullTime{Time: now, Valid: true}
+	}
+	stored.Anonymized = sql.NullTime{Time: now, Valid: true}
+	stored.Updated = now
+	stored.Version++
+	if _, err := m.erasures.create(ctx, &UserErasure{UserID: u.ID, RequestedBy: requestedBy}); err != nil {
+		return nil, fmt.Errorf("error recording the erasure of user %d: %w", u.ID, err)
+	}
+	erased := *stored
+	if err := m.eraseTraces(&erased); err != nil {
+		return nil, err
+	}
+	if err := m.enqueueUserEvents(ctx, EventUserErased, nil, &erased); err != nil {
+		return nil, err
+	}
+	return &erased, nil
+}
+
+// eraseTraces is like the one of *DB; its callers have to hold mu
+func (m *MemoryStore) eraseTraces(erased *User) error {
+	target := userAuditTarget(erased.ID)
+	for _, e := range m.auditEvents.rows {
+		if e.Target == target && len(e.Diff) > 0 {
+			e.Diff = e.Diff.erased()
+		}
+	}
+	events := map[int64]bool{}
+	for _, e := range m.outbox.rows {
+		if e.Target != target {
+			continue
+		}
+		payload, err := erasedPayload(e.Payload, erased)
+		if err != nil {
+			return err
+		}
+		e.Payload = payload
+		events[e.ID] = true
+	}
+	for _, d := range m.deliveries.rows {
+		if !events[d.EventID] {
+			continue
+		}
+		payload, err := erasedPayload(d.Payload, erased)
+		if err != nil {
+			return err
+		}
+		d.Payload = payload
+	}
+	return nil
+}
+
+func (m *MemoryStore) enqueueUserEvents(ctx context.Context, eventType string, before *User, after *User) error {
+	events, err := userEvents(eventType, before, after)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if _, err := m.outbox.create(ctx, e); err != nil {
+			return fmt.Errorf("error writing event %s of %s to the outbox: %w", e.Type, e.Target, err)
+		}
+	}
+	for _, notify := range m.watchers {
+		notify(after.OrganizationID)
+	}
+	return nil
+}
+
+// ExportUser ...
+func (m *MemoryStore) ExportUser(ctx context.Context, u *User) (*UserExport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	erasures, _, err := m.erasures.list(ctx, ListOptions{}, false, func(e *UserErasure) bool {
+		return e.UserID == u.ID
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing the erasures of user %d: %w", u.ID, err)
+	}
+	match, err := AuditEventFilter{}.matches(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the audit events of user %d: %w", u.ID, err)
+	}
+	target := userAuditTarget(u.ID)
+	events, _, err := m.auditEvents.list(ctx, ListOptions{}, false, func(e *AuditEvent) bool {
+		return match(e) && (e.ActorID.Valid && e.ActorID.Int64 == u.ID || e.Target == target)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing the audit events of user %d: %w", u.ID, err)
+	}
+	return newUserExport(u, erasures, events), nil
+}
+
+// SearchUsers ...
+func (m *MemoryStore) SearchUsers(ctx context.Context, text string, opts ListOptions) ([]*UserSearchResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users, _, err := m.users.list(ctx, ListOptions{Limit: opts.Limit, Offset: opts.Offset}, false, userContains(text))
+	if err != nil {
+		return nil, fmt.Errorf("error searching users for '%s': %w", text, err)
+	}
+	results := make([]*UserSearchResult, len(users))
+	for i, u := range users {
+		results[i] = &UserSearchResult{User: *u, Rank: 1}
+	}
+	return results, nil
+}
+
+// CountUserSearch ...
+func (m *MemoryStore) CountUserSearch(ctx context.Context, text string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, count, err := m.users.list(ctx, ListOptions{}, false, userContains(text))
+	if err != nil {
+		return 0, fmt.Errorf("error counting the users found for '%s': %w", text, err)
+	}
+	return count, nil
+}
+
+func userContains(text string) func(u *User) bool {
+	text = strings.ToLower(text)
+	return func(u *User) bool {
+		for _, field := range []string{u.Username, u.Email, u.FirstName.String, u.LastName.String} {
+			if strings.Contains(strings.ToLower(field), text) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// CreateOrganization ...
+func (m *MemoryStore) CreateOrganization(ctx context.Context, o *Organization) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.organizations.create(ctx, o)
+}
+
+// UpdateOrganization ...
+func (m *MemoryStore) UpdateOrganization(ctx context.Context, o *Organization) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.organizations.update(ctx, o)
+}
+
+// GetOrganizationByID ...
+func (m *MemoryStore) GetOrganizationByID(ctx context.Context, id int64) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.organizations.getBy(ctx, "id", id, false)
+}
+
+// GetOrganizationBySlug ...
+func (m *MemoryStore) GetOrganizationBySlug(ctx context.Context, slug string) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.organizations.getBy(ctx, "slug", slug, false)
+}
+
+// ListOrganizations ...
+func (m *MemoryStore) ListOrganizations(ctx context.Context, opts ListOptions) ([]*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	organizations, _, err := m.organizations.list(ctx, opts, false, nil)
+	return organizations, err
+}
+
+// CountOrganizations ...
+func (m *MemoryStore) CountOrganizations(ctx context.Context, opts ListOptions) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, count, err := m.organizations.list(ctx, opts, false, nil)
+	return count, err
+}
+
+// DeleteOrganization ...
+func (m *MemoryStore) DeleteOrganization(ctx context.Context, o *Organization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.organizations.delete(ctx, o.ID, o.Version)
+}
+
+// RecordAuditEvent ...
+func (m *MemoryStore) RecordAuditEvent(ctx context.Context, e *AuditEvent) (*AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if organizationID, ok := Tenant(ctx); ok && !e.OrganizationID.Valid {
+		e.OrganizationID = sql.NullInt64{Int64: organizationID, Valid: true}
+	}
+	prevHash := ""
+	if last, ok := m.auditEvents.rows[m.auditEvents.lastID]; ok {
+		prevHash = last.Hash
+	}
+	if err := e.chainTo(prevHash); err != nil {
+		return nil, err
+	}
+	recorded, err := m.auditEvents.create(ctx, e)
+	if err != nil {
+		return nil, fmt.Errorf("error recording audit event %s on %s: %w", e.Action, e.Target, err)
+	}
+	return recorded, nil
+}
+
+// ListAuditEvents ...
+func (m *MemoryStore) ListAuditEvents(ctx context.Context, filter AuditEventFilter, opts ListOptions) ([]*AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	match, err := filter.matches(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing audit events: %w", err)
+	}
+	events, _, err := m.auditEvents.list(ctx, opts, true, match)
+	return events, err
+}
+
+// CountAuditEvents ...
+func (m *MemoryStore) CountAuditEvents(ctx context.Context, filter AuditEventFilter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	match, err := filter.matches(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error counting audit events: %w", err)
+	}
+	_, count, err := m.auditEvents.list(ctx, ListOptions{}, true, match)
+	return count, err
+}
+
+// matches returns the in-memory equivalent of the conditions of the filter,
+// scoped to the organization of ctx
+func (filter AuditEventFilter) matches(ctx context.Context) (func(e *AuditEvent) bool, error) {
+	organizationID, scoped, err := tenantFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(e *AuditEvent) bool {
+		return (!scoped || e.OrganizationID.Valid && e.OrganizationID.Int64 == organizationID) &&
+			(!filter.ActorID.Valid || e.ActorID == filter.ActorID) &&
+			(filter.Action == "" || e.Action == filter.Action) &&
+			(filter.Target == "" || e.Target == filter.Target) &&
+			(filter.Outcome == "" || e.Outcome == filter.Outcome) &&
+			(!filter.From.Valid || !e.Created.Before(filter.From.Time)) &&
+			(!filter.To.Valid || e.Created.Before(filter.To.Time))
+	}, nil
+}
+
+// DispatchOutboxEvents is like the one of *DB, except that the events are not locked
+// while being passed to deliver, so concurrent dispatches may pass the same events
+func (m *MemoryStore) DispatchOutboxEvents(
+	ctx context.Context,
+	limit int,
+	deliver func(ctx context.Context, e *OutboxEvent) error,
+) (int, error) {
+	m.mu.Lock()
+	now := m.now()
+	var pending []*OutboxEvent
+	for _, id := range m.outbox.ids() {
+		if len(pending) == limit {
+			break
+		}
+		if e := m.outbox.rows[id]; !e.Dispatched.Valid && !e.NextAttempt.After(now) {
+			copied := *e
+			pending = append(pending, &copied)
+		}
+	}
+	m.mu.Unlock()
+
+	nbDispatched := 0
+	for _, e := range pending {
+		errDeliver := deliver(ctx, e)
+		m.mu.Lock()
+		stored := m.outbox.rows[e.ID]
+		stored.Attempts++
+		if errDeliver != nil {
+			stored.LastError = sql.NullString{String: errDeliver.Error(), Valid: true}
+			stored.NextAttempt = m.now().Add(retryDelay(stored.Attempts))
+		} else {
+			stored.LastError = sql.NullString{}
+			stored.Dispatched = sql.NullTime{Time: m.now(), Valid: true}
+			nbDispatched++
+		}
+		m.mu.Unlock()
+	}
+	return nbDispatched, nil
+}
+
+// ListOutboxEvents ...
+func (m *MemoryStore) ListOutboxEvents(ctx context.Context, after int64, limit int) ([]*OutboxEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	organizationID, scoped, err := tenantFrom(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing outbox events: %w", err)
+	}
+	var events []*OutboxEvent
+	for _, id := range m.outbox.ids() {
+		if len(events) == limit {
+			break
+		}
+		if e := m.outbox.rows[id]; id > after && (!scoped || e.OrganizationID == organizationID) {
+			copied := *e
+			events = append(events, &copied)
+		}
+	}
+	return events, nil
+}
+
+// LatestOutboxEventID ...
+func (m *MemoryStore) LatestOutboxEventID(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.outbox.lastID, nil
+}
+
+// WatchOutboxEvents calls notify, while still holding the lock of the store,
+// so notify must neither block nor use the store
+func (m *MemoryStore) WatchOutboxEvents(ctx context.Context, notify func(organizationID int64)) error {
+	m.mu.Lock()
+	m.lastWatcher++
+	watcher := m.lastWatcher
+	m.watchers[watcher] = notify
+	m.mu.Unlock()
+
+	<-ctx.Done()
+	m.mu.Lock()
+	delete(m.watchers, watcher)
+	m.mu.Unlock()
+	return ctx.Err()
+}
+
+// CreateWebhook ...
+func (m *MemoryStore) CreateWebhook(ctx context.Context, w *Webhook) (*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, err := tenantOf(ctx, w.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	return m.webhooks.create(ctx, w)
+}
+
+// UpdateWebhook ...
+func (m *MemoryStore) UpdateWebhook(ctx context.Context, w *Webhook) (*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, err := tenantOf(ctx, w.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	return m.webhooks.update(ctx, w)
+}
+
+// GetWebhookByID ...
+func (m *MemoryStore) GetWebhookByID(ctx context.Context, id int64) (*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.webhooks.getBy(ctx, "id", id, false)
+}
+
+// ListWebhooks ...
+func (m *MemoryStore) ListWebhooks(ctx context.Context, opts ListOptions) ([]*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	webhooks, _, err := m.webhooks.list(ctx, opts, false, nil)
+	return webhooks, err
+}
+
+// CountWebhooks ...
+func (m *MemoryStore) CountWebhooks(ctx context.Context, opts ListOptions) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, count, err := m.webhooks.list(ctx, opts, false, nil)
+	return count, err
+}
+
+// DeleteWebhook ...
+func (m *MemoryStore) DeleteWebhook(ctx context.Context, w *Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.webhooks.delete(ctx, w.ID, w.Version)
+}
+
+// ListWebhookDeliveries ...
+func (m *MemoryStore) ListWebhookDeliveries(ctx context.Context, w *Webhook, opts ListOptions) ([]*WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deliveries, _, err := m.deliveries.list(ctx, opts, true, func(d *WebhookDelivery) bool {
+		return d.WebhookID == w.ID
+	})
+	return deliveries, err
+}
+
+// CountWebhookDeliveries ...
+func (m *MemoryStore) CountWebhookDeliveries(ctx context.Context, w *Webhook) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, count, err := m.deliveries.list(ctx, ListOptions{}, true, func(d *WebhookDelivery) bool {
+		return d.WebhookID == w.ID
+	})
+	return count, err
+}
+
+// GetWebhookDeliveryByID ...
+func (m *MemoryStore) GetWebhookDeliveryByID(ctx context.Context, id int64) (*WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deliveries.getBy(ctx, "id", id, false)
+}
+
+// RedeliverWebhookDelivery ...
+func (m *MemoryStore) RedeliverWebhookDelivery(ctx context.Context, d *WebhookDelivery) (*WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, err := m.deliveries.stored(ctx, d.ID, false)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	stored.Status = WebhookDeliveryPending
+	stored.Attempts = 0
+	stored.NextAttempt = now
+	stored.Updated = now
+	redelivered := *stored
+	return &redelivered, nil
+}
+
+// EnqueueWebhookDeliveries ...
+func (m *MemoryStore) EnqueueWebhookDeliveries(ctx context.Context, e *OutboxEvent) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx = WithTenant(ctx, e.OrganizationID)
+	webhooks, _, err := m.webhooks.list(ctx, ListOptions{}, false, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error listing the webhooks of organization %d: %w", e.OrganizationID, err)
+	}
+	nbSubscribed := 0
+	for _, w := range webhooks {
+		if !w.Events.Matches(e.Type) {
+			continue
+		}
+		nbSubscribed++
+		_, err := m.deliveries.create(ctx, &WebhookDelivery{
+			WebhookID:   w.ID,
+			EventID:     e.ID,
+			EventType:   e.Type,
+			Payload:     e.Payload,
+			Status:      WebhookDeliveryPending,
+			NextAttempt: m.now(),
+		})
+		var errDuplicate *ErrDuplicateRow
+		if err != nil && !errors.As(err, &errDuplicate) {
+			return 0, fmt.Errorf("error enqueuing the delivery of event %d to webhook %d: %w", e.ID, w.ID, err)
+		}
+	}
+	return nbSubscribed, nil
+}
+
+// DispatchWebhookDeliveries is like the one of *DB, except that the deliveries are not
+// locked while being sent, so concurrent dispatches may send the same deliveries
+func (m *MemoryStore) DispatchWebhookDeliveries(ctx context.Context, limit int, maxAttempts int, send WebhookSend) (int, error) {
+	type pendingDelivery struct {
+		delivery WebhookDelivery
+		webhook  Webhook
+	}
+	m.mu.Lock()
+	now := m.now()
+	var pending []pendingDelivery
+	for _, id := range m.deliveries.ids() {
+		if len(pending) == limit {
+			break
+		}
+		d := m.deliveries.rows[id]
+		if d.Status == WebhookDeliveryPending && !d.NextAttempt.After(now) {
+			pending = append(pending, pendingDelivery{delivery: *d, webhook: *m.webhooks.rows[d.WebhookID]})
+		}
+	}
+	m.mu.Unlock()
+
+	nbSucceeded := 0
+	for _, p := range pending {
+		var responseStatus int
+		errSend := errWebhookDeleted
+		if !p.webhook.Deleted.Valid {
+			responseStatus, errSend = send(ctx, &p.webhook, &p.delivery)
+		}
+		m.mu.Lock()
+		stored := m.deliveries.rows[p.delivery.ID]
+		stored.Attempts++
+		stored.ResponseStatus = sql.NullInt64{Int64: int64(responseStatus), Valid: responseStatus != 0}
+		stored.Updated = m.now()
+		if errSend == nil {
+			stored.Status = WebhookDeliverySucceeded
+			stored.LastError = sql.NullString{}
+			stored.Delivered = sql.NullTime{Time: stored.Updated, Valid: true}
+			nbSucceeded++
+		} else {
+			stored.Status, _ = webhookDeliveryAfterFailure(&p.delivery, maxAttempts, errSend)
+			stored.LastError = sql.NullString{String: errSend.Error(), Valid: true}
+			stored.NextAttempt = stored.Updated.Add(retryDelay(stored.Attempts))
+		}
+		m.mu.Unlock()
+	}
+	return nbSucceeded, nil
+}
+
+// Health ...
+func (m *MemoryStore) Health(ctx context.Context) Health {
+	return Health{Up: true, Checked: time.Now().UTC()}
+}
+
+// memoryTable keeps entities of type T in memory, interpreting their struct tags
+// the way Repository[T] does, and enforcing the given unique constraints among
+// the entities which are not deleted; its callers have to serialize the access
+type memoryTable[T any] struct {
+	name    string
+	columns map[string]column
+	pk      string
+	deleted string
+	version string
+	tenant  string
+	updated string
+	unique  [][]string
+	rows    map[int64]*T
+	lastID  int64
+}
+
+func newMemoryTable[T any](name string, unique ...[]string) *memoryTable[T] {
+	var zero T
+	table := &memoryTable[T]{name: name, columns: map[string]column{}, unique: unique, rows: map[int64]*T{}}
+	for _, c := range columnsOf(reflect.TypeOf(zero)) {
+		table.columns[c.name] = c
+		switch c.role {
+		case "pk":
+			table.pk = c.name
+		case "deleted":
+			table.deleted = c.name
+		case "version":
+			table.version = c.name
+		case "tenant":
+			table.tenant = c.name
+		case "updated":
+			table.updated = c.name
+		}
+	}
+	return table
+}
+
+func (table *memoryTable[T]) field(entity *T, column string) reflect.Value {
+	return reflect.ValueOf(entity).Elem().Field(table.columns[column].field)
+}
+
+// valueOf returns the value of the column as the database would give it to
+// a filter, i.e. nil for NULL, and int64, string, time.Time or bool otherwise
+func (table *memoryTable[T]) valueOf(entity *T, column string) interface{} {
+	f := table.field(entity, column)
+	switch v := f.Interface().(type) {
+	case sql.NullString:
+		if v.Valid {
+			return v.String
+		}
+		return nil
+	case sql.NullTime:
+		if v.Valid {
+			return v.Time
+		}
+		return nil
+	case sql.NullInt64:
+		if v.Valid {
+			return v.Int64
+		}
+		return nil
+	case time.Time:
+		return v
+	}
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return f.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(f.Uint())
+	case reflect.String:
+		return f.String()
+	case reflect.Bool:
+		return f.Bool()
+	}
+	return f.Interface()
+}
+
+func (table *memoryTable[T]) isDeleted(entity *T) bool {
+	return table.deleted != "" && table.valueOf(entity, table.deleted) != nil
+}
+
+func (table *memoryTable[T]) setNow(entity *T, column string) {
+	now := time.Now().UTC()
+	switch f := table.field(entity, column); f.Interface().(type) {
+	case sql.NullTime:
+		f.Set(reflect.ValueOf(sql.NullTime{Time: now, Valid: true}))
+	case time.Time:
+		f.Set(reflect.ValueOf(now))
+	}
+}
+
+// inScope reports whether the entity can be reached with ctx
+func (table *memoryTable[T]) inScope(ctx context.Context, entity *T) (bool, error) {
+	if table.tenant == "" {
+		return true, nil
+	}
+	organizationID, scoped, err := tenantFrom(ctx)
+	if err != nil {
+		return false, err
+	}
+	return !scoped || table.valueOf(entity, table.tenant) == organizationID, nil
+}
+
+// stored returns the stored entity (not a copy) with the given id, if in scope
+func (table *memoryTable[T]) stored(ctx context.Context, id int64, withDeleted bool) (*T, error) {
+	entity, ok := table.rows[id]
+	if !ok || (!withDeleted && table.isDeleted(entity)) {
+		return nil, sql.ErrNoRows
+	}
+	if inScope, err := table.inScope(ctx, entity); err != nil || !inScope {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return nil, err
+	}
+	return entity, nil
+}
+
+func (table *memoryTable[T]) validateUnique(entity *T, id int64) error {
+	for _, columns := range table.unique {
+		for otherID, other := range table.rows {
+			if otherID == id || table.isDeleted(other) {
+				continue
+			}
+			same := true
+			for _, c := range columns {
+				if table.valueOf(other, c) != table.valueOf(entity, c) {
+					same = false
+					break
+				}
+			}
+			if same {
+				c := columns[len(columns)-1]
+				return &ErrDuplicateRow{Table: table.name, ColName: c, ColValue: fmt.Sprint(table.valueOf(entity, c))}
+			}
+		}
+	}
+	return nil
+}
+
+func (table *memoryTable[T]) create(ctx context.Context, entity *T) (*T, error) {
+	var created T
+	for name, c := range table.columns {
+		switch c.role {
+		case "", "tenant":
+			table.field(&created, name).Set(table.field(entity, name))
+		case "readonly":
+			// the nullable ones, e.g. an anonymization time, are NULL by default
+			if _, ok := table.field(&created, name).Interface().(time.Time); ok {
+				table.setNow(&created, name)
+			}
+		case "updated":
+			table.setNow(&created, name)
+		case "version":
+			table.field(&created, name).SetInt(1)
+		}
+	}
+	if table.tenant != "" {
+		organizationID, scoped, err := tenantFrom(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if scoped {
+			table.field(&created, table.tenant).SetInt(organizationID)
+		}
+	}
+	if err := table.validateUnique(&created, 0); err != nil {
+		return nil, err
+	}
+	table.lastID++
+	table.field(&created, table.pk).SetInt(table.lastID)
+	table.rows[table.lastID] = &created
+	copied := created
+	return &copied, nil
+}
+
+func (table *memoryTable[T]) update(ctx context.Context, entity *T) (*T, error) {
+	id := table.field(entity, table.pk).Int()
+	stored, err := table.stored(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	if table.version != "" && table.field(stored, table.version).Int() != table.field(entity, table.version).Int() {
+		return nil, &ErrStaleRow{Table: table.name, ID: id}
+	}
+	updated := *stored
+	for name, c := range table.columns {
+		if c.role == "" {
+			table.field(&updated, name).Set(table.field(entity, name))
+		}
+	}
+	if err := table.validateUnique(&updated, id); err != nil {
+		return nil, err
+	}
+	table.changed(&updated)
+	*stored = updated
+	return &updated, nil
+}
+
+// changed sets the update time and increments the version of the entity
+func (table *memoryTable[T]) changed(entity *T) {
+	if table.updated != "" {
+		table.setNow(entity, table.updated)
+	}
+	if table.version != "" {
+		f := table.field(entity, table.version)
+		f.SetInt(f.Int() + 1)
+	}
+}
+
+func (table *memoryTable[T]) getBy(ctx context.Context, column string, value interface{}, withDeleted bool) (*T, error) {
+	if _, ok := table.columns[column]; !ok {
+		return nil, fmt.Errorf("unknown column %s of table %s", column, table.name)
+	}
+	for _, id := range table.ids() {
+		entity := table.rows[id]
+		if table.valueOf(entity, column) != value {
+			continue
+		}
+		if _, err := table.stored(ctx, id, withDeleted); err == nil {
+			copied := *entity
+			return &copied, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// delete marks the entity as deleted, or removes it if T is not soft-deleted;
+// if version is not 0, the entity must still have it
+func (table *memoryTable[T]) delete(ctx context.Context, id int64, version int64) error {
+	stored, err := table.stored(ctx, id, false)
+	if err != nil {
+		return err
+	}
+	if version != 0 && table.field(stored, table.version).Int() != version {
+		return &ErrStaleRow{Table: table.name, ID: id}
+	}
+	if table.deleted == "" {
+		delete(table.rows, id)
+		return nil
+	}
+	table.setNow(stored, table.deleted)
+	table.changed(stored)
+	return nil
+}
+
+func (table *memoryTable[T]) restore(ctx context.Context, id int64) (*T, error) {
+	stored, err := table.stored(ctx, id, true)
+	if err != nil {
+		return nil, err
+	}
+	if !table.isDeleted(stored) {
+		return nil, sql.ErrNoRows
+	}
+	restored := *stored
+	table.field(&restored, table.deleted).Set(reflect.Zero(table.field(&restored, table.deleted).Type()))
+	if err := table.validateUnique(&restored, id); err != nil {
+		return nil, err
+	}
+	table.changed(&restored)
+	*stored = restored
+	return &restored, nil
+}
+
+// list lists the entities in scope which are not deleted (unless opts includes
+// them), meet the filters of opts and match (if given), in the order of opts and
+// then of their key (descending if desc), and returns the ones of the page of
+// opts, together with how many there are regardless of the page
+func (table *memoryTable[T]) list(ctx context.Context, opts ListOptions, desc bool, match func(*T) bool) ([]*T, int64, error) {
+	var listed []*T
+	for _, id := range table.ids() {
+		entity, err := table.stored(ctx, id, opts.IncludeDeleted)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if (match == nil || match(entity)) && table.meets(entity, opts.Query) {
+			copied := *entity
+			listed = append(listed, &copied)
+		}
+	}
+	total := int64(len(listed))
+
+	var orders []query.Sort
+	if opts.Query != nil {
+		orders = append(orders, opts.Query.Sorts...)
+	}
+	orders = append(orders, query.Sort{Column: table.pk, Desc: desc})
+	cursor := opts.After
+	if opts.Before > 0 {
+		cursor = opts.Before
+		for i := range orders {
+			orders[i].Desc = !orders[i].Desc
+		}
+	}
+	compare := func(a, b *T) int {
+		for _, o := range orders {
+			c, _ := query.Compare(table.valueOf(a, o.Column), table.valueOf(b, o.Column))
+			if o.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(listed, func(i, j int) bool { return compare(listed[i], listed[j]) < 0 })
+
+	start := opts.Offset
+	if cursor > 0 {
+		// like the SQL lists, the cursor can not point to the entities of other tenants
+		after, err := table.stored(ctx, cursor, true)
+		switch {
+		case err == sql.ErrNoRows:
+			// only the key of the entity the cursor points to is known
+			if len(orders) > 1 {
+				return nil, 0, ErrStaleCursor
+			}
+			after = new(T)
+			table.field(after, table.pk).SetInt(cursor)
+		case err != nil:
+			return nil, 0, err
+		}
+		start = len(listed)
+		for i, entity := range listed {
+			if compare(after, entity) < 0 {
+				start = i
+				break
+			}
+		}
+	}
+	if start > len(listed) {
+		start = len(listed)
+	}
+	listed = listed[start:]
+	if opts.Limit > 0 && len(listed) > opts.Limit {
+		listed = listed[:opts.Limit]
+	}
+	if opts.Before > 0 {
+		reverse(listed)
+	}
+	if listed == nil {
+		listed = []*T{}
+	}
+	return listed, total, nil
+}
+
+func (table *memoryTable[T]) meets(entity *T, q *query.Query) bool {
+	if q == nil {
+		return true
+	}
+	for _, f := range q.Filters {
+		if _, ok := table.columns[f.Column]; !ok || !f.Matches(table.valueOf(entity, f.Column)) {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshot returns a function which brings the rows back to how they are now
+func (table *memoryTable[T]) snapshot() (restore func()) {
+	rows := make(map[int64]T, len(table.rows))
+	for id, entity := range table.rows {
+		rows[id] = *entity
+	}
+	return func() {
+		table.rows = make(map[int64]*T, len(rows))
+		for id, entity := range rows {
+			entity := entity
+			table.rows[id] = &entity
+		}
+	}
+}
+
+func (table *memoryTable[T]) ids() []int64 {
+	ids := make([]int64, 0, len(table.rows))
+	for id := range table.rows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestMemoryStoreVersionedWrites(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare returns the user to write, as read before the write
+		prepare   func(ctx context.Context, m *MemoryStore, u *User) *User
+		wantStale bool
+		wantNoRow bool
+	}{
+		{
+			name:    "current version",
+			prepare: func(ctx context.Context, m *MemoryStore, u *User) *User { return u },
+		},
+		{
+			name: "changed since read",
+			prepare: func(ctx context.Context, m *MemoryStore, u *User) *User {
+				read := *u
+				if _, err := m.UpdateUser(ctx, u); err != nil {
+					t.Fatal(err)
+				}
+				return &read
+			},
+			wantStale: true,
+		},
+		{
+			name: "deleted since read",
+			prepare: func(ctx context.Context, m *MemoryStore, u *User) *User {
+				if err := m.DeleteUser(ctx, u); err != nil {
+					t.Fatal(err)
+				}
+				return u
+			},
+			wantNoRow: true,
+		},
+		{
+			name: "never existed",
+			prepare: func(ctx context.Context, m *MemoryStore, u *User) *User {
+				missing := *u
+				missing.ID = u.ID + 1
+				return &missing
+			},
+			wantNoRow: true,
+		},
+	}
+	writes := map[string]func(ctx context.Context, m *MemoryStore, u *User) error{
+		"update": func(ctx context.Context, m *MemoryStore, u *User) error {
+			_, err := m.UpdateUser(ctx, u)
+			return err
+		},
+		"delete": func(ctx context.Context, m *MemoryStore, u *User) error {
+			return m.DeleteUser(ctx, u)
+		},
+	}
+	for writeName, write := range writes {
+		for _, tt := range tests {
+			t.Run(writeName+" "+tt.name, func(t *testing.T) {
+				ctx := WithAllTenants(context.Background())
+				m := NewMemoryStore()
+				o, err := m.GetOrganizationBySlug(ctx, DefaultOrganizationSlug)
+				if err != nil {
+					t.Fatal(err)
+				}
+				u, err := m.CreateUser(ctx, &User{OrganizationID: o.ID, Username: "jo", Email: "jo@example.com"})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = write(ctx, m, tt.prepare(ctx, m, u))
+
+				var errStale *ErrStaleRow
+				if got := errors.As(err, &errStale); got != tt.wantStale {
+					t.Errorf("stale row error = %v, want %v (err: %v)", got, tt.wantStale, err)
+				}
+				if got := errors.Is(err, sql.ErrNoRows); got != tt.wantNoRow {
+					t.Errorf("no rows error = %v, want %v (err: %v)", got, tt.wantNoRow, err)
+				}
+				if !tt.wantStale && !tt.wantNoRow && err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestMemoryStoreInTx(t *testing.T) {
+	ctx := WithAllTenants(context.Background())
+	m := NewMemoryStore()
+	o, err := m.GetOrganizationBySlug(ctx, DefaultOrganizationSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := m.CreateUser(ctx, &User{OrganizationID: o.ID, Username: "jdoe", Email: "jdoe@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errFailed := errors.New("failed")
+	err = m.InTx(ctx, func(ctx context.Context) error {
+		changed := *u
+		changed.Email = "jdoe@example.org"
+		if _, err := m.UpdateUser(ctx, &changed); err != nil {
+			return err
+		}
+		// joins the transaction, instead of starting another one
+		return m.InTx(ctx, func(ctx context.Context) error {
+			if _, err := m.CreateUser(ctx, &User{OrganizationID: o.ID, Username: "jroe", Email: "jroe@example.com"}); err != nil {
+				return err
+			}
+			if _, err := m.RecordAuditEvent(ctx, &AuditEvent{Action: "user.create", Target: "user:2"}); err != nil {
+				return err
+			}
+			return errFailed
+		})
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("expected the error of the transaction, got %v", err)
+	}
+	if got, err := m.GetUserByID(ctx, u.ID); err != nil || got.Email != u.Email || got.Version != u.Version {
+		t.Errorf("expected the update to be undone, got %+v (%v)", got, err)
+	}
+	if _, err := m.GetUserByUsername(ctx, "jroe"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the creation to be undone, got %v", err)
+	}
+	if count, err := m.CountAuditEvents(ctx, AuditEventFilter{}); err != nil || count != 0 {
+		t.Errorf("expected no audit events, got %d (%v)", count, err)
+	}
+	created, err := m.CreateUser(ctx, &User{OrganizationID: o.ID, Username: "jroe", Email: "jroe@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == u.ID+1 {
+		t.Errorf("expected the id taken in the transaction not to be given back")
+	}
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Organization is a tenant, i.e. a customer owning users and their data
+type Organization struct {
+	ID      int64        `json:"id" repo:"pk"`
+	Name    string       `json:"name" validate:"required"`
+	Slug    string       `json:"slug" validate:"required,alphanum,lowercase"`
+	Created time.Time    `json:"created" repo:"readonly"`
+	Updated time.Time    `json:"updated" repo:"updated"`
+	Deleted sql.NullTime `json:"deleted,omitempty" repo:"deleted"`
+	Version int64        `json:"version" repo:"version"`
+}
+
+// DefaultOrganizationSlug is the slug of the organization created with the schema,
+// which owns the users created before organizations were introduced
+const DefaultOrganizationSlug = "default"
+
+var organizationRepo *Repository[Organization]
+
+func init() {
+	organizationRepo = NewRepository[Organization](dbSchema + ".organization")
+}
+
+func (o *Organization) validateNoDuplicate(ctx context.Context, db *DB) error {
+	oWithSameSlug, err := o.GetBySlug(ctx, db)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("error finding if an organization with slug %s already exists: %v", o.Slug, err)
+	}
+	if oWithSameSlug.ID != o.ID {
+		return &ErrDuplicateRow{Table: "organization", ColName: "slug", ColValue: o.Slug}
+	}
+	return nil
+}
+
+// Create ...
+func (o *Organization) Create(ctx context.Context, db *DB) (*Organization, error) {
+	return o.upsert(ctx, db, organizationRepo.Create)
+}
+
+// Update updates the organization as long as it still has the version it had
+// when it was read, returning an *ErrStaleRow otherwise
+func (o *Organization) Update(ctx context.Context, db *DB) (*Organization, error) {
+	return o.upsert(ctx, db, organizationRepo.Update)
+}
+
+func (o *Organization) upsert(
+	ctx context.Context,
+	db *DB,
+	upsertFn func(ctx context.Context, db *DB, o *Organization) (*Organization, error),
+) (*Organization, error) {
+	var oo *Organization
+	err := db.InTx(ctx, func(ctx context.Context) error {
+		if err := o.validateNoDuplicate(ctx, db); err != nil {
+			return err
+		}
+		var err error
+		oo, err = upsertFn(ctx, db, o)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return oo, nil
+}
+
+// GetByID ...
+func (o *Organization) GetByID(ctx context.Context, db *DB) (*Organization, error) {
+	return organizationRepo.GetByID(ctx, db, o.ID)
+}
+
+// GetBySlug ...
+func (o *Organization) GetBySlug(ctx context.Context, db *DB) (*Organization, error) {
+	return organizationRepo.GetBy(ctx, db, "slug", o.Slug)
+}
+
+// List ...
+func (o *Organization) List(ctx context.Context, db *DB, opts ListOptions) ([]*Organization, error) {
+	return organizationRepo.List(ctx, db, opts)
+}
+
+// Count counts the organizations which List would list, regardless of the page
+func (o *Organization) Count(ctx context.Context, db *DB, opts ListOptions) (int64, error) {
+	return organizationRepo.Count(ctx, db, opts)
+}
+
+// Delete deletes the organization, as long as it still has the version it had
+// when it was read (if it was read at all), returning an *ErrStaleRow otherwise
+func (o *Organization) Delete(ctx context.Context, db *DB) error {
+	if o.Version > 0 {
+		return organizationRepo.DeleteVersion(ctx, db, o.ID, o.Version)
+	}
+	return organizationRepo.Delete(ctx, db, o.ID)
+}
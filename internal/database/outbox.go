@@ -0,0 +1,360 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// User lifecycle event types
+const (
+	EventUserCreated     = "user.created"
+	EventUserUpdated     = "user.updated"
+	EventUserRoleChanged = "user.role_changed"
+	// EventUserEmailChanged and EventUserPasswordChanged follow a user.updated
+	// event, like EventUserRoleChanged does
+	EventUserEmailChanged    = "user.email_changed"
+	EventUserPasswordChanged = "user.password_changed"
+	EventUserDeleted         = "user.deleted"
+	EventUserRestored        = "user.restored"
+	EventUserErased          = "user.erased"
+)
+
+// EventTypes are all the event types, e.g. for webhooks to subscribe to
+var EventTypes = []string{
+	EventUserCreated,
+	EventUserUpdated,
+	EventUserRoleChanged,
+	EventUserEmailChanged,
+	EventUserPasswordChanged,
+	EventUserDeleted,
+	EventUserRestored,
+	EventUserErased,
+}
+
+// OutboxEvent is a domain event which is written in the same transaction as the
+// change it describes, and then dispatched downstream, at least once
+type OutboxEvent struct {
+	ID             int64        `json:"id" repo:"pk"`
+	OrganizationID int64        `json:"organization_id" db:"organization_id"`
+	Type           string       `json:"type"`
+	Target         string       `json:"target"`
+	Payload        EventPayload `json:"payload"`
+	Created        time.Time    `json:"created" repo:"readonly"`
+	// Attempts is the number of times the event has been passed to the sinks
+	Attempts    int            `json:"attempts" repo:"readonly"`
+	NextAttempt time.Time      `json:"next_attempt" db:"next_attempt" repo:"readonly"`
+	LastError   sql.NullString `json:"last_error,omitempty" db:"last_error" repo:"readonly"`
+	Dispatched  sql.NullTime   `json:"dispatched,omitempty" repo:"readonly"`
+}
+
+// EventPayload is the JSON data of an event
+type EventPayload json.RawMessage
+
+// Value ...
+func (p EventPayload) Value() (driver.Value, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	return string(p), nil
+}
+
+// Scan ...
+func (p *EventPayload) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*p = nil
+	case []byte:
+		*p = append(EventPayload{}, v...)
+	case string:
+		*p = EventPayload(v)
+	default:
+		return fmt.Errorf("can not scan %T into an event payload", src)
+	}
+	return nil
+}
+
+// MarshalJSON ...
+func (p EventPayload) MarshalJSON() ([]byte, error) {
+	if len(p) == 0 {
+		return []byte("null"), nil
+	}
+	return p, nil
+}
+
+// UnmarshalJSON ...
+func (p *EventPayload) UnmarshalJSON(data []byte) error {
+	*p = append(EventPayload{}, data...)
+	return nil
+}
+
+// UserEventData is the payload of the user lifecycle events
+type UserEventData struct {
+	ID             int64      `json:"id"`
+	OrganizationID int64      `json:"organization_id"`
+	Username       string     `json:"username"`
+	Email          string     `json:"email"`
+	FirstName      *string    `json:"first_name"`
+	LastName       *string    `json:"last_name"`
+	Role           string     `json:"role"`
+	Created        time.Time  `json:"created"`
+	Updated        time.Time  `json:"updated"`
+	Deleted        *time.Time `json:"deleted"`
+	Version        int64      `json:"version"`
+	// PreviousRole is only set for the user.role_changed events
+	PreviousRole string `json:"previous_role,omitempty"`
+	// PreviousEmail is only set for the user.email_changed events
+	PreviousEmail string `json:"previous_email,omitempty"`
+}
+
+// userEvents returns the events of the given user change: the one of the given
+// type and, if before is given, one for each of the role, email and password
+// which changed, e.g. user.role_changed
+func userEvents(eventType string, before *User, after *User) ([]*OutboxEvent, error) {
+	data := UserEventData{
+		ID:             after.ID,
+		OrganizationID: after.OrganizationID,
+		Username:       after.Username,
+		Email:          after.Email,
+		FirstName:      nullStringPtr(after.FirstName),
+		LastName:       nullStringPtr(after.LastName),
+		Role:           after.Role.String(),
+		Created:        after.Created,
+		Updated:        after.Updated,
+		Deleted:        nullTimePtr(after.Deleted),
+		Version:        after.Version,
+	}
+	event, err := newOutboxEvent(eventType, after, data)
+	if err != nil {
+		return nil, err
+	}
+	events := []*OutboxEvent{event}
+	if before == nil {
+		return events, nil
+	}
+	changes := []struct {
+		changed   bool
+		eventType string
+		data      UserEventData
+	}{
+		{before.Role != after.Role, EventUserRoleChanged, data},
+		{before.Email != after.Email, EventUserEmailChanged, data},
+		{before.Password != after.Password, EventUserPasswordChanged, data},
+	}
+	changes[0].data.PreviousRole = before.Role.String()
+	changes[1].data.PreviousEmail = before.Email
+	for _, change := range changes {
+		if !change.changed {
+			continue
+		}
+		event, err := newOutboxEvent(change.eventType, after, change.data)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func newOutboxEvent(eventType string, u *User, data UserEventData) (*OutboxEvent, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling the payload of event %s of user %d: %w", eventType, u.ID, err)
+	}
+	return &OutboxEvent{
+		OrganizationID: u.OrganizationID,
+		Type:           eventType,
+		Target:         fmt.Sprintf("user:%d", u.ID),
+		Payload:        payload,
+	}, nil
+}
+
+// retryDelay is how long to wait before attempting again to deliver
+// what failed to be delivered after the given number of attempts
+func retryDelay(attempts int) time.Duration {
+	// doubling from a second, up to an hour
+	if attempts >= 12 {
+		return time.Hour
+	}
+	return time.Second << attempts
+}
+
+// outboxChannel is the channel on which the database notifies, with the id of their
+// organization, that events were written to the outbox
+const outboxChannel = "outbox_event"
+
+// outboxLockKey identifies the advisory lock serializing the writes to the outbox,
+// so that the events are committed in the order of their ids, which the streams
+// rely on to resume after an id
+const outboxLockKey = 7236015
+
+var sqlOutboxLock string
+var sqlOutboxInsert string
+var sqlOutboxNotify string
+var sqlOutboxPending string
+var sqlOutboxDispatched string
+var sqlOutboxFailed string
+var sqlOutboxAfter string
+var sqlOutboxLatestID string
+
+func init() {
+	table := dbSchema + ".outbox_event"
+	sqlOutboxLock = `SELECT pg_advisory_xact_lock($1)`
+	sqlOutboxInsert = `INSERT INTO ` + table + ` (organization_id, type, target, payload) VALUES ($1, $2, $3, $4)`
+	// delivered on commit, once per transaction and organization
+	sqlOutboxNotify = `SELECT pg_notify('` + outboxChannel + `', $1)`
+	// events locked by another dispatcher are skipped, so dispatchers can run side by side
+	sqlOutboxPending = `SELECT * FROM ` + table + `
+		WHERE dispatched IS NULL AND next_attempt <= CURRENT_TIMESTAMP
+		ORDER BY id LIMIT :limit FOR UPDATE SKIP LOCKED`
+	sqlOutboxDispatched = `UPDATE ` + table + `
+		SET dispatched=CURRENT_TIMESTAMP, attempts=attempts+1, last_error=NULL WHERE id=$1`
+	sqlOutboxFailed = `UPDATE ` + table + `
+		SET attempts=attempts+1, last_error=$2, next_attempt=CURRENT_TIMESTAMP + make_interval(secs => $3)
+		WHERE id=$1`
+	sqlOutboxAfter = `SELECT * FROM ` + table + ` WHERE id > :after ORDER BY id LIMIT :limit`
+	sqlOutboxLatestID = `SELECT COALESCE(MAX(id), 0) FROM ` + table
+}
+
+// enqueueEvents writes the given events to the outbox; it is meant to be called
+// in the transaction of the change the events describe
+func enqueueEvents(ctx context.Context, db *DB, events []*OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	if _, err := Exec(ctx, db, sqlOutboxLock, outboxLockKey); err != nil {
+		return fmt.Errorf("error locking the outbox: %w", err)
+	}
+	notified := map[int64]bool{}
+	for _, e := range events {
+		if _, err := Exec(ctx, db, sqlOutboxInsert, e.OrganizationID, e.Type, e.Target, e.Payload); err != nil {
+			return fmt.Errorf("error writing event %s of %s to the outbox: %w", e.Type, e.Target, err)
+		}
+		if notified[e.OrganizationID] {
+			continue
+		}
+		if _, err := Exec(ctx, db, sqlOutboxNotify, strconv.FormatInt(e.OrganizationID, 10)); err != nil {
+			return fmt.Errorf("error notifying event %s of %s: %w", e.Type, e.Target, err)
+		}
+		notified[e.OrganizationID] = true
+	}
+	return nil
+}
+
+// ListOutboxEvents lists, oldest first, at most limit of the events written
+// after the one with the given id, in the organization of ctx
+func (db *DB) ListOutboxEvents(ctx context.Context, after int64, limit int) ([]*OutboxEvent, error) {
+	arg := map[string]interface{}{"after": after, "limit": limit}
+	sqlSelect, err := scopeNamedSQL(ctx, sqlOutboxAfter, "organization_id", arg)
+	if err != nil {
+		return nil, fmt.Errorf("error listing outbox events: %w", err)
+	}
+	var events []*OutboxEvent
+	err = SelectMany(ctx, db, sqlSelect, arg, func(rows *sqlx.Rows) error {
+		var e OutboxEvent
+		if err := rows.StructScan(&e); err != nil {
+			return fmt.Errorf("error scanning outbox event row to struct: %w", err)
+		}
+		events = append(events, &e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing the outbox events after %d: %w", after, err)
+	}
+	return events, nil
+}
+
+// LatestOutboxEventID returns the id of the latest event, of any organization,
+// or 0 if there is none
+func (db *DB) LatestOutboxEventID(ctx context.Context) (int64, error) {
+	var id int64
+	if err := SelectOne(ctx, db, sqlOutboxLatestID, &id); err != nil {
+		return 0, fmt.Errorf("error selecting the latest outbox event id: %w", err)
+	}
+	return id, nil
+}
+
+// WatchOutboxEvents listens, on a connection of its own, to the notifications of the
+// events written to the outbox, by any instance of the API, and calls notify with the
+// organization of the events, until ctx is done or the connection fails
+func (db *DB) WatchOutboxEvents(ctx context.Context, notify func(organizationID int64)) error {
+	config, err := pgx.ParseConnectionString(db.url)
+	if err != nil {
+		return fmt.Errorf("error parsing the db url to listen to outbox events: %w", err)
+	}
+	conn, err := pgx.Connect(config)
+	if err != nil {
+		return fmt.Errorf("error connecting to db to listen to outbox events: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.Listen(outboxChannel); err != nil {
+		return fmt.Errorf("error listening to outbox events: %w", err)
+	}
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error waiting for outbox events: %w", err)
+		}
+		organizationID, err := strconv.ParseInt(notification.Payload, 10, 64)
+		if err != nil {
+			log.Warn().Msgf("ignoring outbox notification with invalid organization %q", notification.Payload)
+			continue
+		}
+		notify(organizationID)
+	}
+}
+
+// DispatchOutboxEvents passes the pending events, oldest first and at most limit of them,
+// to deliver, and marks them as dispatched if it succeeds, or schedules them for another
+// attempt otherwise, and returns how many were dispatched. The events stay locked until
+// all of them have been passed, while deliver gets a context without the transaction.
+func (db *DB) DispatchOutboxEvents(
+	ctx context.Context,
+	limit int,
+	deliver func(ctx context.Context, e *OutboxEvent) error,
+) (int, error) {
+	nbDispatched := 0
+	err := db.InTx(ctx, func(txCtx context.Context) error {
+		var events []*OutboxEvent
+		err := SelectMany(txCtx, db, sqlOutboxPending, map[string]interface{}{"limit": limit}, func(rows *sqlx.Rows) error {
+			var e OutboxEvent
+			if err := rows.StructScan(&e); err != nil {
+				return fmt.Errorf("error scanning outbox event row to struct: %w", err)
+			}
+			events = append(events, &e)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error selecting the pending outbox events: %w", err)
+		}
+		for _, e := range events {
+			if errDeliver := deliver(ctx, e); errDeliver != nil {
+				delay := retryDelay(e.Attempts + 1)
+				if _, err := Exec(txCtx, db, sqlOutboxFailed, e.ID, errDeliver.Error(), delay.Seconds()); err != nil {
+					return fmt.Errorf("error scheduling outbox event %d for another attempt: %w", e.ID, err)
+				}
+				continue
+			}
+			if _, err := Exec(txCtx, db, sqlOutboxDispatched, e.ID); err != nil {
+				return fmt.Errorf("error marking outbox event %d as dispatched: %w", e.ID, err)
+			}
+			nbDispatched++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return nbDispatched, nil
+}
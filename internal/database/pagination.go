@@ -0,0 +1,265 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/padurean/purest/internal/query"
+)
+
+// Cursor points between two entities of a list, by the key of the entity which
+// the page starts after, or which the page ends before, in the order of the list
+type Cursor struct {
+	After  int64 `json:"a,omitempty"`
+	Before int64 `json:"b,omitempty"`
+}
+
+// Encode returns the opaque representation of the cursor, to be used in URLs
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor ...
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %s: %v", s, err)
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor %s: %v", s, err)
+	}
+	if c.After < 0 || c.Before < 0 || (c.After > 0 && c.Before > 0) {
+		return nil, fmt.Errorf("invalid cursor %s", s)
+	}
+	return &c, nil
+}
+
+// ErrStaleCursor is returned when listing, sorted by more than the key, from a cursor
+// pointing to an entity which does not exist anymore, so its place in the list is unknown
+var ErrStaleCursor = errors.New("stale cursor: the entity it points to does not exist anymore, start again from the first page")
+
+// Sizes of the pages of the lists
+const (
+	PageSizeDefault = 20
+	PageSizeMax     = 100
+)
+
+// Page is a page of a list, either by its number (starting from 1),
+// or, if the number is 0, by a cursor (with no cursor for the first page)
+type Page struct {
+	Number int
+	Size   int
+	Cursor *Cursor
+
+	// set by the lister, after listing the page
+	listed bool
+	total  int64
+	keys   []int64
+}
+
+// ListOptions returns the options for listing the entities of the page
+func (p *Page) ListOptions() ListOptions {
+	opts := ListOptions{Limit: p.Size}
+	switch {
+	case p.Number > 0:
+		opts.Offset = (p.Number - 1) * p.Size
+	case p.Cursor != nil:
+		opts.After = p.Cursor.After
+		opts.Before = p.Cursor.Before
+	}
+	return opts
+}
+
+// Listed records the total number of entities of the list
+// and the keys of the entities of the page, in the order of the list
+func (p *Page) Listed(total int64, keys []int64) {
+	p.listed = true
+	p.total = total
+	p.keys = keys
+}
+
+// Total returns the total number of entities of the list, if it has been listed
+func (p *Page) Total() (int64, bool) {
+	return p.total, p.listed
+}
+
+// Next returns the next page, if there might be one
+func (p *Page) Next() (*Page, bool) {
+	if !p.listed {
+		return nil, false
+	}
+	n := len(p.keys)
+	if p.Number > 0 {
+		if int64(p.Number*p.Size) >= p.total {
+			return nil, false
+		}
+		return &Page{Number: p.Number + 1, Size: p.Size}, true
+	}
+	// a full page might be followed by more, while a page before a cursor is
+	// followed at least by the entity the cursor points to
+	if n == 0 || (n < p.Size && (p.Cursor == nil || p.Cursor.Before == 0)) {
+		return nil, false
+	}
+	return &Page{Size: p.Size, Cursor: &Cursor{After: p.keys[n-1]}}, true
+}
+
+// Prev returns the previous page, if there might be one
+func (p *Page) Prev() (*Page, bool) {
+	if !p.listed {
+		return nil, false
+	}
+	n := len(p.keys)
+	if p.Number > 0 {
+		if p.Number == 1 {
+			return nil, false
+		}
+		number := p.Number - 1
+		if last := int((p.total + int64(p.Size) - 1) / int64(p.Size)); number > last {
+			number = last
+		}
+		if number < 1 {
+			return nil, false
+		}
+		return &Page{Number: number, Size: p.Size}, true
+	}
+	if p.Cursor == nil || n == 0 || (p.Cursor.Before > 0 && n < p.Size) {
+		return nil, false
+	}
+	return &Page{Size: p.Size, Cursor: &Cursor{Before: p.keys[0]}}, true
+}
+
+// listSQL builds the named query listing the rows of the given table which meet
+// all the given conditions (among which the scope ones, which the row of the cursor
+// of opts has to meet too) and the filters of opts, sorted as opts say, if at all,
+// and then by the given key, and the page of which is given by opts; if the rows
+// come in the reverse order of the list (i.e. when listing the page before
+// a cursor), the returned reversed is true
+func listSQL(
+	table string,
+	scope []string,
+	conditions []string,
+	key string,
+	desc bool,
+	opts ListOptions,
+	arg map[string]interface{},
+) (sqlList string, reversed bool) {
+	conditions = append(append(append([]string{}, scope...), conditions...), opts.Query.Conditions(arg)...)
+	var orders []query.Sort
+	if opts.Query != nil {
+		orders = append(orders, opts.Query.Sorts...)
+	}
+	orders = append(orders, query.Sort{Column: key, Desc: desc})
+
+	offset := " OFFSET :offset"
+	arg["limit"] = opts.Limit
+	arg["offset"] = opts.Offset
+	switch {
+	case opts.After > 0:
+		conditions = append(conditions, keysetCondition(table, key, orders, "after", scope))
+		arg["after"] = opts.After
+		offset = ""
+	case opts.Before > 0:
+		// listing before a key is listing after it in the reverse order
+		for i := range orders {
+			orders[i].Desc = !orders[i].Desc
+		}
+		conditions = append(conditions, keysetCondition(table, key, orders, "before", scope))
+		arg["before"] = opts.Before
+		offset = ""
+		reversed = true
+	}
+	orderBy := make([]string, len(orders))
+	for i, o := range orders {
+		orderBy[i] = o.Column + " ASC"
+		if o.Desc {
+			orderBy[i] = o.Column + " DESC"
+		}
+	}
+	return `SELECT * FROM ` + table + where(conditions) +
+		` ORDER BY ` + strings.Join(orderBy, ", ") + ` LIMIT :limit` + offset, reversed
+}
+
+// checkCursor returns ErrStaleCursor if the entity which the page of opts starts after,
+// or ends before, is needed by keysetCondition, as the list is sorted by more than the
+// key, but does not exist anymore (e.g. it has been purged), or is out of the scope
+// of ctx, in the given tenant column (if any)
+func checkCursor(ctx context.Context, db *DB, table string, key string, tenant string, opts ListOptions) error {
+	cursor := opts.After
+	if opts.Before > 0 {
+		cursor = opts.Before
+	}
+	if cursor == 0 || opts.Query == nil || len(opts.Query.Sorts) == 0 {
+		return nil
+	}
+	sqlSelect, args := `SELECT 1 FROM `+table+` WHERE `+key+`=$1`, []interface{}{cursor}
+	if tenant != "" {
+		var err error
+		if sqlSelect, args, err = scopeSQL(ctx, sqlSelect, tenant, args); err != nil {
+			return fmt.Errorf("error checking the cursor of the %s list: %w", table, err)
+		}
+	}
+	var exists bool
+	if err := SelectOne(ctx, db, `SELECT EXISTS (`+sqlSelect+`)`, &exists, args...); err != nil {
+		return fmt.Errorf("error checking the cursor of the %s list: %w", table, err)
+	}
+	if !exists {
+		return ErrStaleCursor
+	}
+	return nil
+}
+
+// keysetCondition builds the condition met by the rows which come after the row
+// having the key given by the named param, in the given order (which ends with
+// the key, and the columns of which are not nullable); that row is only looked up
+// among the ones meeting the given scope conditions, so that the rows of other
+// tenants are out of reach of the cursors
+func keysetCondition(table string, key string, orders []query.Sort, param string, scope []string) string {
+	valueOf := func(column string) string {
+		if column == key {
+			return ":" + param
+		}
+		return "(SELECT " + column + " FROM " + table + where(append([]string{key + "=:" + param}, scope...)) + ")"
+	}
+	alternatives := make([]string, len(orders))
+	for i, o := range orders {
+		var terms []string
+		for _, prev := range orders[:i] {
+			terms = append(terms, prev.Column+"="+valueOf(prev.Column))
+		}
+		op := ">"
+		if o.Desc {
+			op = "<"
+		}
+		terms = append(terms, o.Column+op+valueOf(o.Column))
+		alternatives[i] = strings.Join(terms, " AND ")
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0]
+	}
+	return "((" + strings.Join(alternatives, ") OR (") + "))"
+}
+
+// countSQL builds the named query counting the rows of the given table
+// which meet all the given conditions
+func countSQL(table string, conditions []string) string {
+	return `SELECT count(*) FROM ` + table + where(conditions)
+}
+
+func where(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+func reverse[T any](s []T) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/padurean/purest/internal/query"
+)
+
+func TestListSQLScopesTheCursor(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ListOptions
+	}{
+		{"after", ListOptions{After: 7, Limit: 10}},
+		{"before", ListOptions{Before: 7, Limit: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Query = &query.Query{Sorts: []query.Sort{{Column: "username"}}}
+			arg := map[string]interface{}{}
+			sqlList, _ := listSQL("purest.user", []string{"organization_id=:tenant"}, []string{"deleted IS NULL"},
+				"id", false, tt.opts, arg)
+			subquery := "(SELECT username FROM purest.user WHERE id=:" + tt.name + " AND organization_id=:tenant)"
+			if !strings.Contains(sqlList, subquery) {
+				t.Errorf("expected the subquery %s, got %s", subquery, sqlList)
+			}
+			if strings.Contains(sqlList, "WHERE id=:"+tt.name+")") {
+				t.Errorf("expected no subquery out of the scope, got %s", sqlList)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+type sessionKey struct{}
+
+// session tracks whether a write was made while serving a request, so that
+// the reads which follow it are served by the primary and see the write
+type session struct {
+	wrote int32
+}
+
+// NewSession returns a context whose reads stick to the primary once
+// a write was made with it (or any context derived from it)
+func NewSession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey{}, &session{})
+}
+
+func markWrite(ctx context.Context) {
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		atomic.StoreInt32(&s.wrote, 1)
+	}
+}
+
+func wrote(ctx context.Context) bool {
+	s, ok := ctx.Value(sessionKey{}).(*session)
+	return ok && atomic.LoadInt32(&s.wrote) == 1
+}
+
+func connectReplicas(ctx context.Context, config Config) ([]*DB, error) {
+	var replicas []*DB
+	for _, url := range config.ReplicaURLs {
+		// replicas are not required for startup, unreachable ones
+		// are marked as down until a health check succeeds
+		db, err := sqlx.Open(config.Driver, url)
+		if err != nil {
+			return nil, err
+		}
+		configurePool(db, config)
+		replica := &DB{
+			DB:         db,
+			stmts:      newStmtCache[*sqlx.Stmt](),
+			namedStmts: newStmtCache[*sqlx.NamedStmt](),
+			health:     &healthState{},
+		}
+		replica.checkHealth(ctx)
+		replicas = append(replicas, replica)
+	}
+	return replicas, nil
+}
+
+// reader returns the handle to read from: the primary if ctx carries a
+// transaction or a write was made in its session, a healthy replica otherwise
+// or the primary again if there is no healthy replica
+func (db *DB) reader(ctx context.Context) *DB {
+	if len(db.replicas) == 0 {
+		return db
+	}
+	if _, inTx := txFrom(ctx); inTx || wrote(ctx) {
+		return db
+	}
+	n := uint32(len(db.replicas))
+	start := atomic.AddUint32(db.nextReplica, 1)
+	for i := uint32(0); i < n; i++ {
+		if replica := db.replicas[(start+i)%n]; replica.healthy() {
+			return replica
+		}
+	}
+	return db
+}
+
+// readWithFallback runs read on the reader for ctx and, if it is a replica
+// which fails with a connection error, marks it as down and reruns read on the primary
+func (db *DB) readWithFallback(ctx context.Context, read func(r *DB) error) error {
+	r := db.reader(ctx)
+	err := read(r)
+	if err == nil || r == db || !isConnError(err) || ctx.Err() != nil {
+		return err
+	}
+	log.Warn().Err(err).Msg("error reading from db replica, falling back to primary")
+	r.setHealth(err)
+	return read(db)
+}
+
+func isConnError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr)
+}
@@ -0,0 +1,427 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/padurean/purest/internal/query"
+)
+
+// Repository provides the CRUD operations of an entity, with the SQL statements
+// being built from the struct tags of the entity type T.
+//
+// Column names are taken from the `db` tag (or the lowercased field name, as sqlx
+// does), while the `repo` tag marks the columns that have a special role:
+//
+//	pk       - the int64 primary key (required)
+//	readonly - set by the database only, e.g. a creation timestamp
+//	updated  - set to the current timestamp on every update
+//	deleted  - soft-delete timestamp; without it Delete removes the row
+//	version  - incremented on every change, which is only made if the version
+//	           of the entity is still the one it had when it was read
+//	tenant   - the int64 id of the organization owning the entity, set on creation
+//	           and never changed; all the operations are scoped to the organization
+//	           carried by the context (see WithTenant and WithAllTenants)
+//
+// Soft-deleted entities are left out by all the operations, except for the
+// ones which explicitly include them.
+type Repository[T any] struct {
+	table                  string
+	pk                     string
+	deleted                string
+	version                string
+	tenant                 string
+	tenantField            int
+	columns                map[string]bool
+	sqlInsert              string
+	sqlUpdate              string
+	sqlSelectBy            string
+	sqlSelectByWithDeleted string
+	sqlDelete              string
+	sqlDeleteVersion       string
+	sqlRestore             string
+}
+
+type column struct {
+	name  string
+	role  string
+	field int
+}
+
+// ListOptions ...
+type ListOptions struct {
+	Limit  int
+	Offset int
+	// After and Before are the keys of the entities the listed ones come after,
+	// or before, in the order of the list; when any is set, Offset is ignored
+	After          int64
+	Before         int64
+	IncludeDeleted bool
+	// Query filters and sorts the list; sorting is only allowed by non-nullable columns
+	Query *query.Query
+}
+
+// NewRepository builds the repository of T for the given (schema qualified) table;
+// it panics if T is not a struct or if it has no `repo:"pk"` field
+func NewRepository[T any](table string) *Repository[T] {
+	var zero T
+	t := reflect.TypeOf(zero)
+	if t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("repository entity must be a struct, got %s", t))
+	}
+
+	repo := &Repository[T]{table: table, columns: map[string]bool{}}
+	var writable, insertable []string
+	var updated string
+	for _, c := range columnsOf(t) {
+		repo.columns[c.name] = true
+		switch c.role {
+		case "pk":
+			repo.pk = c.name
+		case "readonly":
+		case "updated":
+			updated = c.name
+		case "deleted":
+			repo.deleted = c.name
+		case "version":
+			repo.version = c.name
+		case "tenant":
+			repo.tenant = c.name
+			repo.tenantField = c.field
+			insertable = append(insertable, c.name)
+		case "":
+			writable = append(writable, c.name)
+			insertable = append(insertable, c.name)
+		default:
+			panic(fmt.Sprintf("unknown repo tag '%s' for column %s of %s", c.role, c.name, t))
+		}
+	}
+	if repo.pk == "" {
+		panic(fmt.Sprintf("%s has no primary key field (i.e. tagged with `repo:\"pk\"`)", t))
+	}
+
+	params := make([]string, len(insertable))
+	for i, name := range insertable {
+		params[i] = ":" + name
+	}
+	assignments := make([]string, len(writable))
+	for i, name := range writable {
+		assignments[i] = name + "=:" + name
+	}
+	setUpdated := ""
+	if updated != "" {
+		setUpdated += ", " + updated + "=CURRENT_TIMESTAMP"
+	}
+	andVersion := ""
+	if repo.version != "" {
+		setUpdated += ", " + repo.version + "=" + repo.version + "+1"
+		andVersion = " AND " + repo.version + "=:" + repo.version
+	}
+	andNotDeleted := ""
+	if repo.deleted != "" {
+		andNotDeleted = " AND " + repo.deleted + " IS NULL"
+	}
+	andTenant := ""
+	if repo.tenant != "" {
+		andTenant = " AND " + repo.tenant + "=:" + repo.tenant
+	}
+
+	repo.sqlInsert = `INSERT INTO ` + table + ` (` + strings.Join(insertable, ", ") + `)
+		VALUES (` + strings.Join(params, ", ") + `) RETURNING ` + repo.pk
+	repo.sqlUpdate = `UPDATE ` + table + `
+		SET ` + strings.Join(assignments, ", ") + setUpdated + `
+		WHERE ` + repo.pk + `=:` + repo.pk + andTenant + andNotDeleted + andVersion + ` RETURNING ` + repo.pk
+	repo.sqlSelectBy = `SELECT * FROM ` + table + ` WHERE %s=$1` + andNotDeleted
+	repo.sqlSelectByWithDeleted = `SELECT * FROM ` + table + ` WHERE %s=$1`
+	if repo.deleted != "" {
+		repo.sqlDelete = `UPDATE ` + table + ` SET ` + repo.deleted + `=CURRENT_TIMESTAMP` + setUpdated + `
+		WHERE ` + repo.pk + `=$1` + andNotDeleted + ` RETURNING ` + repo.pk
+		repo.sqlRestore = `UPDATE ` + table + ` SET ` + repo.deleted + `=NULL` + setUpdated + `
+		WHERE ` + repo.pk + `=:` + repo.pk + ` AND ` + repo.deleted + ` IS NOT NULL RETURNING ` + repo.pk
+	} else {
+		repo.sqlDelete = `DELETE FROM ` + table + ` WHERE ` + repo.pk + `=$1 RETURNING ` + repo.pk
+	}
+	if repo.version != "" {
+		repo.sqlDeleteVersion = strings.Replace(
+			repo.sqlDelete, ` RETURNING `, ` AND `+repo.version+`=$2 RETURNING `, 1)
+	}
+
+	return repo
+}
+
+func columnsOf(t reflect.Type) []column {
+	var columns []column
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		name := f.Tag.Get("db")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		columns = append(columns, column{name: name, role: f.Tag.Get("repo"), field: i})
+	}
+	return columns
+}
+
+// Create ...
+func (repo *Repository[T]) Create(ctx context.Context, db *DB, entity *T) (*T, error) {
+	entity, err := repo.ofTenant(ctx, entity)
+	if err != nil {
+		return nil, err
+	}
+	var created T
+	if err := Upsert(ctx, db, repo.sqlInsert, repo.selectByWithDeleted(repo.pk), entity, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// Update updates the entity; if T has a version, it returns an *ErrStaleRow
+// if the entity has been changed since its version was read, or sql.ErrNoRows
+// if it does not exist anymore
+func (repo *Repository[T]) Update(ctx context.Context, db *DB, entity *T) (*T, error) {
+	entity, err := repo.ofTenant(ctx, entity)
+	if err != nil {
+		return nil, err
+	}
+	var updated T
+	if err := Upsert(ctx, db, repo.sqlUpdate, repo.selectByWithDeleted(repo.pk), entity, &updated); err != nil {
+		if repo.version != "" && errors.Is(err, sql.ErrNoRows) {
+			return nil, repo.staleOrMissing(ctx, db, repo.idOf(entity), err)
+		}
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// GetByID ...
+func (repo *Repository[T]) GetByID(ctx context.Context, db *DB, id int64) (*T, error) {
+	return repo.GetBy(ctx, db, repo.pk, id)
+}
+
+// GetByIDWithDeleted is like GetByID, but it also gets the entity if it is deleted
+func (repo *Repository[T]) GetByIDWithDeleted(ctx context.Context, db *DB, id int64) (*T, error) {
+	return repo.getBy(ctx, db, repo.selectByWithDeleted, repo.pk, id)
+}
+
+// GetBy gets the entity having the given value in the given column
+func (repo *Repository[T]) GetBy(ctx context.Context, db *DB, column string, value interface{}) (*T, error) {
+	return repo.getBy(ctx, db, repo.selectBy, column, value)
+}
+
+func (repo *Repository[T]) getBy(
+	ctx context.Context,
+	db *DB,
+	sqlSelectBy func(column string) string,
+	column string,
+	value interface{},
+) (*T, error) {
+	if !repo.columns[column] {
+		return nil, fmt.Errorf("unknown column %s of table %s", column, repo.table)
+	}
+	sqlSelect, args, err := repo.scope(ctx, sqlSelectBy(column), value)
+	if err != nil {
+		return nil, err
+	}
+	var entity T
+	if err := SelectOne(ctx, db, sqlSelect, &entity, args...); err != nil {
+		return nil, err
+	}
+	return &entity, nil
+}
+
+// List lists the entities in the order of their primary key, or as sorted by
+// opts; it returns ErrStaleCursor if the page is after, or before, an entity
+// which does not exist anymore, while the list is sorted by other columns
+func (repo *Repository[T]) List(ctx context.Context, db *DB, opts ListOptions) ([]*T, error) {
+	arg := map[string]interface{}{}
+	scope, err := repo.listScope(ctx, arg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCursor(ctx, db, repo.table, repo.pk, repo.tenant, opts); err != nil {
+		return nil, err
+	}
+	sqlList, reversed := listSQL(repo.table, scope, repo.listConditions(opts), repo.pk, false, opts, arg)
+	entities, err := repo.list(ctx, db, sqlList, arg)
+	if err != nil {
+		return nil, err
+	}
+	if reversed {
+		reverse(entities)
+	}
+	return entities, nil
+}
+
+// Count counts the entities which List would list, regardless of the page
+func (repo *Repository[T]) Count(ctx context.Context, db *DB, opts ListOptions) (int64, error) {
+	arg := map[string]interface{}{}
+	scope, err := repo.listScope(ctx, arg)
+	if err != nil {
+		return 0, err
+	}
+	conditions := append(append(scope, repo.listConditions(opts)...), opts.Query.Conditions(arg)...)
+	count, err := Count(ctx, db, countSQL(repo.table, conditions), arg)
+	if err != nil {
+		return 0, fmt.Errorf("error counting %s rows: %w", repo.table, err)
+	}
+	return count, nil
+}
+
+// listScope returns the conditions of the tenant of ctx, if the entities belong to tenants
+func (repo *Repository[T]) listScope(ctx context.Context, arg map[string]interface{}) ([]string, error) {
+	if repo.tenant == "" {
+		return nil, nil
+	}
+	return scopeConditions(ctx, nil, repo.tenant, arg)
+}
+
+func (repo *Repository[T]) listConditions(opts ListOptions) []string {
+	if repo.deleted != "" && !opts.IncludeDeleted {
+		return []string{repo.deleted + " IS NULL"}
+	}
+	return nil
+}
+
+// ListBy lists all the entities having the given value in the given column
+func (repo *Repository[T]) ListBy(ctx context.Context, db *DB, column string, value interface{}) ([]*T, error) {
+	if !repo.columns[column] {
+		return nil, fmt.Errorf("unknown column %s of table %s", column, repo.table)
+	}
+	arg := map[string]interface{}{"value": value}
+	scope, err := repo.listScope(ctx, arg)
+	if err != nil {
+		return nil, err
+	}
+	conditions := append(append([]string{column + "=:value"}, repo.listConditions(ListOptions{})...), scope...)
+	sqlListBy := `SELECT * FROM ` + repo.table + where(conditions) + ` ORDER BY ` + repo.pk
+	return repo.list(ctx, db, sqlListBy, arg)
+}
+
+func (repo *Repository[T]) list(ctx context.Context, db *DB, sqlList string, arg interface{}) ([]*T, error) {
+	entities := []*T{}
+	err := SelectMany(ctx, db, sqlList, arg, func(rows *sqlx.Rows) error {
+		var entity T
+		if err := rows.StructScan(&entity); err != nil {
+			return fmt.Errorf("error scanning %s row to struct: %w", repo.table, err)
+		}
+		entities = append(entities, &entity)
+		return nil
+	})
+	return entities, err
+}
+
+// Delete marks the entity as deleted if it has a `repo:"deleted"` column
+// or removes it otherwise
+func (repo *Repository[T]) Delete(ctx context.Context, db *DB, id int64) error {
+	sqlDelete, args, err := repo.scope(ctx, repo.sqlDelete, id)
+	if err != nil {
+		return err
+	}
+	return MarkAsDeleted(ctx, db, sqlDelete, id, args[1:]...)
+}
+
+// DeleteVersion is like Delete, but it returns an *ErrStaleRow if the entity has been
+// changed since the given version was read, or sql.ErrNoRows if it does not exist anymore
+func (repo *Repository[T]) DeleteVersion(ctx context.Context, db *DB, id int64, version int64) error {
+	if repo.version == "" {
+		return fmt.Errorf("%s entities are not versioned", repo.table)
+	}
+	sqlDelete, args, err := repo.scope(ctx, repo.sqlDeleteVersion, id, version)
+	if err != nil {
+		return err
+	}
+	nbDeleted, err := Exec(ctx, db, sqlDelete, args...)
+	if err != nil {
+		return fmt.Errorf("error deleting %s %d: %w", repo.table, id, err)
+	}
+	if nbDeleted == 0 {
+		return repo.staleOrMissing(ctx, db, id, fmt.Errorf("error deleting %s %d: %w", repo.table, id, sql.ErrNoRows))
+	}
+	return nil
+}
+
+// staleOrMissing tells why a versioned write of the entity with the given id matched
+// no row: it returns an *ErrStaleRow if the entity still exists, so it has another
+// version, or errNoRows otherwise, e.g. if it has been deleted since it was read
+func (repo *Repository[T]) staleOrMissing(ctx context.Context, db *DB, id int64, errNoRows error) error {
+	if _, err := repo.GetByID(ctx, db, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNoRows
+		}
+		return fmt.Errorf("error checking whether %s %d still exists: %w", repo.table, id, err)
+	}
+	return &ErrStaleRow{Table: repo.table, ID: id}
+}
+
+// Restore unmarks the given soft-deleted entity as deleted
+func (repo *Repository[T]) Restore(ctx context.Context, db *DB, id int64) (*T, error) {
+	if repo.deleted == "" {
+		return nil, fmt.Errorf("%s entities can not be restored as they are not soft-deleted", repo.table)
+	}
+	arg := map[string]interface{}{repo.pk: id}
+	sqlRestore := repo.sqlRestore
+	if repo.tenant != "" {
+		var err error
+		if sqlRestore, err = scopeNamedSQL(ctx, sqlRestore, repo.tenant, arg); err != nil {
+			return nil, err
+		}
+	}
+	var restored T
+	if err := Upsert(ctx, db, sqlRestore, repo.selectByWithDeleted(repo.pk), arg, &restored); err != nil {
+		return nil, err
+	}
+	return &restored, nil
+}
+
+// scope restricts the given positional SQL to the organization of ctx, if T is tenant-owned
+func (repo *Repository[T]) scope(ctx context.Context, sqlScoped string, args ...interface{}) (string, []interface{}, error) {
+	if repo.tenant == "" {
+		return sqlScoped, args, nil
+	}
+	return scopeSQL(ctx, sqlScoped, repo.tenant, args)
+}
+
+// ofTenant returns a copy of the entity, owned by the organization of ctx,
+// if T is tenant-owned and ctx is scoped to an organization
+func (repo *Repository[T]) ofTenant(ctx context.Context, entity *T) (*T, error) {
+	if repo.tenant == "" {
+		return entity, nil
+	}
+	organizationID, scoped, err := tenantFrom(ctx)
+	if err != nil || !scoped {
+		return entity, err
+	}
+	owned := *entity
+	reflect.ValueOf(&owned).Elem().Field(repo.tenantField).SetInt(organizationID)
+	return &owned, nil
+}
+
+func (repo *Repository[T]) idOf(entity *T) int64 {
+	v := reflect.ValueOf(entity).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("repo") == "pk" {
+			return v.Field(i).Int()
+		}
+	}
+	return 0
+}
+
+func (repo *Repository[T]) selectBy(column string) string {
+	return fmt.Sprintf(repo.sqlSelectBy, column)
+}
+
+func (repo *Repository[T]) selectByWithDeleted(column string) string {
+	return fmt.Sprintf(repo.sqlSelectByWithDeleted, column)
+}
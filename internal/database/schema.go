@@ -1,7 +1,9 @@
 package database
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/padurean/purest/internal/auth"
 	"github.com/padurean/purest/internal/env"
@@ -17,6 +19,19 @@ func init() {
 
 	schemaSQL = `
 		CREATE SCHEMA IF NOT EXISTS ` + dbSchema + ` AUTHORIZATION ` + dbUser + `;
+		CREATE TABLE IF NOT EXISTS ` + dbSchema + `.organization (
+			id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			name character varying(255) NOT NULL,
+			slug character varying(64) NOT NULL,
+			created timestamp with time zone NOT NULL DEFAULT now(),
+			updated timestamp with time zone NOT NULL DEFAULT now(),
+			deleted timestamp with time zone,
+			version bigint NOT NULL DEFAULT 1
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS organization_slug_active_unique_idx ON ` + dbSchema + `.organization (slug) WHERE deleted IS NULL;
+		INSERT INTO ` + dbSchema + `.organization (name, slug)
+			SELECT 'Default', '` + DefaultOrganizationSlug + `'
+			WHERE NOT EXISTS (SELECT 1 FROM ` + dbSchema + `.organization);
 		CREATE TABLE IF NOT EXISTS ` + dbSchema + `.user (
 			id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
 			username character varying(255) NOT NULL,
@@ -24,66 +39,157 @@ func init() {
 			email character varying(255) NOT NULL,
 			first_name character varying(255),
 			last_name character varying(255),
-			role smallint,
+			role smallint NOT NULL,
 			created timestamp with time zone NOT NULL DEFAULT now(),
 			updated timestamp with time zone NOT NULL DEFAULT now(),
 			deleted timestamp with time zone
 		);
-		CREATE UNIQUE INDEX IF NOT EXISTS user_username_unique_idx ON ` + dbSchema + `.user (username);
-		CREATE UNIQUE INDEX IF NOT EXISTS user_email_unique_idx ON ` + dbSchema + `.user (email);
+		ALTER TABLE IF EXISTS ONLY ` + dbSchema + `.user
+			ADD COLUMN IF NOT EXISTS anonymized timestamp with time zone,
+			ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1,
+			ADD COLUMN IF NOT EXISTS organization_id bigint REFERENCES ` + dbSchema + `.organization (id);
+		-- the users created before organizations belong to the default one
+		UPDATE ` + dbSchema + `.user SET organization_id=(
+			SELECT id FROM ` + dbSchema + `.organization WHERE slug='` + DefaultOrganizationSlug + `' ORDER BY id LIMIT 1
+		) WHERE organization_id IS NULL;
+		ALTER TABLE ` + dbSchema + `.user ALTER COLUMN organization_id SET NOT NULL;
+		-- the users can be sorted by role, which the keyset pagination requires to be set;
+		-- those without a role, who could not be read, get the least privileged one
+		UPDATE ` + dbSchema + `.user SET role=` + strconv.Itoa(int(auth.RoleAuditor)) + ` WHERE role IS NULL;
+		ALTER TABLE ` + dbSchema + `.user ALTER COLUMN role SET NOT NULL;
+		-- usernames and emails are unique per organization,
+		-- and are released when users are deleted
+		DROP INDEX IF EXISTS ` + dbSchema + `.user_username_unique_idx;
+		DROP INDEX IF EXISTS ` + dbSchema + `.user_email_unique_idx;
+		DROP INDEX IF EXISTS ` + dbSchema + `.user_username_active_unique_idx;
+		DROP INDEX IF EXISTS ` + dbSchema + `.user_email_active_unique_idx;
+		CREATE UNIQUE INDEX IF NOT EXISTS user_organization_username_active_unique_idx ON ` + dbSchema + `.user (organization_id, username) WHERE deleted IS NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS user_organization_email_active_unique_idx ON ` + dbSchema + `.user (organization_id, email) WHERE deleted IS NULL;
 		CREATE INDEX IF NOT EXISTS user_created_idx ON ` + dbSchema + `.user (created);
 		CREATE INDEX IF NOT EXISTS user_updated_idx ON ` + dbSchema + `.user (updated);
 		CREATE INDEX IF NOT EXISTS user_deleted_idx ON ` + dbSchema + `.user (deleted);
+		CREATE INDEX IF NOT EXISTS user_role_idx ON ` + dbSchema + `.user (role);
+		-- for the case-insensitive prefix filters
+		CREATE INDEX IF NOT EXISTS user_username_prefix_idx ON ` + dbSchema + `.user (lower(username) varchar_pattern_ops);
+		CREATE INDEX IF NOT EXISTS user_email_prefix_idx ON ` + dbSchema + `.user (lower(email) varchar_pattern_ops);
+		CREATE INDEX IF NOT EXISTS user_first_name_prefix_idx ON ` + dbSchema + `.user (lower(first_name) varchar_pattern_ops);
+		CREATE INDEX IF NOT EXISTS user_last_name_prefix_idx ON ` + dbSchema + `.user (lower(last_name) varchar_pattern_ops);
+		-- for the user search
+		CREATE EXTENSION IF NOT EXISTS pg_trgm;
+		CREATE INDEX IF NOT EXISTS user_username_trgm_idx ON ` + dbSchema + `.user USING gin (lower(username) gin_trgm_ops);
+		CREATE INDEX IF NOT EXISTS user_email_trgm_idx ON ` + dbSchema + `.user USING gin (lower(email) gin_trgm_ops);
+		CREATE INDEX IF NOT EXISTS user_first_name_trgm_idx ON ` + dbSchema + `.user USING gin (lower(first_name) gin_trgm_ops);
+		CREATE INDEX IF NOT EXISTS user_last_name_trgm_idx ON ` + dbSchema + `.user USING gin (lower(last_name) gin_trgm_ops);
+		CREATE TABLE IF NOT EXISTS ` + dbSchema + `.user_erasure (
+			id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			user_id bigint NOT NULL,
+			requested_by bigint NOT NULL,
+			created timestamp with time zone NOT NULL DEFAULT now()
+		);
+		ALTER TABLE IF EXISTS ONLY ` + dbSchema + `.user_erasure
+			ADD COLUMN IF NOT EXISTS organization_id bigint;
+		UPDATE ` + dbSchema + `.user_erasure e SET organization_id=u.organization_id
+			FROM ` + dbSchema + `.user u WHERE u.id=e.user_id AND e.organization_id IS NULL;
+		ALTER TABLE ` + dbSchema + `.user_erasure ALTER COLUMN organization_id SET NOT NULL;
+		CREATE INDEX IF NOT EXISTS user_erasure_user_id_idx ON ` + dbSchema + `.user_erasure (user_id);
+		CREATE TABLE IF NOT EXISTS ` + dbSchema + `.audit_event (
+			id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			actor_id bigint,
+			actor_role character varying(32),
+			action character varying(64) NOT NULL,
+			target character varying(255) NOT NULL,
+			outcome character varying(16) NOT NULL,
+			diff jsonb,
+			ip character varying(64) NOT NULL,
+			user_agent text NOT NULL,
+			request_id character varying(64) NOT NULL,
+			created timestamp with time zone NOT NULL,
+			prev_hash character varying(64) NOT NULL,
+			hash character varying(64) NOT NULL
+		);
+		ALTER TABLE IF EXISTS ONLY ` + dbSchema + `.audit_event
+			ADD COLUMN IF NOT EXISTS organization_id bigint,
+			ADD COLUMN IF NOT EXISTS diff_hash character varying(64) NOT NULL DEFAULT '';
+		CREATE INDEX IF NOT EXISTS audit_event_organization_id_idx ON ` + dbSchema + `.audit_event (organization_id);
+		CREATE INDEX IF NOT EXISTS audit_event_actor_id_idx ON ` + dbSchema + `.audit_event (actor_id);
+		CREATE INDEX IF NOT EXISTS audit_event_action_idx ON ` + dbSchema + `.audit_event (action);
+		CREATE INDEX IF NOT EXISTS audit_event_target_idx ON ` + dbSchema + `.audit_event (target);
+		CREATE INDEX IF NOT EXISTS audit_event_created_idx ON ` + dbSchema + `.audit_event (created);
+		CREATE TABLE IF NOT EXISTS ` + dbSchema + `.outbox_event (
+			id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			organization_id bigint NOT NULL,
+			type character varying(64) NOT NULL,
+			target character varying(255) NOT NULL,
+			payload jsonb NOT NULL,
+			created timestamp with time zone NOT NULL DEFAULT now(),
+			attempts integer NOT NULL DEFAULT 0,
+			next_attempt timestamp with time zone NOT NULL DEFAULT now(),
+			last_error text,
+			dispatched timestamp with time zone
+		);
+		-- for the dispatcher, which only looks for the pending events
+		CREATE INDEX IF NOT EXISTS outbox_event_pending_idx ON ` + dbSchema + `.outbox_event (id) WHERE dispatched IS NULL;
+		CREATE TABLE IF NOT EXISTS ` + dbSchema + `.webhook (
+			id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			organization_id bigint NOT NULL REFERENCES ` + dbSchema + `.organization (id),
+			url character varying(2048) NOT NULL,
+			events text NOT NULL,
+			secret character varying(255) NOT NULL,
+			created timestamp with time zone NOT NULL DEFAULT now(),
+			updated timestamp with time zone NOT NULL DEFAULT now(),
+			deleted timestamp with time zone,
+			version bigint NOT NULL DEFAULT 1
+		);
+		CREATE INDEX IF NOT EXISTS webhook_organization_id_idx ON ` + dbSchema + `.webhook (organization_id);
+		CREATE TABLE IF NOT EXISTS ` + dbSchema + `.webhook_delivery (
+			id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			organization_id bigint NOT NULL,
+			webhook_id bigint NOT NULL REFERENCES ` + dbSchema + `.webhook (id),
+			event_id bigint NOT NULL,
+			event_type character varying(64) NOT NULL,
+			payload jsonb NOT NULL,
+			status character varying(16) NOT NULL DEFAULT 'pending',
+			attempts integer NOT NULL DEFAULT 0,
+			next_attempt timestamp with time zone NOT NULL DEFAULT now(),
+			last_error text,
+			response_status integer,
+			created timestamp with time zone NOT NULL DEFAULT now(),
+			updated timestamp with time zone NOT NULL DEFAULT now(),
+			delivered timestamp with time zone
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS webhook_delivery_webhook_event_unique_idx ON ` + dbSchema + `.webhook_delivery (webhook_id, event_id);
+		CREATE INDEX IF NOT EXISTS webhook_delivery_pending_idx ON ` + dbSchema + `.webhook_delivery (id) WHERE status='pending';
 	`
 }
 
-// !!! >>>>>>>>>
-// TODO OGG: just some examples, remove them when not needed anymore:
-// CREATE TABLE IF NOT EXISTS person (
-// 	first_name text,
-// 	last_name text,
-// 	email text
-// );
-
-// ALTER TABLE IF EXISTS ONLY person
-// ADD COLUMN IF NOT EXISTS phone_number VARCHAR(255);
-
-// CREATE TABLE IF NOT EXISTS place (
-// 	country text,
-// 	city text NULL,
-// 	telcode integer
-
-// // Person ...
-// type Person struct {
-// 	FirstName   string `db:"first_name"`
-// 	LastName    string `db:"last_name"`
-// 	Email       string
-// 	PhoneNumber sql.NullString `db:"phone_number"`
-// }
-
-// // Place ...
-// type Place struct {
-// 	Country string
-// 	City    sql.NullString
-// 	TelCode int
-// }
-// !!! <<<<<<<<<
+// Table returns the given table qualified by the schema of the database (e.g. for
+// NewRepository), which is only known once it has been loaded from env in init
+func Table(name string) string {
+	return dbSchema + "." + name
+}
 
 // Migrate ...
-func Migrate(db *DB) {
+func Migrate(ctx context.Context, db *DB) {
 	// exec the schema or fail; multi-statement Exec behavior varies between
 	// database drivers;  pq will exec them all, sqlite3 won't, ymmv
-	db.MustExec(schemaSQL)
+	db.MustExecContext(ctx, schemaSQL)
 }
 
-// CreateDefaultUser ...
-func CreateDefaultUser(db *DB) {
+// CreateDefaultUser creates, if there is no user in any organization,
+// a super-admin in the default organization
+func CreateDefaultUser(ctx context.Context, db *DB) {
+	ctx = WithAllTenants(ctx)
+	o, err := (&Organization{Slug: DefaultOrganizationSlug}).GetBySlug(ctx, db)
+	if err != nil {
+		panic(fmt.Sprintf("error getting the %s organization: %v", DefaultOrganizationSlug, err))
+	}
 	u := User{
-		Username: auth.DefaultAdminUser,
-		Password: auth.DefaultAdminPassword,
-		Role:     auth.RoleAdmin,
+		Username:       auth.DefaultAdminUser,
+		Password:       auth.DefaultAdminPassword,
+		Role:           auth.RoleSuperAdmin,
+		OrganizationID: o.ID,
 	}
-	users, err := u.List(db, 1, 0)
+	users, err := u.List(ctx, db, ListOptions{Limit: 1})
 	if err != nil {
 		panic(fmt.Sprintf(
 			"error listing users to find out if default user needs to be created: %v", err))
@@ -94,7 +200,7 @@ func CreateDefaultUser(db *DB) {
 			panic(err.Error())
 		}
 		u.Password = hashedPassword
-		_, err = u.Create(db)
+		_, err = u.Create(ctx, db)
 		if err != nil {
 			panic(err.Error())
 		}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/padurean/purest/internal/query"
+)
+
+// UserSearchMinLength is the minimum length of the searched text,
+// below which trigrams can not match it
+const UserSearchMinLength = 3
+
+// UserSearchFields are the columns searched by SearchUsers
+var UserSearchFields = []string{"username", "email", "first_name", "last_name"}
+
+// UserSearchResult ...
+type UserSearchResult struct {
+	User
+	Rank float64 `db:"rank"`
+}
+
+var userSQLSearchMatches string
+var userSQLSearchRank string
+
+func init() {
+	// a field matches if it contains the text, or a word similar to it;
+	// both are backed by the trigram indexes created by the schema
+	var matches, ranks []string
+	for _, field := range UserSearchFields {
+		matches = append(matches,
+			`lower(`+field+`) LIKE :pattern`,
+			`:text <% lower(`+field+`)`)
+		ranks = append(ranks, `word_similarity(:text, lower(`+field+`))`)
+	}
+	userSQLSearchMatches = `(` + strings.Join(matches, ` OR `) + `)`
+	userSQLSearchRank = `greatest(` + strings.Join(ranks, `, `) + `)`
+}
+
+// userSearch returns the FROM and WHERE clauses of the search, scoped to the
+// organization of ctx, and their named params
+func userSearch(ctx context.Context, text string) (string, map[string]interface{}, error) {
+	text = strings.ToLower(text)
+	arg := map[string]interface{}{
+		"text":    text,
+		"pattern": "%" + query.EscapeLike(text) + "%",
+	}
+	conditions, err := scopeConditions(
+		ctx, []string{`deleted IS NULL`, userSQLSearchMatches}, "organization_id", arg)
+	if err != nil {
+		return "", nil, err
+	}
+	return ` FROM ` + dbSchema + `.user` + where(conditions), arg, nil
+}
+
+// SearchUsers finds the (not deleted) users whose username, email, first or last name
+// contains the given text or a word similar to it, the most similar first
+func SearchUsers(ctx context.Context, db *DB, text string, opts ListOptions) ([]*UserSearchResult, error) {
+	from, arg, err := userSearch(ctx, text)
+	if err != nil {
+		return nil, fmt.Errorf("error searching users for '%s': %w", text, err)
+	}
+	arg["limit"] = opts.Limit
+	arg["offset"] = opts.Offset
+	sqlSearch := `SELECT *, ` + userSQLSearchRank + ` AS rank` + from + `
+		ORDER BY rank DESC, id LIMIT :limit OFFSET :offset`
+	results := []*UserSearchResult{}
+	err = SelectMany(ctx, db, sqlSearch, arg, func(rows *sqlx.Rows) error {
+		var result UserSearchResult
+		if err := rows.StructScan(&result); err != nil {
+			return fmt.Errorf("error scanning user search result row to struct: %w", err)
+		}
+		results = append(results, &result)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error searching users for '%s': %w", text, err)
+	}
+	return results, nil
+}
+
+// CountUserSearch counts the users which SearchUsers finds, regardless of the page
+func CountUserSearch(ctx context.Context, db *DB, text string) (int64, error) {
+	from, arg, err := userSearch(ctx, text)
+	if err != nil {
+		return 0, fmt.Errorf("error counting the users found for '%s': %w", text, err)
+	}
+	count, err := Count(ctx, db, `SELECT count(*)`+from, arg)
+	if err != nil {
+		return 0, fmt.Errorf("error counting the users found for '%s': %w", text, err)
+	}
+	return count, nil
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// maximum number of statements of each kind kept prepared per DB handle;
+// statements for queries beyond it are prepared and closed for each use
+const maxCachedStmts = 512
+
+type stmt interface {
+	Close() error
+}
+
+// stmtCache keeps the statements prepared on the connection pool by SQL text;
+// database/sql transparently re-prepares them on other pool connections
+type stmtCache[S stmt] struct {
+	mu    sync.Mutex
+	stmts map[string]S
+}
+
+func newStmtCache[S stmt]() *stmtCache[S] {
+	return &stmtCache[S]{stmts: map[string]S{}}
+}
+
+// get returns the cached statement for query, preparing it if needed;
+// cached is false if the cache is full and the statement must be closed after use
+func (c *stmtCache[S]) get(
+	ctx context.Context,
+	query string,
+	prepare func(ctx context.Context, query string) (S, error),
+) (s S, cached bool, err error) {
+	c.mu.Lock()
+	s, ok := c.stmts[query]
+	c.mu.Unlock()
+	if ok {
+		return s, true, nil
+	}
+
+	s, err = prepare(ctx, query)
+	if err != nil {
+		return s, false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if concurrentlyCached, ok := c.stmts[query]; ok {
+		_ = s.Close()
+		return concurrentlyCached, true, nil
+	}
+	if len(c.stmts) >= maxCachedStmts {
+		return s, false, nil
+	}
+	c.stmts[query] = s
+	return s, true, nil
+}
+
+func (c *stmtCache[S]) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var firstErr error
+	for query, s := range c.stmts {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error closing prepared statement %s: %w", query, err)
+		}
+		delete(c.stmts, query)
+	}
+	return firstErr
+}
+
+// preparex returns a prepared statement for query, bound to the transaction
+// carried by ctx if any; release must be called when done with the statement
+func (db *DB) preparex(ctx context.Context, query string) (s *sqlx.Stmt, release func(), err error) {
+	tx, inTx := txFrom(ctx)
+	if db.stmts == nil {
+		if inTx {
+			s, err = tx.PreparexContext(ctx, query)
+		} else {
+			s, err = db.DB.PreparexContext(ctx, query)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, func() { _ = s.Close() }, nil
+	}
+
+	s, cached, err := db.stmts.get(ctx, query, db.DB.PreparexContext)
+	if err != nil {
+		return nil, nil, err
+	}
+	release = func() {}
+	if !cached {
+		release = func() { _ = s.Close() }
+	}
+	if inTx {
+		txStmt := tx.StmtxContext(ctx, s)
+		releasePoolStmt := release
+		return txStmt, func() { _ = txStmt.Close(); releasePoolStmt() }, nil
+	}
+	return s, release, nil
+}
+
+// prepareNamed is the named parameters counterpart of preparex
+func (db *DB) prepareNamed(ctx context.Context, query string) (s *sqlx.NamedStmt, release func(), err error) {
+	tx, inTx := txFrom(ctx)
+	if db.namedStmts == nil {
+		if inTx {
+			s, err = tx.PrepareNamedContext(ctx, query)
+		} else {
+			s, err = db.DB.PrepareNamedContext(ctx, query)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, func() { _ = s.Close() }, nil
+	}
+
+	s, cached, err := db.namedStmts.get(ctx, query, db.DB.PrepareNamedContext)
+	if err != nil {
+		return nil, nil, err
+	}
+	release = func() {}
+	if !cached {
+		release = func() { _ = s.Close() }
+	}
+	if inTx {
+		txStmt := tx.NamedStmtContext(ctx, s)
+		releasePoolStmt := release
+		return txStmt, func() { _ = txStmt.Close(); releasePoolStmt() }, nil
+	}
+	return s, release, nil
+}
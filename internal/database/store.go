@@ -0,0 +1,265 @@
+package database
+
+import "context"
+
+// UserStore persists users. Like the queries of the repositories, all its
+// operations are scoped to the organization of the context.
+type UserStore interface {
+	CreateUser(ctx context.Context, u *User) (*User, error)
+	// UpdateUser returns an *ErrStaleRow if the user has been changed
+	// since its version was read
+	UpdateUser(ctx context.Context, u *User) (*User, error)
+	RestoreUser(ctx context.Context, u *User) (*User, error)
+	GetUserByID(ctx context.Context, id int64) (*User, error)
+	GetUserByIDWithDeleted(ctx context.Context, id int64) (*User, error)
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	ListUsers(ctx context.Context, opts ListOptions) ([]*User, error)
+	CountUsers(ctx context.Context, opts ListOptions) (int64, error)
+	DeleteUser(ctx context.Context, u *User) error
+	EraseUser(ctx context.Context, u *User, requestedBy int64) (*User, error)
+	ExportUser(ctx context.Context, u *User) (*UserExport, error)
+	SearchUsers(ctx context.Context, text string, opts ListOptions) ([]*UserSearchResult, error)
+	CountUserSearch(ctx context.Context, text string) (int64, error)
+}
+
+// OrganizationStore persists organizations
+type OrganizationStore interface {
+	CreateOrganization(ctx context.Context, o *Organization) (*Organization, error)
+	UpdateOrganization(ctx context.Context, o *Organization) (*Organization, error)
+	GetOrganizationByID(ctx context.Context, id int64) (*Organization, error)
+	GetOrganizationBySlug(ctx context.Context, slug string) (*Organization, error)
+	ListOrganizations(ctx context.Context, opts ListOptions) ([]*Organization, error)
+	CountOrganizations(ctx context.Context, opts ListOptions) (int64, error)
+	DeleteOrganization(ctx context.Context, o *Organization) error
+}
+
+// AuditStore persists the audit log
+type AuditStore interface {
+	RecordAuditEvent(ctx context.Context, e *AuditEvent) (*AuditEvent, error)
+	ListAuditEvents(ctx context.Context, filter AuditEventFilter, opts ListOptions) ([]*AuditEvent, error)
+	CountAuditEvents(ctx context.Context, filter AuditEventFilter) (int64, error)
+}
+
+// OutboxStore holds the events written along with the changes they describe,
+// until they are dispatched
+type OutboxStore interface {
+	DispatchOutboxEvents(ctx context.Context, limit int, deliver func(ctx context.Context, e *OutboxEvent) error) (int, error)
+	ListOutboxEvents(ctx context.Context, after int64, limit int) ([]*OutboxEvent, error)
+	LatestOutboxEventID(ctx context.Context) (int64, error)
+	// WatchOutboxEvents blocks, calling notify whenever events are written,
+	// until ctx is done or it fails
+	WatchOutboxEvents(ctx context.Context, notify func(organizationID int64)) error
+}
+
+// WebhookStore persists the webhooks and their deliveries
+type WebhookStore interface {
+	CreateWebhook(ctx context.Context, w *Webhook) (*Webhook, error)
+	UpdateWebhook(ctx context.Context, w *Webhook) (*Webhook, error)
+	GetWebhookByID(ctx context.Context, id int64) (*Webhook, error)
+	ListWebhooks(ctx context.Context, opts ListOptions) ([]*Webhook, error)
+	CountWebhooks(ctx context.Context, opts ListOptions) (int64, error)
+	DeleteWebhook(ctx context.Context, w *Webhook) error
+	ListWebhookDeliveries(ctx context.Context, w *Webhook, opts ListOptions) ([]*WebhookDelivery, error)
+	CountWebhookDeliveries(ctx context.Context, w *Webhook) (int64, error)
+	GetWebhookDeliveryByID(ctx context.Context, id int64) (*WebhookDelivery, error)
+	RedeliverWebhookDelivery(ctx context.Context, d *WebhookDelivery) (*WebhookDelivery, error)
+	EnqueueWebhookDeliveries(ctx context.Context, e *OutboxEvent) (int, error)
+	DispatchWebhookDeliveries(ctx context.Context, limit int, maxAttempts int, send WebhookSend) (int, error)
+}
+
+// Store is all the persistence the API needs: *DB keeps everything in PostgreSQL,
+// while *MemoryStore keeps it in memory, e.g. for tests
+type Store interface {
+	UserStore
+	OrganizationStore
+	AuditStore
+	OutboxStore
+	WebhookStore
+	Health(ctx context.Context) Health
+	// InTx runs fn in a transaction, which the calls fn makes to the store with the
+	// context it is given join, committed if fn returns nil and rolled back otherwise
+	InTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+var _ Store = (*DB)(nil)
+
+// CreateUser ...
+func (db *DB) CreateUser(ctx context.Context, u *User) (*User, error) {
+	return u.Create(ctx, db)
+}
+
+// UpdateUser ...
+func (db *DB) UpdateUser(ctx context.Context, u *User) (*User, error) {
+	return u.Update(ctx, db)
+}
+
+// RestoreUser ...
+func (db *DB) RestoreUser(ctx context.Context, u *User) (*User, error) {
+	return u.Restore(ctx, db)
+}
+
+// GetUserByID ...
+func (db *DB) GetUserByID(ctx context.Context, id int64) (*User, error) {
+	return (&User{ID: id}).GetByID(ctx, db)
+}
+
+// GetUserByIDWithDeleted ...
+func (db *DB) GetUserByIDWithDeleted(ctx context.Context, id int64) (*User, error) {
+	return (&User{ID: id}).GetByIDWithDeleted(ctx, db)
+}
+
+// GetUserByUsername ...
+func (db *DB) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	return (&User{Username: username}).GetByUsername(ctx, db)
+}
+
+// GetUserByEmail ...
+func (db *DB) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	return (&User{Email: email}).GetByEmail(ctx, db)
+}
+
+// ListUsers ...
+func (db *DB) ListUsers(ctx context.Context, opts ListOptions) ([]*User, error) {
+	return (&User{}).List(ctx, db, opts)
+}
+
+// CountUsers ...
+func (db *DB) CountUsers(ctx context.Context, opts ListOptions) (int64, error) {
+	return (&User{}).Count(ctx, db, opts)
+}
+
+// DeleteUser ...
+func (db *DB) DeleteUser(ctx context.Context, u *User) error {
+	return u.Delete(ctx, db)
+}
+
+// EraseUser ...
+func (db *DB) EraseUser(ctx context.Context, u *User, requestedBy int64) (*User, error) {
+	return u.Erase(ctx, db, requestedBy)
+}
+
+// ExportUser ...
+func (db *DB) ExportUser(ctx context.Context, u *User) (*UserExport, error) {
+	return u.Export(ctx, db)
+}
+
+// SearchUsers ...
+func (db *DB) SearchUsers(ctx context.Context, text string, opts ListOptions) ([]*UserSearchResult, error) {
+	return SearchUsers(ctx, db, text, opts)
+}
+
+// CountUserSearch ...
+func (db *DB) CountUserSearch(ctx context.Context, text string) (int64, error) {
+	return CountUserSearch(ctx, db, text)
+}
+
+// CreateOrganization ...
+func (db *DB) CreateOrganization(ctx context.Context, o *Organization) (*Organization, error) {
+	return o.Create(ctx, db)
+}
+
+// UpdateOrganization ...
+func (db *DB) UpdateOrganization(ctx context.Context, o *Organization) (*Organization, error) {
+	return o.Update(ctx, db)
+}
+
+// GetOrganizationByID ...
+func (db *DB) GetOrganizationByID(ctx context.Context, id int64) (*Organization, error) {
+	return (&Organization{ID: id}).GetByID(ctx, db)
+}
+
+// GetOrganizationBySlug ...
+func (db *DB) GetOrganizationBySlug(ctx context.Context, slug string) (*Organization, error) {
+	return (&Organization{Slug: slug}).GetBySlug(ctx, db)
+}
+
+// ListOrganizations ...
+func (db *DB) ListOrganizations(ctx context.Context, opts ListOptions) ([]*Organization, error) {
+	return (&Organization{}).List(ctx, db, opts)
+}
+
+// CountOrganizations ...
+func (db *DB) CountOrganizations(ctx context.Context, opts ListOptions) (int64, error) {
+	return (&Organization{}).Count(ctx, db, opts)
+}
+
+// DeleteOrganization ...
+func (db *DB) DeleteOrganization(ctx context.Context, o *Organization) error {
+	return o.Delete(ctx, db)
+}
+
+// RecordAuditEvent ...
+func (db *DB) RecordAuditEvent(ctx context.Context, e *AuditEvent) (*AuditEvent, error) {
+	return RecordAuditEvent(ctx, db, e)
+}
+
+// ListAuditEvents ...
+func (db *DB) ListAuditEvents(ctx context.Context, filter AuditEventFilter, opts ListOptions) ([]*AuditEvent, error) {
+	return ListAuditEvents(ctx, db, filter, opts)
+}
+
+// CountAuditEvents ...
+func (db *DB) CountAuditEvents(ctx context.Context, filter AuditEventFilter) (int64, error) {
+	return CountAuditEvents(ctx, db, filter)
+}
+
+// CreateWebhook ...
+func (db *DB) CreateWebhook(ctx context.Context, w *Webhook) (*Webhook, error) {
+	return w.Create(ctx, db)
+}
+
+// UpdateWebhook ...
+func (db *DB) UpdateWebhook(ctx context.Context, w *Webhook) (*Webhook, error) {
+	return w.Update(ctx, db)
+}
+
+// GetWebhookByID ...
+func (db *DB) GetWebhookByID(ctx context.Context, id int64) (*Webhook, error) {
+	return (&Webhook{ID: id}).GetByID(ctx, db)
+}
+
+// ListWebhooks ...
+func (db *DB) ListWebhooks(ctx context.Context, opts ListOptions) ([]*Webhook, error) {
+	return (&Webhook{}).List(ctx, db, opts)
+}
+
+// CountWebhooks ...
+func (db *DB) CountWebhooks(ctx context.Context, opts ListOptions) (int64, error) {
+	return (&Webhook{}).Count(ctx, db, opts)
+}
+
+// DeleteWebhook ...
+func (db *DB) DeleteWebhook(ctx context.Context, w *Webhook) error {
+	return w.Delete(ctx, db)
+}
+
+// ListWebhookDeliveries ...
+func (db *DB) ListWebhookDeliveries(ctx context.Context, w *Webhook, opts ListOptions) ([]*WebhookDelivery, error) {
+	return w.ListDeliveries(ctx, db, opts)
+}
+
+// CountWebhookDeliveries ...
+func (db *DB) CountWebhookDeliveries(ctx context.Context, w *Webhook) (int64, error) {
+	return w.CountDeliveries(ctx, db)
+}
+
+// GetWebhookDeliveryByID ...
+func (db *DB) GetWebhookDeliveryByID(ctx context.Context, id int64) (*WebhookDelivery, error) {
+	return (&WebhookDelivery{ID: id}).GetByID(ctx, db)
+}
+
+// RedeliverWebhookDelivery ...
+func (db *DB) RedeliverWebhookDelivery(ctx context.Context, d *WebhookDelivery) (*WebhookDelivery, error) {
+	return d.Redeliver(ctx, db)
+}
+
+// EnqueueWebhookDeliveries ...
+func (db *DB) EnqueueWebhookDeliveries(ctx context.Context, e *OutboxEvent) (int, error) {
+	return EnqueueWebhookDeliveries(ctx, db, e)
+}
+
+// DispatchWebhookDeliveries ...
+func (db *DB) DispatchWebhookDeliveries(ctx context.Context, limit int, maxAttempts int, send WebhookSend) (int, error) {
+	return DispatchWebhookDeliveries(ctx, db, limit, maxAttempts, send)
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+type tenantKey struct{}
+
+// tenantScope is the organization the queries are scoped to, or all of them
+type tenantScope struct {
+	organizationID int64
+	all            bool
+}
+
+// ErrNoTenant is returned by the queries of tenant-owned rows
+// which are made with a context not scoped to any tenant
+var ErrNoTenant = errors.New("no tenant (i.e. organization) to scope the query to")
+
+// ErrOrganizationRequired is returned when writing tenant-owned rows
+// on behalf of someone who can reach all the organizations, without
+// saying which organization the rows belong to
+var ErrOrganizationRequired = errors.New("the organization is required when acting across organizations")
+
+// WithTenant returns a context which scopes the queries made with it
+// to the rows of the given organization
+func WithTenant(ctx context.Context, organizationID int64) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantScope{organizationID: organizationID})
+}
+
+// WithAllTenants returns a context which lets the queries made with it
+// reach the rows of all the organizations, e.g. for super-admins or system jobs
+func WithAllTenants(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantScope{all: true})
+}
+
+// Tenant returns the organization the given context is scoped to, if any
+func Tenant(ctx context.Context) (int64, bool) {
+	scope, ok := ctx.Value(tenantKey{}).(tenantScope)
+	return scope.organizationID, ok && !scope.all
+}
+
+// tenantFrom returns the organization the queries made with ctx are scoped to,
+// with scoped being false if they can reach all of them
+func tenantFrom(ctx context.Context) (organizationID int64, scoped bool, err error) {
+	scope, ok := ctx.Value(tenantKey{}).(tenantScope)
+	if !ok {
+		return 0, false, ErrNoTenant
+	}
+	return scope.organizationID, !scope.all, nil
+}
+
+// tenantOf returns ctx scoped to the given organization if it can reach all of
+// them, so that writes on behalf of super-admins stay within one organization;
+// contexts which are already scoped stay the same, so they can not be escaped
+func tenantOf(ctx context.Context, organizationID int64) (context.Context, error) {
+	_, scoped, err := tenantFrom(ctx)
+	if err != nil || scoped {
+		return ctx, err
+	}
+	if organizationID == 0 {
+		return ctx, ErrOrganizationRequired
+	}
+	return WithTenant(ctx, organizationID), nil
+}
+
+// scopeSQL adds to the WHERE clause of the given SQL (before RETURNING, if any)
+// the condition restricting it to the organization of ctx, as the next positional
+// param after args, unless ctx can reach all organizations
+func scopeSQL(ctx context.Context, sqlScoped string, column string, args []interface{}) (string, []interface{}, error) {
+	organizationID, scoped, err := tenantFrom(ctx)
+	if err != nil || !scoped {
+		return sqlScoped, args, err
+	}
+	condition := " AND " + column + "=$" + strconv.Itoa(len(args)+1)
+	return insertCondition(sqlScoped, condition), append(args, organizationID), nil
+}
+
+// scopeNamedSQL is like scopeSQL, but for named SQL, with the param named tenant
+func scopeNamedSQL(ctx context.Context, sqlScoped string, column string, arg map[string]interface{}) (string, error) {
+	organizationID, scoped, err := tenantFrom(ctx)
+	if err != nil || !scoped {
+		return sqlScoped, err
+	}
+	arg["tenant"] = organizationID
+	return insertCondition(sqlScoped, " AND "+column+"=:tenant"), nil
+}
+
+// scopeConditions is like scopeNamedSQL, but adds the condition to the given ones
+func scopeConditions(ctx context.Context, conditions []string, column string, arg map[string]interface{}) ([]string, error) {
+	organizationID, scoped, err := tenantFrom(ctx)
+	if err != nil || !scoped {
+		return conditions, err
+	}
+	arg["tenant"] = organizationID
+	return append(conditions, column+"=:tenant"), nil
+}
+
+var trailingClause = regexp.MustCompile(`(?is)\s(RETURNING|ORDER\s+BY)\s.*$`)
+
+func insertCondition(sqlScoped string, condition string) string {
+	if loc := trailingClause.FindStringIndex(sqlScoped); loc != nil {
+		return sqlScoped[:loc[0]] + condition + sqlScoped[loc[0]:]
+	}
+	return sqlScoped + condition
+}
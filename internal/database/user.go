@@ -1,54 +1,78 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/query"
+	"github.com/rs/zerolog/log"
 )
 
 // User ...
 type User struct {
-	ID        int64          `json:"id"`
-	Username  string         `json:"username" validate:"required,alphanum"`
-	Password  string         `json:"password" validate:"required,password"`
-	Email     string         `json:"email" validate:"required,email"`
-	FirstName sql.NullString `json:"first_name" db:"first_name"`
-	LastName  sql.NullString `json:"last_name" db:"last_name"`
-	Role      auth.Role      `json:"role" validate:"required,role"`
-	Created   time.Time      `json:"created"`
-	Updated   time.Time      `json:"updated"`
-	Deleted   sql.NullTime   `json:"deleted,omitempty"`
-}
-
-var userSQLInsert string
-var userSQLUpdate string
-var userSQLSelectByID string
-var userSQLSelectByUsername string
-var userSQLSelectByEmail string
-var userSQLSelectList string
-var userSQLMarkAsDeleted string
+	ID             int64          `json:"id" repo:"pk"`
+	OrganizationID int64          `json:"organization_id" db:"organization_id" repo:"tenant"`
+	Username       string         `json:"username" validate:"required,alphanum"`
+	Password       string         `json:"password" validate:"required,password"`
+	Email          string         `json:"email" validate:"required,email"`
+	FirstName      sql.NullString `json:"first_name" db:"first_name"`
+	LastName       sql.NullString `json:"last_name" db:"last_name"`
+	Role           auth.Role      `json:"role" validate:"required,role"`
+	Created        time.Time      `json:"created" repo:"readonly"`
+	Updated        time.Time      `json:"updated" repo:"updated"`
+	Deleted        sql.NullTime   `json:"deleted,omitempty" repo:"deleted"`
+	Anonymized     sql.NullTime   `json:"anonymized,omitempty" repo:"readonly"`
+	Version        int64          `json:"version" repo:"version"`
+}
+
+// UserQuerySpec is the whitelist of the (indexed) user fields by which users can be listed
+var UserQuerySpec = query.Spec{
+	"id":         {Column: "id", Type: query.Int, Ops: []query.Op{query.OpEq, query.OpIn}, Sortable: true},
+	"username":   {Column: "username", Type: query.String, Ops: []query.Op{query.OpEq, query.OpPrefix}, Sortable: true},
+	"email":      {Column: "email", Type: query.String, Ops: []query.Op{query.OpEq, query.OpPrefix}, Sortable: true},
+	"first_name": {Column: "first_name", Type: query.String, Ops: []query.Op{query.OpPrefix, query.OpNull}},
+	"last_name":  {Column: "last_name", Type: query.String, Ops: []query.Op{query.OpPrefix, query.OpNull}},
+	"role":       {Column: "role", Type: query.Int, Ops: []query.Op{query.OpEq, query.OpNe, query.OpIn}, Sortable: true},
+	// for super-admins, as the users of other organizations are out of reach anyway
+	"organization_id": {Column: "organization_id", Type: query.Int, Ops: []query.Op{query.OpEq, query.OpIn}},
+	"created":         {Column: "created", Type: query.Time, Ops: timeRangeOps, Sortable: true},
+	"updated":         {Column: "updated", Type: query.Time, Ops: timeRangeOps, Sortable: true},
+	"deleted":         {Column: "deleted", Type: query.Time, Ops: append([]query.Op{query.OpNull}, timeRangeOps...)},
+}
+
+var timeRangeOps = []query.Op{query.OpLt, query.OpLte, query.OpGt, query.OpGte}
+
+var userRepo *Repository[User]
+var userSQLPurgeDeleted string
+var userSQLAnonymizeDeleted string
+var userSQLAnonymize string
 
 func init() {
-	userSQLInsert = `INSERT INTO ` + dbSchema + `.user (username, password, email, first_name, last_name, role)
-		VALUES (:username, :password, :email, :first_name, :last_name, :role) RETURNING id`
-	userSQLUpdate = `UPDATE ` + dbSchema + `.user
-		SET username=:username, password=:password, email=:email, first_name=:first_name, last_name=:last_name, role=:role, updated=CURRENT_TIMESTAMP
-		WHERE id=:id RETURNING id`
-	userSQLSelectByID = `SELECT * FROM ` + dbSchema + `.user WHERE id=$1`
-	userSQLSelectByUsername = `SELECT * FROM ` + dbSchema + `.user WHERE username=$1`
-	userSQLSelectByEmail = `SELECT * FROM ` + dbSchema + `.user WHERE email=$1`
-	userSQLSelectList = `SELECT * FROM ` + dbSchema + `.user WHERE deleted IS NULL LIMIT :limit OFFSET :offset`
-	userSQLMarkAsDeleted = `UPDATE ` + dbSchema + `.user SET deleted=CURRENT_TIMESTAMP WHERE id=$1 RETURNING id`
-}
-
-func (u *User) validateNoDuplicate(db *DB) error {
+	userRepo = NewRepository[User](dbSchema + ".user")
+	userSQLPurgeDeleted = `DELETE FROM ` + dbSchema + `.user WHERE deleted < :deleted_before RETURNING *`
+	// the id is kept, so that anything referencing the user stays valid, while
+	// bcrypt never matches the empty password hash, so the user can not sign in
+	userSQLAnonymizeSet := `UPDATE ` + dbSchema + `.user
+		SET username='anonymized' || id, email='anonymized' || id || '@anonymized.invalid',
+			password='', first_name=NULL, last_name=NULL, deleted=COALESCE(deleted, CURRENT_TIMESTAMP),
+			anonymized=CURRENT_TIMESTAMP, updated=CURRENT_TIMESTAMP, version=version+1`
+	userSQLAnonymizeDeleted = userSQLAnonymizeSet + ` WHERE deleted < :deleted_before AND anonymized IS NULL RETURNING *`
+	userSQLAnonymize = userSQLAnonymizeSet + ` WHERE id=$1 AND anonymized IS NULL`
+}
+
+// validateNoDuplicate spares a failed write in the common case; the unique
+// indexes remain the guarantee against concurrent duplicates
+func (u *User) validateNoDuplicate(ctx context.Context, db *DB) error {
 	usernameExists := true
-	uWithSameUsername, err := u.GetByUsername(db)
+	uWithSameUsername, err := u.GetByUsername(ctx, db)
 	if err != nil {
 		switch {
-		case err == sql.ErrNoRows:
+		case errors.Is(err, sql.ErrNoRows):
 			usernameExists = false
 		default:
 			return fmt.Errorf("error finding if an user with username %s already exists: %v", u.Username, err)
@@ -59,10 +83,10 @@ func (u *User) validateNoDuplicate(db *DB) error {
 	}
 
 	emailExists := true
-	uWithSameEmail, err := u.GetByEmail(db)
+	uWithSameEmail, err := u.GetByEmail(ctx, db)
 	if err != nil {
 		switch {
-		case err == sql.ErrNoRows:
+		case errors.Is(err, sql.ErrNoRows):
 			emailExists = false
 		default:
 			return fmt.Errorf("error finding if an user with email %s already exists: %v", u.Email, err)
@@ -75,84 +99,219 @@ func (u *User) validateNoDuplicate(db *DB) error {
 	return nil
 }
 
-// Create ...
-func (u *User) Create(db *DB) (*User, error) {
-	if err := u.validateNoDuplicate(db); err != nil {
-		return nil, err
-	}
+// Create creates the user and writes a user.created event to the outbox
+func (u *User) Create(ctx context.Context, db *DB) (*User, error) {
+	return u.upsert(ctx, db, userRepo.Create, EventUserCreated)
+}
 
-	var uu User
-	if err := Upsert(db, userSQLInsert, userSQLSelectByID, u, &uu); err != nil {
-		return nil, err
-	}
-	return &uu, nil
+// Update updates the user as long as it still has the version it had when it was read,
+// returning an *ErrStaleRow otherwise, and writes a user.updated event to the outbox,
+// followed by a user.role_changed one if the role changed
+func (u *User) Update(ctx context.Context, db *DB) (*User, error) {
+	return u.upsert(ctx, db, userRepo.Update, EventUserUpdated)
 }
 
-// Update ...
-func (u *User) Update(db *DB) (*User, error) {
-	if err := u.validateNoDuplicate(db); err != nil {
+// Restore restores the (soft) deleted user, as long as its username and email
+// have not been taken in the meantime, and writes a user.restored event to the outbox
+func (u *User) Restore(ctx context.Context, db *DB) (*User, error) {
+	return u.upsert(ctx, db, func(ctx context.Context, db *DB, u *User) (*User, error) {
+		return userRepo.Restore(ctx, db, u.ID)
+	}, EventUserRestored)
+}
+
+func (u *User) upsert(
+	ctx context.Context,
+	db *DB,
+	upsertFn func(ctx context.Context, db *DB, u *User) (*User, error),
+	eventType string,
+) (*User, error) {
+	// usernames and emails are unique per organization
+	ctx, err := tenantOf(ctx, u.OrganizationID)
+	if err != nil {
 		return nil, err
 	}
-
-	var uu User
-	if err := Upsert(db, userSQLUpdate, userSQLSelectByID, u, &uu); err != nil {
+	var uu *User
+	err = db.InTx(ctx, func(ctx context.Context) error {
+		if err := u.validateNoDuplicate(ctx, db); err != nil {
+			return err
+		}
+		// the user as it was, to tell whether its role changed
+		var before *User
+		if eventType == EventUserUpdated {
+			var err error
+			if before, err = u.GetByID(ctx, db); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("error getting user %d before updating it: %w", u.ID, err)
+			}
+		}
+		var err error
+		if uu, err = upsertFn(ctx, db, u); err != nil {
+			return err
+		}
+		events, err := userEvents(eventType, before, uu)
+		if err != nil {
+			return err
+		}
+		return enqueueEvents(ctx, db, events)
+	})
+	if err != nil {
 		return nil, err
 	}
-	return &uu, nil
+	return uu, nil
 }
 
 // GetByID ...
-func (u *User) GetByID(db *DB) (*User, error) {
-	var uu User
-	if err := SelectOne(db, userSQLSelectByID, u.ID, &uu); err != nil {
-		return nil, err
-	}
-	return &uu, nil
+func (u *User) GetByID(ctx context.Context, db *DB) (*User, error) {
+	return userRepo.GetByID(ctx, db, u.ID)
+}
+
+// GetByIDWithDeleted is like GetByID, but it also gets the user if it is deleted
+func (u *User) GetByIDWithDeleted(ctx context.Context, db *DB) (*User, error) {
+	return userRepo.GetByIDWithDeleted(ctx, db, u.ID)
 }
 
 // GetByUsername ...
-func (u *User) GetByUsername(db *DB) (*User, error) {
-	var uu User
-	if err := SelectOne(db, userSQLSelectByUsername, u.Username, &uu); err != nil {
-		return nil, err
-	}
-	return &uu, nil
+func (u *User) GetByUsername(ctx context.Context, db *DB) (*User, error) {
+	return userRepo.GetBy(ctx, db, "username", u.Username)
 }
 
 // GetByEmail ...
-func (u *User) GetByEmail(db *DB) (*User, error) {
-	var uu User
-	if err := SelectOne(db, userSQLSelectByEmail, u.Email, &uu); err != nil {
-		return nil, err
-	}
-	return &uu, nil
+func (u *User) GetByEmail(ctx context.Context, db *DB) (*User, error) {
+	return userRepo.GetBy(ctx, db, "email", u.Email)
 }
 
 // List ...
-func (u *User) List(db *DB, limit int, offset int) ([]*User, error) {
-	users := []*User{}
-	usersRows, err := db.NamedQuery(userSQLSelectList, LimitAndOffset{Limit: limit, Offset: offset})
+func (u *User) List(ctx context.Context, db *DB, opts ListOptions) ([]*User, error) {
+	return userRepo.List(ctx, db, opts)
+}
+
+// Count counts the users which List would list, regardless of the page
+func (u *User) Count(ctx context.Context, db *DB, opts ListOptions) (int64, error) {
+	return userRepo.Count(ctx, db, opts)
+}
+
+// Delete deletes the user, as long as it still has the version it had when it was read
+// (if it was read at all), returning an *ErrStaleRow otherwise, and writes a user.deleted
+// event to the outbox
+func (u *User) Delete(ctx context.Context, db *DB) error {
+	return db.InTx(ctx, func(ctx context.Context) error {
+		var err error
+		if u.Version == 0 {
+			err = userRepo.Delete(ctx, db, u.ID)
+		} else {
+			err = userRepo.DeleteVersion(ctx, db, u.ID, u.Version)
+		}
+		if err != nil {
+			return err
+		}
+		deleted, err := u.GetByIDWithDeleted(ctx, db)
+		if err != nil {
+			return fmt.Errorf("error getting user %d after deleting it: %w", u.ID, err)
+		}
+		events, err := userEvents(EventUserDeleted, nil, deleted)
+		if err != nil {
+			return err
+		}
+		return enqueueEvents(ctx, db, events)
+	})
+}
+
+// UserPurgeMode ...
+type UserPurgeMode string
+
+// UserPurgeMode ...
+const (
+	UserPurgeDelete    UserPurgeMode = "delete"
+	UserPurgeAnonymize UserPurgeMode = "anonymize"
+)
+
+// ParseUserPurgeMode ...
+func ParseUserPurgeMode(modeStr string) (UserPurgeMode, error) {
+	switch mode := UserPurgeMode(modeStr); mode {
+	case UserPurgeDelete, UserPurgeAnonymize:
+		return mode, nil
+	default:
+		return "", fmt.Errorf(
+			"unknown user purge mode %s, valid modes: %s, %s", modeStr, UserPurgeDelete, UserPurgeAnonymize)
+	}
+}
+
+// PurgeDeletedUsers permanently removes or anonymizes, depending on mode,
+// the users deleted before the given time and returns how many were purged;
+// for each of them it writes, in the same transaction, a user.deleted event,
+// or a user.erased one if anonymized, to the outbox and a user.purge event,
+// or a user.anonymize one, without actor, to the audit log; the anonymized
+// ones are also erased from their audit events, events and webhook deliveries
+func PurgeDeletedUsers(ctx context.Context, db *DB, deletedBefore time.Time, mode UserPurgeMode) (int64, error) {
+	sqlPurge, eventType, action := userSQLPurgeDeleted, EventUserDeleted, "user.purge"
+	if mode == UserPurgeAnonymize {
+		sqlPurge, eventType, action = userSQLAnonymizeDeleted, EventUserErased, "user.anonymize"
+	}
+	arg := map[string]interface{}{"deleted_before": deletedBefore}
+	sqlPurge, err := scopeNamedSQL(ctx, sqlPurge, "organization_id", arg)
 	if err != nil {
-		return users, fmt.Errorf("error preparing named db select: %v", err)
+		return 0, err
 	}
-	defer usersRows.Close()
-	for usersRows.Next() {
-		u := User{}
-		err := usersRows.StructScan(&u)
+	var nbPurged int64
+	err = db.InTx(ctx, func(ctx context.Context) error {
+		var purged []*User
+		err := SelectMany(ctx, db, sqlPurge, arg, func(rows *sqlx.Rows) error {
+			var u User
+			if err := rows.StructScan(&u); err != nil {
+				return fmt.Errorf("error scanning user row to struct: %w", err)
+			}
+			purged = append(purged, &u)
+			return nil
+		})
 		if err != nil {
-			return users, fmt.Errorf("error scanning user row to struct: %v", err)
+			return fmt.Errorf("error purging users: %w", err)
 		}
-		users = append(users, &u)
-	}
-	err = usersRows.Close()
+		var events []*OutboxEvent
+		for _, u := range purged {
+			if mode == UserPurgeAnonymize {
+				if err := eraseTraces(ctx, db, u); err != nil {
+					return err
+				}
+			}
+			purgeEvents, err := userEvents(eventType, nil, u)
+			if err != nil {
+				return err
+			}
+			events = append(events, purgeEvents...)
+			_, err = RecordAuditEvent(ctx, db, &AuditEvent{
+				Action:         action,
+				Target:         fmt.Sprintf("user:%d", u.ID),
+				Outcome:        AuditOutcomeSuccess,
+				OrganizationID: sql.NullInt64{Int64: u.OrganizationID, Valid: true},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		nbPurged = int64(len(purged))
+		return enqueueEvents(ctx, db, events)
+	})
 	if err != nil {
-		return users, fmt.Errorf("error closing rows: %v", err)
+		return 0, err
 	}
-
-	return users, nil
+	return nbPurged, nil
 }
 
-// Delete ...
-func (u *User) Delete(db *DB) error {
-	return MarkAsDeleted(db, userSQLMarkAsDeleted, u.ID)
+// SchedulePurgeOfDeletedUsers purges, every interval until ctx is done,
+// the users which have been deleted for longer than retention
+func SchedulePurgeOfDeletedUsers(ctx context.Context, db *DB, retention time.Duration, mode UserPurgeMode, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		nbPurged, err := PurgeDeletedUsers(ctx, db, time.Now().Add(-retention), mode)
+		if err != nil {
+			log.Error().Err(err).Msgf("error purging (%s) users deleted for longer than %s", mode, retention)
+		} else if nbPurged > 0 {
+			log.Info().Msgf("purged (%s) %d users deleted for longer than %s", mode, nbPurged, retention)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
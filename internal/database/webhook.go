@@ -0,0 +1,350 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Webhook is the subscription of an URL to the events of an organization,
+// which are posted to it signed with its secret
+type Webhook struct {
+	ID             int64         `json:"id" repo:"pk"`
+	OrganizationID int64         `json:"organization_id" db:"organization_id" repo:"tenant"`
+	URL            string        `json:"url" validate:"required,url,startswith=http"`
+	Events         WebhookEvents `json:"events" validate:"required,min=1"`
+	Secret         string        `json:"secret" validate:"required,min=16"`
+	Created        time.Time     `json:"created" repo:"readonly"`
+	Updated        time.Time     `json:"updated" repo:"updated"`
+	Deleted        sql.NullTime  `json:"deleted,omitempty" repo:"deleted"`
+	Version        int64         `json:"version" repo:"version"`
+}
+
+// WebhookEvents are the event types a webhook subscribes to: exact types, such as
+// user.created, all the types of a kind, such as user.*, or all of them, i.e. *
+type WebhookEvents []string
+
+// Value ...
+func (events WebhookEvents) Value() (driver.Value, error) {
+	return strings.Join(events, ","), nil
+}
+
+// Scan ...
+func (events *WebhookEvents) Scan(src interface{}) error {
+	var joined string
+	switch v := src.(type) {
+	case nil:
+	case []byte:
+		joined = string(v)
+	case string:
+		joined = v
+	default:
+		return fmt.Errorf("can not scan %T into webhook events", src)
+	}
+	*events = nil
+	if joined != "" {
+		*events = strings.Split(joined, ",")
+	}
+	return nil
+}
+
+// Matches reports whether the given event type is among the subscribed ones
+func (events WebhookEvents) Matches(eventType string) bool {
+	for _, e := range events {
+		if e == "*" || e == eventType ||
+			strings.HasSuffix(e, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(e, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidEventType reports whether the given subscribed event type matches some of EventTypes
+func IsValidEventType(e string) bool {
+	for _, eventType := range EventTypes {
+		if WebhookEvents([]string{e}).Matches(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidEventTypes lists the event types a webhook can subscribe to
+func ValidEventTypes() string {
+	return "*, user.*, " + strings.Join(EventTypes, ", ")
+}
+
+// Webhook delivery statuses
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	// WebhookDeliveryDead is the status of the deliveries which failed too many times,
+	// and are only attempted again if redelivered
+	WebhookDeliveryDead = "dead"
+)
+
+// WebhookDelivery is the delivery of an event to a webhook, and its log
+type WebhookDelivery struct {
+	ID             int64        `json:"id" repo:"pk"`
+	OrganizationID int64        `json:"organization_id" db:"organization_id" repo:"tenant"`
+	WebhookID      int64        `json:"webhook_id" db:"webhook_id"`
+	EventID        int64        `json:"event_id" db:"event_id"`
+	EventType      string       `json:"event_type" db:"event_type"`
+	Payload        EventPayload `json:"payload"`
+	Status         string       `json:"status"`
+	// Attempts is the number of times the event has been posted to the webhook
+	Attempts    int            `json:"attempts"`
+	NextAttempt time.Time      `json:"next_attempt" db:"next_attempt"`
+	LastError   sql.NullString `json:"last_error,omitempty" db:"last_error"`
+	// ResponseStatus is the HTTP status the webhook responded with to the last attempt
+	ResponseStatus sql.NullInt64 `json:"response_status,omitempty" db:"response_status"`
+	Created        time.Time     `json:"created" repo:"readonly"`
+	Updated        time.Time     `json:"updated" repo:"updated"`
+	Delivered      sql.NullTime  `json:"delivered,omitempty"`
+}
+
+var webhookRepo *Repository[Webhook]
+var webhookDeliveryRepo *Repository[WebhookDelivery]
+var sqlWebhookDeliveryInsert string
+var sqlWebhookDeliveryPending string
+var sqlWebhookDeliverySucceeded string
+var sqlWebhookDeliveryFailed string
+var sqlWebhookDeliveryRedeliver string
+
+func init() {
+	webhookRepo = NewRepository[Webhook](dbSchema + ".webhook")
+	webhookDeliveryRepo = NewRepository[WebhookDelivery](dbSchema + ".webhook_delivery")
+	table := webhookDeliveryRepo.table
+	// an event dispatched again (as they are at least once) is not delivered again
+	sqlWebhookDeliveryInsert = `INSERT INTO ` + table + ` (organization_id, webhook_id, event_id, event_type, payload)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (webhook_id, event_id) DO NOTHING`
+	sqlWebhookDeliveryPending = `SELECT * FROM ` + table + `
+		WHERE status='` + WebhookDeliveryPending + `' AND next_attempt <= CURRENT_TIMESTAMP
+		ORDER BY id LIMIT :limit FOR UPDATE SKIP LOCKED`
+	sqlWebhookDeliverySucceeded = `UPDATE ` + table + `
+		SET status='` + WebhookDeliverySucceeded + `', attempts=attempts+1, response_status=$2, last_error=NULL,
+			delivered=CURRENT_TIMESTAMP, updated=CURRENT_TIMESTAMP
+		WHERE id=$1`
+	sqlWebhookDeliveryFailed = `UPDATE ` + table + `
+		SET status=$2, attempts=attempts+1, response_status=$3, last_error=$4,
+			next_attempt=CURRENT_TIMESTAMP + make_interval(secs => $5), updated=CURRENT_TIMESTAMP
+		WHERE id=$1`
+	sqlWebhookDeliveryRedeliver = `UPDATE ` + table + `
+		SET status='` + WebhookDeliveryPending + `', attempts=0, next_attempt=CURRENT_TIMESTAMP, updated=CURRENT_TIMESTAMP
+		WHERE id=$1`
+}
+
+// Create ...
+func (w *Webhook) Create(ctx context.Context, db *DB) (*Webhook, error) {
+	ctx, err := tenantOf(ctx, w.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	return webhookRepo.Create(ctx, db, w)
+}
+
+// Update updates the webhook as long as it still has the version it had
+// when it was read, returning an *ErrStaleRow otherwise
+func (w *Webhook) Update(ctx context.Context, db *DB) (*Webhook, error) {
+	ctx, err := tenantOf(ctx, w.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	return webhookRepo.Update(ctx, db, w)
+}
+
+// GetByID ...
+func (w *Webhook) GetByID(ctx context.Context, db *DB) (*Webhook, error) {
+	return webhookRepo.GetByID(ctx, db, w.ID)
+}
+
+// List ...
+func (w *Webhook) List(ctx context.Context, db *DB, opts ListOptions) ([]*Webhook, error) {
+	return webhookRepo.List(ctx, db, opts)
+}
+
+// Count counts the webhooks which List would list, regardless of the page
+func (w *Webhook) Count(ctx context.Context, db *DB, opts ListOptions) (int64, error) {
+	return webhookRepo.Count(ctx, db, opts)
+}
+
+// Delete deletes the webhook, as long as it still has the version it had when it
+// was read (if it was read at all), returning an *ErrStaleRow otherwise; its
+// pending deliveries are not attempted anymore
+func (w *Webhook) Delete(ctx context.Context, db *DB) error {
+	if w.Version > 0 {
+		return webhookRepo.DeleteVersion(ctx, db, w.ID, w.Version)
+	}
+	return webhookRepo.Delete(ctx, db, w.ID)
+}
+
+// ListDeliveries lists the deliveries to the webhook, the latest first
+func (w *Webhook) ListDeliveries(ctx context.Context, db *DB, opts ListOptions) ([]*WebhookDelivery, error) {
+	arg := map[string]interface{}{"webhook_id": w.ID}
+	scope, err := scopeConditions(ctx, nil, "organization_id", arg)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the deliveries of webhook %d: %w", w.ID, err)
+	}
+	sqlList, reversed := listSQL(webhookDeliveryRepo.table, scope, []string{"webhook_id=:webhook_id"},
+		webhookDeliveryRepo.pk, true, opts, arg)
+	deliveries, err := webhookDeliveryRepo.list(ctx, db, sqlList, arg)
+	if err != nil {
+		return nil, err
+	}
+	if reversed {
+		reverse(deliveries)
+	}
+	return deliveries, nil
+}
+
+// CountDeliveries ...
+func (w *Webhook) CountDeliveries(ctx context.Context, db *DB) (int64, error) {
+	arg := map[string]interface{}{"webhook_id": w.ID}
+	conditions, err := scopeConditions(ctx, []string{"webhook_id=:webhook_id"}, "organization_id", arg)
+	if err != nil {
+		return 0, fmt.Errorf("error counting the deliveries of webhook %d: %w", w.ID, err)
+	}
+	count, err := Count(ctx, db, countSQL(webhookDeliveryRepo.table, conditions), arg)
+	if err != nil {
+		return 0, fmt.Errorf("error counting the deliveries of webhook %d: %w", w.ID, err)
+	}
+	return count, nil
+}
+
+// GetByID ...
+func (d *WebhookDelivery) GetByID(ctx context.Context, db *DB) (*WebhookDelivery, error) {
+	return webhookDeliveryRepo.GetByID(ctx, db, d.ID)
+}
+
+// Redeliver makes the delivery pending again, with its attempts reset,
+// whatever its status, e.g. dead after too many failed attempts
+func (d *WebhookDelivery) Redeliver(ctx context.Context, db *DB) (*WebhookDelivery, error) {
+	sqlRedeliver, args, err := scopeSQL(ctx, sqlWebhookDeliveryRedeliver, "organization_id", []interface{}{d.ID})
+	if err != nil {
+		return nil, err
+	}
+	var redelivered *WebhookDelivery
+	err = db.InTx(ctx, func(ctx context.Context) error {
+		nbRedelivered, err := Exec(ctx, db, sqlRedeliver, args...)
+		if err != nil {
+			return fmt.Errorf("error redelivering webhook delivery %d: %w", d.ID, err)
+		}
+		if nbRedelivered == 0 {
+			return sql.ErrNoRows
+		}
+		redelivered, err = d.GetByID(ctx, db)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return redelivered, nil
+}
+
+// EnqueueWebhookDeliveries creates, for each of the webhooks of the organization of
+// the event subscribed to its type, a pending delivery of it, unless there is one
+// already, and returns the number of webhooks subscribed to the event
+func EnqueueWebhookDeliveries(ctx context.Context, db *DB, e *OutboxEvent) (int, error) {
+	ctx = WithTenant(ctx, e.OrganizationID)
+	webhooks, err := webhookRepo.ListBy(ctx, db, "organization_id", e.OrganizationID)
+	if err != nil {
+		return 0, fmt.Errorf("error listing the webhooks of organization %d: %w", e.OrganizationID, err)
+	}
+	nbSubscribed := 0
+	err = db.InTx(ctx, func(ctx context.Context) error {
+		for _, w := range webhooks {
+			if !w.Events.Matches(e.Type) {
+				continue
+			}
+			if _, err := Exec(ctx, db, sqlWebhookDeliveryInsert, e.OrganizationID, w.ID, e.ID, e.Type, e.Payload); err != nil {
+				return fmt.Errorf("error enqueuing the delivery of event %d to webhook %d: %w", e.ID, w.ID, err)
+			}
+			nbSubscribed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return nbSubscribed, nil
+}
+
+// WebhookSend posts the delivery to the webhook and returns the HTTP status of
+// the response (0 if there is none), failing if the delivery did not succeed
+type WebhookSend func(ctx context.Context, w *Webhook, d *WebhookDelivery) (int, error)
+
+// DispatchWebhookDeliveries sends the pending deliveries, oldest first and at most
+// limit of them, and marks them as succeeded, or schedules them for another attempt
+// if they failed, unless they failed maxAttempts times, when they are marked as dead;
+// it returns how many succeeded. Like DispatchOutboxEvents, the deliveries stay locked
+// until all of them have been sent, while send gets a context without the transaction.
+func DispatchWebhookDeliveries(ctx context.Context, db *DB, limit int, maxAttempts int, send WebhookSend) (int, error) {
+	ctx = WithAllTenants(ctx)
+	nbSucceeded := 0
+	err := db.InTx(ctx, func(txCtx context.Context) error {
+		var deliveries []*WebhookDelivery
+		err := SelectMany(txCtx, db, sqlWebhookDeliveryPending, map[string]interface{}{"limit": limit}, func(rows *sqlx.Rows) error {
+			var d WebhookDelivery
+			if err := rows.StructScan(&d); err != nil {
+				return fmt.Errorf("error scanning webhook delivery row to struct: %w", err)
+			}
+			deliveries = append(deliveries, &d)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error selecting the pending webhook deliveries: %w", err)
+		}
+		for _, d := range deliveries {
+			status, errSend := sendWebhookDelivery(ctx, txCtx, db, d, send)
+			if errSend == nil {
+				if _, err := Exec(txCtx, db, sqlWebhookDeliverySucceeded, d.ID, status); err != nil {
+					return fmt.Errorf("error marking webhook delivery %d as succeeded: %w", d.ID, err)
+				}
+				nbSucceeded++
+				continue
+			}
+			nextStatus, attempts := webhookDeliveryAfterFailure(d, maxAttempts, errSend)
+			_, err := Exec(txCtx, db, sqlWebhookDeliveryFailed,
+				d.ID, nextStatus, sql.NullInt64{Int64: int64(status), Valid: status != 0},
+				errSend.Error(), retryDelay(attempts).Seconds())
+			if err != nil {
+				return fmt.Errorf("error recording the failure of webhook delivery %d: %w", d.ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return nbSucceeded, nil
+}
+
+// errWebhookDeleted fails the deliveries to deleted webhooks
+var errWebhookDeleted = errors.New("the webhook has been deleted")
+
+func sendWebhookDelivery(ctx context.Context, txCtx context.Context, db *DB, d *WebhookDelivery, send WebhookSend) (int, error) {
+	w, err := webhookRepo.GetByIDWithDeleted(txCtx, db, d.WebhookID)
+	if err != nil {
+		return 0, fmt.Errorf("error getting webhook %d: %w", d.WebhookID, err)
+	}
+	if w.Deleted.Valid {
+		return 0, errWebhookDeleted
+	}
+	return send(ctx, w, d)
+}
+
+// webhookDeliveryAfterFailure returns the status and the number of attempts
+// of the delivery after its current attempt failed with the given error
+func webhookDeliveryAfterFailure(d *WebhookDelivery, maxAttempts int, err error) (string, int) {
+	attempts := d.Attempts + 1
+	if attempts >= maxAttempts || errors.Is(err, errWebhookDeleted) {
+		return WebhookDeliveryDead, attempts
+	}
+	return WebhookDeliveryPending, attempts
+}
@@ -3,8 +3,10 @@ package env
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog/log"
@@ -15,11 +17,45 @@ const appPrefix = "PUREST_"
 const dbPrefix = appPrefix + "DB_"
 const dbDriver = dbPrefix + "DRIVER"
 const dbURL = dbPrefix + "URL"
+const dbReplicaURLs = dbPrefix + "REPLICA_URLS"
 const dbUser = dbPrefix + "USER"
 const dbSchema = dbPrefix + "SCHEMA"
+const dbQueryTimeout = dbPrefix + "QUERY_TIMEOUT"
+const dbMaxOpenConns = dbPrefix + "MAX_OPEN_CONNS"
+const dbMaxIdleConns = dbPrefix + "MAX_IDLE_CONNS"
+const dbConnMaxLifetime = dbPrefix + "CONN_MAX_LIFETIME"
+const dbConnMaxIdleTime = dbPrefix + "CONN_MAX_IDLE_TIME"
+const dbConnectTimeout = dbPrefix + "CONNECT_TIMEOUT"
+const dbConnectRetries = dbPrefix + "CONNECT_RETRIES"
+const dbHealthCheckInterval = dbPrefix + "HEALTH_CHECK_INTERVAL"
+
+const userPrefix = appPrefix + "USER_"
+const userPurgeRetention = userPrefix + "PURGE_RETENTION"
+const userPurgeMode = userPrefix + "PURGE_MODE"
+const userPurgeInterval = userPrefix + "PURGE_INTERVAL"
+
+const outboxPrefix = appPrefix + "OUTBOX_"
+const outboxDispatchInterval = outboxPrefix + "DISPATCH_INTERVAL"
+const outboxBatchSize = outboxPrefix + "BATCH_SIZE"
+
+const webhookPrefix = appPrefix + "WEBHOOK_"
+const webhookDispatchInterval = webhookPrefix + "DISPATCH_INTERVAL"
+const webhookMaxAttempts = webhookPrefix + "MAX_ATTEMPTS"
+const webhookTimeout = webhookPrefix + "TIMEOUT"
+
+const eventsPrefix = appPrefix + "EVENTS_"
+const eventsHeartbeatInterval = eventsPrefix + "HEARTBEAT_INTERVAL"
+
+const graphQLPrefix = appPrefix + "GRAPHQL_"
+const graphQLMaxDepth = graphQLPrefix + "MAX_DEPTH"
+const graphQLMaxComplexity = graphQLPrefix + "MAX_COMPLEXITY"
 
 const httpPrefix = appPrefix + "HTTP_"
 const httpPort = httpPrefix + "PORT"
+const httpRequireIfMatch = httpPrefix + "REQUIRE_IF_MATCH"
+
+const grpcPrefix = appPrefix + "GRPC_"
+const grpcPort = grpcPrefix + "PORT"
 
 const logPrefix = appPrefix + "LOG_"
 const logLevel = logPrefix + "LEVEL"
@@ -38,12 +74,33 @@ func init() {
 	env := GetAppEnv().String()
 	log.Info().Msgf("loaded `%s` env", env)
 
-	godotenv.Load(".env." + env + ".local")
+	dir := envDir()
+	godotenv.Load(filepath.Join(dir, ".env."+env+".local"))
 	if "test" != env {
-		godotenv.Load(".env.local")
+		godotenv.Load(filepath.Join(dir, ".env.local"))
+	}
+	godotenv.Load(filepath.Join(dir, ".env."+env))
+	godotenv.Load(filepath.Join(dir, ".env")) // The Original .env
+}
+
+// envDir returns the directory of the .env files: the current one or, if it has
+// none, its closest parent which has, e.g. the root of the module when running
+// the tests of a package
+func envDir() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, ".env")); err == nil {
+			return d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return dir
+		}
+		d = parent
 	}
-	godotenv.Load(".env." + env)
-	godotenv.Load() // The Original .env
 }
 
 func getEnvOrPanic(key string) string {
@@ -55,6 +112,15 @@ func getEnvOrPanic(key string) string {
 	return value
 }
 
+func getEnvOrDefault(key string, defaultValue string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		value = defaultValue
+	}
+	log.Info().Msgf("ENV: %s=%s", key, value)
+	return value
+}
+
 func getBoolEnvOrPanic(key string) bool {
 	vs := getEnvOrPanic(key)
 	v, err := strconv.ParseBool(vs)
@@ -73,6 +139,15 @@ func getIntEnvOrPanic(key string) int {
 	return v
 }
 
+func getDurationEnvOrPanic(key string) time.Duration {
+	vs := getEnvOrPanic(key)
+	v, err := time.ParseDuration(vs)
+	if err != nil {
+		panic(fmt.Sprintf("Env var '%s' value '%s' is not a duration (e.g. 500ms, 5s, 1m): %v", key, vs, err))
+	}
+	return v
+}
+
 // AppEnv ...
 type AppEnv int8
 
@@ -121,6 +196,17 @@ func GetDbURL() string {
 	return getEnvOrPanic(dbURL)
 }
 
+// GetDbReplicaURLs returns the comma separated URLs of the read replicas, if any
+func GetDbReplicaURLs() []string {
+	var urls []string
+	for _, url := range strings.Split(getEnvOrDefault(dbReplicaURLs, ""), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
 // GetDbUser ...
 func GetDbUser() string {
 	return getEnvOrPanic(dbUser)
@@ -131,11 +217,116 @@ func GetDbSchema() string {
 	return getEnvOrPanic(dbSchema)
 }
 
+// GetDbQueryTimeout ...
+func GetDbQueryTimeout() time.Duration {
+	return getDurationEnvOrPanic(dbQueryTimeout)
+}
+
+// GetDbMaxOpenConns ...
+func GetDbMaxOpenConns() int {
+	return getIntEnvOrPanic(dbMaxOpenConns)
+}
+
+// GetDbMaxIdleConns ...
+func GetDbMaxIdleConns() int {
+	return getIntEnvOrPanic(dbMaxIdleConns)
+}
+
+// GetDbConnMaxLifetime ...
+func GetDbConnMaxLifetime() time.Duration {
+	return getDurationEnvOrPanic(dbConnMaxLifetime)
+}
+
+// GetDbConnMaxIdleTime ...
+func GetDbConnMaxIdleTime() time.Duration {
+	return getDurationEnvOrPanic(dbConnMaxIdleTime)
+}
+
+// GetDbConnectTimeout ...
+func GetDbConnectTimeout() time.Duration {
+	return getDurationEnvOrPanic(dbConnectTimeout)
+}
+
+// GetDbConnectRetries ...
+func GetDbConnectRetries() int {
+	return getIntEnvOrPanic(dbConnectRetries)
+}
+
+// GetDbHealthCheckInterval ...
+func GetDbHealthCheckInterval() time.Duration {
+	return getDurationEnvOrPanic(dbHealthCheckInterval)
+}
+
+// GetUserPurgeRetention ...
+func GetUserPurgeRetention() time.Duration {
+	return getDurationEnvOrPanic(userPurgeRetention)
+}
+
+// GetUserPurgeMode ...
+func GetUserPurgeMode() string {
+	return getEnvOrPanic(userPurgeMode)
+}
+
+// GetUserPurgeInterval ...
+func GetUserPurgeInterval() time.Duration {
+	return getDurationEnvOrPanic(userPurgeInterval)
+}
+
+// GetOutboxDispatchInterval ...
+func GetOutboxDispatchInterval() time.Duration {
+	return getDurationEnvOrPanic(outboxDispatchInterval)
+}
+
+// GetOutboxBatchSize ...
+func GetOutboxBatchSize() int {
+	return getIntEnvOrPanic(outboxBatchSize)
+}
+
+// GetWebhookDispatchInterval ...
+func GetWebhookDispatchInterval() time.Duration {
+	return getDurationEnvOrPanic(webhookDispatchInterval)
+}
+
+// GetWebhookMaxAttempts ...
+func GetWebhookMaxAttempts() int {
+	return getIntEnvOrPanic(webhookMaxAttempts)
+}
+
+// GetWebhookTimeout ...
+func GetWebhookTimeout() time.Duration {
+	return getDurationEnvOrPanic(webhookTimeout)
+}
+
+// GetEventsHeartbeatInterval ...
+func GetEventsHeartbeatInterval() time.Duration {
+	return getDurationEnvOrPanic(eventsHeartbeatInterval)
+}
+
+// GetGraphQLMaxDepth ...
+func GetGraphQLMaxDepth() int {
+	return getIntEnvOrPanic(graphQLMaxDepth)
+}
+
+// GetGraphQLMaxComplexity ...
+func GetGraphQLMaxComplexity() int {
+	return getIntEnvOrPanic(graphQLMaxComplexity)
+}
+
 // GetHTTPPort ...
 func GetHTTPPort() string {
 	return getEnvOrPanic(httpPort)
 }
 
+// GetHTTPRequireIfMatch ...
+func GetHTTPRequireIfMatch() bool {
+	return getBoolEnvOrPanic(httpRequireIfMatch)
+}
+
+// GetGRPCPort ...
+func GetGRPCPort() string {
+	return getEnvOrPanic(grpcPort)
+}
+
 // GetLogLevel ...
 func GetLogLevel() string {
 	return getEnvOrPanic(logLevel)
@@ -0,0 +1,72 @@
+// Package i18n chooses the locale of each request, by its Accept-Language header, and
+// translates the messages sent to the clients by the catalogues of the packages
+// which send them, falling back to English for what is not translated
+package i18n
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/text/language"
+)
+
+// Default is the locale of the requests which do not ask for one of the Locales
+const Default = "en"
+
+// Locales are the locales the messages are translated to, the Default first
+var Locales = []string{Default, "de", "fr", "ro"}
+
+var matcher = func() language.Matcher {
+	tags := make([]language.Tag, len(Locales))
+	for i, locale := range Locales {
+		tags[i] = language.MustParse(locale)
+	}
+	return language.NewMatcher(tags)
+}()
+
+// Match returns the one of the Locales which best matches the given Accept-Language
+// header (e.g. de for de-CH,de;q=0.9,en;q=0.8), or the Default one
+func Match(acceptLanguage string) string {
+	_, i := language.MatchStrings(matcher, acceptLanguage)
+	return Locales[i]
+}
+
+type localeKey struct{}
+
+// WithLocale returns a copy of the given context which carries the given locale
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeKey{}, locale)
+}
+
+// Locale returns the locale of the given context, or the Default one
+func Locale(ctx context.Context) string {
+	if locale, ok := ctx.Value(localeKey{}).(string); ok {
+		return locale
+	}
+	return Default
+}
+
+// Catalogue holds the translations of some messages, by locale and by message ID,
+// as formats of fmt.Sprintf; the Default locale is expected to have all of them
+type Catalogue map[string]map[string]string
+
+// Has reports whether there is a translation of the given message to the given locale
+func (c Catalogue) Has(locale string, id string) bool {
+	_, ok := c[locale][id]
+	return ok
+}
+
+// T returns the message with the given ID translated to the given locale, or to the
+// Default one if there is no such translation, formatted with the given args
+func (c Catalogue) T(locale string, id string, args ...interface{}) string {
+	format, ok := c[locale][id]
+	if !ok {
+		if format, ok = c[Default][id]; !ok {
+			return id
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,125 @@
+// Package outbox dispatches the events of the transactional outbox, i.e. the domain
+// events written in the same transaction as the changes they describe, to sinks which
+// deliver them downstream. An event is only marked as dispatched once all the sinks
+// have taken it, so it is delivered at least once, and possibly more than once.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/padurean/purest/internal/database"
+	"github.com/rs/zerolog/log"
+)
+
+// Sink delivers events downstream, e.g. to a message broker; an error makes
+// the event be passed again, later, to all the sinks
+type Sink interface {
+	Deliver(ctx context.Context, e *database.OutboxEvent) error
+}
+
+// SinkFunc adapts a function to a Sink
+type SinkFunc func(ctx context.Context, e *database.OutboxEvent) error
+
+// Deliver ...
+func (fn SinkFunc) Deliver(ctx context.Context, e *database.OutboxEvent) error {
+	return fn(ctx, e)
+}
+
+// LogSink logs the events, e.g. when there is nothing downstream yet
+type LogSink struct{}
+
+// Deliver ...
+func (LogSink) Deliver(ctx context.Context, e *database.OutboxEvent) error {
+	log.Info().
+		Int64("event_id", e.ID).
+		Int64("organization_id", e.OrganizationID).
+		Str("target", e.Target).
+		RawJSON("payload", e.Payload).
+		Msgf("event %s", e.Type)
+	return nil
+}
+
+// MemorySink keeps the events in memory, e.g. for tests
+type MemorySink struct {
+	mu     sync.Mutex
+	events []*database.OutboxEvent
+}
+
+// Deliver ...
+func (sink *MemorySink) Deliver(ctx context.Context, e *database.OutboxEvent) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.events = append(sink.events, e)
+	return nil
+}
+
+// Events returns the events delivered so far, in the order they were delivered
+func (sink *MemorySink) Events() []*database.OutboxEvent {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return append([]*database.OutboxEvent{}, sink.events...)
+}
+
+// Dispatcher passes the pending events of the outbox to its sinks
+type Dispatcher struct {
+	store     database.OutboxStore
+	sinks     []Sink
+	batchSize int
+}
+
+// DefaultBatchSize is the number of events dispatched at once when none is given
+const DefaultBatchSize = 100
+
+// NewDispatcher returns a dispatcher passing the events, batchSize at a time
+// (DefaultBatchSize if not positive), to the given sinks, in the given order
+func NewDispatcher(store database.OutboxStore, batchSize int, sinks ...Sink) *Dispatcher {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	return &Dispatcher{store: store, sinks: sinks, batchSize: batchSize}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, e *database.OutboxEvent) error {
+	for _, sink := range d.sinks {
+		if err := sink.Deliver(ctx, e); err != nil {
+			return fmt.Errorf("error delivering event %d (%s of %s) to %T: %w", e.ID, e.Type, e.Target, sink, err)
+		}
+	}
+	return nil
+}
+
+// DispatchPending dispatches, batch by batch, the events which are pending,
+// and returns how many were dispatched
+func (d *Dispatcher) DispatchPending(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		nbDispatched, err := d.store.DispatchOutboxEvents(ctx, d.batchSize, d.deliver)
+		total += nbDispatched
+		// a batch which is not full (of dispatched events) is the last one for now
+		if err != nil || nbDispatched < d.batchSize {
+			return total, err
+		}
+	}
+}
+
+// Run dispatches the pending events every interval until ctx is done
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		nbDispatched, err := d.DispatchPending(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("error dispatching outbox events")
+		} else if nbDispatched > 0 {
+			log.Debug().Msgf("dispatched %d outbox events", nbDispatched)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/database"
+)
+
+// newStore returns a store with an user, whose creation event is still pending
+func newStore(t *testing.T) (context.Context, *database.MemoryStore, *database.User) {
+	t.Helper()
+	ctx := database.WithAllTenants(context.Background())
+	store := database.NewMemoryStore()
+	o, err := store.GetOrganizationBySlug(ctx, database.DefaultOrganizationSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.CreateUser(ctx, &database.User{
+		OrganizationID: o.ID,
+		Username:       "jdoe",
+		Email:          "jdoe@example.com",
+		Role:           auth.RoleAdmin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx, store, u
+}
+
+// outboxEvents returns all the events of the outbox, oldest first
+func outboxEvents(t *testing.T, ctx context.Context, store *database.MemoryStore) []*database.OutboxEvent {
+	t.Helper()
+	events, err := store.ListOutboxEvents(ctx, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestDispatcherEventTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		// change changes the user, whose creation has already been dispatched, if not nil
+		change func(ctx context.Context, store *database.MemoryStore, u *database.User) error
+		want   []string
+	}{
+		{"create", nil, []string{database.EventUserCreated}},
+		{"update", func(ctx context.Context, store *database.MemoryStore, u *database.User) error {
+			u.Username = "john"
+			_, err := store.UpdateUser(ctx, u)
+			return err
+		}, []string{database.EventUserUpdated}},
+		{"role change", func(ctx context.Context, store *database.MemoryStore, u *database.User) error {
+			u.Role = auth.RoleAuditor
+			_, err := store.UpdateUser(ctx, u)
+			return err
+		}, []string{database.EventUserUpdated, database.EventUserRoleChanged}},
+		{"delete", func(ctx context.Context, store *database.MemoryStore, u *database.User) error {
+			return store.DeleteUser(ctx, u)
+		}, []string{database.EventUserDeleted}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, store, u := newStore(t)
+			if tt.change != nil {
+				if _, err := NewDispatcher(store, 0, &MemorySink{}).DispatchPending(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if err := tt.change(ctx, store, u); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sink := &MemorySink{}
+			nbDispatched, err := NewDispatcher(store, 0, sink).DispatchPending(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nbDispatched != len(tt.want) {
+				t.Fatalf("expected %d dispatched events, got %d", len(tt.want), nbDispatched)
+			}
+			var types []string
+			for _, e := range sink.Events() {
+				types = append(types, e.Type)
+				if e.Target != fmt.Sprintf("user:%d", u.ID) || e.OrganizationID != u.OrganizationID {
+					t.Fatalf("expected event %s of user %d, got one of %s", e.Type, u.ID, e.Target)
+				}
+			}
+			if fmt.Sprint(types) != fmt.Sprint(tt.want) {
+				t.Fatalf("expected events %v, got %v", tt.want, types)
+			}
+		})
+	}
+}
+
+func TestDispatcherRoleChangePayload(t *testing.T) {
+	ctx, store, u := newStore(t)
+	u.Role = auth.RoleAuditor
+	if _, err := store.UpdateUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	sink := &MemorySink{}
+	if _, err := NewDispatcher(store, 0, sink).DispatchPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	events := sink.Events()
+	last := events[len(events)-1]
+	var data database.UserEventData
+	if err := json.Unmarshal(last.Payload, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Role != auth.RoleAuditor.String() || data.PreviousRole != auth.RoleAdmin.String() {
+		t.Fatalf("expected a change from %s to %s, got one from %s to %s",
+			auth.RoleAdmin, auth.RoleAuditor, data.PreviousRole, data.Role)
+	}
+}
+
+func TestDispatcherRedeliversAfterFailure(t *testing.T) {
+	ctx, store, _ := newStore(t)
+	delivered := &MemorySink{}
+	failing := true
+	dispatcher := NewDispatcher(store, 0, delivered, SinkFunc(func(ctx context.Context, e *database.OutboxEvent) error {
+		if failing {
+			return errors.New("broker unavailable")
+		}
+		return nil
+	}))
+
+	nbDispatched, err := dispatcher.DispatchPending(ctx)
+	if err != nil || nbDispatched != 0 {
+		t.Fatalf("expected no dispatched event, got %d (err: %v)", nbDispatched, err)
+	}
+	e := outboxEvents(t, ctx, store)[0]
+	if e.Dispatched.Valid || e.Attempts != 1 || !e.LastError.Valid {
+		t.Fatalf("expected the event to be pending after a failed attempt, got %+v", e)
+	}
+	if !e.NextAttempt.After(time.Now()) {
+		t.Fatalf("expected the next attempt to be delayed, got %s", e.NextAttempt)
+	}
+
+	// the next attempt is not due yet
+	failing = false
+	if nbDispatched, _ := dispatcher.DispatchPending(ctx); nbDispatched != 0 {
+		t.Fatalf("expected no dispatched event before the next attempt, got %d", nbDispatched)
+	}
+
+	store.Advance(time.Hour)
+	if nbDispatched, err := dispatcher.DispatchPending(ctx); err != nil || nbDispatched != 1 {
+		t.Fatalf("expected the event to be dispatched, got %d (err: %v)", nbDispatched, err)
+	}
+	// the sinks before the failing one got the event twice: at least once
+	if n := len(delivered.Events()); n != 2 {
+		t.Fatalf("expected the event to be delivered twice, got %d", n)
+	}
+	e = outboxEvents(t, ctx, store)[0]
+	if !e.Dispatched.Valid || e.Attempts != 2 || e.LastError.Valid {
+		t.Fatalf("expected the event to be dispatched at the second attempt, got %+v", e)
+	}
+}
+
+func TestDispatcherMarksDispatched(t *testing.T) {
+	ctx, store, u := newStore(t)
+	for i := 0; i < 4; i++ {
+		u.FirstName.String, u.FirstName.Valid = fmt.Sprintf("John %d", i), true
+		updated, err := store.UpdateUser(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u = updated
+	}
+
+	sink := &MemorySink{}
+	// in batches smaller than the pending events
+	dispatcher := NewDispatcher(store, 2, sink)
+	if nbDispatched, err := dispatcher.DispatchPending(ctx); err != nil || nbDispatched != 5 {
+		t.Fatalf("expected 5 dispatched events, got %d (err: %v)", nbDispatched, err)
+	}
+	for _, e := range outboxEvents(t, ctx, store) {
+		if !e.Dispatched.Valid || e.Attempts != 1 {
+			t.Fatalf("expected event %d to be dispatched at the first attempt, got %+v", e.ID, e)
+		}
+	}
+	// dispatched events are not dispatched again
+	if nbDispatched, err := dispatcher.DispatchPending(ctx); err != nil || nbDispatched != 0 {
+		t.Fatalf("expected no more dispatched events, got %d (err: %v)", nbDispatched, err)
+	}
+	if n := len(sink.Events()); n != 5 {
+		t.Fatalf("expected 5 delivered events, got %d", n)
+	}
+}
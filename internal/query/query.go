@@ -0,0 +1,343 @@
+// Package query parses the filtering and sorting of lists, given in URL query params as
+//
+//	filter[field][op]=value&sort=-field1,field2
+//
+// against a whitelist of the fields which can be filtered and sorted by, and turns
+// them into SQL conditions and orderings.
+package query
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Op is a filter operator
+type Op string
+
+// Filter operators
+const (
+	OpEq     Op = "eq"
+	OpNe     Op = "ne"
+	OpLt     Op = "lt"
+	OpLte    Op = "lte"
+	OpGt     Op = "gt"
+	OpGte    Op = "gte"
+	OpIn     Op = "in"     // comma separated values
+	OpPrefix Op = "prefix" // case-insensitive
+	OpNull   Op = "null"   // true or false
+)
+
+// Type is the type of the values of a field
+type Type uint8
+
+// Types
+const (
+	String Type = iota + 1
+	Int
+	Time // in RFC 3339 format
+)
+
+// Field describes how a field can be filtered and sorted by
+type Field struct {
+	Column   string
+	Type     Type
+	Ops      []Op
+	Sortable bool
+}
+
+// Spec is the whitelist of the fields of a list, by their names in URLs
+type Spec map[string]Field
+
+// Filter ...
+type Filter struct {
+	Column string
+	Op     Op
+	Value  interface{}
+}
+
+// Sort ...
+type Sort struct {
+	Column string
+	Desc   bool
+}
+
+// Query ...
+type Query struct {
+	Filters []Filter
+	Sorts   []Sort
+}
+
+// SortParam is the URL query param holding the sort fields
+const SortParam = "sort"
+
+var filterParam = regexp.MustCompile(`^filter\[(\w+)\]\[(\w+)\]$`)
+
+// Parse parses the filter and sort params from the given URL query values
+func (spec Spec) Parse(values url.Values) (*Query, error) {
+	q := &Query{}
+	// sorted, so that the same filters always give the same SQL
+	var params []string
+	for param := range values {
+		if strings.HasPrefix(param, "filter") {
+			params = append(params, param)
+		}
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		match := filterParam.FindStringSubmatch(param)
+		if match == nil {
+			return nil, fmt.Errorf("malformed filter param %s: expected filter[field][op]", param)
+		}
+		name, op := match[1], Op(match[2])
+		field, ok := spec[name]
+		if !ok {
+			return nil, fmt.Errorf("can not filter by %s: %s", name, spec.names(false))
+		}
+		if !field.allows(op) {
+			return nil, fmt.Errorf("can not filter %s by %s: valid operators are %s", name, op, field.ops())
+		}
+		for _, value := range values[param] {
+			v, err := field.parse(op, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of filter param %s: %v", param, err)
+			}
+			q.Filters = append(q.Filters, Filter{Column: field.Column, Op: op, Value: v})
+		}
+	}
+
+	if sortParam := values.Get(SortParam); sortParam != "" {
+		sorted := map[string]bool{}
+		for _, name := range strings.Split(sortParam, ",") {
+			desc := strings.HasPrefix(name, "-")
+			name = strings.TrimPrefix(name, "-")
+			field, ok := spec[name]
+			if !ok || !field.Sortable {
+				return nil, fmt.Errorf("can not sort by '%s': %s", name, spec.names(true))
+			}
+			if sorted[name] {
+				return nil, fmt.Errorf("can not sort by %s more than once", name)
+			}
+			sorted[name] = true
+			q.Sorts = append(q.Sorts, Sort{Column: field.Column, Desc: desc})
+		}
+	}
+	return q, nil
+}
+
+func (spec Spec) names(sortable bool) string {
+	var names []string
+	for name, field := range spec {
+		if !sortable || field.Sortable {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	what := "filtered"
+	if sortable {
+		what = "sorted"
+	}
+	return fmt.Sprintf("the fields which can be %s by are %s", what, strings.Join(names, ", "))
+}
+
+func (field Field) allows(op Op) bool {
+	for _, allowed := range field.Ops {
+		if op == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (field Field) ops() string {
+	ops := make([]string, len(field.Ops))
+	for i, op := range field.Ops {
+		ops[i] = string(op)
+	}
+	return strings.Join(ops, ", ")
+}
+
+func (field Field) parse(op Op, value string) (interface{}, error) {
+	switch op {
+	case OpNull:
+		return strconv.ParseBool(value)
+	case OpPrefix:
+		return value, nil
+	case OpIn:
+		var values []interface{}
+		for _, v := range strings.Split(value, ",") {
+			parsed, err := field.parseValue(v)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, parsed)
+		}
+		return values, nil
+	default:
+		return field.parseValue(value)
+	}
+}
+
+func (field Field) parseValue(value string) (interface{}, error) {
+	switch field.Type {
+	case Int:
+		return strconv.ParseInt(value, 10, 64)
+	case Time:
+		return time.Parse(time.RFC3339, value)
+	default:
+		return value, nil
+	}
+}
+
+var comparisons = map[Op]string{
+	OpEq:  "=",
+	OpNe:  "<>",
+	OpLt:  "<",
+	OpLte: "<=",
+	OpGt:  ">",
+	OpGte: ">=",
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EscapeLike escapes the wildcards of LIKE patterns in the given text
+func EscapeLike(text string) string {
+	return likeEscaper.Replace(text)
+}
+
+// Conditions returns the SQL conditions of the filters, which all have to be met,
+// adding the values of their named params to arg
+func (q *Query) Conditions(arg map[string]interface{}) []string {
+	if q == nil {
+		return nil
+	}
+	var conditions []string
+	for i, f := range q.Filters {
+		param := "q" + strconv.Itoa(i)
+		switch f.Op {
+		case OpNull:
+			if f.Value.(bool) {
+				conditions = append(conditions, f.Column+" IS NULL")
+			} else {
+				conditions = append(conditions, f.Column+" IS NOT NULL")
+			}
+		case OpPrefix:
+			conditions = append(conditions, "lower("+f.Column+") LIKE :"+param)
+			arg[param] = EscapeLike(strings.ToLower(f.Value.(string))) + "%"
+		case OpIn:
+			values := f.Value.([]interface{})
+			params := make([]string, len(values))
+			for j, v := range values {
+				params[j] = ":" + param + "_" + strconv.Itoa(j)
+				arg[param+"_"+strconv.Itoa(j)] = v
+			}
+			conditions = append(conditions, f.Column+" IN ("+strings.Join(params, ", ")+")")
+		default:
+			conditions = append(conditions, f.Column+comparisons[f.Op]+":"+param)
+			arg[param] = f.Value
+		}
+	}
+	return conditions
+}
+
+// FiltersBy reports whether the query filters by the given column
+func (q *Query) FiltersBy(column string) bool {
+	if q == nil {
+		return false
+	}
+	for _, f := range q.Filters {
+		if f.Column == column {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether the given value of the filtered column meets the filter,
+// as its SQL condition would, with nil standing for NULL
+func (f Filter) Matches(value interface{}) bool {
+	if f.Op == OpNull {
+		return (value == nil) == f.Value.(bool)
+	}
+	if value == nil {
+		return false
+	}
+	switch f.Op {
+	case OpPrefix:
+		s, ok := value.(string)
+		return ok && strings.HasPrefix(strings.ToLower(s), strings.ToLower(f.Value.(string)))
+	case OpIn:
+		for _, v := range f.Value.([]interface{}) {
+			if c, ok := Compare(value, v); ok && c == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	c, ok := Compare(value, f.Value)
+	if !ok {
+		return false
+	}
+	switch f.Op {
+	case OpEq:
+		return c == 0
+	case OpNe:
+		return c != 0
+	case OpLt:
+		return c < 0
+	case OpLte:
+		return c <= 0
+	case OpGt:
+		return c > 0
+	case OpGte:
+		return c >= 0
+	default:
+		return false
+	}
+}
+
+// Compare compares two values of the same type, i.e. string, int64, time.Time
+// or bool, returning -1, 0 or +1, and false if they can not be compared
+func Compare(a interface{}, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case int64:
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, true
+			case x.After(y):
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, true
+			case !x:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
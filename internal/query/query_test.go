@@ -0,0 +1,245 @@
+package query
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSpec = Spec{
+	"username": {Column: "username", Type: String, Ops: []Op{OpEq, OpNe, OpPrefix, OpIn}, Sortable: true},
+	"role":     {Column: "role", Type: Int, Ops: []Op{OpEq, OpNe, OpLt, OpLte, OpGt, OpGte, OpIn}, Sortable: true},
+	"created":  {Column: "created", Type: Time, Ops: []Op{OpLt, OpGte}, Sortable: true},
+	"deleted":  {Column: "deleted", Type: Time, Ops: []Op{OpNull}},
+	"email":    {Column: "email", Type: String, Ops: []Op{OpEq}},
+}
+
+func TestSpecParse(t *testing.T) {
+	created := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		name  string
+		query string
+		want  *Query
+		// wantErr is a part of the message of the expected error, if any
+		wantErr string
+	}{
+		{name: "nothing", query: "", want: &Query{}},
+		{
+			name:  "filters, sorted by param",
+			query: "filter[username][prefix]=jo&filter[role][gte]=2&filter[deleted][null]=true",
+			want: &Query{Filters: []Filter{
+				{Column: "deleted", Op: OpNull, Value: true},
+				{Column: "role", Op: OpGte, Value: int64(2)},
+				{Column: "username", Op: OpPrefix, Value: "jo"},
+			}},
+		},
+		{
+			name:  "time",
+			query: "filter[created][lt]=2022-03-04T05:06:07Z",
+			want:  &Query{Filters: []Filter{{Column: "created", Op: OpLt, Value: created}}},
+		},
+		{
+			name:  "in list",
+			query: "filter[role][in]=1,3",
+			want:  &Query{Filters: []Filter{{Column: "role", Op: OpIn, Value: []interface{}{int64(1), int64(3)}}}},
+		},
+		{
+			name:  "repeated filter",
+			query: "filter[role][ne]=1&filter[role][ne]=3",
+			want: &Query{Filters: []Filter{
+				{Column: "role", Op: OpNe, Value: int64(1)},
+				{Column: "role", Op: OpNe, Value: int64(3)},
+			}},
+		},
+		{
+			name:  "multi-key sort",
+			query: "sort=-role,username,-created",
+			want: &Query{Sorts: []Sort{
+				{Column: "role", Desc: true},
+				{Column: "username"},
+				{Column: "created", Desc: true},
+			}},
+		},
+		{name: "unknown field", query: "filter[password][eq]=x", wantErr: "can not filter by password"},
+		{name: "op not allowed", query: "filter[email][prefix]=jo", wantErr: "can not filter email by prefix: valid operators are eq"},
+		{name: "unknown op", query: "filter[role][like]=1", wantErr: "can not filter role by like"},
+		{name: "malformed", query: "filter[role]=1", wantErr: "malformed filter param filter[role]"},
+		{name: "not an int", query: "filter[role][eq]=admin", wantErr: "invalid value of filter param filter[role][eq]"},
+		{name: "not an int in list", query: "filter[role][in]=1,admin", wantErr: "invalid value of filter param filter[role][in]"},
+		{name: "not a time", query: "filter[created][gte]=yesterday", wantErr: "invalid value of filter param filter[created][gte]"},
+		{name: "not a bool", query: "filter[deleted][null]=maybe", wantErr: "invalid value of filter param filter[deleted][null]"},
+		{name: "unknown sort field", query: "sort=password", wantErr: "can not sort by 'password': the fields which can be sorted by are created, role, username"},
+		{name: "not sortable", query: "sort=-email", wantErr: "can not sort by 'email'"},
+		{name: "sorted twice", query: "sort=role,-role", wantErr: "can not sort by role more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := testSpec.Parse(values)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected the error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestQueryConditions(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []Filter
+		want    []string
+		wantArg map[string]interface{}
+	}{
+		{
+			name:    "comparison",
+			filters: []Filter{{Column: "role", Op: OpGte, Value: int64(2)}},
+			want:    []string{"role>=:q0"},
+			wantArg: map[string]interface{}{"q0": int64(2)},
+		},
+		{
+			name:    "prefix with wildcards",
+			filters: []Filter{{Column: "username", Op: OpPrefix, Value: `50%_Off\`}},
+			want:    []string{"lower(username) LIKE :q0"},
+			wantArg: map[string]interface{}{"q0": `50\%\_off\\%`},
+		},
+		{
+			name:    "in list",
+			filters: []Filter{{Column: "role", Op: OpIn, Value: []interface{}{int64(1), int64(3)}}},
+			want:    []string{"role IN (:q0_0, :q0_1)"},
+			wantArg: map[string]interface{}{"q0_0": int64(1), "q0_1": int64(3)},
+		},
+		{
+			name: "null and not null",
+			filters: []Filter{
+				{Column: "deleted", Op: OpNull, Value: true},
+				{Column: "anonymized", Op: OpNull, Value: false},
+			},
+			want:    []string{"deleted IS NULL", "anonymized IS NOT NULL"},
+			wantArg: map[string]interface{}{},
+		},
+		{
+			name: "params by position",
+			filters: []Filter{
+				{Column: "role", Op: OpNe, Value: int64(1)},
+				{Column: "username", Op: OpEq, Value: "jdoe"},
+			},
+			want:    []string{"role<>:q0", "username=:q1"},
+			wantArg: map[string]interface{}{"q0": int64(1), "q1": "jdoe"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arg := map[string]interface{}{}
+			got := (&Query{Filters: tt.filters}).Conditions(arg)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected the conditions %v, got %v", tt.want, got)
+			}
+			if !reflect.DeepEqual(arg, tt.wantArg) {
+				t.Errorf("expected the params %v, got %v", tt.wantArg, arg)
+			}
+		})
+	}
+
+	t.Run("no query", func(t *testing.T) {
+		var q *Query
+		if got := q.Conditions(map[string]interface{}{}); got != nil {
+			t.Errorf("expected no conditions, got %v", got)
+		}
+	})
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"jdoe", "jdoe"},
+		{"50%", `50\%`},
+		{"j_doe", `j\_doe`},
+		{`back\slash`, `back\\slash`},
+		{`\%_`, `\\\%\_`},
+	}
+	for _, tt := range tests {
+		if got := EscapeLike(tt.text); got != tt.want {
+			t.Errorf("EscapeLike(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	created := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		name   string
+		filter Filter
+		value  interface{}
+		want   bool
+	}{
+		{"eq", Filter{Op: OpEq, Value: int64(2)}, int64(2), true},
+		{"eq other", Filter{Op: OpEq, Value: int64(2)}, int64(3), false},
+		{"ne", Filter{Op: OpNe, Value: "jdoe"}, "jroe", true},
+		{"lt", Filter{Op: OpLt, Value: int64(2)}, int64(1), true},
+		{"lt equal", Filter{Op: OpLt, Value: int64(2)}, int64(2), false},
+		{"lte equal", Filter{Op: OpLte, Value: int64(2)}, int64(2), true},
+		{"gt", Filter{Op: OpGt, Value: created}, created.Add(time.Second), true},
+		{"gte earlier", Filter{Op: OpGte, Value: created}, created.Add(-time.Second), false},
+		{"in", Filter{Op: OpIn, Value: []interface{}{int64(1), int64(3)}}, int64(3), true},
+		{"not in", Filter{Op: OpIn, Value: []interface{}{int64(1), int64(3)}}, int64(2), false},
+		{"prefix ignores case", Filter{Op: OpPrefix, Value: "JO"}, "john", true},
+		{"prefix wildcard is literal", Filter{Op: OpPrefix, Value: "j%"}, "john", false},
+		{"prefix underscore is literal", Filter{Op: OpPrefix, Value: "j_"}, "jo", false},
+		{"prefix of escaped text", Filter{Op: OpPrefix, Value: "50%_"}, "50%_off", true},
+		{"null", Filter{Op: OpNull, Value: true}, nil, true},
+		{"null of a value", Filter{Op: OpNull, Value: true}, created, false},
+		{"not null", Filter{Op: OpNull, Value: false}, created, true},
+		// NULL meets no comparison in SQL
+		{"ne null", Filter{Op: OpNe, Value: "jdoe"}, nil, false},
+		{"other type", Filter{Op: OpEq, Value: int64(2)}, "2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Matches(tt.value); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	created := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		name   string
+		a      interface{}
+		b      interface{}
+		want   int
+		wantOK bool
+	}{
+		{"strings", "a", "b", -1, true},
+		{"ints", int64(3), int64(2), 1, true},
+		{"times", created, created, 0, true},
+		{"bools", false, true, -1, true},
+		{"different types", int64(1), "1", 0, false},
+		{"unsupported type", 1, 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Compare(tt.a, tt.b)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("expected %d, %v, got %d, %v", tt.want, tt.wantOK, got, ok)
+			}
+		})
+	}
+}
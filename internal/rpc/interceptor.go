@@ -0,0 +1,198 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/padurean/purest/internal/auth"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/env"
+	"github.com/padurean/purest/internal/i18n"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/rpc/userv1"
+	"github.com/padurean/purest/internal/service"
+	"github.com/padurean/purest/internal/validator"
+	"github.com/rs/xid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDKey is the metadata key of the request ID, like the X-Request-Id header
+const requestIDKey = "x-request-id"
+
+// publicMethods are the methods which do not need a token
+var publicMethods = map[string]bool{
+	userv1.UserService_SignIn_FullMethodName: true,
+}
+
+// methodRoles are the roles allowed to call the methods, the same as for the
+// REST operations they mirror; the methods which are not listed allow any role
+var methodRoles = map[string][]auth.Role{
+	userv1.UserService_CreateUser_FullMethodName:  {auth.RoleAdmin, auth.RoleSuperAdmin},
+	userv1.UserService_GetUser_FullMethodName:     {auth.RoleAdmin, auth.RoleSuperAdmin},
+	userv1.UserService_ListUsers_FullMethodName:   {auth.RoleAdmin, auth.RoleSuperAdmin},
+	userv1.UserService_UpdateUser_FullMethodName:  {auth.RoleAdmin, auth.RoleSuperAdmin},
+	userv1.UserService_DeleteUser_FullMethodName:  {auth.RoleAdmin, auth.RoleSuperAdmin},
+	userv1.UserService_RestoreUser_FullMethodName: {auth.RoleAdmin, auth.RoleSuperAdmin},
+}
+
+// unaryInterceptor sets on the context of each call what the services find in it,
+// like the middlewares of the REST API do, authenticates the call (unless its method
+// is public) and turns the errors of the services into statuses
+func unaryInterceptor(store database.Store, logger *logging.Logger, logRequests bool) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+		start := time.Now()
+		origin := auditOrigin(ctx)
+		ctx = context.WithValue(ctx, icontext.KeyStore, store)
+		ctx = context.WithValue(ctx, icontext.KeyAuditOrigin, origin)
+		ctx = context.WithValue(ctx, "logger", logger)
+		ctx = i18n.WithLocale(ctx, localeOf(ctx))
+		ctx = database.NewSession(ctx)
+		_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, origin.RequestID))
+
+		defer func() {
+			if p := recover(); p != nil {
+				logger.Error().Str("method", info.FullMethod).Msgf("panic: %v", p)
+				// the panic is logged, while its details are not for the clients
+				err = status.Error(codes.Internal, "internal error")
+			}
+			if logRequests {
+				logger.Info().
+					Str("method", info.FullMethod).
+					Str("code", status.Code(err).String()).
+					Str("duration", time.Since(start).String()).
+					Str("ip", origin.IP).
+					Str("req_id", origin.RequestID).
+					Msg("")
+			}
+		}()
+
+		if !publicMethods[info.FullMethod] {
+			if ctx, err = authenticate(ctx, methodRoles[info.FullMethod]...); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = handler(ctx, req)
+		return resp, statusOf(err)
+	}
+}
+
+// authenticate verifies the token in the authorization metadata, checks that its
+// role is one of the given ones (if any) and that its user has not been deleted since,
+// like the authenticate middleware does
+func authenticate(ctx context.Context, roles ...auth.Role) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	authorization := md.Get("authorization")
+	if len(authorization) == 0 || authorization[0] == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing authorization metadata")
+	}
+	jsonToken, err := auth.VerifyToken(strings.TrimPrefix(authorization[0], "Bearer "))
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err := auth.CheckRole(jsonToken.Role, roles...); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	ctx = context.WithValue(ctx, icontext.KeyJSONToken, jsonToken)
+	// the queries made on behalf of the user only reach the rows of its organization
+	if jsonToken.Role == auth.RoleSuperAdmin {
+		ctx = database.WithAllTenants(ctx)
+	} else {
+		ctx = database.WithTenant(ctx, jsonToken.OrganizationID)
+	}
+	u, err := service.GetSignedInUser(ctx)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return context.WithValue(ctx, icontext.KeySignedInUser, u), nil
+}
+
+// auditOrigin returns where the call comes from, reusing the request ID sent by the
+// client, if any, e.g. by a gateway which got it from the X-Request-Id header
+func auditOrigin(ctx context.Context) *database.AuditOrigin {
+	origin := &database.AuditOrigin{}
+	if p, ok := peer.FromContext(ctx); ok {
+		origin.IP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(origin.IP); err == nil {
+			origin.IP = host
+		}
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if userAgent := md.Get("user-agent"); len(userAgent) > 0 {
+		origin.UserAgent = userAgent[0]
+	}
+	if requestID := md.Get(requestIDKey); len(requestID) > 0 && requestID[0] != "" {
+		origin.RequestID = requestID[0]
+	} else {
+		origin.RequestID = xid.New().String()
+	}
+	return origin
+}
+
+// localeOf returns the locale which best matches the accept-language metadata, like
+// the locale middleware does for the Accept-Language header
+func localeOf(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return i18n.Match(strings.Join(md.Get("accept-language"), ","))
+}
+
+// statusOf returns the status of the given error of a service, or the error
+// itself if it is already a status (or nil)
+func statusOf(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var code codes.Code
+	switch service.KindOf(err) {
+	case service.KindInvalid:
+		code = codes.InvalidArgument
+	case service.KindUnauthorized:
+		code = codes.Unauthenticated
+	case service.KindForbidden:
+		code = codes.PermissionDenied
+	case service.KindNotFound:
+		code = codes.NotFound
+	case service.KindConflict:
+		code = codes.AlreadyExists
+	case service.KindUnprocessable, service.KindPreconditionRequired:
+		code = codes.FailedPrecondition
+	case service.KindStale:
+		code = codes.Aborted
+	default:
+		if env.GetAppEnv() == env.Production {
+			// the details of the internal errors (e.g. of SQL) are only for the logs
+			return status.Error(codes.Internal, "internal error")
+		}
+		code = codes.Internal
+	}
+	st := status.New(code, err.Error())
+	var errInvalid *validator.Error
+	if errors.As(err, &errInvalid) {
+		// the fields which are invalid, as the REST API lists them in the errors of the problem
+		badRequest := &errdetails.BadRequest{}
+		for _, f := range errInvalid.Fields {
+			badRequest.FieldViolations = append(badRequest.FieldViolations,
+				&errdetails.BadRequest_FieldViolation{Field: f.Field, Description: f.Message})
+		}
+		if withDetails, err := st.WithDetails(badRequest); err == nil {
+			st = withDetails
+		}
+	}
+	return st.Err()
+}
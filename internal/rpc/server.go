@@ -0,0 +1,53 @@
+// Package rpc serves the gRPC API, which is generated from the protobuf definitions
+// in the proto directory, and which serves the users with the same business rules
+// as the REST API, as both use the services of the service package
+package rpc
+
+import (
+	"net"
+
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/env"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/rpc/userv1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+)
+
+// Options ...
+type Options struct {
+	// RequireVersion makes the changes require the version of the user they
+	// change, like PUREST_HTTP_REQUIRE_IF_MATCH does for the If-Match header
+	RequireVersion bool
+	// LogRequests logs each call, like PUREST_LOG_REQUESTS does for the HTTP requests
+	LogRequests bool
+}
+
+// NewServer returns the gRPC server of the API, serving it from the given store
+func NewServer(store database.Store, logger *logging.Logger, opts Options) *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(unaryInterceptor(store, logger, opts.LogRequests)))
+	userv1.RegisterUserServiceServer(server, &userServer{requireVersion: opts.RequireVersion})
+	return server
+}
+
+// Start starts serving the gRPC API on the given port, in the background, and returns
+// the server, which is to be stopped (e.g. with GracefulStop) along with the HTTP one
+func Start(port string, logger *logging.Logger, store database.Store, opts Options) *grpc.Server {
+	logger.Info().Msg("starting gRPC server ...")
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("gRPC server startup on port %s failed", port)
+	}
+	server := NewServer(store, logger, opts)
+	if env.GetAppEnv() == env.Development {
+		// lets clients like grpcurl list and call the services without their .proto files
+		reflection.Register(server)
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Err(err).Msg("gRPC server stopped serving")
+		}
+	}()
+	logger.Info().Msgf("server is ready to handle gRPC requests on port %s", port)
+	return server
+}
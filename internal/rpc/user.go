@@ -0,0 +1,254 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/query"
+	"github.com/padurean/purest/internal/rpc/userv1"
+	"github.com/padurean/purest/internal/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// userServer serves the UserService, leaving the authentication and the
+// mapping of the errors of the services to statuses to the interceptor
+type userServer struct {
+	userv1.UnimplementedUserServiceServer
+	requireVersion bool
+}
+
+// toUser returns the user as the API renders it
+func toUser(u *database.User) *userv1.User {
+	nullString := func(s sql.NullString) *string {
+		if !s.Valid {
+			return nil
+		}
+		return &s.String
+	}
+	nullTime := func(t sql.NullTime) *timestamppb.Timestamp {
+		if !t.Valid {
+			return nil
+		}
+		return timestamppb.New(t.Time)
+	}
+	return &userv1.User{
+		Id:             u.ID,
+		OrganizationId: u.OrganizationID,
+		Username:       u.Username,
+		Email:          u.Email,
+		FirstName:      nullString(u.FirstName),
+		LastName:       nullString(u.LastName),
+		Role:           userv1.Role(u.Role),
+		Created:        timestamppb.New(u.Created),
+		Updated:        timestamppb.New(u.Updated),
+		Deleted:        nullTime(u.Deleted),
+		Anonymized:     nullTime(u.Anonymized),
+		Version:        u.Version,
+	}
+}
+
+// fromUserInput returns the user to create, or to update, as given
+func fromUserInput(input *userv1.UserInput) *database.User {
+	nullString := func(s *string) sql.NullString {
+		if s == nil {
+			return sql.NullString{}
+		}
+		return sql.NullString{String: *s, Valid: true}
+	}
+	return &database.User{
+		Username:  input.GetUsername(),
+		Password:  input.GetPassword(),
+		Email:     input.GetEmail(),
+		FirstName: nullString(input.FirstName),
+		LastName:  nullString(input.LastName),
+		Role:      auth.Role(input.GetRole()),
+	}
+}
+
+// SignIn ...
+func (s *userServer) SignIn(ctx context.Context, req *userv1.SignInRequest) (*userv1.SignInResponse, error) {
+	signIn, err := service.SignInUser(ctx, req.GetUsernameOrEmail(), req.GetPassword(), req.GetOrganization())
+	if err != nil {
+		return nil, err
+	}
+	return &userv1.SignInResponse{
+		Token:      signIn.Token,
+		Expiration: timestamppb.New(signIn.Expiration),
+		Warning:    signIn.Warning,
+	}, nil
+}
+
+// CreateUser ...
+func (s *userServer) CreateUser(ctx context.Context, req *userv1.CreateUserRequest) (*userv1.User, error) {
+	created, err := service.CreateUser(ctx, fromUserInput(req.GetUser()))
+	if err != nil {
+		return nil, err
+	}
+	return toUser(created), nil
+}
+
+// GetUser ...
+func (s *userServer) GetUser(ctx context.Context, req *userv1.GetUserRequest) (*userv1.User, error) {
+	u, err := service.GetUser(ctx, req.GetId(), req.GetIncludeDeleted())
+	if err != nil {
+		return nil, err
+	}
+	return toUser(u), nil
+}
+
+// ListUsers checks its arguments like GET /users checks its URL query params
+func (s *userServer) ListUsers(ctx context.Context, req *userv1.ListUsersRequest) (*userv1.ListUsersResponse, error) {
+	page := &database.Page{Size: database.PageSizeDefault}
+	if req.GetPage() != 0 {
+		if req.GetPage() < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "page %d is not a positive integer number", req.GetPage())
+		}
+		page.Number = int(req.GetPage())
+	}
+	if req.GetPageSize() != 0 {
+		if req.GetPageSize() < 0 || req.GetPageSize() > database.PageSizeMax {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"page_size %d is not an integer number between 1 and %d", req.GetPageSize(), database.PageSizeMax)
+		}
+		page.Size = int(req.GetPageSize())
+	}
+	if req.GetCursor() != "" {
+		if page.Number > 0 {
+			return nil, status.Error(codes.InvalidArgument, "page and cursor can not be used together")
+		}
+		var err error
+		if page.Cursor, err = database.DecodeCursor(req.GetCursor()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	values := url.Values{}
+	for _, filter := range req.GetFilter() {
+		values.Add(fmt.Sprintf("filter[%s][%s]", filter.GetField(), filter.GetOp()), filter.GetValue())
+	}
+	if req.GetSort() != "" {
+		values.Set(query.SortParam, req.GetSort())
+	}
+	q, err := database.UserQuerySpec.Parse(values)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// filtering by the deletion time implies including the deleted users
+	includeDeleted := q.FiltersBy("deleted")
+	if req.IncludeDeleted != nil {
+		includeDeleted = req.GetIncludeDeleted()
+	}
+
+	users, err := service.ListUsers(ctx, page, q, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	resp := &userv1.ListUsersResponse{Users: make([]*userv1.User, len(users))}
+	for i, u := range users {
+		resp.Users[i] = toUser(u)
+	}
+	resp.TotalCount, _ = page.Total()
+	if next, ok := page.Next(); ok {
+		if next.Number > 0 {
+			resp.NextPage = int32(next.Number)
+		} else {
+			resp.NextCursor = next.Cursor.Encode()
+		}
+	}
+	if prev, ok := page.Prev(); ok {
+		if prev.Number > 0 {
+			resp.PrevPage = int32(prev.Number)
+		} else {
+			resp.PrevCursor = prev.Cursor.Encode()
+		}
+	}
+	return resp, nil
+}
+
+// UpdateUser ...
+func (s *userServer) UpdateUser(ctx context.Context, req *userv1.UpdateUserRequest) (*userv1.User, error) {
+	current, err := service.GetUser(ctx, req.GetId(), false)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.CheckVersion(req.Version, current.Version, s.requireVersion); err != nil {
+		return nil, err
+	}
+	updated, err := service.UpdateUser(ctx, current, fromUserInput(req.GetUser()))
+	if err != nil {
+		return nil, err
+	}
+	return toUser(updated), nil
+}
+
+// DeleteUser ...
+func (s *userServer) DeleteUser(ctx context.Context, req *userv1.DeleteUserRequest) (*emptypb.Empty, error) {
+	u, err := service.GetUser(ctx, req.GetId(), false)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.CheckVersion(req.Version, u.Version, s.requireVersion); err != nil {
+		return nil, err
+	}
+	if err := service.DeleteUser(ctx, u); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// RestoreUser ...
+func (s *userServer) RestoreUser(ctx context.Context, req *userv1.RestoreUserRequest) (*userv1.User, error) {
+	u, err := service.GetUser(ctx, req.GetId(), true)
+	if err != nil {
+		return nil, err
+	}
+	restored, err := service.RestoreUser(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return toUser(restored), nil
+}
+
+// GetMe ...
+func (s *userServer) GetMe(ctx context.Context, req *userv1.GetMeRequest) (*userv1.User, error) {
+	u, err := service.GetSignedInUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return toUser(u), nil
+}
+
+// UpdatePassword ...
+func (s *userServer) UpdatePassword(ctx context.Context, req *userv1.UpdatePasswordRequest) (*userv1.User, error) {
+	u, err := service.GetSignedInUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := service.UpdatePassword(ctx, u, req.GetOldPassword(), req.GetNewPassword())
+	if err != nil {
+		return nil, err
+	}
+	return toUser(updated), nil
+}
+
+// UpdateEmail ...
+func (s *userServer) UpdateEmail(ctx context.Context, req *userv1.UpdateEmailRequest) (*userv1.User, error) {
+	u, err := service.GetSignedInUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.CheckVersion(req.Version, u.Version, s.requireVersion); err != nil {
+		return nil, err
+	}
+	updated, err := service.UpdateEmail(ctx, u, req.GetEmail())
+	if err != nil {
+		return nil, err
+	}
+	return toUser(updated), nil
+}
@@ -0,0 +1,147 @@
+package rpc_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/rpc"
+	"github.com/padurean/purest/internal/rpc/userv1"
+	"github.com/rs/zerolog"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newClient serves the gRPC API from the given store over an in-memory connection,
+// and returns a client of its user service
+func newClient(t *testing.T, store database.Store) userv1.UserServiceClient {
+	t.Helper()
+	nop := zerolog.Nop()
+	listener := bufconn.Listen(1 << 20)
+	server := rpc.NewServer(store, &logging.Logger{Logger: &nop}, rpc.Options{})
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return userv1.NewUserServiceClient(conn)
+}
+
+// withToken returns the context of a call authorized by the given token
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestCreateUserErrors(t *testing.T) {
+	if err := auth.GenerateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	store := database.NewMemoryStore()
+	ctx := database.WithAllTenants(context.Background())
+	o, err := store.GetOrganizationBySlug(ctx, database.DefaultOrganizationSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := store.CreateUser(ctx, &database.User{
+		OrganizationID: o.ID,
+		Username:       "admin",
+		Email:          "admin@example.com",
+		Role:           auth.RoleAdmin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := auth.GenerateToken(admin.ID, o.ID, auth.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredToken, err := auth.GenerateTokenExpiring(admin.ID, o.ID, auth.RoleAdmin, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newClient(t, store)
+
+	tests := []struct {
+		name  string
+		token string
+		user  *userv1.UserInput
+		want  codes.Code
+		// wantMessage is a part of the message of the expected status
+		wantMessage string
+		// wantViolations are the fields of the expected bad request details, if any
+		wantViolations []string
+	}{
+		{
+			name:  "duplicate email",
+			token: token,
+			user: &userv1.UserInput{Username: "jdoe", Password: "Pa$$w0rd!", Email: admin.Email,
+				Role: userv1.Role_ROLE_AUDITOR},
+			want:        codes.AlreadyExists,
+			wantMessage: "email '" + admin.Email + "' already exists",
+		},
+		{
+			name:           "invalid input",
+			token:          token,
+			user:           &userv1.UserInput{Username: "jdoe", Email: "jdoe", Role: userv1.Role_ROLE_AUDITOR},
+			want:           codes.InvalidArgument,
+			wantViolations: []string{"password", "email"},
+		},
+		{
+			name:  "expired token",
+			token: expiredToken,
+			user: &userv1.UserInput{Username: "jdoe", Password: "Pa$$w0rd!", Email: "jdoe@example.com",
+				Role: userv1.Role_ROLE_AUDITOR},
+			want:        codes.Unauthenticated,
+			wantMessage: auth.ErrTokenExpired.Error(),
+		},
+		{
+			name: "missing token",
+			user: &userv1.UserInput{Username: "jdoe", Password: "Pa$$w0rd!", Email: "jdoe@example.com"},
+			want: codes.Unauthenticated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.token != "" {
+				ctx = withToken(tt.token)
+			}
+			_, err := client.CreateUser(ctx, &userv1.CreateUserRequest{User: tt.user})
+			st := status.Convert(err)
+			if st.Code() != tt.want {
+				t.Fatalf("expected the code %s, got %s (%s)", tt.want, st.Code(), st.Message())
+			}
+			if !strings.Contains(st.Message(), tt.wantMessage) {
+				t.Errorf("expected the message %q, got %q", tt.wantMessage, st.Message())
+			}
+			var fields []string
+			for _, detail := range st.Details() {
+				if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+					for _, v := range badRequest.GetFieldViolations() {
+						fields = append(fields, v.GetField())
+					}
+				}
+			}
+			if got, want := strings.Join(fields, ","), strings.Join(tt.wantViolations, ","); got != want {
+				t.Errorf("expected the field violations %q, got %q", want, got)
+			}
+		})
+	}
+}
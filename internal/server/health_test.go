@@ -0,0 +1,29 @@
+package server_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/testkit"
+)
+
+func TestHealthDetailsAuthentication(t *testing.T) {
+	s := testkit.NewServer(t)
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"anyone checks the health", "/api/v1/health", "", http.StatusOK},
+		{"anyone gets the details", "/api/v1/health/details", "", http.StatusUnauthorized},
+		{"auditor gets the details", "/api/v1/health/details", s.Token(auth.RoleAuditor), http.StatusUnauthorized},
+		{"admin gets the details", "/api/v1/health/details", s.Token(auth.RoleAdmin), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkStatus(t, s.Do(http.MethodGet, tt.path, tt.token, nil), tt.status)
+		})
+	}
+}
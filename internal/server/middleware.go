@@ -4,22 +4,33 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
 	"github.com/padurean/purest/internal/auth"
 	icontext "github.com/padurean/purest/internal/context"
 	"github.com/padurean/purest/internal/controller"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/i18n"
+	"github.com/padurean/purest/internal/query"
+	"github.com/padurean/purest/internal/service"
+	"github.com/rs/zerolog/hlog"
 )
 
-func authenticate(role *auth.Role) func(http.Handler) http.Handler {
+// authenticate verifies the token of the request and, if any roles are given,
+// that the signed-in user has one of them, and puts the signed-in user in the
+// context of the request, unless it has been deleted since the token was issued
+func authenticate(roles ...auth.Role) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
-				render.Render(w, r, controller.ErrUnauthorized(errors.New("missing Authorization header")))
+				render.Render(w, r, controller.ErrUnauthorized(auth.ErrTokenMissing))
 				return
 			}
 			token := strings.TrimPrefix(authHeader, "Bearer ")
@@ -28,44 +39,265 @@ func authenticate(role *auth.Role) func(http.Handler) http.Handler {
 				render.Render(w, r, controller.ErrUnauthorized(err))
 				return
 			}
-			if role != nil && (*role) != jsonToken.Role {
-				render.Render(w, r, controller.ErrUnauthorized(
-					fmt.Errorf(
-						"%s role has insufficient permissions: this operation requires the %s role",
-						jsonToken.Role, *role)))
+			if err := auth.CheckRole(jsonToken.Role, roles...); err != nil {
+				render.Render(w, r, controller.ErrUnauthorized(err))
 				return
 			}
 			ctx := context.WithValue(r.Context(), icontext.KeyJSONToken, jsonToken)
+			// the queries made on behalf of the user only reach the rows of its organization
+			if jsonToken.Role == auth.RoleSuperAdmin {
+				ctx = database.WithAllTenants(ctx)
+			} else {
+				ctx = database.WithTenant(ctx, jsonToken.OrganizationID)
+			}
+			u, err := service.GetSignedInUser(ctx)
+			if err != nil {
+				render.Render(w, r, controller.ErrService(err))
+				return
+			}
+			ctx = context.WithValue(ctx, icontext.KeySignedInUser, u)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-const pageSizeDefault = 20
+// authenticateIfToken is like authenticate, with no roles, for the requests which carry
+// a token, while it lets the ones which do not through, e.g. to sign in, so that it is
+// up to the handler to check who can do what
+func authenticateIfToken(next http.Handler) http.Handler {
+	authenticated := authenticate()(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authenticated.ServeHTTP(w, r)
+	})
+}
+
+// accessTokenParam is the URL query param which can carry the token instead of the
+// Authorization header, where the browsers can not set it, e.g. for EventSource
+const accessTokenParam = "access_token"
+
+// tokenFromQuery authenticates the requests which carry their token in the URL
+// query, instead of the Authorization header, as if it was in the header
+func tokenFromQuery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get(accessTokenParam); token != "" && r.Header.Get("Authorization") == "" {
+			r = r.Clone(r.Context())
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redactedURL returns the URL of the request without the token it may carry, e.g. for logging
+func redactedURL(r *http.Request) string {
+	query := r.URL.Query()
+	if query.Get(accessTokenParam) == "" {
+		return r.URL.String()
+	}
+	query.Set(accessTokenParam, "REDACTED")
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// accessLog logs the method, URL, status, size and duration of the requests,
+// without the token they may carry in their URL
+func accessLog(next http.Handler) http.Handler {
+	return hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
+		hlog.FromRequest(r).Info().
+			Str("method", r.Method).
+			Str("url", redactedURL(r)).
+			Int("status", status).
+			Int("size", size).
+			Str("duration", duration.String()).
+			Msg("")
+	})(next)
+}
+
+// timeout is like middleware.Timeout, except for the requests of the given paths,
+// e.g. the streams, which last until the client goes away
+func timeout(d time.Duration, exceptPaths ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withTimeout := middleware.Timeout(d)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, path := range exceptPaths {
+				if r.URL.Path == path {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			withTimeout.ServeHTTP(w, r)
+		})
+	}
+}
+
+// dbSession makes the reads which follow a write, while serving the same
+// request, go to the primary database instead of a replica
+func dbSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(database.NewSession(r.Context())))
+	})
+}
+
+// locale puts on the request context the locale which best matches its Accept-Language
+// header, in which the messages of the errors are sent back
+func locale(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale := i18n.Match(r.Header.Get("Accept-Language"))
+		w.Header().Set("Content-Language", locale)
+		w.Header().Add("Vary", "Accept-Language")
+		next.ServeHTTP(w, r.WithContext(i18n.WithLocale(r.Context(), locale)))
+	})
+}
+
+// auditOrigin puts on the request context where the request comes from,
+// which is recorded by the audit log together with what the request does
+func auditOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := &database.AuditOrigin{IP: r.RemoteAddr, UserAgent: r.UserAgent()}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			origin.IP = host
+		}
+		if id, ok := hlog.IDFromRequest(r); ok {
+			origin.RequestID = id.String()
+		}
+		ctx := context.WithValue(r.Context(), icontext.KeyAuditOrigin, origin)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
+// requireIfMatch rejects, when required, the requests which do not carry an
+// If-Match header, i.e. which do not state the version of the resource they
+// were based on
+func requireIfMatch(required bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if required && r.Header.Get("If-Match") == "" {
+				render.Render(w, r, controller.ErrPreconditionRequired(
+					errors.New("missing If-Match header: use the ETag returned when the resource was read")))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// paginate puts on the request context the requested page of the list, either
+// by its number or by a cursor (which is the default), and, once the handler
+// has listed it, adds the X-Total-Count and Link (next and prev) headers
 func paginate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		page := 1
+		query := r.URL.Query()
+		page := &database.Page{Size: database.PageSizeDefault}
 		var err error
-		if pageParam := r.URL.Query().Get(icontext.KeyPage.Str()); pageParam != "" {
-			page, err = strconv.Atoi(pageParam)
-			if err != nil {
+		if pageParam := query.Get(icontext.KeyPage.Str()); pageParam != "" {
+			page.Number, err = strconv.Atoi(pageParam)
+			if err != nil || page.Number < 1 {
 				render.Render(w, r, controller.ErrBadRequest(
-					fmt.Errorf("'page' url param '%s' is not an integer number", pageParam)))
+					fmt.Errorf("'page' url param '%s' is not a positive integer number", pageParam)))
 				return
 			}
 		}
-		pageSize := pageSizeDefault
-		if pageSizeParam := r.URL.Query().Get(icontext.KeyPageSize.Str()); pageSizeParam != "" {
-			pageSize, err = strconv.Atoi(pageSizeParam)
-			if err != nil {
+		if pageSizeParam := query.Get(icontext.KeyPageSize.Str()); pageSizeParam != "" {
+			page.Size, err = strconv.Atoi(pageSizeParam)
+			if err != nil || page.Size < 1 || page.Size > database.PageSizeMax {
+				render.Render(w, r, controller.ErrBadRequest(
+					fmt.Errorf("'pageSize' url param '%s' is not an integer number between 1 and %d",
+						pageSizeParam, database.PageSizeMax)))
+				return
+			}
+		}
+		if cursorParam := query.Get(icontext.KeyCursor.Str()); cursorParam != "" {
+			if page.Number > 0 {
 				render.Render(w, r, controller.ErrBadRequest(
-					fmt.Errorf("'pageSize' url param '%s' is not an integer number", pageSizeParam)))
+					errors.New("'page' and 'cursor' url params can not be used together")))
+				return
+			}
+			page.Cursor, err = database.DecodeCursor(cursorParam)
+			if err != nil {
+				render.Render(w, r, controller.ErrBadRequest(err))
 				return
 			}
 		}
 		ctx := context.WithValue(r.Context(), icontext.KeyPage, page)
-		ctx = context.WithValue(ctx, icontext.KeyPageSize, pageSize)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(&pageHeadersWriter{ResponseWriter: w, r: r, page: page}, r.WithContext(ctx))
 	})
 }
+
+// filterAndSort puts on the request context the filtering and sorting of the list,
+// parsed from the URL query params against the given whitelist of fields
+func filterAndSort(spec query.Spec) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q, err := spec.Parse(r.URL.Query())
+			if err != nil {
+				render.Render(w, r, controller.ErrBadRequest(err))
+				return
+			}
+			ctx := context.WithValue(r.Context(), icontext.KeyQuery, q)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// pageHeadersWriter adds the paging headers right before the response is written
+type pageHeadersWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	page        *database.Page
+	wroteHeader bool
+}
+
+func (pw *pageHeadersWriter) WriteHeader(status int) {
+	if !pw.wroteHeader {
+		pw.wroteHeader = true
+		pw.setPageHeaders()
+	}
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *pageHeadersWriter) Write(b []byte) (int, error) {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+	return pw.ResponseWriter.Write(b)
+}
+
+func (pw *pageHeadersWriter) setPageHeaders() {
+	total, ok := pw.page.Total()
+	if !ok {
+		return
+	}
+	header := pw.Header()
+	header.Set("X-Total-Count", strconv.FormatInt(total, 10))
+	var links []string
+	if next, ok := pw.page.Next(); ok {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(pw.r, next)))
+	}
+	if prev, ok := pw.page.Prev(); ok {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(pw.r, prev)))
+	}
+	if len(links) > 0 {
+		header.Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// pageURL returns the URL of the request, changed to point to the given page
+func pageURL(r *http.Request, page *database.Page) string {
+	query := r.URL.Query()
+	query.Del(icontext.KeyPage.Str())
+	query.Del(icontext.KeyCursor.Str())
+	query.Set(icontext.KeyPageSize.Str(), strconv.Itoa(page.Size))
+	switch {
+	case page.Number > 0:
+		query.Set(icontext.KeyPage.Str(), strconv.Itoa(page.Number))
+	case page.Cursor != nil:
+		query.Set(icontext.KeyCursor.Str(), page.Cursor.Encode())
+	}
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
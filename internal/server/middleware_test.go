@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+const token = "v4.public.eyJzdWIiOiIxIn0"
+
+func TestRedactedURL(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"no query", "/api/v1/events/stream", "/api/v1/events/stream"},
+		{"no token", "/api/v1/users?page=2&pageSize=10", "/api/v1/users?page=2&pageSize=10"},
+		{"empty token", "/api/v1/events/stream?access_token=", "/api/v1/events/stream?access_token="},
+		{"token", "/api/v1/events/stream?access_token=" + token, "/api/v1/events/stream?access_token=REDACTED"},
+		{"token among others", "/api/v1/events/stream?types=user.created&access_token=" + token,
+			"/api/v1/events/stream?access_token=REDACTED&types=user.created"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if got := redactedURL(r); got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAccessLogRedactsToken(t *testing.T) {
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+	var authorization string
+	handler := hlog.NewHandler(logger)(accessLog(tokenFromQuery(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+		}))))
+
+	r := httptest.NewRequest(http.MethodGet, eventStreamPath+"?access_token="+token, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	// the token still authenticates the request
+	if authorization != "Bearer "+token {
+		t.Fatalf("expected the token to be in the Authorization header, got %q", authorization)
+	}
+	if strings.Contains(logs.String(), token) {
+		t.Fatalf("expected the token to be redacted from the logs, got %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), `"url":"`+eventStreamPath+`?access_token=REDACTED"`) {
+		t.Fatalf("expected the access log of %s, got %s", eventStreamPath, logs.String())
+	}
+}
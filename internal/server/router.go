@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"time"
@@ -8,12 +9,14 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/docgen"
+	"github.com/go-chi/render"
 	"github.com/padurean/purest/internal/auth"
 	icontext "github.com/padurean/purest/internal/context"
 	"github.com/padurean/purest/internal/controller"
 	"github.com/padurean/purest/internal/database"
 	"github.com/padurean/purest/internal/env"
 	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/stream"
 	"github.com/rs/zerolog/hlog"
 
 	// init Swagger API Docs
@@ -21,12 +24,15 @@ import (
 	httpSwagger "github.com/swaggo/http-swagger"
 )
 
+// eventStreamPath is the path of the stream of events, which is not timed out
+const eventStreamPath = "/api/v1/events/stream"
+
 // Router ...
 type Router struct {
 	chi.Router
 }
 
-func (router Router) setupCommonMiddlewares(db *database.DB, logger *logging.Logger) {
+func (router Router) setupCommonMiddlewares(store database.Store, logger *logging.Logger) {
 	router.Use(
 		middleware.RequestID,
 		middleware.RealIP,
@@ -35,9 +41,12 @@ func (router Router) setupCommonMiddlewares(db *database.DB, logger *logging.Log
 		// Set a timeout value on the request context (ctx), that will signal
 		// through ctx.Done() that the request has timed out and further
 		// processing should be stopped.
-		middleware.Timeout(60*time.Second),
-		// set DB connection on request context
-		middleware.WithValue(icontext.KeyDB, db),
+		timeout(60*time.Second, eventStreamPath),
+		// set the store (e.g. the DB connection) on request context
+		middleware.WithValue(icontext.KeyStore, store),
+		// set the broker of the event streams on request context
+		middleware.WithValue(icontext.KeyBroker, stream.NewBroker(store, env.GetEventsHeartbeatInterval())),
+		dbSession,
 
 		//--> logging middleware
 		hlog.NewHandler(*logger.Logger),
@@ -47,25 +56,31 @@ func (router Router) setupCommonMiddlewares(db *database.DB, logger *logging.Log
 		hlog.RequestIDHandler("req_id", "X-Request-Id"),
 		//<--
 
+		// set where the request comes from, for the audit log
+		auditOrigin,
+
+		// set the locale of the messages of the errors, by the Accept-Language header
+		locale,
+
 		// set the logger on the request context
 		middleware.WithValue("logger", logger),
 	)
 
 	if env.GetLogRequests() {
-		router.Use(
-			hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
-				hlog.FromRequest(r).Info().
-					Str("method", r.Method).
-					Str("url", r.URL.String()).
-					Int("status", status).
-					Int("size", size).
-					Str("duration", duration.String()).
-					Msg("")
-			}))
+		router.Use(accessLog)
 	}
 }
 
 func (router Router) setupRoutes() {
+	// set before the routes, so that the sub-routers get them too
+	router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		render.Render(w, r, controller.ErrNotFound(fmt.Errorf("no route for %s", r.URL.Path)))
+	})
+	router.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		render.Render(w, r, controller.ErrMethodNotAllowed(
+			fmt.Errorf("method %s is not allowed for %s", r.Method, r.URL.Path)))
+	})
+
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		msg := "Hello, my name is puREST. Pleased to meet you! :)"
 		logging.Simple(r).Debug().Msgf("Simple Logger: %s", msg)
@@ -80,30 +95,87 @@ func (router Router) setupRoutes() {
 
 	router.Route("/api", func(router chi.Router) {
 		router.Route("/v1", func(router chi.Router) {
+			authSuperAdmin := authenticate(auth.RoleSuperAdmin)
+			authAdmin := authenticate(auth.RoleAdmin, auth.RoleSuperAdmin)
+			authAdminOrAuditor := authenticate(auth.RoleAdmin, auth.RoleAuditor, auth.RoleSuperAdmin)
+			authAny := authenticate()
+			ifMatch := requireIfMatch(env.GetHTTPRequireIfMatch())
 
-			roleAdmin := auth.RoleAdmin
-			authAdmin := authenticate(&roleAdmin)
-			authAny := authenticate(nil)
+			// anyone can check whether the API is up, while only the admins see why not
+			router.Get("/health", controller.Health)
+			router.With(authAdmin).Get("/health/details", controller.HealthDetails)
 
 			router.Route("/users", func(router chi.Router) {
-				router.With(controller.UserCtx).Post("/sign-in/{usernameOrEmail}", controller.UserSignIn)
+				router.Post("/sign-in/{usernameOrEmail}", controller.UserSignIn)
 
 				routerAdmin := router.With(authAdmin)
 				routerAdmin.Post("/", controller.UserCreate)
-				routerAdmin.With(paginate).Get("/", controller.UserList)
+				routerAdmin.With(paginate, filterAndSort(database.UserQuerySpec)).Get("/", controller.UserList)
+				routerAdmin.With(paginate).Get("/search", controller.UserSearch)
 				routerAdmin.Route("/{id}", func(routerAdmin chi.Router) {
-					routerAdmin.Use(controller.UserCtx)
-					routerAdmin.Get("/", controller.UserGet)
-					routerAdmin.Put("/", controller.UserUpdate)
-					routerAdmin.Delete("/", controller.UserDelete)
+					routerAdmin.Group(func(routerAdmin chi.Router) {
+						routerAdmin.Use(controller.UserCtxWithDeleted)
+						routerAdmin.Post("/restore", controller.UserRestore)
+						routerAdmin.Get("/export", controller.UserExport)
+						routerAdmin.Post("/erase", controller.UserErase)
+					})
+					routerAdmin.Group(func(routerAdmin chi.Router) {
+						routerAdmin.Use(controller.UserCtx)
+						routerAdmin.Get("/", controller.UserGet)
+						routerAdmin.With(ifMatch).Put("/", controller.UserUpdate)
+						routerAdmin.With(ifMatch).Patch("/", controller.UserPatch)
+						routerAdmin.With(ifMatch).Delete("/", controller.UserDelete)
+					})
 				})
 
-				routerAuthAny := router.With(authAny).With(controller.SignedInUserCtx)
+				routerAuthAny := router.With(authAny)
 				routerAuthAny.Get("/me", controller.UserGetMe)
+				routerAuthAny.Get("/me/export", controller.UserExportMe)
 				routerAuthAny.Put("/password", controller.UserUpdatePassword)
-				routerAuthAny.Put("/email", controller.UserUpdateEmail)
+				routerAuthAny.With(ifMatch).Put("/email", controller.UserUpdateEmail)
+			})
+
+			router.Route("/organizations", func(router chi.Router) {
+				router.Use(authSuperAdmin)
+				router.Post("/", controller.OrganizationCreate)
+				router.With(paginate).Get("/", controller.OrganizationList)
+				router.Route("/{id}", func(router chi.Router) {
+					router.Use(controller.OrganizationCtx)
+					router.Get("/", controller.OrganizationGet)
+					router.With(ifMatch).Put("/", controller.OrganizationUpdate)
+					router.With(ifMatch).Delete("/", controller.OrganizationDelete)
+				})
 			})
 
+			router.Route("/webhooks", func(router chi.Router) {
+				router.Use(authAdmin)
+				router.Post("/", controller.WebhookCreate)
+				router.With(paginate).Get("/", controller.WebhookList)
+				router.Route("/{id}", func(router chi.Router) {
+					router.Use(controller.WebhookCtx)
+					router.Get("/", controller.WebhookGet)
+					router.With(ifMatch).Put("/", controller.WebhookUpdate)
+					router.With(ifMatch).Delete("/", controller.WebhookDelete)
+					router.With(paginate).Get("/deliveries", controller.WebhookDeliveryList)
+					router.Post("/deliveries/{deliveryID}/redeliver", controller.WebhookRedeliver)
+				})
+			})
+
+			router.With(authAdminOrAuditor).With(paginate).Get("/audit-events", controller.AuditEventList)
+
+			router.With(tokenFromQuery, authAdminOrAuditor).Get("/events/stream", controller.EventStream)
+
+			// each field checks the role it requires, as signing in requires none
+			router.With(authenticateIfToken).Post("/graphql", controller.GraphQL(controller.GraphQLOptions{
+				MaxDepth:       env.GetGraphQLMaxDepth(),
+				MaxComplexity:  env.GetGraphQLMaxComplexity(),
+				RequireVersion: env.GetHTTPRequireIfMatch(),
+				Introspection:  env.GetAppEnv() == env.Development,
+			}))
+			if env.GetAppEnv() == env.Development {
+				router.Get("/graphql/playground", controller.GraphQLPlayground)
+			}
+
 		})
 	})
 }
@@ -128,10 +200,19 @@ func (router Router) generateAPIDocs(logger *logging.Logger) {
 }
 
 // Setup ...
-func (router Router) Setup(db *database.DB, logger *logging.Logger) {
-	router.setupCommonMiddlewares(db, logger)
+func (router Router) Setup(store database.Store, logger *logging.Logger) {
+	router.setupCommonMiddlewares(store, logger)
 	router.setupRoutes()
 	if env.GetAppEnv() == env.Development {
 		router.generateAPIDocs(logger)
 	}
 }
+
+// NewHandler returns the router of the API, serving it from the given store,
+// without generating the API docs, e.g. for tests
+func NewHandler(store database.Store, logger *logging.Logger) http.Handler {
+	router := Router{Router: chi.NewRouter()}
+	router.setupCommonMiddlewares(store, logger)
+	router.setupRoutes()
+	return router
+}
@@ -14,7 +14,7 @@ import (
 )
 
 // Start ...
-func Start(port string, logger *logging.Logger, db *database.DB) {
+func Start(port string, logger *logging.Logger, store database.Store) {
 	logger.Info().Msg("starting server ...")
 
 	done := make(chan bool, 1)
@@ -22,7 +22,7 @@ func Start(port string, logger *logging.Logger, db *database.DB) {
 
 	signal.Notify(quit, os.Interrupt)
 
-	server := newServer(port, logger, db)
+	server := newServer(port, logger, store)
 	go gracefullShutdown(server, logger, quit, done)
 
 	logger.Info().Msgf("server is ready to handle HTTP requests on port %s", port)
@@ -49,9 +49,9 @@ func gracefullShutdown(server *http.Server, logger *logging.Logger, quit <-chan
 	close(done)
 }
 
-func newServer(port string, logger *logging.Logger, db *database.DB) *http.Server {
+func newServer(port string, logger *logging.Logger, store database.Store) *http.Server {
 	router := Router{Router: chi.NewRouter()}
-	router.Setup(db, logger)
+	router.Setup(store, logger)
 
 	return &http.Server{
 		Addr:     ":" + port,
@@ -0,0 +1,633 @@
+package server_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/controller"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/testkit"
+)
+
+// userBody is the body of a request creating, or replacing, the given user
+func userBody(username string, role auth.Role) map[string]interface{} {
+	return map[string]interface{}{
+		"username": username,
+		"password": testkit.DefaultPassword,
+		"email":    username + "@example.com",
+		"role":     role,
+	}
+}
+
+// checkStatus fails the test, with the body of the response, if it does not have the given status
+func checkStatus(t *testing.T, resp *http.Response, status int) {
+	t.Helper()
+	if resp.StatusCode != status {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s %s: expected status %d, got %d: %s",
+			resp.Request.Method, resp.Request.URL.Path, status, resp.StatusCode, body)
+	}
+}
+
+// checkProblem fails the test if the response is not the problem with the given status and code
+func checkProblem(t *testing.T, s *testkit.Server, resp *http.Response, status int, code controller.ProblemCode) {
+	t.Helper()
+	checkStatus(t, resp, status)
+	var problem controller.ErrResponse
+	s.Decode(resp, &problem)
+	if problem.AppCode != code {
+		t.Fatalf("%s %s: expected problem %s, got %s: %s",
+			resp.Request.Method, resp.Request.URL.Path, code, problem.AppCode, problem.Detail)
+	}
+}
+
+func userPath(id int64) string {
+	return fmt.Sprintf("/api/v1/users/%d", id)
+}
+
+func TestUserSignIn(t *testing.T) {
+	s := testkit.NewServer(t)
+	admin := s.SeedUser(&database.User{Username: "jdoe", Email: "jdoe@example.com"})
+	acme := s.SeedOrganization("acme")
+	s.SeedUser(&database.User{Username: "acme-admin", OrganizationID: acme.ID})
+	deleted := s.SeedUser(&database.User{Username: "gone"})
+	if err := s.Store.DeleteUser(s.Ctx(), deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		usernameOrEmail string
+		request         controller.SignInRequest
+		status          int
+		code            controller.ProblemCode
+	}{
+		{"by username", "jdoe", controller.SignInRequest{Password: testkit.DefaultPassword}, http.StatusOK, ""},
+		{"by email", "jdoe@example.com", controller.SignInRequest{Password: testkit.DefaultPassword}, http.StatusOK, ""},
+		{"wrong password", "jdoe", controller.SignInRequest{Password: "Wr0ngPassw0rd!"},
+			http.StatusUnauthorized, controller.ProblemAuthWrongPassword},
+		{"missing password", "jdoe", controller.SignInRequest{},
+			http.StatusBadRequest, controller.ProblemValidationFailed},
+		{"unknown user", "nobody", controller.SignInRequest{Password: testkit.DefaultPassword},
+			http.StatusNotFound, "NOT_FOUND"},
+		{"deleted user", "gone", controller.SignInRequest{Password: testkit.DefaultPassword},
+			http.StatusNotFound, "NOT_FOUND"},
+		{"user of another organization", "acme-admin", controller.SignInRequest{Password: testkit.DefaultPassword},
+			http.StatusNotFound, "NOT_FOUND"},
+		{"user of the given organization", "acme-admin",
+			controller.SignInRequest{Password: testkit.DefaultPassword, Organization: "acme"}, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := s.Do(http.MethodPost, "/api/v1/users/sign-in/"+url.PathEscape(tt.usernameOrEmail), "", tt.request)
+			if tt.status != http.StatusOK {
+				checkProblem(t, s, resp, tt.status, tt.code)
+				return
+			}
+			checkStatus(t, resp, http.StatusOK)
+			var signIn controller.SignInResponse
+			s.Decode(resp, &signIn)
+			if signIn.Token == "" {
+				t.Fatal("expected a token")
+			}
+			// the token is the one of the signed-in user
+			resp = s.Do(http.MethodGet, "/api/v1/users/me", signIn.Token, nil)
+			checkStatus(t, resp, http.StatusOK)
+			var me controller.UserResponse
+			s.Decode(resp, &me)
+			if tt.request.Organization == "" && me.ID != admin.ID {
+				t.Fatalf("expected to be signed in as user %d, got %d", admin.ID, me.ID)
+			}
+		})
+	}
+}
+
+func TestUserCRUD(t *testing.T) {
+	s := testkit.NewServer(t)
+	token := s.Token(auth.RoleAdmin)
+
+	resp := s.Do(http.MethodPost, "/api/v1/users", token, userBody("jdoe", auth.RoleAuditor))
+	checkStatus(t, resp, http.StatusCreated)
+	var created controller.UserResponse
+	s.Decode(resp, &created)
+	path := userPath(created.ID)
+
+	resp = s.Do(http.MethodGet, path, token, nil)
+	checkStatus(t, resp, http.StatusOK)
+	var got controller.UserResponse
+	s.Decode(resp, &got)
+	if got.Username != "jdoe" || got.Role != auth.RoleAuditor {
+		t.Fatalf("expected jdoe, an Auditor, got %s, a %s", got.Username, got.Role)
+	}
+
+	resp = s.Do(http.MethodPost, "/api/v1/users", token, userBody("jdoe", auth.RoleAuditor))
+	checkProblem(t, s, resp, http.StatusUnprocessableEntity, controller.ProblemUserDuplicateUsername)
+
+	replacement := userBody("john", auth.RoleAdmin)
+	replacement["first_name"] = "John"
+	resp = s.Do(http.MethodPut, path, token, replacement)
+	checkStatus(t, resp, http.StatusOK)
+	var updated controller.UserResponse
+	s.Decode(resp, &updated)
+	if updated.Username != "john" || updated.Role != auth.RoleAdmin || updated.FirstName.String != "John" {
+		t.Fatalf("expected john, an Admin named John, got %+v", updated.User)
+	}
+	if updated.Version != got.Version+1 {
+		t.Fatalf("expected version %d, got %d", got.Version+1, updated.Version)
+	}
+
+	resp = s.Do(http.MethodDelete, path, token, nil)
+	checkStatus(t, resp, http.StatusNoContent)
+	resp = s.Do(http.MethodGet, path, token, nil)
+	checkProblem(t, s, resp, http.StatusNotFound, "NOT_FOUND")
+	// the username is released by the deletion
+	resp = s.Do(http.MethodPost, "/api/v1/users", token, userBody("john", auth.RoleAdmin))
+	checkStatus(t, resp, http.StatusCreated)
+	var other controller.UserResponse
+	s.Decode(resp, &other)
+
+	// and taken again by the restore
+	resp = s.Do(http.MethodPost, path+"/restore", token, nil)
+	checkProblem(t, s, resp, http.StatusUnprocessableEntity, controller.ProblemUserDuplicateUsername)
+	resp = s.Do(http.MethodDelete, userPath(other.ID), token, nil)
+	checkStatus(t, resp, http.StatusNoContent)
+	resp = s.Do(http.MethodPost, path+"/restore", token, nil)
+	checkStatus(t, resp, http.StatusOK)
+	resp = s.Do(http.MethodGet, path, token, nil)
+	checkStatus(t, resp, http.StatusOK)
+	resp = s.Do(http.MethodPost, path+"/restore", token, nil)
+	checkStatus(t, resp, http.StatusUnprocessableEntity)
+}
+
+func TestUserRoles(t *testing.T) {
+	tests := []struct {
+		name   string
+		actor  auth.Role
+		target auth.Role
+		// do sends the request of the actor, with the given token, on the given target
+		do     func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response
+		status int
+		code   controller.ProblemCode
+	}{
+		{
+			name: "auditor lists users", actor: auth.RoleAuditor, target: auth.RoleAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, _ *database.User) *http.Response {
+				return s.Do(http.MethodGet, "/api/v1/users", token, nil)
+			},
+			status: http.StatusUnauthorized, code: controller.ProblemAuthInsufficientRole,
+		},
+		{
+			name: "auditor gets a user", actor: auth.RoleAuditor, target: auth.RoleAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				return s.Do(http.MethodGet, userPath(target.ID), token, nil)
+			},
+			status: http.StatusUnauthorized, code: controller.ProblemAuthInsufficientRole,
+		},
+		{
+			name: "admin creates an admin", actor: auth.RoleAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, _ *database.User) *http.Response {
+				return s.Do(http.MethodPost, "/api/v1/users", token, userBody("created", auth.RoleAdmin))
+			},
+			status: http.StatusCreated,
+		},
+		{
+			name: "admin creates a super-admin", actor: auth.RoleAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, _ *database.User) *http.Response {
+				return s.Do(http.MethodPost, "/api/v1/users", token, userBody("created", auth.RoleSuperAdmin))
+			},
+			status: http.StatusUnauthorized, code: controller.ProblemAuthRoleNotAssignable,
+		},
+		{
+			name: "super-admin creates a super-admin", actor: auth.RoleSuperAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, _ *database.User) *http.Response {
+				body := userBody("created", auth.RoleSuperAdmin)
+				body["organization_id"] = s.Organization(database.DefaultOrganizationSlug).ID
+				return s.Do(http.MethodPost, "/api/v1/users", token, body)
+			},
+			status: http.StatusCreated,
+		},
+		{
+			name: "admin promotes an admin to super-admin", actor: auth.RoleAdmin, target: auth.RoleAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				return s.Do(http.MethodPut, userPath(target.ID), token, userBody(target.Username, auth.RoleSuperAdmin))
+			},
+			status: http.StatusUnauthorized, code: controller.ProblemAuthRoleNotAssignable,
+		},
+		{
+			name: "admin patches the role of an admin to super-admin", actor: auth.RoleAdmin, target: auth.RoleAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				req := s.NewRequest(http.MethodPatch, userPath(target.ID), token,
+					map[string]interface{}{"role": auth.RoleSuperAdmin})
+				req.Header.Set("Content-Type", controller.ContentTypeMergePatch)
+				return s.Send(req)
+			},
+			status: http.StatusUnauthorized, code: controller.ProblemAuthRoleNotAssignable,
+		},
+		{
+			name: "admin demotes a super-admin", actor: auth.RoleAdmin, target: auth.RoleSuperAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				return s.Do(http.MethodPut, userPath(target.ID), token, userBody(target.Username, auth.RoleAdmin))
+			},
+			status: http.StatusUnauthorized, code: controller.ProblemAuthRoleNotAssignable,
+		},
+		{
+			name: "admin deletes a super-admin", actor: auth.RoleAdmin, target: auth.RoleSuperAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				return s.Do(http.MethodDelete, userPath(target.ID), token, nil)
+			},
+			status: http.StatusUnauthorized, code: controller.ProblemAuthRoleNotAssignable,
+		},
+		{
+			name: "admin restores a super-admin", actor: auth.RoleAdmin, target: auth.RoleSuperAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				deleteUser(t, s, target)
+				return s.Do(http.MethodPost, userPath(target.ID)+"/restore", token, nil)
+			},
+			status: http.StatusUnauthorized, code: controller.ProblemAuthRoleNotAssignable,
+		},
+		{
+			name: "super-admin restores a super-admin", actor: auth.RoleSuperAdmin, target: auth.RoleSuperAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				deleteUser(t, s, target)
+				return s.Do(http.MethodPost, userPath(target.ID)+"/restore", token, nil)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "admin erases a super-admin", actor: auth.RoleAdmin, target: auth.RoleSuperAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				return s.Do(http.MethodPost, userPath(target.ID)+"/erase", token, nil)
+			},
+			status: http.StatusUnauthorized, code: controller.ProblemAuthRoleNotAssignable,
+		},
+		{
+			name: "super-admin erases a super-admin", actor: auth.RoleSuperAdmin, target: auth.RoleSuperAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				return s.Do(http.MethodPost, userPath(target.ID)+"/erase", token, nil)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "admin erases an admin", actor: auth.RoleAdmin, target: auth.RoleAdmin,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				return s.Do(http.MethodPost, userPath(target.ID)+"/erase", token, nil)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "admin deletes an auditor", actor: auth.RoleAdmin, target: auth.RoleAuditor,
+			do: func(t *testing.T, s *testkit.Server, token string, target *database.User) *http.Response {
+				return s.Do(http.MethodDelete, userPath(target.ID), token, nil)
+			},
+			status: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testkit.NewServer(t)
+			var target *database.User
+			if tt.target != 0 {
+				target = s.SeedUser(&database.User{Username: "target", Role: tt.target})
+			}
+			resp := tt.do(t, s, s.Token(tt.actor), target)
+			if tt.code != "" {
+				checkProblem(t, s, resp, tt.status, tt.code)
+				return
+			}
+			checkStatus(t, resp, tt.status)
+		})
+	}
+}
+
+// deleteUser deletes the given user straight from the store
+func deleteUser(t *testing.T, s *testkit.Server, u *database.User) {
+	t.Helper()
+	if err := s.Store.DeleteUser(s.Ctx(), u); err != nil {
+		t.Fatalf("error deleting user %d: %v", u.ID, err)
+	}
+}
+
+func TestDeletedUserToken(t *testing.T) {
+	s := testkit.NewServer(t)
+	admin := s.SeedUser(&database.User{Username: "gone-admin", Role: auth.RoleAdmin})
+	auditor := s.SeedUser(&database.User{Username: "gone-auditor", Role: auth.RoleAuditor})
+	superAdmin := s.SeedUser(&database.User{Username: "gone-super-admin", Role: auth.RoleSuperAdmin})
+	tokens := map[*database.User]string{}
+	for _, u := range []*database.User{admin, auditor, superAdmin} {
+		// issued before the user was deleted
+		tokens[u] = s.TokenFor(u)
+		deleteUser(t, s, u)
+	}
+	other := s.SeedUser(&database.User{Username: "other"})
+
+	tests := []struct {
+		name   string
+		u      *database.User
+		method string
+		path   string
+		body   interface{}
+	}{
+		{"admin lists users", admin, http.MethodGet, "/api/v1/users", nil},
+		{"admin creates an user", admin, http.MethodPost, "/api/v1/users", userBody("new", auth.RoleAdmin)},
+		{"admin deletes an user", admin, http.MethodDelete, userPath(other.ID), nil},
+		{"admin lists webhooks", admin, http.MethodGet, "/api/v1/webhooks", nil},
+		{"admin gets itself", admin, http.MethodGet, "/api/v1/users/me", nil},
+		{"auditor lists audit events", auditor, http.MethodGet, "/api/v1/audit-events", nil},
+		{"super-admin lists organizations", superAdmin, http.MethodGet, "/api/v1/organizations", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkStatus(t, s.Do(tt.method, tt.path, tokens[tt.u], tt.body), http.StatusUnauthorized)
+		})
+	}
+}
+
+func TestUserOfAnotherOrganization(t *testing.T) {
+	s := testkit.NewServer(t)
+	acme := s.SeedOrganization("acme")
+	other := s.SeedUser(&database.User{Username: "acme-user", OrganizationID: acme.ID})
+	deletedOther := s.SeedUser(&database.User{Username: "acme-gone", OrganizationID: acme.ID})
+	deleteUser(t, s, deletedOther)
+	admin := s.Token(auth.RoleAdmin)
+	superAdmin := s.Token(auth.RoleSuperAdmin)
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{"admin gets", admin, http.MethodGet, userPath(other.ID), nil, http.StatusNotFound},
+		{"admin replaces", admin, http.MethodPut, userPath(other.ID), userBody("acme-user", auth.RoleAdmin), http.StatusNotFound},
+		{"admin deletes", admin, http.MethodDelete, userPath(other.ID), nil, http.StatusNotFound},
+		{"admin exports", admin, http.MethodGet, userPath(other.ID) + "/export", nil, http.StatusNotFound},
+		{"admin restores", admin, http.MethodPost, userPath(deletedOther.ID) + "/restore", nil, http.StatusNotFound},
+		{"admin erases", admin, http.MethodPost, userPath(other.ID) + "/erase", nil, http.StatusNotFound},
+		{"super-admin gets", superAdmin, http.MethodGet, userPath(other.ID), nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkStatus(t, s.Do(tt.method, tt.path, tt.token, tt.body), tt.status)
+		})
+	}
+
+	t.Run("admin lists after a cursor of another organization", func(t *testing.T) {
+		// as if the user did not exist, so that its sort values can not be probed
+		cursor := database.Cursor{After: other.ID}.Encode()
+		resp := s.Do(http.MethodGet, "/api/v1/users?sort=username&cursor="+cursor, admin, nil)
+		checkProblem(t, s, resp, http.StatusBadRequest, controller.ProblemStaleCursor)
+	})
+
+	t.Run("admin lists", func(t *testing.T) {
+		resp := s.Do(http.MethodGet, "/api/v1/users?pageSize=100", admin, nil)
+		checkStatus(t, resp, http.StatusOK)
+		var users []controller.UserResponse
+		s.Decode(resp, &users)
+		for _, u := range users {
+			if u.OrganizationID != s.Organization(database.DefaultOrganizationSlug).ID {
+				t.Fatalf("listed user %d of organization %d", u.ID, u.OrganizationID)
+			}
+		}
+	})
+}
+
+func TestUserIfMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifMatch func(current int64) string
+		status  int
+	}{
+		{"none", func(int64) string { return "" }, 0},
+		{"current version", controller.ETag, 0},
+		{"any version", func(int64) string { return "*" }, 0},
+		{"one of the versions", func(current int64) string {
+			return controller.ETag(current-1) + ", " + controller.ETag(current)
+		}, 0},
+		{"previous version", func(current int64) string { return controller.ETag(current - 1) }, http.StatusPreconditionFailed},
+		{"weak current version", func(current int64) string { return "W/" + controller.ETag(current) }, http.StatusPreconditionFailed},
+	}
+	requests := []struct {
+		method      string
+		contentType string
+		body        func(u *database.User) interface{}
+		status      int
+	}{
+		{http.MethodPut, "", func(u *database.User) interface{} { return userBody(u.Username, auth.RoleAdmin) }, http.StatusOK},
+		{http.MethodPatch, controller.ContentTypeMergePatch,
+			func(*database.User) interface{} { return map[string]string{"first_name": "John"} }, http.StatusOK},
+		{http.MethodDelete, "", func(*database.User) interface{} { return nil }, http.StatusNoContent},
+	}
+	for _, r := range requests {
+		for _, tt := range tests {
+			t.Run(r.method+" "+tt.name, func(t *testing.T) {
+				s := testkit.NewServer(t)
+				u := s.SeedUser(&database.User{})
+				// a version which has a previous one
+				u, err := s.Store.UpdateUser(s.Ctx(), u)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req := s.NewRequest(r.method, userPath(u.ID), s.Token(auth.RoleAdmin), r.body(u))
+				if r.contentType != "" {
+					req.Header.Set("Content-Type", r.contentType)
+				}
+				if ifMatch := tt.ifMatch(u.Version); ifMatch != "" {
+					req.Header.Set("If-Match", ifMatch)
+				}
+				resp := s.Send(req)
+				if tt.status == http.StatusPreconditionFailed {
+					checkProblem(t, s, resp, tt.status, "PRECONDITION_FAILED")
+					return
+				}
+				checkStatus(t, resp, r.status)
+				if r.method != http.MethodDelete && resp.Header.Get("ETag") != controller.ETag(u.Version+1) {
+					t.Fatalf("expected ETag %s, got %s", controller.ETag(u.Version+1), resp.Header.Get("ETag"))
+				}
+			})
+		}
+	}
+}
+
+func TestUserPatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		patch       interface{}
+		status      int
+		code        controller.ProblemCode
+		// wantPassword is the password of the patched user, if it is not the seeded one
+		wantPassword string
+	}{
+		{
+			name:        "merge patch of the role",
+			contentType: controller.ContentTypeMergePatch,
+			patch:       map[string]interface{}{"role": auth.RoleAuditor},
+			status:      http.StatusOK,
+		},
+		{
+			name:        "JSON Patch of the role",
+			contentType: controller.ContentTypeJSONPatch,
+			patch:       []map[string]interface{}{{"op": "replace", "path": "/role", "value": auth.RoleAuditor}},
+			status:      http.StatusOK,
+		},
+		{
+			name:         "password",
+			contentType:  controller.ContentTypeJSONPatch,
+			patch:        []map[string]interface{}{{"op": "add", "path": "/password", "value": "N3w-Pa$$w0rd"}},
+			status:       http.StatusOK,
+			wantPassword: "N3w-Pa$$w0rd",
+		},
+		{
+			name:        "failing test operation",
+			contentType: controller.ContentTypeJSONPatch,
+			patch: []map[string]interface{}{
+				{"op": "test", "path": "/role", "value": auth.RoleSuperAdmin},
+				{"op": "replace", "path": "/role", "value": auth.RoleAuditor},
+			},
+			status: http.StatusUnprocessableEntity,
+			code:   "UNPROCESSABLE_ENTITY",
+		},
+		{
+			name:        "unknown field",
+			contentType: controller.ContentTypeMergePatch,
+			patch:       map[string]interface{}{"organization_id": 2},
+			status:      http.StatusBadRequest,
+			code:        "BAD_REQUEST",
+		},
+		{
+			name:        "wrong content type",
+			contentType: "application/json",
+			patch:       map[string]interface{}{"role": auth.RoleAuditor},
+			status:      http.StatusUnsupportedMediaType,
+			code:        "UNSUPPORTED_MEDIA_TYPE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testkit.NewServer(t)
+			// a username which is no longer valid, so that the patch fails if it validates more than the role
+			u := s.SeedUser(&database.User{Username: "j.doe"})
+			req := s.NewRequest(http.MethodPatch, userPath(u.ID), s.Token(auth.RoleAdmin), tt.patch)
+			req.Header.Set("Content-Type", tt.contentType)
+			resp := s.Send(req)
+			if tt.code != "" {
+				checkProblem(t, s, resp, tt.status, tt.code)
+				return
+			}
+			checkStatus(t, resp, tt.status)
+			patched, err := s.Store.GetUserByID(s.Ctx(), u.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantPassword == "" {
+				if patched.Password != u.Password {
+					t.Errorf("expected the password hash to be kept, got %q instead of %q", patched.Password, u.Password)
+				}
+				if patched.Role != auth.RoleAuditor {
+					t.Errorf("expected the role %s, got %s", auth.RoleAuditor, patched.Role)
+				}
+			} else if !auth.ComparePasswords(tt.wantPassword, patched.Password) {
+				t.Errorf("expected the password to be changed to %q", tt.wantPassword)
+			}
+			if patched.Username != u.Username || patched.Email != u.Email {
+				t.Errorf("expected only the patched fields to change, got %+v", patched)
+			}
+		})
+	}
+}
+
+var linkPattern = regexp.MustCompile(`<([^>]+)>; rel="(next|prev)"`)
+
+// links returns the URLs of the next and previous pages, by rel, of the Link header
+func links(resp *http.Response) map[string]string {
+	byRel := map[string]string{}
+	for _, match := range linkPattern.FindAllStringSubmatch(resp.Header.Get("Link"), -1) {
+		byRel[match[2]] = match[1]
+	}
+	return byRel
+}
+
+func TestUserListCursorPaging(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		// want are the usernames of the seeded users in the order of the list
+		want []string
+	}{
+		{"by id", "", []string{"u4", "u2", "u7", "u1", "u5", "u3", "u6"}},
+		{"by username", "&sort=username", []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7"}},
+		{"by username descending", "&sort=-username", []string{"u7", "u6", "u5", "u4", "u3", "u2", "u1"}},
+		{"by role then id", "&sort=-role", []string{"u2", "u1", "u3", "u4", "u7", "u5", "u6"}},
+		{"filtered", "&filter[username][prefix]=u&sort=-username&filter[role][eq]=2", []string{"u3", "u2", "u1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testkit.NewServer(t)
+			// the token is of a super-admin, so that it is not listed among the admins and auditors
+			token := s.Token(auth.RoleSuperAdmin)
+			for _, username := range []string{"u4", "u2", "u7", "u1", "u5", "u3", "u6"} {
+				role := auth.RoleAdmin
+				if username == "u1" || username == "u2" || username == "u3" {
+					role = auth.RoleAuditor
+				}
+				s.SeedUser(&database.User{Username: username, Role: role})
+			}
+			query := "?pageSize=3&filter[role][ne]=3" + tt.query
+
+			var forward []string
+			var pages []string
+			next := "/api/v1/users" + query
+			for next != "" {
+				pages = append(pages, next)
+				resp := s.Do(http.MethodGet, next, token, nil)
+				checkStatus(t, resp, http.StatusOK)
+				if total := resp.Header.Get("X-Total-Count"); total != fmt.Sprint(len(tt.want)) {
+					t.Fatalf("expected a total of %d, got %s", len(tt.want), total)
+				}
+				next = links(resp)["next"]
+				var users []controller.UserResponse
+				s.Decode(resp, &users)
+				for _, u := range users {
+					forward = append(forward, u.Username)
+				}
+			}
+			if fmt.Sprint(forward) != fmt.Sprint(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, forward)
+			}
+
+			// back from the last page
+			var backward []string
+			prev := links(s.Do(http.MethodGet, pages[len(pages)-1], token, nil))["prev"]
+			for prev != "" {
+				resp := s.Do(http.MethodGet, prev, token, nil)
+				checkStatus(t, resp, http.StatusOK)
+				prev = links(resp)["prev"]
+				var users []controller.UserResponse
+				s.Decode(resp, &users)
+				page := make([]string, len(users))
+				for i, u := range users {
+					page[i] = u.Username
+				}
+				backward = append(page, backward...)
+			}
+			lastPage := (len(tt.want) - 1) / 3 * 3
+			if fmt.Sprint(backward) != fmt.Sprint(tt.want[:lastPage]) {
+				t.Fatalf("expected %v before the last page, got %v", tt.want[:lastPage], backward)
+			}
+		})
+	}
+
+	t.Run("stale cursor", func(t *testing.T) {
+		s := testkit.NewServer(t)
+		cursor := database.Cursor{After: 1000}.Encode()
+		resp := s.Do(http.MethodGet, "/api/v1/users?sort=username&cursor="+cursor, s.Token(auth.RoleAdmin), nil)
+		checkProblem(t, s, resp, http.StatusBadRequest, controller.ProblemStaleCursor)
+	})
+}
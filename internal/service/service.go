@@ -0,0 +1,145 @@
+// Package service holds the business rules of the users, shared by the REST, GraphQL
+// and gRPC APIs, so that the validation, the permission and duplicate checks and the
+// audit log behave the same whichever API the request came through.
+//
+// The services find what they need in the context, as the APIs put it there: the
+// Store, the logger, the token of the signed-in user (and the tenant it reaches) and
+// the origin of the request, for the audit log.
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/logging"
+)
+
+// Kind is the kind of an Error, which each API maps to its own status
+type Kind uint8
+
+// Kinds of errors
+const (
+	// KindInvalid is for the invalid input
+	KindInvalid Kind = iota + 1
+	// KindUnauthorized is for the requests which are not (or no longer) authenticated
+	KindUnauthorized
+	// KindForbidden is for the requests of users who are not allowed to do what they ask
+	KindForbidden
+	// KindNotFound is for the entities which do not exist, or are out of reach
+	KindNotFound
+	// KindConflict is for the entities which would duplicate other ones
+	KindConflict
+	// KindUnprocessable is for the requests which can not be done in the current state
+	KindUnprocessable
+	// KindStale is for the changes of entities which have been changed in the meantime
+	KindStale
+	// KindPreconditionRequired is for the changes which do not state the version they are based on
+	KindPreconditionRequired
+	// KindInternal is for everything else
+	KindInternal
+)
+
+// Error is an error of a service
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap ...
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(kind Kind, err error) *Error {
+	return &Error{Kind: kind, Err: err}
+}
+
+// internalError logs the error, which is unexpected, and returns it as an Error
+func internalError(ctx context.Context, err error, format string, args ...interface{}) *Error {
+	logging.SimpleFromCtx(ctx).Err(err).Msgf(format, args...)
+	return newError(KindInternal, err)
+}
+
+// KindOf returns the kind of the given error, KindInternal if it is not an Error
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+// Audit records the given event, as done while serving the request of ctx, together
+// with the diff between before and after (any of which can be nil); unless already
+// set, the actor is the signed-in user and the outcome is success. The events of
+// changes are recorded in the transaction of the change (see InTx), so that neither
+// is kept without the other.
+func Audit(ctx context.Context, e *database.AuditEvent, before interface{}, after interface{}) error {
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return newError(KindInternal, err)
+	}
+	if !e.ActorID.Valid {
+		if jsonToken, err := icontext.JSONToken(ctx); err == nil {
+			e.ActorID = sql.NullInt64{Int64: jsonToken.UserID, Valid: true}
+			e.ActorRole = sql.NullString{String: jsonToken.Role.String(), Valid: true}
+		}
+	}
+	if e.Outcome == "" {
+		e.Outcome = database.AuditOutcomeSuccess
+	}
+	if e.Diff, err = database.AuditDiffOf(before, after); err != nil {
+		return internalError(ctx, err, "error recording audit event %s on %s", e.Action, e.Target)
+	}
+	if origin, err := icontext.AuditOrigin(ctx); err == nil {
+		e.IP = origin.IP
+		e.UserAgent = origin.UserAgent
+		e.RequestID = origin.RequestID
+	}
+	if _, err := store.RecordAuditEvent(ctx, e); err != nil {
+		return internalError(ctx, err, "error recording audit event %s on %s", e.Action, e.Target)
+	}
+	return nil
+}
+
+// InTx runs fn in a transaction of the Store of ctx, e.g. to make a change and record
+// its audit event; the errors of fn are returned as they are, while failing to commit
+// the transaction is an internal error
+func InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return newError(KindInternal, err)
+	}
+	var errFn error
+	err = store.InTx(ctx, func(ctx context.Context) error {
+		errFn = fn(ctx)
+		return errFn
+	})
+	if err != nil && errFn == nil {
+		return internalError(ctx, err, "error committing transaction")
+	}
+	return err
+}
+
+// UserAuditTarget ...
+func UserAuditTarget(id int64) string {
+	return fmt.Sprintf("user:%d", id)
+}
+
+// UserAuditEvent returns the event of the given action on the user,
+// which happens in the organization of the user
+func UserAuditEvent(action string, u *database.User) *database.AuditEvent {
+	return &database.AuditEvent{
+		Action:         action,
+		Target:         UserAuditTarget(u.ID),
+		OrganizationID: sql.NullInt64{Int64: u.OrganizationID, Valid: u.OrganizationID != 0},
+	}
+}
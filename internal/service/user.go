@@ -0,0 +1,578 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/padurean/purest/internal/auth"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/query"
+	"github.com/padurean/purest/internal/validator"
+)
+
+// SignIn is the token of a signed-in user
+type SignIn struct {
+	Token      string
+	Expiration time.Time
+	// Warning is set when the user should change its password ASAP
+	Warning string
+}
+
+// userAuditView returns the user as the APIs render it, for diffing it
+func userAuditView(u *database.User) interface{} {
+	if u == nil {
+		return nil
+	}
+	nullString := func(s sql.NullString) *string {
+		if !s.Valid {
+			return nil
+		}
+		return &s.String
+	}
+	nullTime := func(t sql.NullTime) *time.Time {
+		if !t.Valid {
+			return nil
+		}
+		return &t.Time
+	}
+	return &struct {
+		*database.User
+		FirstName  *string    `json:"first_name"`
+		LastName   *string    `json:"last_name"`
+		Deleted    *time.Time `json:"deleted"`
+		Anonymized *time.Time `json:"anonymized"`
+	}{u, nullString(u.FirstName), nullString(u.LastName), nullTime(u.Deleted), nullTime(u.Anonymized)}
+}
+
+// validate validates the given input like the APIs do, naming the fields by their JSON names
+func validate(ctx context.Context, input interface{}) error {
+	if err := validator.Validate(ctx, input); err != nil {
+		return newError(KindInvalid, err)
+	}
+	return nil
+}
+
+// validateFields is like validate, but only for the given fields, by their JSON names
+func validateFields(ctx context.Context, input interface{}, fields ...string) error {
+	if err := validator.ValidateFields(ctx, input, fields...); err != nil {
+		return newError(KindInvalid, err)
+	}
+	return nil
+}
+
+// writeError returns the error of writing the given user as an Error
+func writeError(ctx context.Context, err error, action string, u *database.User) error {
+	var errDuplicate *database.ErrDuplicateRow
+	var errStale *database.ErrStaleRow
+	switch {
+	case errors.As(err, &errDuplicate):
+		return newError(KindConflict, err)
+	case errors.Is(err, database.ErrOrganizationRequired):
+		return newError(KindUnprocessable, err)
+	case errors.As(err, &errStale):
+		return newError(KindStale, err)
+	case errors.Is(err, sql.ErrNoRows):
+		// deleted since it was read
+		return newError(KindNotFound, fmt.Errorf("user %d not found", u.ID))
+	default:
+		return internalError(ctx, err, "error %s user %d (%s)", action, u.ID, u.Username)
+	}
+}
+
+// updateUser updates the given user and records the given event of the update, with
+// the diff from the current user, in the same transaction
+func updateUser(
+	ctx context.Context,
+	store database.Store,
+	u *database.User,
+	action string,
+	e *database.AuditEvent,
+	current *database.User,
+) (*database.User, error) {
+	var updated *database.User
+	err := InTx(ctx, func(ctx context.Context) error {
+		var err error
+		if updated, err = store.UpdateUser(ctx, u); err != nil {
+			return writeError(ctx, err, action, u)
+		}
+		return Audit(ctx, e, userAuditView(current), userAuditView(updated))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// hashPassword replaces the password of the user with its hash
+func hashPassword(u *database.User, password string) error {
+	hashedPassword, err := auth.HashAndSaltPassword(password)
+	if err != nil {
+		return newError(KindUnprocessable, err)
+	}
+	u.Password = hashedPassword
+	return nil
+}
+
+// ErrRoleNotAssignable is for the users who can not assign (or take away) a role
+var ErrRoleNotAssignable = fmt.Errorf(
+	"only the %s role can assign the %s role", auth.RoleSuperAdmin, auth.RoleSuperAdmin)
+
+// CheckCanAssignRole checks that the signed-in user can assign (or take away)
+// the given roles, given that only super-admins can manage other super-admins
+func CheckCanAssignRole(ctx context.Context, roles ...auth.Role) error {
+	hasSuperAdmin := false
+	for _, role := range roles {
+		hasSuperAdmin = hasSuperAdmin || role == auth.RoleSuperAdmin
+	}
+	if !hasSuperAdmin {
+		return nil
+	}
+	jsonToken, err := icontext.JSONToken(ctx)
+	if err != nil {
+		return newError(KindUnauthorized, err)
+	}
+	if jsonToken.Role != auth.RoleSuperAdmin {
+		return newError(KindForbidden, ErrRoleNotAssignable)
+	}
+	return nil
+}
+
+// CheckVersion checks the version the change of an entity is based on, if any,
+// against its current version, when the API can not use the If-Match header
+func CheckVersion(version *int64, current int64, required bool) error {
+	if version == nil {
+		if required {
+			return newError(KindPreconditionRequired,
+				errors.New("missing version: use the version returned when the entity was read"))
+		}
+		return nil
+	}
+	if *version != current {
+		return newError(KindStale, fmt.Errorf(
+			"version %d does not match the current version %d: the entity has been changed in the meantime",
+			*version, current))
+	}
+	return nil
+}
+
+// GetUser gets the user with the given id, which can be a deleted one if withDeleted
+func GetUser(ctx context.Context, id int64, withDeleted bool) (*database.User, error) {
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	getByID := store.GetUserByID
+	if withDeleted {
+		getByID = store.GetUserByIDWithDeleted
+	}
+	u, err := getByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, newError(KindNotFound, fmt.Errorf("user %d not found", id))
+		}
+		return nil, internalError(ctx, err, "error getting user with id %d", id)
+	}
+	return u, nil
+}
+
+// GetUserByUsernameOrEmail gets the user by email, if it looks like one, or else by username
+func GetUserByUsernameOrEmail(ctx context.Context, usernameOrEmail string) (*database.User, error) {
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	u, err := userByUsernameOrEmail(ctx, store, usernameOrEmail)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, newError(KindNotFound, fmt.Errorf("user %s not found", usernameOrEmail))
+		}
+		return nil, internalError(ctx, err, "error getting user %s by username or email", usernameOrEmail)
+	}
+	return u, nil
+}
+
+func userByUsernameOrEmail(ctx context.Context, store database.UserStore, usernameOrEmail string) (*database.User, error) {
+	if strings.Contains(usernameOrEmail, "@") {
+		u, err := store.GetUserByEmail(ctx, usernameOrEmail)
+		if err != sql.ErrNoRows {
+			return u, err
+		}
+	}
+	return store.GetUserByUsername(ctx, usernameOrEmail)
+}
+
+// GetSignedInUser gets the user the token of ctx was issued to
+func GetSignedInUser(ctx context.Context) (*database.User, error) {
+	jsonToken, err := icontext.JSONToken(ctx)
+	if err != nil {
+		return nil, newError(KindUnauthorized, err)
+	}
+	u, err := GetUser(ctx, jsonToken.UserID, false)
+	if KindOf(err) == KindNotFound {
+		// the user has been deleted since the token was issued
+		return nil, newError(KindUnauthorized,
+			fmt.Errorf("signed-in user %d does not exist anymore", jsonToken.UserID))
+	}
+	return u, err
+}
+
+// ListUsers lists the users of the given page, filtered and sorted by q (if not nil),
+// and records the total number of users on the page
+func ListUsers(ctx context.Context, page *database.Page, q *query.Query, includeDeleted bool) ([]*database.User, error) {
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	opts := page.ListOptions()
+	opts.IncludeDeleted = includeDeleted
+	opts.Query = q
+	users, err := store.ListUsers(ctx, opts)
+	if err != nil {
+		if errors.Is(err, database.ErrStaleCursor) {
+			return nil, newError(KindInvalid, err)
+		}
+		return nil, internalError(ctx, err, "error listing users page")
+	}
+	total, err := store.CountUsers(ctx, opts)
+	if err != nil {
+		return nil, internalError(ctx, err, "error counting users")
+	}
+	keys := make([]int64, len(users))
+	for i, u := range users {
+		keys[i] = u.ID
+	}
+	page.Listed(total, keys)
+	return users, nil
+}
+
+// SearchUsers searches the users of the given page, which is paginated by number
+// (the first one if not set), by the given text, and records the total number of
+// users found on the page
+func SearchUsers(ctx context.Context, page *database.Page, text string) ([]*database.UserSearchResult, error) {
+	// ranked results can only be paginated by page number
+	if page.Cursor != nil {
+		return nil, newError(KindInvalid, errors.New("search results are paginated by page number, not by cursor"))
+	}
+	if page.Number == 0 {
+		page.Number = 1
+	}
+	if utf8.RuneCountInString(text) < database.UserSearchMinLength {
+		return nil, newError(KindInvalid, fmt.Errorf(
+			"the searched text '%s' must have at least %d characters", text, database.UserSearchMinLength))
+	}
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	results, err := store.SearchUsers(ctx, text, page.ListOptions())
+	if err != nil {
+		return nil, internalError(ctx, err, "error searching users by %s", text)
+	}
+	total, err := store.CountUserSearch(ctx, text)
+	if err != nil {
+		return nil, internalError(ctx, err, "error counting the users found by %s", text)
+	}
+	keys := make([]int64, len(results))
+	for i, result := range results {
+		keys[i] = result.ID
+	}
+	page.Listed(total, keys)
+	return results, nil
+}
+
+// SignInUser checks the password of the user with the given username or email, of
+// the organization with the given slug (the default one if empty), and issues its token
+func SignInUser(ctx context.Context, usernameOrEmail string, password string, organization string) (*SignIn, error) {
+	if err := validate(ctx, &struct {
+		Password string `json:"password" validate:"required"`
+	}{password}); err != nil {
+		return nil, err
+	}
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	if organization == "" {
+		organization = database.DefaultOrganizationSlug
+	}
+	o, err := store.GetOrganizationBySlug(ctx, organization)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, newError(KindNotFound, fmt.Errorf("organization %s not found", organization))
+		}
+		return nil, internalError(ctx, err, "error getting organization %s by slug", organization)
+	}
+	// the user is looked up, and the sign-in audited, within its organization
+	ctx = database.WithTenant(ctx, o.ID)
+	u, err := GetUserByUsernameOrEmail(ctx, usernameOrEmail)
+	if err != nil {
+		if KindOf(err) == KindNotFound {
+			if err := Audit(ctx, &database.AuditEvent{
+				Action:  "user.sign_in",
+				Target:  "user:" + usernameOrEmail,
+				Outcome: database.AuditOutcomeFailure,
+			}, nil, nil); err != nil {
+				return nil, err
+			}
+		}
+		return nil, err
+	}
+	if !auth.ComparePasswords(password, u.Password) {
+		if err := Audit(ctx, &database.AuditEvent{
+			Action:  "user.sign_in",
+			Target:  UserAuditTarget(u.ID),
+			Outcome: database.AuditOutcomeFailure,
+		}, nil, nil); err != nil {
+			return nil, err
+		}
+		err := fmt.Errorf("%w supplied for user %d", auth.ErrWrongPassword, u.ID)
+		logging.SimpleFromCtx(ctx).Err(err).Msg("")
+		return nil, newError(KindUnauthorized, err)
+	}
+	token, expiration, err := auth.GenerateToken(u.ID, u.OrganizationID, u.Role)
+	if err != nil {
+		return nil, internalError(ctx, err, "error generating token for user %d", u.ID)
+	}
+	warning := ""
+	if u.Username == auth.DefaultAdminUser && password == auth.DefaultAdminPassword {
+		warning = fmt.Sprintf(
+			"%s user is using the default password, to improve security please change it ASAP",
+			u.Username)
+	}
+	// no token is handed out without its sign-in being recorded
+	if err := Audit(ctx, &database.AuditEvent{
+		ActorID:   sql.NullInt64{Int64: u.ID, Valid: true},
+		ActorRole: sql.NullString{String: u.Role.String(), Valid: true},
+		Action:    "user.sign_in",
+		Target:    UserAuditTarget(u.ID),
+	}, nil, nil); err != nil {
+		return nil, err
+	}
+	return &SignIn{Token: token, Expiration: expiration, Warning: warning}, nil
+}
+
+// CreateUser creates the given user, whose password is given in plain text
+func CreateUser(ctx context.Context, u *database.User) (*database.User, error) {
+	if err := validate(ctx, u); err != nil {
+		return nil, err
+	}
+	if err := CheckCanAssignRole(ctx, u.Role); err != nil {
+		return nil, err
+	}
+	if err := hashPassword(u, u.Password); err != nil {
+		return nil, err
+	}
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	var created *database.User
+	err = InTx(ctx, func(ctx context.Context) error {
+		var err error
+		if created, err = store.CreateUser(ctx, u); err != nil {
+			return writeError(ctx, err, "creating", u)
+		}
+		return Audit(ctx, UserAuditEvent("user.create", created), nil, userAuditView(created))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// UpdateUser replaces the current user with the given one, whose password is given
+// in plain text, keeping its id, version and organization
+func UpdateUser(ctx context.Context, current *database.User, u *database.User) (*database.User, error) {
+	if err := validate(ctx, u); err != nil {
+		return nil, err
+	}
+	if err := CheckCanAssignRole(ctx, current.Role, u.Role); err != nil {
+		return nil, err
+	}
+	u.ID = current.ID
+	u.Version = current.Version
+	// users can not be moved to other organizations
+	u.OrganizationID = current.OrganizationID
+	if err := hashPassword(u, u.Password); err != nil {
+		return nil, err
+	}
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	return updateUser(ctx, store, u, "updating", UserAuditEvent("user.update", current), current)
+}
+
+// PatchUser changes the given fields, by their JSON names, of the current user to the
+// ones of the given user, validating only them; the password is given in plain text,
+// and is only hashed and changed if it is among the fields
+func PatchUser(ctx context.Context, current *database.User, u *database.User, fields []string) (*database.User, error) {
+	if len(fields) == 0 {
+		return current, nil
+	}
+	if err := validateFields(ctx, u, fields...); err != nil {
+		return nil, err
+	}
+	if err := CheckCanAssignRole(ctx, current.Role, u.Role); err != nil {
+		return nil, err
+	}
+	u.ID = current.ID
+	u.Version = current.Version
+	// users can not be moved to other organizations
+	u.OrganizationID = current.OrganizationID
+	password := u.Password
+	u.Password = current.Password
+	for _, field := range fields {
+		if field == "password" {
+			if err := hashPassword(u, password); err != nil {
+				return nil, err
+			}
+		}
+	}
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	return updateUser(ctx, store, u, "updating", UserAuditEvent("user.update", current), current)
+}
+
+// UpdatePassword changes the password of the given (signed-in) user, if the old one is right
+func UpdatePassword(ctx context.Context, u *database.User, oldPassword string, newPassword string) (*database.User, error) {
+	if err := validate(ctx, &struct {
+		OldPassword string `json:"old_password" validate:"required"`
+		NewPassword string `json:"new_password" validate:"required,password"`
+	}{oldPassword, newPassword}); err != nil {
+		return nil, err
+	}
+	if !auth.ComparePasswords(oldPassword, u.Password) {
+		if err := Audit(ctx, &database.AuditEvent{
+			Action:  "user.update_password",
+			Target:  UserAuditTarget(u.ID),
+			Outcome: database.AuditOutcomeFailure,
+		}, nil, nil); err != nil {
+			return nil, err
+		}
+		return nil, newError(KindUnauthorized, fmt.Errorf("%w: the old password is incorrect", auth.ErrWrongPassword))
+	}
+	changed := *u
+	if err := hashPassword(&changed, newPassword); err != nil {
+		return nil, err
+	}
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	return updateUser(ctx, store, &changed, "updating password of", UserAuditEvent("user.update_password", u), u)
+}
+
+// UpdateEmail changes the email of the given (signed-in) user
+func UpdateEmail(ctx context.Context, u *database.User, email string) (*database.User, error) {
+	if err := validate(ctx, &struct {
+		Email string `json:"email" validate:"required,email"`
+	}{email}); err != nil {
+		return nil, err
+	}
+	changed := *u
+	changed.Email = email
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	return updateUser(ctx, store, &changed, "updating email of", UserAuditEvent("user.update_email", u), u)
+}
+
+// DeleteUser deletes the given user, which can then be restored
+func DeleteUser(ctx context.Context, u *database.User) error {
+	if err := CheckCanAssignRole(ctx, u.Role); err != nil {
+		return err
+	}
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return newError(KindInternal, err)
+	}
+	return InTx(ctx, func(ctx context.Context) error {
+		if err := store.DeleteUser(ctx, u); err != nil {
+			var errStale *database.ErrStaleRow
+			if errors.As(err, &errStale) {
+				return newError(KindStale, err)
+			}
+			if errors.Is(err, sql.ErrNoRows) {
+				return newError(KindNotFound, fmt.Errorf("user %d not found", u.ID))
+			}
+			return internalError(ctx, err, "error deleting user %d", u.ID)
+		}
+		return Audit(ctx, UserAuditEvent("user.delete", u), nil, nil)
+	})
+}
+
+// RestoreUser restores the given deleted user
+func RestoreUser(ctx context.Context, u *database.User) (*database.User, error) {
+	if !u.Deleted.Valid {
+		return nil, newError(KindUnprocessable, fmt.Errorf("user %d is not deleted", u.ID))
+	}
+	if err := CheckCanAssignRole(ctx, u.Role); err != nil {
+		return nil, err
+	}
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	var restored *database.User
+	err = InTx(ctx, func(ctx context.Context) error {
+		var err error
+		if restored, err = store.RestoreUser(ctx, u); err != nil {
+			return writeError(ctx, err, "restoring", u)
+		}
+		return Audit(ctx, UserAuditEvent("user.restore", u), userAuditView(u), userAuditView(restored))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+// EraseUser irreversibly anonymizes the personal data of the given user, deleted or
+// not, at the request of the signed-in user
+func EraseUser(ctx context.Context, u *database.User) (*database.User, error) {
+	if err := CheckCanAssignRole(ctx, u.Role); err != nil {
+		return nil, err
+	}
+	jsonToken, err := icontext.JSONToken(ctx)
+	if err != nil {
+		return nil, newError(KindUnauthorized, err)
+	}
+	store, err := icontext.Store(ctx)
+	if err != nil {
+		return nil, newError(KindInternal, err)
+	}
+	var erased *database.User
+	err = InTx(ctx, func(ctx context.Context) error {
+		var err error
+		if erased, err = store.EraseUser(ctx, u, jsonToken.UserID); err != nil {
+			var errAlreadyErased *database.ErrAlreadyErased
+			switch {
+			case errors.As(err, &errAlreadyErased):
+				return newError(KindUnprocessable, err)
+			case errors.Is(err, sql.ErrNoRows):
+				return newError(KindNotFound, fmt.Errorf("user %d not found", u.ID))
+			default:
+				return internalError(ctx, err, "error erasing user %d", u.ID)
+			}
+		}
+		// no diff, as it would keep the erased personal data
+		return Audit(ctx, UserAuditEvent("user.erase", u), nil, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	logging.SimpleFromCtx(ctx).Info().Msgf(
+		"personal data of user %d erased at the request of user %d", u.ID, jsonToken.UserID)
+	return erased, nil
+}
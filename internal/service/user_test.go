@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/padurean/purest/internal/auth"
+	icontext "github.com/padurean/purest/internal/context"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/rs/zerolog"
+)
+
+// failingStore fails to delete users and to record audit events with the given errors, if any
+type failingStore struct {
+	*database.MemoryStore
+	errDelete error
+	errAudit  error
+}
+
+func (s *failingStore) DeleteUser(ctx context.Context, u *database.User) error {
+	if s.errDelete != nil {
+		return s.errDelete
+	}
+	return s.MemoryStore.DeleteUser(ctx, u)
+}
+
+func (s *failingStore) RecordAuditEvent(ctx context.Context, e *database.AuditEvent) (*database.AuditEvent, error) {
+	if s.errAudit != nil {
+		return nil, s.errAudit
+	}
+	return s.MemoryStore.RecordAuditEvent(ctx, e)
+}
+
+// newTestContext returns the context of a request of an admin of the default
+// organization, served with the given store
+func newTestContext(t *testing.T, store database.Store) context.Context {
+	t.Helper()
+	nop := zerolog.Nop()
+	ctx := context.WithValue(context.Background(), "logger", &logging.Logger{Logger: &nop})
+	ctx = context.WithValue(ctx, icontext.KeyStore, store)
+	o, err := store.GetOrganizationBySlug(database.WithAllTenants(ctx), database.DefaultOrganizationSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, icontext.KeyJSONToken,
+		&auth.JSONToken{UserID: 1, OrganizationID: o.ID, Role: auth.RoleAdmin})
+	return database.WithTenant(ctx, o.ID)
+}
+
+func TestDeleteUserErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantKind Kind
+	}{
+		{"stale", &database.ErrStaleRow{}, KindStale},
+		{"not found", sql.ErrNoRows, KindNotFound},
+		{"unexpected", errors.New("driver: bad connection"), KindInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &failingStore{MemoryStore: database.NewMemoryStore(), errDelete: tt.err}
+			err := DeleteUser(newTestContext(t, store), &database.User{ID: 2})
+			if got := KindOf(err); got != tt.wantKind {
+				t.Errorf("expected an error of kind %v, got %v (%v)", tt.wantKind, got, err)
+			}
+		})
+	}
+}
+
+func TestAuditFailure(t *testing.T) {
+	if err := auth.GenerateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	store := &failingStore{MemoryStore: database.NewMemoryStore()}
+	ctx := newTestContext(t, store)
+	u, err := CreateUser(ctx, &database.User{
+		Username: "jdoe",
+		Email:    "jdoe@example.com",
+		Password: "Pass-w0rd!",
+		Role:     auth.RoleAuditor,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.errAudit = errors.New("driver: bad connection")
+
+	tests := []struct {
+		name string
+		do   func() error
+		// check fails the test if the change has not been undone
+		check func(t *testing.T)
+	}{
+		{
+			name: "create",
+			do: func() error {
+				_, err := CreateUser(ctx, &database.User{
+					Username: "jroe", Email: "jroe@example.com", Password: "Pass-w0rd!", Role: auth.RoleAuditor})
+				return err
+			},
+			check: func(t *testing.T) {
+				if _, err := store.GetUserByUsername(ctx, "jroe"); !errors.Is(err, sql.ErrNoRows) {
+					t.Errorf("expected the user not to be created, got %v", err)
+				}
+			},
+		},
+		{
+			name: "update email",
+			do: func() error {
+				_, err := UpdateEmail(ctx, u, "jdoe@example.org")
+				return err
+			},
+			check: func(t *testing.T) {
+				if got, err := store.GetUserByID(ctx, u.ID); err != nil || got.Email != u.Email {
+					t.Errorf("expected the email to stay %s, got %+v (%v)", u.Email, got, err)
+				}
+			},
+		},
+		{
+			name: "delete",
+			do:   func() error { return DeleteUser(ctx, u) },
+			check: func(t *testing.T) {
+				if _, err := store.GetUserByID(ctx, u.ID); err != nil {
+					t.Errorf("expected the user not to be deleted, got %v", err)
+				}
+			},
+		},
+		{
+			name: "sign in",
+			do: func() error {
+				signIn, err := SignInUser(ctx, "jdoe", "Pass-w0rd!", "")
+				if err == nil && signIn.Token == "" {
+					t.Errorf("expected no token")
+				}
+				return err
+			},
+		},
+		{
+			name: "wrong password",
+			do: func() error {
+				_, err := SignInUser(ctx, "jdoe", "Wrong-passw0rd!", "")
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := KindOf(tt.do()); got != KindInternal {
+				t.Fatalf("expected an error of kind %v, got %v", KindInternal, got)
+			}
+			if tt.check != nil {
+				tt.check(t)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+// Package stream pushes the events of the outbox to the clients following them as they
+// happen, e.g. over Server-Sent Events or WebSocket.
+//
+// The events themselves do not go through the Broker: it only wakes up the subscriptions
+// of the organization of the events written, by any instance of the API, which then read
+// from the outbox the events they have not sent yet. So a subscription can resume after
+// any event, a slow client holds back nobody but itself, the events do not pile up in
+// memory, and a subscription woken up several times before it reads only reads once.
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/padurean/purest/internal/database"
+	"github.com/rs/zerolog/log"
+)
+
+// BatchSize is the max number of events read at once by a subscription
+const BatchSize = 100
+
+const (
+	watchBackoffMin = 1 * time.Second
+	watchBackoffMax = 30 * time.Second
+)
+
+// Broker wakes up the subscriptions when events are written to the outbox.
+// It only watches the outbox while there are subscriptions.
+type Broker struct {
+	store     database.OutboxStore
+	heartbeat time.Duration
+
+	mu            sync.Mutex
+	subscriptions map[*Subscription]struct{}
+	stopWatching  context.CancelFunc
+}
+
+// NewBroker returns a broker whose subscriptions send a heartbeat every given
+// interval, also when there are events, so the clients can tell they are alive
+func NewBroker(store database.OutboxStore, heartbeat time.Duration) *Broker {
+	return &Broker{store: store, heartbeat: heartbeat, subscriptions: map[*Subscription]struct{}{}}
+}
+
+// Subscription follows the events of an organization, or of all of them
+type Subscription struct {
+	broker         *Broker
+	organizationID int64
+	all            bool
+	wake           chan struct{}
+	heartbeat      *time.Ticker
+	after          int64
+}
+
+// Subscribe returns a subscription to the events of the organization ctx is
+// scoped to (or of all of them if it can reach all), starting after the given
+// event id, which has to be closed once done with
+func (b *Broker) Subscribe(ctx context.Context, after int64) *Subscription {
+	organizationID, scoped := database.Tenant(ctx)
+	s := &Subscription{
+		broker:         b,
+		organizationID: organizationID,
+		all:            !scoped,
+		// one pending wake up is enough, as it makes the subscription read all there is
+		wake:      make(chan struct{}, 1),
+		heartbeat: time.NewTicker(b.heartbeat),
+		after:     after,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscriptions[s] = struct{}{}
+	if b.stopWatching == nil {
+		var watchCtx context.Context
+		watchCtx, b.stopWatching = context.WithCancel(context.Background())
+		go b.watch(watchCtx)
+	}
+	return s
+}
+
+func (b *Broker) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscriptions, s)
+	if len(b.subscriptions) == 0 && b.stopWatching != nil {
+		b.stopWatching()
+		b.stopWatching = nil
+	}
+}
+
+// notify wakes up the subscriptions which follow the given organization
+func (b *Broker) notify(organizationID int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscriptions {
+		if s.all || s.organizationID == organizationID {
+			s.wakeUp()
+		}
+	}
+}
+
+// notifyAll wakes up all the subscriptions, e.g. to catch up with the
+// events which were written while the outbox was not watched
+func (b *Broker) notifyAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscriptions {
+		s.wakeUp()
+	}
+}
+
+// watch watches the outbox until ctx is done, watching it again,
+// with exponential backoff, whenever watching fails
+func (b *Broker) watch(ctx context.Context) {
+	backoff := watchBackoffMin
+	for {
+		started := time.Now()
+		err := b.store.WatchOutboxEvents(ctx, b.notify)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > watchBackoffMax {
+			backoff = watchBackoffMin
+		}
+		log.Error().Err(err).Msgf("error watching outbox events, watching again in %s ...", backoff)
+		b.notifyAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > watchBackoffMax {
+			backoff = watchBackoffMax
+		}
+	}
+}
+
+func (s *Subscription) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Next reads the next events, at most BatchSize of them, which are
+// considered sent once read; a full batch means there may be more
+func (s *Subscription) Next(ctx context.Context) ([]*database.OutboxEvent, error) {
+	events, err := s.broker.store.ListOutboxEvents(ctx, s.after, BatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the events after %d: %w", s.after, err)
+	}
+	if len(events) > 0 {
+		s.after = events[len(events)-1].ID
+	}
+	return events, nil
+}
+
+// Wait blocks until events may have been written since the last call of Next, or until
+// the heartbeat interval passes, when it returns true, as the heartbeat is due. Next
+// should be called after either, as the heartbeats also catch up with the events
+// whose notifications were lost, e.g. while the database was not reachable.
+func (s *Subscription) Wait(ctx context.Context) (heartbeat bool, err error) {
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-s.wake:
+		return false, nil
+	case <-s.heartbeat.C:
+		return true, nil
+	}
+}
+
+// HeartbeatDue reports, without blocking, whether the heartbeat is due,
+// e.g. while there are more events to send right away
+func (s *Subscription) HeartbeatDue() bool {
+	select {
+	case <-s.heartbeat.C:
+		return true
+	default:
+		return false
+	}
+}
+
+// HeartbeatInterval ...
+func (s *Subscription) HeartbeatInterval() time.Duration {
+	return s.broker.heartbeat
+}
+
+// Close ...
+func (s *Subscription) Close() {
+	s.heartbeat.Stop()
+	s.broker.unsubscribe(s)
+}
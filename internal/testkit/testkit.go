@@ -0,0 +1,228 @@
+// Package testkit serves the full API router with httptest, backed by an in-memory
+// store, for fast end-to-end tests of the API which need no PostgreSQL, e.g.:
+//
+//	func TestUserGetMe(t *testing.T) {
+//		s := testkit.NewServer(t)
+//		token := s.Token(auth.RoleAdmin)
+//		resp := s.Do(http.MethodGet, "/api/v1/users/me", token, nil)
+//		if resp.StatusCode != http.StatusOK {
+//			t.Fatalf("expected 200, got %d", resp.StatusCode)
+//		}
+//		var u controller.UserResponse
+//		s.Decode(resp, &u)
+//	}
+package testkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/database"
+	"github.com/padurean/purest/internal/logging"
+	"github.com/padurean/purest/internal/outbox"
+	"github.com/padurean/purest/internal/server"
+	"github.com/padurean/purest/internal/webhook"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultPassword is the password of the seeded users which are given none
+const DefaultPassword = "Passw0rd!"
+
+var keysOnce sync.Once
+var keysErr error
+
+// Server is the API served from an in-memory store, which is closed
+// when the test which started it ends
+type Server struct {
+	*httptest.Server
+	Store *database.MemoryStore
+
+	t      testing.TB
+	mu     sync.Mutex
+	seeded int
+}
+
+// NewServer starts the API, with no users, only the default organization
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	// tokens are signed with keys kept in memory, instead of the ones from the files
+	keysOnce.Do(func() { keysErr = auth.GenerateKeys() })
+	if keysErr != nil {
+		t.Fatalf("error generating access keys: %v", keysErr)
+	}
+	nop := zerolog.Nop()
+	store := database.NewMemoryStore()
+	s := &Server{
+		Server: httptest.NewServer(server.NewHandler(store, &logging.Logger{Logger: &nop})),
+		Store:  store,
+		t:      t,
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Ctx is the context of the changes made by the kit, which reaches all the
+// organizations, e.g. to change the store straight, bypassing the API
+func (s *Server) Ctx() context.Context {
+	return database.WithAllTenants(context.Background())
+}
+
+// Organization returns the organization with the given slug, failing the test if there is none
+func (s *Server) Organization(slug string) *database.Organization {
+	s.t.Helper()
+	o, err := s.Store.GetOrganizationBySlug(s.Ctx(), slug)
+	if err != nil {
+		s.t.Fatalf("error getting organization %s: %v", slug, err)
+	}
+	return o
+}
+
+// SeedOrganization creates an organization with the given slug
+func (s *Server) SeedOrganization(slug string) *database.Organization {
+	s.t.Helper()
+	o, err := s.Store.CreateOrganization(s.Ctx(), &database.Organization{Name: slug, Slug: slug})
+	if err != nil {
+		s.t.Fatalf("error seeding organization %s: %v", slug, err)
+	}
+	return o
+}
+
+// SeedUser creates the given user, filling in whatever it is missing: a unique
+// username and email, DefaultPassword, the Admin role and the default organization.
+// The password is given in plain text, and the created user has it hashed.
+func (s *Server) SeedUser(u *database.User) *database.User {
+	s.t.Helper()
+	s.mu.Lock()
+	s.seeded++
+	n := s.seeded
+	s.mu.Unlock()
+
+	seeded := *u
+	if seeded.Username == "" {
+		seeded.Username = fmt.Sprintf("user%d", n)
+	}
+	if seeded.Email == "" {
+		seeded.Email = seeded.Username + "@example.com"
+	}
+	if seeded.Password == "" {
+		seeded.Password = DefaultPassword
+	}
+	if seeded.Role == 0 {
+		seeded.Role = auth.RoleAdmin
+	}
+	if seeded.OrganizationID == 0 {
+		seeded.OrganizationID = s.Organization(database.DefaultOrganizationSlug).ID
+	}
+	// the cheapest hashing, to keep the tests fast
+	hashed, err := bcrypt.GenerateFromPassword([]byte(seeded.Password), bcrypt.MinCost)
+	if err != nil {
+		s.t.Fatalf("error hashing the password of user %s: %v", seeded.Username, err)
+	}
+	seeded.Password = string(hashed)
+	created, err := s.Store.CreateUser(s.Ctx(), &seeded)
+	if err != nil {
+		s.t.Fatalf("error seeding user %s: %v", seeded.Username, err)
+	}
+	return created
+}
+
+// TokenFor mints an access token of the given user
+func (s *Server) TokenFor(u *database.User) string {
+	s.t.Helper()
+	token, _, err := auth.GenerateToken(u.ID, u.OrganizationID, u.Role)
+	if err != nil {
+		s.t.Fatalf("error generating token for user %d: %v", u.ID, err)
+	}
+	return token
+}
+
+// Token seeds a user with the given role, in the default organization,
+// and mints an access token of it
+func (s *Server) Token(role auth.Role) string {
+	s.t.Helper()
+	return s.TokenFor(s.SeedUser(&database.User{Role: role}))
+}
+
+// DispatchEvents dispatches the pending events of the outbox to a local sink, and
+// to the webhooks subscribed to them, and returns them in the order they were written
+func (s *Server) DispatchEvents() []*database.OutboxEvent {
+	s.t.Helper()
+	sink := &outbox.MemorySink{}
+	dispatcher := outbox.NewDispatcher(s.Store, 0, sink, webhook.NewSink(s.Store))
+	if _, err := dispatcher.DispatchPending(context.Background()); err != nil {
+		s.t.Fatalf("error dispatching events: %v", err)
+	}
+	return sink.Events()
+}
+
+// DispatchWebhooks posts the pending webhook deliveries, e.g. to an httptest
+// server, and returns how many succeeded; deliveries are dead after maxAttempts
+func (s *Server) DispatchWebhooks(maxAttempts int) int {
+	s.t.Helper()
+	nbSucceeded, err := webhook.NewDispatcher(s.Store, http.DefaultClient, maxAttempts).DispatchPending(context.Background())
+	if err != nil {
+		s.t.Fatalf("error dispatching webhook deliveries: %v", err)
+	}
+	return nbSucceeded
+}
+
+// Do sends a request to the given path of the API, e.g. /api/v1/users, with the
+// given token (if not empty) and body (if not nil) marshaled as JSON
+func (s *Server) Do(method string, path string, token string, body interface{}) *http.Response {
+	s.t.Helper()
+	return s.Send(s.NewRequest(method, path, token, body))
+}
+
+// NewRequest builds the request which Do sends, e.g. to set more headers before
+// sending it with Send
+func (s *Server) NewRequest(method string, path string, token string, body interface{}) *http.Request {
+	s.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatalf("error marshaling request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		s.t.Fatalf("error creating request %s %s: %v", method, path, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// Send sends the given request to the API
+func (s *Server) Send(req *http.Request) *http.Response {
+	s.t.Helper()
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		s.t.Fatalf("error sending request %s %s: %v", req.Method, req.URL, err)
+	}
+	s.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// Decode unmarshals the JSON body of the response into v
+func (s *Server) Decode(resp *http.Response, v interface{}) {
+	s.t.Helper()
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		s.t.Fatalf("error decoding response body of %s %s: %v", resp.Request.Method, resp.Request.URL, err)
+	}
+}
@@ -0,0 +1,112 @@
+package validator
+
+import (
+	"reflect"
+
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/i18n"
+)
+
+// rules are the translations of the rules of the validations which do not come with
+// the validator (e.g. all of them for German and Romanian), in the format of the
+// universal translator: {0} is the field and {1} the param of the rule, but for the
+// role, of which {0} are the valid roles; the rules which can be of strings or of
+// lists (e.g. min) have a message for each
+var rules = i18n.Catalogue{
+	"en": {
+		"startswith": "{0} must start with {1}",
+		"role":       "invalid role - {0}",
+	},
+	"de": {
+		"required":   "{0} ist ein Pflichtfeld",
+		"min-string": "{0} muss mindestens {1} Zeichen lang sein",
+		"min-items":  "{0} muss mindestens {1} Elemente enthalten",
+		"email":      "{0} muss eine gültige E-Mail-Adresse sein",
+		"url":        "{0} muss eine gültige URL sein",
+		"alphanum":   "{0} darf nur alphanumerische Zeichen enthalten",
+		"lowercase":  "{0} darf nur Kleinbuchstaben enthalten",
+		"startswith": "{0} muss mit {1} beginnen",
+		"role":       "ungültige Rolle - {0}",
+	},
+	"fr": {
+		"lowercase":  "{0} ne doit contenir que des lettres minuscules",
+		"startswith": "{0} doit commencer par {1}",
+		"role":       "rôle invalide - {0}",
+	},
+	"ro": {
+		"required":   "{0} este un câmp obligatoriu",
+		"min-string": "{0} trebuie să aibă cel puțin {1} caractere",
+		"min-items":  "{0} trebuie să conțină cel puțin {1} elemente",
+		"email":      "{0} trebuie să fie o adresă de email validă",
+		"url":        "{0} trebuie să fie un URL valid",
+		"alphanum":   "{0} poate conține doar caractere alfanumerice",
+		"lowercase":  "{0} poate conține doar litere mici",
+		"startswith": "{0} trebuie să înceapă cu {1}",
+		"role":       "rol invalid - {0}",
+	},
+}
+
+// registerTranslations registers, for the given locale, the translations of the rules
+// which it has in the rules catalogue, and the ones of the custom validations
+func registerTranslations(translator ut.Translator, locale string) {
+	for _, tag := range []string{"required", "email", "url", "alphanum", "lowercase", "startswith"} {
+		if rules.Has(locale, tag) {
+			register(translator, tag, map[string]string{tag: rules.T(locale, tag)},
+				func(fe validator.FieldError) (string, []string) {
+					return fe.Tag(), []string{fe.Field(), fe.Param()}
+				})
+		}
+	}
+	if rules.Has(locale, "min-string") {
+		register(translator, "min",
+			map[string]string{"min-string": rules.T(locale, "min-string"), "min-items": rules.T(locale, "min-items")},
+			func(fe validator.FieldError) (string, []string) {
+				if fe.Kind() == reflect.String {
+					return "min-string", []string{fe.Field(), fe.Param()}
+				}
+				return "min-items", []string{fe.Field(), fe.Param()}
+			})
+	}
+	//--> custom validations, which are translated to all the locales
+	register(translator, "password", map[string]string{"password": auth.PasswordRequirementsMsgIn(locale)},
+		func(fe validator.FieldError) (string, []string) {
+			return "password", []string{fe.Field()}
+		})
+	register(translator, "role", map[string]string{"role": rules.T(locale, "role")},
+		func(fe validator.FieldError) (string, []string) {
+			return "role", []string{auth.ValidRolesMsgIn(locale)}
+		})
+	//<--
+}
+
+// register registers the translation of the given rule, made of the given messages, by
+// key, of which the given function chooses one, with its params, for each error
+func register(
+	translator ut.Translator,
+	tag string,
+	messages map[string]string,
+	choose func(fe validator.FieldError) (key string, params []string),
+) {
+	_ = validate.RegisterTranslation(
+		tag,
+		translator,
+		func(ut ut.Translator) error {
+			for key, msg := range messages {
+				if err := ut.Add(key, msg, true); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(ut ut.Translator, fe validator.FieldError) string {
+			key, params := choose(fe)
+			t, err := ut.T(key, params...)
+			if err != nil {
+				return fe.(error).Error()
+			}
+			return t
+		},
+	)
+}
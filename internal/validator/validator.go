@@ -1,22 +1,29 @@
 package validator
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"reflect"
 	"strings"
 
+	"github.com/go-playground/locales/de"
 	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/fr"
+	"github.com/go-playground/locales/ro"
 	ut "github.com/go-playground/universal-translator"
 	"github.com/go-playground/validator/v10"
 	en_translations "github.com/go-playground/validator/v10/translations/en"
+	fr_translations "github.com/go-playground/validator/v10/translations/fr"
 	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/i18n"
 	"github.com/rs/zerolog/log"
 )
 
 // use a single instance of Validate, it caches struct info
 var (
-	validate   *validator.Validate
-	translator ut.Translator
+	validate *validator.Validate
+	// translators are the translators of the validation errors, by locale
+	translators = map[string]ut.Translator{}
 )
 
 func init() {
@@ -41,55 +48,168 @@ func init() {
 	})
 	//<--
 
-	//--> register validator translation
-	en := en.New()
-	uni := ut.New(en, en)
-	var found bool
-	translator, found = uni.GetTranslator("en")
-	if !found {
-		log.Error().Msg("error geting english translator for validation errors")
-		return
+	//--> register validator translations, one translator per locale
+	uni := ut.New(en.New(), en.New(), de.New(), fr.New(), ro.New())
+	for _, locale := range i18n.Locales {
+		translator, found := uni.GetTranslator(locale)
+		if !found {
+			log.Error().Msgf("error getting %s translator for validation errors", locale)
+			continue
+		}
+		//----> the translations which come with the validator, if any
+		switch locale {
+		case "en":
+			_ = en_translations.RegisterDefaultTranslations(validate, translator)
+		case "fr":
+			_ = fr_translations.RegisterDefaultTranslations(validate, translator)
+		}
+		//<----
+		registerTranslations(translator, locale)
+		translators[locale] = translator
 	}
-	en_translations.RegisterDefaultTranslations(validate, translator)
-	//----> custom translations
-	_ = validate.RegisterTranslation(
-		"password",
-		translator,
-		func(ut ut.Translator) error {
-			return ut.Add("password", auth.PasswordRequirementsMsg, true)
-		},
-		func(ut ut.Translator, fe validator.FieldError) string {
-			t, _ := ut.T("password", fe.Field())
-			return t
-		},
-	)
-	_ = validate.RegisterTranslation(
-		"role",
-		translator,
-		func(ut ut.Translator) error {
-			return ut.Add("role", "invalid role - "+auth.ValidRolesMsg, true)
-		},
-		func(ut ut.Translator, fe validator.FieldError) string {
-			t, _ := ut.T("role", fe.Field())
-			return t
-		},
-	)
-	//<----
 	//<--
 }
 
-// Validate ...
-func Validate(s interface{}) error {
+// FieldError tells what is invalid in a field: the rule which it breaks, with the
+// parameter of the rule (if any), e.g. rule min with param 8
+type FieldError struct {
+	Field   string `json:"field"` // path of the field, by its JSON names, e.g. events[1]
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// Error is the error of the validation of a struct, telling all that is invalid in it,
+// field by field, in the order of the fields
+type Error struct {
+	Fields []FieldError
+}
+
+// NewError returns the error of the validation of the given fields, for the checks
+// which are not made by Validate
+func NewError(fields ...FieldError) *Error {
+	return &Error{Fields: fields}
+}
+
+func (e *Error) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		messages[i] = f.Message
+	}
+	return strings.Join(messages, ", ")
+}
+
+// Validate validates the given struct, with the messages of the errors
+// translated to the locale of the given context
+func Validate(ctx context.Context, s interface{}) error {
 	err := validate.Struct(s)
-	if err != nil && translator != nil {
-		// translate all error at once
-		errsMap := err.(validator.ValidationErrors).Translate(translator)
-		var errs []string
-		for _, v := range errsMap {
-			errs = append(errs, v)
+	translator, ok := translators[i18n.Locale(ctx)]
+	if !ok {
+		translator, ok = translators[i18n.Default]
+	}
+	if err == nil || !ok {
+		return err
+	}
+	validationErrs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return err
+	}
+	// the errors come in the order of the fields, which keeps the order stable
+	fields := make([]FieldError, len(validationErrs))
+	for i, fe := range validationErrs {
+		fields[i] = FieldError{
+			Field:   fieldPath(reflect.TypeOf(s), fe.StructNamespace()),
+			Rule:    fe.Tag(),
+			Param:   fe.Param(),
+			Message: translate(fe, translator),
+		}
+	}
+	return &Error{Fields: fields}
+}
+
+// ValidateFields is like Validate, but only for the given fields, by their paths (e.g.
+// username), e.g. for the ones a partial update changes, as the other ones are kept
+func ValidateFields(ctx context.Context, s interface{}, fields ...string) error {
+	err := Validate(ctx, s)
+	var errInvalid *Error
+	if !errors.As(err, &errInvalid) {
+		return err
+	}
+	var kept []FieldError
+	for _, f := range errInvalid.Fields {
+		for _, field := range fields {
+			if f.Field == field || strings.HasPrefix(f.Field, field+".") || strings.HasPrefix(f.Field, field+"[") {
+				kept = append(kept, f)
+				break
+			}
 		}
-		return fmt.Errorf("%v", strings.Join(errs, ", "))
 	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return &Error{Fields: kept}
+}
 
-	return nil
+// translate returns the message of the given error translated by the given translator,
+// or by the English one if the given one has no translation of the rule
+func translate(fe validator.FieldError, translator ut.Translator) string {
+	// the message of the error itself is what is returned when there is no translation
+	if msg := fe.Translate(translator); msg != fe.(error).Error() {
+		return msg
+	}
+	if english, ok := translators[i18n.Default]; ok {
+		return fe.Translate(english)
+	}
+	return fe.(error).Error()
+}
+
+// fieldPath returns the path of the field of the given type which has the given
+// namespace (e.g. UserRequest.User.Username) by the JSON names of its fields, leaving
+// out the embedded structs, whose fields are at the same level in JSON (e.g. username)
+func fieldPath(t reflect.Type, namespace string) string {
+	var path strings.Builder
+	// the first part of the namespace is the name of the struct itself
+	for _, part := range strings.Split(namespace, ".")[1:] {
+		name, index := part, ""
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name, index = part[:i], part[i:]
+		}
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		var field reflect.StructField
+		ok := t.Kind() == reflect.Struct
+		if ok {
+			field, ok = t.FieldByName(name)
+		}
+		if !ok {
+			// should not happen, but the path is then the rest of the namespace
+			if path.Len() > 0 {
+				path.WriteByte('.')
+			}
+			path.WriteString(part)
+			continue
+		}
+		t = field.Type
+		if index != "" {
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if k := t.Kind(); k == reflect.Slice || k == reflect.Array || k == reflect.Map {
+				t = t.Elem()
+			}
+		}
+		if field.Anonymous && index == "" {
+			continue
+		}
+		jsonName := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if jsonName == "" || jsonName == "-" {
+			jsonName = field.Name
+		}
+		if path.Len() > 0 {
+			path.WriteByte('.')
+		}
+		path.WriteString(jsonName + index)
+	}
+	return path.String()
 }
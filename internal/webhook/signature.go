@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSignature ...
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Sign returns the value of the signature header of the given body, sent at the given time
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + hex.EncodeToString(signature(secret, t, body))
+}
+
+func signature(secret string, t string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Verify checks, for receivers, that the signature header of the given body
+// is valid and that it was signed at most tolerance ago (if tolerance is set)
+func Verify(secret string, header string, body []byte, tolerance time.Duration) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			v1 = value
+		}
+	}
+	timestamp, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp '%s'", ErrInvalidSignature, t)
+	}
+	if tolerance > 0 && time.Since(time.Unix(timestamp, 0)) > tolerance {
+		return fmt.Errorf("%w: signed more than %s ago", ErrInvalidSignature, tolerance)
+	}
+	expected, err := hex.DecodeString(v1)
+	if err != nil || !hmac.Equal(expected, signature(secret, t, body)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
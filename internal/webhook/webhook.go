@@ -0,0 +1,147 @@
+// Package webhook posts the events of the outbox to the webhooks subscribed to them.
+//
+// The events are not posted by the outbox dispatcher, whose Sink only records, for each
+// subscribed webhook, a pending delivery; the deliveries are then posted by a Dispatcher,
+// and retried with exponential backoff until they succeed, or failed too many times, so
+// that a webhook which is down does not hold back the others.
+//
+// Each delivery is a JSON Envelope, posted with the headers:
+//
+//	X-Webhook-Id        - the id of the delivery, the same for all its attempts
+//	X-Webhook-Event     - the type of the event, e.g. user.created
+//	X-Webhook-Signature - t=<unix timestamp>,v1=<HMAC-SHA256 of "<timestamp>.<body>",
+//	                      keyed with the secret of the webhook, hex encoded>
+//
+// Receivers should check the signature (see Verify) and reject old timestamps, to
+// prevent replays, and should ignore the events they have already seen, by their id.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/padurean/purest/internal/database"
+	"github.com/rs/zerolog/log"
+)
+
+// Headers of the deliveries
+const (
+	HeaderID        = "X-Webhook-Id"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Envelope is the body of the deliveries
+type Envelope struct {
+	// ID is the id of the event, the same for all the webhooks it is delivered to
+	ID             int64  `json:"id"`
+	Type           string `json:"type"`
+	OrganizationID int64  `json:"organization_id"`
+	// Created is when the delivery was enqueued, right after the change
+	Created time.Time             `json:"created"`
+	Data    database.EventPayload `json:"data"`
+}
+
+// Sink enqueues the deliveries of the outbox events to the webhooks subscribed to them
+type Sink struct {
+	store database.WebhookStore
+}
+
+// NewSink ...
+func NewSink(store database.WebhookStore) *Sink {
+	return &Sink{store: store}
+}
+
+// Deliver ...
+func (sink *Sink) Deliver(ctx context.Context, e *database.OutboxEvent) error {
+	if _, err := sink.store.EnqueueWebhookDeliveries(ctx, e); err != nil {
+		return fmt.Errorf("error enqueuing webhook deliveries of event %d: %w", e.ID, err)
+	}
+	return nil
+}
+
+// DefaultBatchSize is the number of deliveries sent at once
+const DefaultBatchSize = 100
+
+// Dispatcher posts the pending deliveries to their webhooks
+type Dispatcher struct {
+	store       database.WebhookStore
+	client      *http.Client
+	maxAttempts int
+}
+
+// NewDispatcher returns a dispatcher posting the deliveries with the given client,
+// until they succeed or fail maxAttempts times, when they become dead
+func NewDispatcher(store database.WebhookStore, client *http.Client, maxAttempts int) *Dispatcher {
+	return &Dispatcher{store: store, client: client, maxAttempts: maxAttempts}
+}
+
+func (d *Dispatcher) send(ctx context.Context, w *database.Webhook, delivery *database.WebhookDelivery) (int, error) {
+	body, err := json.Marshal(Envelope{
+		ID:             delivery.EventID,
+		Type:           delivery.EventType,
+		OrganizationID: delivery.OrganizationID,
+		Created:        delivery.Created,
+		Data:           delivery.Payload,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling webhook delivery %d: %w", delivery.ID, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("error creating request of webhook delivery %d: %w", delivery.ID, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderSignature, Sign(w.Secret, time.Now(), body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error posting webhook delivery %d: %w", delivery.ID, err)
+	}
+	defer resp.Body.Close()
+	// drained, so that the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// DispatchPending posts, batch by batch, the deliveries which are pending,
+// and returns how many succeeded
+func (d *Dispatcher) DispatchPending(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		nbSucceeded, err := d.store.DispatchWebhookDeliveries(ctx, DefaultBatchSize, d.maxAttempts, d.send)
+		total += nbSucceeded
+		if err != nil || nbSucceeded < DefaultBatchSize {
+			return total, err
+		}
+	}
+}
+
+// Run posts the pending deliveries every interval until ctx is done
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		nbSucceeded, err := d.DispatchPending(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("error dispatching webhook deliveries")
+		} else if nbSucceeded > 0 {
+			log.Debug().Msgf("dispatched %d webhook deliveries", nbSucceeded)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
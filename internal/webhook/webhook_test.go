@@ -0,0 +1,256 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/padurean/purest/internal/auth"
+	"github.com/padurean/purest/internal/database"
+)
+
+const secret = "0123456789abcdef"
+
+// delivery is a delivery as received by the receiver
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver is a webhook which responds with its status and records what it receives
+type receiver struct {
+	*httptest.Server
+	mu         sync.Mutex
+	status     int
+	deliveries []delivery
+}
+
+func newReceiver(t *testing.T) *receiver {
+	rcv := &receiver{status: http.StatusOK}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.deliveries = append(rcv.deliveries, delivery{header: r.Header.Clone(), body: body})
+		w.WriteHeader(rcv.status)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *receiver) respondWith(status int) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.status = status
+}
+
+func (rcv *receiver) received() []delivery {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]delivery{}, rcv.deliveries...)
+}
+
+// setup subscribes the receiver to the user events, creates an user and
+// enqueues the delivery of its creation event
+func setup(t *testing.T, rcv *receiver) (context.Context, *database.MemoryStore, *database.Webhook) {
+	t.Helper()
+	ctx := database.WithAllTenants(context.Background())
+	store := database.NewMemoryStore()
+	o, err := store.GetOrganizationBySlug(ctx, database.DefaultOrganizationSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := store.CreateWebhook(ctx, &database.Webhook{
+		OrganizationID: o.ID,
+		URL:            rcv.URL,
+		Events:         database.WebhookEvents{"user.*"},
+		Secret:         secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.CreateUser(ctx, &database.User{
+		OrganizationID: o.ID,
+		Username:       "jdoe",
+		Email:          "jdoe@example.com",
+		Role:           auth.RoleAdmin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := store.ListOutboxEvents(ctx, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range events {
+		if err := NewSink(store).Deliver(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ctx, store, w
+}
+
+// deliveryOf returns the one delivery of the webhook
+func deliveryOf(t *testing.T, ctx context.Context, store *database.MemoryStore, w *database.Webhook) *database.WebhookDelivery {
+	t.Helper()
+	deliveries, err := store.ListWebhookDeliveries(ctx, w, database.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("expected one delivery, got %d", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	now := time.Now()
+	tests := []struct {
+		name      string
+		header    string
+		body      []byte
+		tolerance time.Duration
+		valid     bool
+	}{
+		{"valid", Sign(secret, now, body), body, time.Minute, true},
+		{"valid without tolerance", Sign(secret, now.Add(-time.Hour), body), body, 0, true},
+		{"other secret", Sign("fedcba9876543210", now, body), body, time.Minute, false},
+		{"tampered body", Sign(secret, now, body), []byte(`{"id":2}`), time.Minute, false},
+		{"too old", Sign(secret, now.Add(-2*time.Minute), body), body, time.Minute, false},
+		{"other timestamp", strings.Replace(Sign(secret, now, body),
+			"t="+strconv.FormatInt(now.Unix(), 10), "t="+strconv.FormatInt(now.Unix()+1, 10), 1), body, time.Minute, false},
+		{"no timestamp", "v1=00", body, time.Minute, false},
+		{"no signature", "t=" + strconv.FormatInt(now.Unix(), 10), body, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(secret, tt.header, tt.body, tt.tolerance)
+			if tt.valid && err != nil {
+				t.Fatalf("expected a valid signature, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("expected an invalid signature, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDispatcherSignsDeliveries(t *testing.T) {
+	rcv := newReceiver(t)
+	ctx, store, w := setup(t, rcv)
+
+	nbSucceeded, err := NewDispatcher(store, rcv.Client(), 3).DispatchPending(ctx)
+	if err != nil || nbSucceeded != 1 {
+		t.Fatalf("expected one successful delivery, got %d (err: %v)", nbSucceeded, err)
+	}
+	received := rcv.received()
+	if len(received) != 1 {
+		t.Fatalf("expected one received delivery, got %d", len(received))
+	}
+	header, body := received[0].header, received[0].body
+	if err := Verify(secret, header.Get(HeaderSignature), body, time.Minute); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+	d := deliveryOf(t, ctx, store, w)
+	if header.Get(HeaderID) != strconv.FormatInt(d.ID, 10) || header.Get(HeaderEvent) != database.EventUserCreated {
+		t.Fatalf("expected delivery %d of %s, got delivery %s of %s",
+			d.ID, database.EventUserCreated, header.Get(HeaderID), header.Get(HeaderEvent))
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.ID != d.EventID || envelope.Type != database.EventUserCreated || envelope.OrganizationID != w.OrganizationID {
+		t.Fatalf("expected the envelope of event %d, got %+v", d.EventID, envelope)
+	}
+	if d.Status != database.WebhookDeliverySucceeded || !d.Delivered.Valid || d.ResponseStatus.Int64 != http.StatusOK {
+		t.Fatalf("expected a succeeded delivery, got %+v", d)
+	}
+}
+
+func TestDispatcherBacksOffAfterFailures(t *testing.T) {
+	rcv := newReceiver(t)
+	rcv.respondWith(http.StatusServiceUnavailable)
+	ctx, store, w := setup(t, rcv)
+	dispatcher := NewDispatcher(store, rcv.Client(), 10)
+
+	for attempts := 1; attempts <= 4; attempts++ {
+		if nbSucceeded, err := dispatcher.DispatchPending(ctx); err != nil || nbSucceeded != 0 {
+			t.Fatalf("expected no successful delivery, got %d (err: %v)", nbSucceeded, err)
+		}
+		d := deliveryOf(t, ctx, store, w)
+		if d.Status != database.WebhookDeliveryPending || d.Attempts != attempts ||
+			d.ResponseStatus.Int64 != http.StatusServiceUnavailable || !d.LastError.Valid {
+			t.Fatalf("expected a pending delivery after %d failed attempts, got %+v", attempts, d)
+		}
+		// the delay doubles with each failed attempt
+		if delay := d.NextAttempt.Sub(d.Updated); delay != time.Second<<attempts {
+			t.Fatalf("expected the attempt %d to be in %s, got %s", attempts+1, time.Second<<attempts, delay)
+		}
+		// and nothing is sent before it elapses
+		if _, err := dispatcher.DispatchPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(rcv.received()); n != attempts {
+			t.Fatalf("expected %d received deliveries, got %d", attempts, n)
+		}
+		store.Advance(time.Second << attempts)
+	}
+}
+
+func TestDispatcherDeadLettersAndRedelivers(t *testing.T) {
+	const maxAttempts = 3
+	rcv := newReceiver(t)
+	rcv.respondWith(http.StatusInternalServerError)
+	ctx, store, w := setup(t, rcv)
+	dispatcher := NewDispatcher(store, rcv.Client(), maxAttempts)
+
+	for i := 0; i < maxAttempts+2; i++ {
+		if _, err := dispatcher.DispatchPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+		store.Advance(time.Hour)
+	}
+	d := deliveryOf(t, ctx, store, w)
+	if d.Status != database.WebhookDeliveryDead || d.Attempts != maxAttempts {
+		t.Fatalf("expected a dead delivery after %d attempts, got %+v", maxAttempts, d)
+	}
+	if n := len(rcv.received()); n != maxAttempts {
+		t.Fatalf("expected %d received deliveries, got %d", maxAttempts, n)
+	}
+
+	rcv.respondWith(http.StatusNoContent)
+	redelivered, err := store.RedeliverWebhookDelivery(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redelivered.Status != database.WebhookDeliveryPending || redelivered.Attempts != 0 {
+		t.Fatalf("expected a pending delivery, with no attempts, got %+v", redelivered)
+	}
+	if nbSucceeded, err := dispatcher.DispatchPending(ctx); err != nil || nbSucceeded != 1 {
+		t.Fatalf("expected one successful delivery, got %d (err: %v)", nbSucceeded, err)
+	}
+	d = deliveryOf(t, ctx, store, w)
+	if d.Status != database.WebhookDeliverySucceeded || d.Attempts != 1 || d.LastError.Valid {
+		t.Fatalf("expected a succeeded delivery, got %+v", d)
+	}
+	// all the attempts are of the same delivery, which receivers tell by its id
+	received := rcv.received()
+	for _, r := range received {
+		if r.header.Get(HeaderID) != strconv.FormatInt(d.ID, 10) {
+			t.Fatalf("expected all the attempts to be of delivery %d, got one of %s", d.ID, r.header.Get(HeaderID))
+		}
+	}
+	if len(received) != maxAttempts+1 {
+		t.Fatalf("expected %d received deliveries, got %d", maxAttempts+1, len(received))
+	}
+}